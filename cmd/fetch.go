@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+func runFetchArticle(args []string) int {
+	o := newOptions("fetch-article", "<message-id>")
+	server := addServerFlags(o.flags)
+	if status, ok := o.parse(args); !ok {
+		return status
+	}
+	if o.flags.NArg() != 1 {
+		o.flags.Usage()
+		return exitUsage
+	}
+
+	cfg, logger, err := o.load(server.apply)
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+	nntpServers, err := servers(cfg, logger)
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+
+	conn, err := nntpServers[0].Dial()
+	if err != nil {
+		logger.Error("Could not connect", "server", nntpServers[0].Address, "error", err)
+		return exitFailure
+	}
+	defer conn.Close()
+
+	reader, err := conn.ReadMessage(o.flags.Arg(0))
+	if err != nil {
+		logger.Error("Could not read article", "message", o.flags.Arg(0), "error", err)
+		return exitFailure
+	}
+	if _, err := io.Copy(os.Stdout, reader); err != nil {
+		logger.Error("Could not read article", "message", o.flags.Arg(0), "error", err)
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/esteth/usenet/pkg/downloader"
+	"github.com/esteth/usenet/pkg/newznab"
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/postprocess"
+)
+
+func runGet(args []string) int {
+	o := newOptions("get", "")
+	server := addServerFlags(o.flags)
+	nzbPath := o.flags.String("nzb", "", "an NZB file to download the articles from")
+	indexerURL := o.flags.String("indexer", "", "the URL of a newznab indexer to search")
+	indexerKey := o.flags.String("indexer-key", "", "the API key for the newznab indexer")
+	query := o.flags.String("search", "", "search the indexer and download the newest result, instead of an NZB file")
+	extract := o.flags.Bool("unpack", false, "verify and repair with PAR2, then join split files and extract any archives once the download completes")
+	keepGoing := o.flags.Bool("keep-going", false, "keep downloading even once more is missing than PAR2 can repair")
+	if status, ok := o.parse(args); !ok {
+		return status
+	}
+
+	cfg, logger, err := o.load(server.apply)
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+	if *nzbPath == "" && *query == "" {
+		fmt.Fprintf(o.flags.Output(), "Must specify the path to an NZB file, or a search\n")
+		return exitUsage
+	}
+	nntpServers, err := servers(cfg, logger)
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+
+	var n nzb.Nzb
+	if *nzbPath != "" {
+		n, err = nzbFromFile(*nzbPath)
+	} else {
+		n, err = nzbFromSearch(logger, *indexerURL, *indexerKey, *query)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return exitFailure
+	}
+
+	ctx, stop := interruptContext(logger)
+	defer stop()
+	d, err := downloader.New(downloader.Config{Servers: nntpServers, CacheSize: int64(cfg.CacheSize), Logger: logger})
+	if err != nil {
+		logger.Error(err.Error())
+		return exitFailure
+	}
+	result, err := d.Download(ctx, downloader.Job{
+		Nzb: n,
+		Dir: ".",
+		OnEvent: func(event downloader.Event) {
+			switch event.Type {
+			case downloader.SegmentDone:
+				logger.Debug("Wrote segment", "segment", event.Segment.ID, "server", event.Server)
+			case downloader.SegmentFailed:
+				logger.Warn("Could not download segment", "segment", event.Segment.ID, "error", event.Err)
+			}
+		},
+		OnUnrepairable: func(damage downloader.Damage) bool {
+			if *keepGoing {
+				logger.Warn("Too much is missing to repair", "damage", damage.String())
+				return false
+			}
+			logger.Error("Stopping download, as too much is missing to repair", "damage", damage.String())
+			return true
+		},
+	})
+	d.Close()
+	printSummary(os.Stderr, result)
+	if status := downloadStatus(ctx, logger, err); status != exitOK {
+		return status
+	}
+
+	complete := result.Complete()
+	if *extract {
+		verified, err := postProcess(ctx, logger, ".", n.Password())
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			return exitFailure
+		}
+		// Missing segments don't matter if PAR2 repaired the damage they caused.
+		complete = complete || verified
+	}
+	if !complete {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// downloadStatus returns the exit status for the error returned by a download, or exitOK if it
+// finished. Errors other than being interrupted are logged, except for the download being
+// stopped as unrepairable, which was logged when it happened.
+func downloadStatus(ctx context.Context, logger *slog.Logger, err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, downloader.ErrUnrepairable):
+		return exitFailure
+	case ctx.Err() != nil:
+		return exitInterrupted
+	}
+	logger.Error(err.Error())
+	return exitFailure
+}
+
+// interruptContext returns a context which is cancelled by the first SIGINT or SIGTERM, so that a
+// command can stop starting new work and finish what it is doing. A second signal exits at once.
+//
+// The returned function stops listening for signals.
+func interruptContext(logger *slog.Logger) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Warn("Stopping once the segments in progress finish; interrupt again to quit now", "signal", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			os.Exit(exitInterrupted)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
+
+// printSummary reports the segments of each file which could not be downloaded, with why each
+// attempt to download them failed, followed by the totals.
+func printSummary(w io.Writer, result downloader.Result) {
+	var total, failed, pending int
+	for _, file := range result.Files {
+		var fileFailed, filePending int
+		for _, s := range file.Segments {
+			switch s.Status {
+			case downloader.Failed:
+				fileFailed++
+			case downloader.Pending:
+				filePending++
+			}
+		}
+		total += len(file.Segments)
+		failed += fileFailed
+		pending += filePending
+		if file.Err != nil {
+			fmt.Fprintf(w, "%s: %v\n", file.File.Subject, file.Err)
+		}
+		if fileFailed == 0 && filePending == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s: %d of %d segments failed, %d not attempted\n",
+			file.File.Subject, fileFailed, len(file.Segments), filePending)
+		for _, s := range file.Failed() {
+			fmt.Fprintf(w, "    segment %d <%s>:\n", s.Segment.Number, s.Segment.ID)
+			for _, a := range s.Attempts {
+				fmt.Fprintf(w, "        %s: %s: %v\n", a.Server, a.Reason, a.Err)
+			}
+		}
+	}
+	fmt.Fprintf(w, "Downloaded %d of %d segments", total-failed-pending, total)
+	if failed > 0 || pending > 0 {
+		fmt.Fprintf(w, "; %d failed, %d not attempted", failed, pending)
+	}
+	fmt.Fprintln(w)
+}
+
+// postProcess verifies and repairs the download in dir, then unpacks it. It returns whether PAR2
+// verification showed every file to be intact, whether or not after repair.
+func postProcess(ctx context.Context, logger *slog.Logger, dir string, password string) (bool, error) {
+	p := postprocess.New(postprocess.Verify(), postprocess.Repair(), postprocess.Unpack())
+	job := &postprocess.Job{Dir: dir, Password: password, Logger: logger}
+	err := p.Run(ctx, job, func(r postprocess.Result) {
+		for _, line := range r.Log {
+			logger.Info(line, "stage", r.Stage)
+		}
+	})
+	return job.Verified, err
+}
+
+func nzbFromFile(path string) (nzb.Nzb, error) {
+	n, err := nzb.FromFile(path)
+	if err != nil {
+		return nzb.Nzb{}, fmt.Errorf("Could not parse nzb file: %w", err)
+	}
+	return n, nil
+}
+
+func nzbFromSearch(logger *slog.Logger, indexerURL string, apiKey string, query string) (nzb.Nzb, error) {
+	if indexerURL == "" {
+		return nzb.Nzb{}, fmt.Errorf("Must specify an indexer to search")
+	}
+	client := newznab.NewClient(newznab.Indexer{URL: indexerURL, APIKey: apiKey}, nil)
+	results, err := client.Search(context.Background(), newznab.Query{Q: query})
+	if err != nil {
+		return nzb.Nzb{}, fmt.Errorf("Could not search indexer: %w", err)
+	}
+	if len(results) == 0 {
+		return nzb.Nzb{}, fmt.Errorf("No results found for '%s'", query)
+	}
+	logger.Info("Downloading search result", "title", results[0].Title, "bytes", results[0].Size)
+	n, err := client.Fetch(context.Background(), results[0])
+	if err != nil {
+		return nzb.Nzb{}, fmt.Errorf("Could not fetch NZB: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/esteth/usenet/pkg/downloader"
+	"github.com/esteth/usenet/pkg/nzb"
+)
+
+func TestInterruptContext(t *testing.T) {
+	logs := &bytes.Buffer{}
+	ctx, stop := interruptContext(slog.New(slog.NewTextHandler(logs, nil)))
+	defer stop()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatalf("Could not send SIGINT: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Context was not cancelled by SIGINT")
+	}
+	if !strings.Contains(logs.String(), "interrupt again to quit now") {
+		t.Errorf("Expected a warning that a second interrupt quits, got %q", logs.String())
+	}
+}
+
+func TestDownloadStatus(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		err    error
+		status int
+		logged bool
+	}{
+		{"finished", context.Background(), nil, exitOK, false},
+		{"unrepairable", context.Background(), fmt.Errorf("Stopped: %w", downloader.ErrUnrepairable), exitFailure, false},
+		{"interrupted", cancelled, context.Canceled, exitInterrupted, false},
+		{"failed", context.Background(), errors.New("Could not create directory"), exitFailure, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logs := &bytes.Buffer{}
+			status := downloadStatus(test.ctx, slog.New(slog.NewTextHandler(logs, nil)), test.err)
+			if status != test.status {
+				t.Errorf("Expected exit status %d, got %d", test.status, status)
+			}
+			if logged := logs.Len() > 0; logged != test.logged {
+				t.Errorf("Expected the error to be logged: %v, got %q", test.logged, logs.String())
+			}
+		})
+	}
+}
+
+func TestPrintSummary(t *testing.T) {
+	result := downloader.Result{Files: []downloader.FileResult{
+		{
+			File: nzb.File{Subject: `"complete.bin" yEnc (1/2)`},
+			Segments: []downloader.SegmentResult{
+				{Segment: nzb.Segment{Number: 1, ID: "a@example"}, Status: downloader.Done},
+				{Segment: nzb.Segment{Number: 2, ID: "b@example"}, Status: downloader.Skipped},
+			},
+		},
+		{
+			File: nzb.File{Subject: `"damaged.bin" yEnc (1/3)`},
+			Segments: []downloader.SegmentResult{
+				{Segment: nzb.Segment{Number: 1, ID: "c@example"}, Status: downloader.Done},
+				{
+					Segment: nzb.Segment{Number: 2, ID: "d@example"},
+					Status:  downloader.Failed,
+					Attempts: []downloader.Attempt{
+						{Server: "news.example:563", Reason: downloader.Missing, Err: errors.New("430 No such article")},
+						{Server: "backup.example:563", Reason: downloader.Timeout, Err: errors.New("i/o timeout")},
+					},
+				},
+				{Segment: nzb.Segment{Number: 3, ID: "e@example"}},
+			},
+		},
+		{
+			File:     nzb.File{Subject: `"corrupt.bin" yEnc (1/1)`},
+			Segments: []downloader.SegmentResult{{Segment: nzb.Segment{Number: 1, ID: "f@example"}, Status: downloader.Done}},
+			Err:      errors.New("File does not match its checksum"),
+		},
+	}}
+
+	out := &bytes.Buffer{}
+	printSummary(out, result)
+	expected := `"damaged.bin" yEnc (1/3): 1 of 3 segments failed, 1 not attempted
+    segment 2 <d@example>:
+        news.example:563: missing: 430 No such article
+        backup.example:563: timeout: i/o timeout
+"corrupt.bin" yEnc (1/1): File does not match its checksum
+Downloaded 4 of 6 segments; 1 failed, 1 not attempted
+`
+	if out.String() != expected {
+		t.Errorf("Expected summary:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	printSummary(out, downloader.Result{Files: result.Files[:1]})
+	if expected := "Downloaded 2 of 2 segments\n"; out.String() != expected {
+		t.Errorf("Expected summary %q, got %q", expected, out.String())
+	}
+}
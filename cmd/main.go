@@ -0,0 +1,98 @@
+// Command usenet downloads binaries from Usenet. It fetches the articles described by NZB files,
+// checks and repairs downloads with PAR2, and can run as a daemon controlled over HTTP.
+//
+// Usage:
+//
+//	usenet <command> [flags] [arguments]
+//
+// Run "usenet help" to list the commands, and "usenet <command> -h" for a command's flags.
+//
+// Every command takes a -config flag naming a TOML configuration file, which defaults to
+// $USENET_CONFIG. Commands exit with status 0 on success, 1 if they fail, 2 if they are given
+// invalid arguments, flags or configuration, and 130 if they are interrupted.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	exitOK = 0
+	// exitFailure is returned when a command fails, or finds the damage it was asked to look for.
+	exitFailure = 1
+	// exitUsage is returned when a command is given invalid arguments, flags or configuration.
+	exitUsage = 2
+	// exitInterrupted is returned when a command is stopped by SIGINT or SIGTERM before it has
+	// finished, as shells do for SIGINT.
+	exitInterrupted = 130
+)
+
+// A command is one of the things usenet can do, or a group of them.
+type command struct {
+	name string
+	// args describes the arguments the command takes after its flags.
+	args    string
+	summary string
+	// run runs the command with the arguments following its name, returning the exit status.
+	run func(args []string) int
+	// subcommands, if set, are chosen between by the first argument instead of calling run.
+	subcommands []command
+}
+
+func commands() []command {
+	return []command{
+		{name: "get", args: "[-nzb <file> | -search <query>]", summary: "download the articles of an NZB file", run: runGet},
+		{name: "fetch-article", args: "<message-id>", summary: "print the body of a single article", run: runFetchArticle},
+		{name: "par2", summary: "inspect, verify, repair and create PAR2 recovery sets", subcommands: []command{
+			{name: "inspect", args: "<file.par2>", summary: "print the packets of a PAR2 file", run: runPar2Inspect},
+			{name: "verify", args: "[dir]", summary: "check the files in a directory against their recovery set", run: runPar2Verify},
+			{name: "repair", args: "[dir]", summary: "verify the files in a directory, then repair any damage", run: runPar2Repair},
+			{name: "create", args: "<base> <file>...", summary: "create a recovery set protecting files", run: runPar2Create},
+		}},
+		{name: "nzb", summary: "work with NZB files", subcommands: []command{
+			{name: "inspect", args: "<file.nzb>", summary: "list the files and segments of an NZB", run: runNzbInspect},
+			{name: "check", args: "<file.nzb>", summary: "ask the servers which of an NZB's articles they have, and whether it could be repaired", run: runNzbCheck},
+		}},
+		{name: "serve", summary: "run the download daemon and its HTTP API", run: runServe},
+	}
+}
+
+func main() {
+	os.Exit(dispatch("usenet", commands(), os.Args[1:]))
+}
+
+// dispatch runs the command named by the first of args.
+func dispatch(prefix string, cmds []command, args []string) int {
+	if len(args) == 0 {
+		printCommands(os.Stderr, prefix, cmds)
+		return exitUsage
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		printCommands(os.Stdout, prefix, cmds)
+		return exitOK
+	}
+	for _, c := range cmds {
+		if c.name != args[0] {
+			continue
+		}
+		if c.subcommands != nil {
+			return dispatch(prefix+" "+c.name, c.subcommands, args[1:])
+		}
+		return c.run(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command '%s %s'\n\n", prefix, args[0])
+	printCommands(os.Stderr, prefix, cmds)
+	return exitUsage
+}
+
+func printCommands(w io.Writer, prefix string, cmds []command) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [arguments]\n\nCommands:\n", prefix)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "  %-15s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command.\n", strings.TrimSpace(prefix))
+}
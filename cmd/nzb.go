@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/esteth/usenet/pkg/downloader"
+	"github.com/esteth/usenet/pkg/nzb"
+)
+
+func runNzbInspect(args []string) int {
+	o := newOptions("nzb inspect", "<file.nzb>")
+	if status, ok := o.parse(args); !ok {
+		return status
+	}
+	if o.flags.NArg() != 1 {
+		o.flags.Usage()
+		return exitUsage
+	}
+	if _, _, err := o.load(nil); err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+
+	n, err := nzb.FromFile(o.flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return exitFailure
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "SEGMENTS\tBYTES\tMISSING\tSUBJECT\n")
+	segments := 0
+	for _, file := range n.Files {
+		segments += len(file.Segments)
+		fmt.Fprintf(w, "%d\t%d\t%v\t%s\n", len(file.Segments), file.Bytes(), missingSegments(file), file.Subject)
+	}
+	w.Flush()
+	fmt.Printf("\n%d files, %d segments, %d bytes\n", len(n.Files), segments, n.Bytes())
+	for _, meta := range n.Meta {
+		fmt.Printf("%s: %s\n", meta.Type, meta.Value)
+	}
+	return exitOK
+}
+
+func runNzbCheck(args []string) int {
+	o := newOptions("nzb check", "<file.nzb>")
+	server := addServerFlags(o.flags)
+	asJSON := o.flags.Bool("json", false, "print the report as JSON")
+	if status, ok := o.parse(args); !ok {
+		return status
+	}
+	if o.flags.NArg() != 1 {
+		o.flags.Usage()
+		return exitUsage
+	}
+	cfg, logger, err := o.load(server.apply)
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+	nntpServers, err := servers(cfg, logger)
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+	n, err := nzbFromFile(o.flags.Arg(0))
+	if err != nil {
+		logger.Error(err.Error())
+		return exitFailure
+	}
+
+	ctx, stop := interruptContext(logger)
+	defer stop()
+	d, err := downloader.New(downloader.Config{Servers: nntpServers, Logger: logger})
+	if err != nil {
+		logger.Error(err.Error())
+		return exitFailure
+	}
+	result, err := d.Check(ctx, n)
+	d.Close()
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return exitFailure
+	}
+
+	if *asJSON {
+		err = json.NewEncoder(os.Stdout).Encode(newCheckReport(result))
+	} else {
+		printCheck(os.Stdout, result)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return exitFailure
+	}
+	if !result.Repairable() {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// checkReport is the JSON form of the result of nzb check.
+type checkReport struct {
+	Complete bool `json:"complete"`
+	// Repairable is true if every segment is available, or PAR2 is estimated to be able to repair
+	// the files without those which aren't.
+	Repairable bool                `json:"repairable"`
+	Segments   int                 `json:"segments"`
+	Missing    int                 `json:"missing"`
+	Servers    []checkServerReport `json:"servers"`
+	Files      []checkFileReport   `json:"files"`
+	// Damage is omitted if there is no PAR2 index file to estimate the damage with, or the
+	// subjects of the files don't name them well enough to.
+	Damage *checkDamageReport `json:"damage,omitempty"`
+}
+
+type checkServerReport struct {
+	Address   string `json:"address"`
+	Available int    `json:"available"`
+}
+
+type checkFileReport struct {
+	Name     string `json:"name"`
+	Subject  string `json:"subject"`
+	Bytes    int64  `json:"bytes"`
+	Segments int    `json:"segments"`
+	Missing  int    `json:"missing"`
+	// Available holds the number of segments each server has, in the same order as the report's
+	// servers.
+	Available []int `json:"available"`
+	// MissingSegments lists the numbers of the segments no server has.
+	MissingSegments []int `json:"missingSegments,omitempty"`
+}
+
+type checkDamageReport struct {
+	DamagedSlices  int   `json:"damagedSlices"`
+	RecoverySlices int   `json:"recoverySlices"`
+	MissingBytes   int64 `json:"missingBytes"`
+}
+
+func newCheckReport(result downloader.CheckResult) checkReport {
+	report := checkReport{
+		Complete:   result.Complete(),
+		Repairable: result.Repairable(),
+		Missing:    result.Missing(),
+		Servers:    make([]checkServerReport, len(result.Servers)),
+	}
+	for i, address := range result.Servers {
+		report.Servers[i].Address = address
+	}
+	for _, f := range result.Files {
+		file := checkFileReport{
+			Name:      f.File.Name(),
+			Subject:   f.File.Subject,
+			Bytes:     f.File.Bytes(),
+			Segments:  len(f.Segments),
+			Missing:   f.Missing(),
+			Available: make([]int, len(result.Servers)),
+		}
+		for i := range result.Servers {
+			file.Available[i] = f.AvailableOn(i)
+			report.Servers[i].Available += file.Available[i]
+		}
+		for _, s := range f.Segments {
+			if !s.Available() {
+				file.MissingSegments = append(file.MissingSegments, s.Segment.Number)
+			}
+		}
+		report.Segments += file.Segments
+		report.Files = append(report.Files, file)
+	}
+	if d := result.Damage; d != nil {
+		report.Damage = &checkDamageReport{DamagedSlices: d.DamagedSlices, RecoverySlices: d.RecoverySlices, MissingBytes: d.MissingBytes}
+	}
+	return report
+}
+
+// printCheck prints how many of each file's segments each server has, followed by whether the
+// files could be downloaded intact.
+func printCheck(w io.Writer, result downloader.CheckResult) {
+	report := newCheckReport(result)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "SEGMENTS\tMISSING")
+	for i := range report.Servers {
+		fmt.Fprintf(tw, "\tSERVER %d", i+1)
+	}
+	fmt.Fprintf(tw, "\tSUBJECT\n")
+	for _, f := range report.Files {
+		fmt.Fprintf(tw, "%d\t%d", f.Segments, f.Missing)
+		for _, available := range f.Available {
+			fmt.Fprintf(tw, "\t%d", available)
+		}
+		fmt.Fprintf(tw, "\t%s\n", f.Subject)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	for i, s := range report.Servers {
+		fmt.Fprintf(w, "Server %d, %s: %d of %d segments\n", i+1, s.Address, s.Available, report.Segments)
+	}
+	fmt.Fprintf(w, "%d of %d segments are missing from every server\n", report.Missing, report.Segments)
+	switch d := result.Damage; {
+	case report.Complete:
+		fmt.Fprintf(w, "Complete\n")
+	case d == nil:
+		fmt.Fprintf(w, "Not repairable: the damage can't be estimated without a PAR2 index file and the names of the files\n")
+	case d.Repairable():
+		fmt.Fprintf(w, "Repairable: %d slices are damaged, and %d recovery slices are available\n", d.DamagedSlices, d.RecoverySlices)
+	default:
+		fmt.Fprintf(w, "Not repairable: %v\n", d)
+	}
+}
+
+// missingSegments returns the numbers of the segments absent from a file's run of segments,
+// which the poster may have failed to upload.
+func missingSegments(file nzb.File) []int {
+	missing := []int{}
+	next := 1
+	for _, segment := range file.Segments {
+		for ; next < segment.Number; next++ {
+			missing = append(missing, next)
+		}
+		if segment.Number >= next {
+			next = segment.Number + 1
+		}
+	}
+	return missing
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/esteth/usenet/pkg/config"
+	"github.com/esteth/usenet/pkg/credentials"
+	"github.com/esteth/usenet/pkg/nntp"
+)
+
+// options are the flags every command shares: where its configuration is, and how to log.
+type options struct {
+	flags      *flag.FlagSet
+	configPath string
+	logLevel   string
+	logFormat  string
+}
+
+// newOptions creates the flag set for the named command, with the shared flags registered.
+// args describes the arguments the command takes after its flags.
+func newOptions(name string, args string) *options {
+	o := &options{flags: flag.NewFlagSet(name, flag.ContinueOnError)}
+	o.flags.Usage = func() {
+		fmt.Fprintf(o.flags.Output(), "Usage: usenet %s [flags] %s\n\nFlags:\n", name, args)
+		o.flags.PrintDefaults()
+	}
+	o.flags.StringVar(&o.configPath, "config", os.Getenv("USENET_CONFIG"), "a TOML configuration file. Flags given on the command line override its settings. Defaults to $USENET_CONFIG")
+	o.flags.StringVar(&o.logLevel, "log-level", "info", "the minimum level of messages to log: debug, info, warn or error. debug traces NNTP commands")
+	o.flags.StringVar(&o.logFormat, "log-format", "text", "the format to log in: text or json")
+	return o
+}
+
+// parse parses args. If the command should not go on to run, because help was asked for or the
+// flags were invalid, it returns false and the status to exit with.
+func (o *options) parse(args []string) (int, bool) {
+	if err := o.flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// load loads the configuration, then applies the flags given on the command line. apply is
+// called with the name of each flag which was set and isn't one of the shared flags, and may be
+// nil if the command has no flags which change the configuration.
+func (o *options) load(apply func(cfg *config.Config, name string) error) (config.Config, *slog.Logger, error) {
+	var cfg config.Config
+	var err error
+	if o.configPath != "" {
+		cfg, err = config.Load(o.configPath)
+	} else {
+		cfg, err = config.FromEnv()
+	}
+	if err != nil {
+		return config.Config{}, nil, err
+	}
+	o.flags.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		switch f.Name {
+		case "config":
+		case "log-level":
+			cfg.Log.Level = o.logLevel
+		case "log-format":
+			cfg.Log.Format = o.logFormat
+		default:
+			if apply != nil {
+				err = apply(&cfg, f.Name)
+			}
+		}
+	})
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		return config.Config{}, nil, err
+	}
+	logger, err := cfg.Logger(os.Stderr)
+	if err != nil {
+		return config.Config{}, nil, err
+	}
+	return cfg, logger, nil
+}
+
+// serverOptions are the flags giving a server to use instead of the configured ones.
+type serverOptions struct {
+	address      string
+	useTLS       bool
+	user         string
+	password     string
+	passwordFile string
+	connections  int
+}
+
+func addServerFlags(fs *flag.FlagSet) *serverOptions {
+	s := &serverOptions{}
+	fs.StringVar(&s.address, "server", "", "the host:port of a server to connect to, instead of the servers in the configuration file")
+	fs.BoolVar(&s.useTLS, "tls", true, "whether to connect to the server given with -server over TLS")
+	fs.StringVar(&s.user, "user", "", "a username to auth to the server given with -server")
+	fs.StringVar(&s.password, "password", "", "a password for auth to the server given with -server. Prefer a configuration file, as arguments are visible to other users")
+	fs.StringVar(&s.passwordFile, "password-file", "", "a file holding the password for the server given with -server")
+	fs.IntVar(&s.connections, "connections", 1, "the number of simultaneous connections to open to each server, overriding the configuration file")
+	return s
+}
+
+// apply applies the server flag with the given name to cfg.
+func (s *serverOptions) apply(cfg *config.Config, name string) error {
+	switch name {
+	case "server":
+		server, err := config.ServerAt(s.address)
+		if err != nil {
+			return err
+		}
+		server.TLS, server.User, server.Connections = &s.useTLS, s.user, s.connections
+		server.Password, server.PasswordFile = credentials.Secret(s.password), s.passwordFile
+		cfg.Servers = []config.Server{server}
+	case "connections":
+		for i := range cfg.Servers {
+			cfg.Servers[i].Connections = s.connections
+		}
+	}
+	return nil
+}
+
+// servers returns the servers to download from, in order of priority, with their credentials
+// resolved.
+func servers(cfg config.Config, logger *slog.Logger) ([]nntp.Server, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, fmt.Errorf("No servers configured: give -server, or a configuration file with a [[servers]] table")
+	}
+	if err := cfg.ResolveCredentials(context.Background()); err != nil {
+		return nil, err
+	}
+	result := cfg.NNTPServers()
+	for i := range result {
+		result[i].Logger = logger
+	}
+	return result, nil
+}
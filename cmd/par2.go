@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/esteth/usenet/pkg/par2"
+	"github.com/esteth/usenet/pkg/par2/scanner"
+	"github.com/esteth/usenet/pkg/postprocess"
+)
+
+// defaultSliceCount is how many slices par2 create splits files into if no slice size is given,
+// as with par2cmdline.
+const defaultSliceCount = 2000
+
+func runPar2Inspect(args []string) int {
+	o := newOptions("par2 inspect", "<file.par2>")
+	if status, ok := o.parse(args); !ok {
+		return status
+	}
+	if o.flags.NArg() != 1 {
+		o.flags.Usage()
+		return exitUsage
+	}
+	if _, _, err := o.load(nil); err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+
+	parFile, err := os.Open(o.flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open PAR file: %v\n", err)
+		return exitFailure
+	}
+	defer parFile.Close()
+
+	parScanner := scanner.NewScanner(parFile)
+	for parScanner.Scan() {
+		packet := parScanner.Packet()
+		fmt.Printf("packet found: %v\n", string(packet.Type()))
+
+		if mainPacket, ok := packet.(scanner.MainPacket); ok {
+			fmt.Printf("Slice Size: %d\n", mainPacket.SliceSize)
+			fmt.Printf("Recovery file IDs: %v\n", mainPacket.RecoveryFileIDs)
+		}
+
+		if fileDescriptionPacket, ok := packet.(scanner.FileDescriptionPacket); ok {
+			fmt.Printf("File Name: %s\n", fileDescriptionPacket.FileName)
+			fmt.Printf("File ID: %v\n", fileDescriptionPacket.ID)
+			fmt.Printf("File MD5: %v\n", fileDescriptionPacket.MD5)
+			fmt.Printf("File MD5-16: %v\n", fileDescriptionPacket.MD516)
+			fmt.Printf("File Length: %d\n", fileDescriptionPacket.FileLength)
+		}
+
+		if fileSliceChecksumPacket, ok := packet.(scanner.FileSliceChecksumPacket); ok {
+			fmt.Printf("File ID: %v\n", fileSliceChecksumPacket.FileID)
+			for _, hash := range fileSliceChecksumPacket.SliceHashes {
+				fmt.Printf("Slice hash: %v\n", hash)
+			}
+			for _, checksum := range fileSliceChecksumPacket.SliceCRC32s {
+				fmt.Printf("Slice checksum: %v\n", checksum)
+			}
+		}
+
+		if recoverySlicePacket, ok := packet.(scanner.RecoverySlicePacket); ok {
+			fmt.Printf("Exponent: %d\n", recoverySlicePacket.Exponent)
+			fmt.Printf("Data Path: %v\n", recoverySlicePacket.RecoveryDataFilePath)
+			fmt.Printf("Data Offset: %d\n", recoverySlicePacket.RecoveryDataFileOffset)
+		}
+
+		if creatorPacket, ok := packet.(scanner.CreatorPacket); ok {
+			fmt.Printf("Creator: %s\n", creatorPacket.Creator)
+		}
+	}
+
+	if err := parScanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading PAR file: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func runPar2Verify(args []string) int {
+	o := newOptions("par2 verify", "[dir]")
+	if status, ok := o.parse(args); !ok {
+		return status
+	}
+	return runPar2Stages(o, postprocess.Verify())
+}
+
+func runPar2Repair(args []string) int {
+	o := newOptions("par2 repair", "[dir]")
+	if status, ok := o.parse(args); !ok {
+		return status
+	}
+	return runPar2Stages(o, postprocess.Verify(), postprocess.Repair())
+}
+
+// runPar2Stages runs post-processing stages on the directory given as the command's argument,
+// which defaults to the working directory.
+//
+// It exits with exitFailure if a stage fails, or if the files are left damaged.
+func runPar2Stages(o *options, stages ...postprocess.Stage) int {
+	if o.flags.NArg() > 1 {
+		o.flags.Usage()
+		return exitUsage
+	}
+	_, logger, err := o.load(nil)
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+	dir := "."
+	if o.flags.NArg() == 1 {
+		dir = o.flags.Arg(0)
+	}
+
+	job := &postprocess.Job{Dir: dir, Logger: logger}
+	err = postprocess.New(stages...).Run(context.Background(), job, func(r postprocess.Result) {
+		for _, line := range r.Log {
+			logger.Info(line, "stage", r.Stage)
+		}
+	})
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		logger.Error("No PAR2 files found", "dir", dir)
+		return exitFailure
+	case err != nil:
+		logger.Error(err.Error())
+		return exitFailure
+	case !job.Verified:
+		return exitFailure
+	}
+	return exitOK
+}
+
+func runPar2Create(args []string) int {
+	o := newOptions("par2 create", "<base> <file>...")
+	sliceSize := o.flags.Int("slice-size", 0, "the size in bytes of each slice, which must be a multiple of 4. By default, files are split into about 2000 slices")
+	redundancy := o.flags.Int("redundancy", 10, "how many recovery slices to create, as a percentage of the number of slices the files are split into")
+	if status, ok := o.parse(args); !ok {
+		return status
+	}
+	if o.flags.NArg() < 2 {
+		o.flags.Usage()
+		return exitUsage
+	}
+	_, logger, err := o.load(nil)
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+	if *redundancy < 0 || *sliceSize < 0 || *sliceSize%4 != 0 {
+		fmt.Fprintf(o.flags.Output(), "-slice-size must be a multiple of 4, and -redundancy must not be negative\n")
+		return exitUsage
+	}
+
+	// The recovery set is written alongside base, and names the files relative to it.
+	base := o.flags.Arg(0)
+	dir := filepath.Dir(base)
+	var names []string
+	var sizes []int64
+	var total int64
+	for _, path := range o.flags.Args()[1:] {
+		name, err := filepath.Rel(dir, path)
+		if err != nil || strings.HasPrefix(name, "..") {
+			fmt.Fprintf(o.flags.Output(), "%s is not within %s, where the recovery set is written\n", path, dir)
+			return exitUsage
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			logger.Error("Could not stat file", "file", path, "error", err)
+			return exitFailure
+		}
+		names = append(names, filepath.ToSlash(name))
+		sizes = append(sizes, info.Size())
+		total += info.Size()
+	}
+
+	size := *sliceSize
+	if size == 0 {
+		size = int((total+defaultSliceCount-1)/defaultSliceCount+3) &^ 3
+		if size == 0 {
+			size = 4
+		}
+	}
+	slices := 0
+	for _, fileSize := range sizes {
+		slices += int((fileSize + int64(size) - 1) / int64(size))
+	}
+	recovery := (slices**redundancy + 99) / 100
+
+	written, err := par2.Create(dir, filepath.Base(base), names, size, volumeSizes(recovery))
+	if err != nil {
+		logger.Error(err.Error())
+		return exitFailure
+	}
+	logger.Info("Created recovery set", "files", len(names), "sliceSize", size, "slices", slices, "recoverySlices", recovery)
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return exitOK
+}
+
+// volumeSizes splits count recovery slices into volumes which double in size, as par2cmdline
+// does, so that a downloader can fetch about as many as it needs.
+func volumeSizes(count int) []int {
+	var sizes []int
+	for size := 1; count > 0; size *= 2 {
+		if size > count {
+			size = count
+		}
+		sizes = append(sizes, size)
+		count -= size
+	}
+	return sizes
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/esteth/usenet/pkg/config"
+	"github.com/esteth/usenet/pkg/daemon"
+	"github.com/esteth/usenet/pkg/feed"
+	"github.com/esteth/usenet/pkg/hooks"
+	"github.com/esteth/usenet/pkg/postprocess"
+	"github.com/esteth/usenet/pkg/sabnzbd"
+	"github.com/esteth/usenet/pkg/watch"
+)
+
+// fetchTimeout is how long fetching an NZB for the SABnzbd-compatible API may take.
+const fetchTimeout = time.Minute
+
+func runServe(args []string) int {
+	o := newOptions("serve", "")
+	server := addServerFlags(o.flags)
+	listen := o.flags.String("listen", "127.0.0.1:8080", "the address to serve the HTTP API on. Addresses other machines can reach need -api-key")
+	stateDir := o.flags.String("state", ".", "the directory to keep the queue in")
+	outputDir := o.flags.String("output", ".", "the directory to write downloads to")
+	apiKey := o.flags.String("api-key", "", "the API key required by the JSON and SABnzbd-compatible APIs. They are disabled if empty")
+	categories := o.flags.String("categories", "", "a comma-separated list of categories reported by the SABnzbd-compatible API")
+	watchDir := o.flags.String("watch", "", "a directory to watch for NZB files to queue. Subdirectories name categories")
+	feedInterval := o.flags.Duration("feed-interval", feed.DefaultInterval, "how often to read the RSS feeds listed in the config file")
+	completeDir := o.flags.String("complete", "", "the directory to move finished downloads to, within a subdirectory for their category")
+	stages := o.flags.String("stages", strings.Join(postprocess.DefaultStages, ","), "a comma-separated list of post-processing stages to run on finished downloads. Empty disables post-processing")
+	metricsAddr := o.flags.String("metrics-addr", "", "an address to serve Prometheus metrics on at /metrics. If empty, they are served at /metrics on the API address")
+	var scripts stringList
+	o.flags.Var(&scripts, "script", "a script to run for each job. May be repeated")
+	scriptEvents := o.flags.String("script-events", string(hooks.Finished), "a comma-separated list of events to run scripts for: added, started and finished")
+	scriptTimeout := o.flags.Duration("script-timeout", hooks.DefaultTimeout, "how long scripts may run for before they are killed")
+	if status, ok := o.parse(args); !ok {
+		return status
+	}
+
+	cfg, logger, err := o.load(func(cfg *config.Config, name string) error {
+		switch name {
+		case "listen":
+			cfg.API.Listen = *listen
+		case "state":
+			cfg.StateDir = *stateDir
+		case "output":
+			cfg.OutputDir = *outputDir
+		case "api-key":
+			cfg.API.Key = *apiKey
+		case "categories":
+			cfg.Categories = nil
+			for _, name := range splitList(*categories) {
+				cfg.Categories = append(cfg.Categories, config.Category{Name: name})
+			}
+		case "watch":
+			cfg.WatchDir = *watchDir
+		case "feed-interval":
+			cfg.FeedInterval = *feedInterval
+		case "complete":
+			cfg.CompleteDir = *completeDir
+		case "stages":
+			cfg.PostProcess.Stages = splitList(*stages)
+		case "metrics-addr":
+			cfg.API.MetricsListen = *metricsAddr
+		case "script":
+			cfg.PostProcess.Scripts = scripts
+		case "script-events":
+			cfg.PostProcess.ScriptEvents = splitList(*scriptEvents)
+		case "script-timeout":
+			cfg.PostProcess.ScriptTimeout = *scriptTimeout
+		default:
+			return server.apply(cfg, name)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+	nntpServers, err := servers(cfg, logger)
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+	pipeline, err := cfg.Pipeline()
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+	hookScripts, err := cfg.Scripts()
+	if err != nil {
+		fmt.Fprintf(o.flags.Output(), "%v\n", err)
+		return exitUsage
+	}
+
+	d, err := daemon.New(daemon.Config{
+		Servers:      nntpServers,
+		QueuePath:    filepath.Join(cfg.StateDir, "queue.json"),
+		OutputDir:    cfg.OutputDir,
+		CacheSize:    int64(cfg.CacheSize),
+		PostProcess:  pipeline,
+		CategoryDirs: cfg.CategoryDirs(),
+		Scripts:      hookScripts,
+		APIKey:       cfg.API.Key,
+		NZBDir:       cfg.WatchDir,
+		Logger:       logger,
+	})
+	if err != nil {
+		logger.Error("Could not start daemon", "error", err)
+		return exitFailure
+	}
+	d.SetSpeedLimit(int64(cfg.SpeedLimit))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", d.Handler())
+	if cfg.API.MetricsListen == "" {
+		mux.Handle("/metrics", d.MetricsHandler())
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", d.MetricsHandler())
+		metricsServer := &http.Server{Addr: cfg.API.MetricsListen, Handler: metricsMux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Metrics server failed", "error", err)
+				stop()
+			}
+		}()
+		defer metricsServer.Shutdown(context.Background())
+	}
+	if cfg.API.Key != "" {
+		sab := sabnzbd.New(d, sabnzbd.Config{
+			APIKey:     cfg.API.Key,
+			Categories: cfg.CategoryNames(),
+			Client:     &http.Client{Timeout: fetchTimeout},
+		})
+		mux.Handle("/api", sab)
+		mux.Handle("/sabnzbd/api", sab)
+	}
+
+	httpServer := &http.Server{Addr: cfg.API.Listen, Handler: mux}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("HTTP server failed", "error", err)
+			stop()
+		}
+	}()
+
+	if cfg.WatchDir != "" {
+		watcher := watch.New(watch.Config{
+			Dir: cfg.WatchDir,
+			OnError: func(err error) {
+				logger.Warn("Watch folder error", "error", err)
+			},
+		}, d)
+		go watcher.Run(ctx)
+	}
+
+	if len(cfg.Feeds) > 0 {
+		poller, err := feed.New(feed.Config{
+			Feeds:     cfg.Feeds,
+			StatePath: filepath.Join(cfg.StateDir, "grabbed.json"),
+			Interval:  cfg.FeedInterval,
+			OnError: func(err error) {
+				logger.Warn("RSS feed error", "error", err)
+			},
+		}, d)
+		if err != nil {
+			logger.Error("Could not load feeds", "error", err)
+			return exitFailure
+		}
+		go poller.Run(ctx)
+	}
+
+	d.Run(ctx)
+	httpServer.Shutdown(context.Background())
+	return exitOK
+}
+
+// splitList splits a comma-separated flag, where an empty flag is an empty list.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// stringList is a flag which may be given more than once, collecting each value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
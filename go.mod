@@ -1,7 +1,24 @@
 module github.com/esteth/usenet
 
-go 1.20
+go 1.21
 
-require golang.org/x/net v0.0.0-20210510120150-4163338589ed
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/bodgit/sevenzip v1.6.0
+	github.com/nwaples/rardecode/v2 v2.4.1
+	golang.org/x/net v0.0.0-20210510120150-4163338589ed
+)
 
-require golang.org/x/text v0.3.6 // indirect
+require (
+	github.com/andybalholm/brotli v1.1.1 // indirect
+	github.com/bodgit/plumbing v1.3.0 // indirect
+	github.com/bodgit/windows v1.0.1 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/ulikunitz/xz v0.5.12 // indirect
+	go4.org v0.0.0-20200411211856-f5505b9728dd // indirect
+	golang.org/x/text v0.20.0 // indirect
+)
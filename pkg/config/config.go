@@ -0,0 +1,560 @@
+// Package config loads the settings shared by the commands from a TOML file, so that servers and
+// their credentials don't have to be given on the command line.
+//
+// A configuration file looks like:
+//
+//	output_dir = "/downloads/incomplete"
+//	complete_dir = "/downloads/complete"
+//	speed_limit = "10M"
+//	cache_size = "256M"
+//
+//	[[servers]]
+//	name = "primary"
+//	host = "news.example.com"
+//	port = 563
+//	user = "me"
+//	password_file = "/run/secrets/news_password"
+//	connections = 20
+//
+//	[[servers]]
+//	name = "backup"
+//	host = "backup.example.com"
+//	priority = 1
+//
+//	[[categories]]
+//	name = "tv"
+//	dir = "/media/tv"
+//
+//	[[feeds]]
+//	name = "indexer"
+//	url = "https://indexer.example.com/rss?t=5000&apikey=..."
+//	category = "tv"
+//	include = ["1080p"]
+//
+//	[postprocess]
+//	stages = ["verify", "repair", "unpack", "cleanup", "move"]
+//	scripts = ["/scripts/notify.sh"]
+//
+// Every setting may be overridden by an environment variable named after its key, upper-cased and
+// prefixed with USENET_, with tables and array indexes separated by underscores: for example
+// USENET_LOG_LEVEL or USENET_SERVERS_0_PASSWORD. Servers, categories and feeds may also be picked
+// out by name, as in USENET_SERVERS_PRIMARY_PASSWORD.
+//
+// A server's password may be given directly, read from a file with password_file, read from an
+// environment variable with password_env, or printed by a helper command given as password_command.
+// If none of those are set, it is looked up in ~/.netrc, or the file named by netrc.
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/esteth/usenet/pkg/credentials"
+	"github.com/esteth/usenet/pkg/feed"
+	"github.com/esteth/usenet/pkg/hooks"
+	"github.com/esteth/usenet/pkg/logging"
+	"github.com/esteth/usenet/pkg/nntp"
+	"github.com/esteth/usenet/pkg/postprocess"
+)
+
+// EnvPrefix starts the name of every environment variable which overrides a setting.
+const EnvPrefix = "USENET"
+
+// Config holds every setting which can be given in a configuration file.
+type Config struct {
+	// OutputDir is the directory downloads are written to.
+	OutputDir string `toml:"output_dir"`
+	// CompleteDir is the directory finished downloads are moved to. If empty, they are left in
+	// OutputDir.
+	CompleteDir string `toml:"complete_dir"`
+	// StateDir is the directory the queue and other state is kept in.
+	StateDir string `toml:"state_dir"`
+	// WatchDir, if set, is a directory to watch for NZB files to queue.
+	WatchDir string `toml:"watch_dir"`
+	// FeedInterval is how often to read RSS feeds.
+	FeedInterval time.Duration `toml:"feed_interval"`
+	// SpeedLimit is the maximum total download speed in bytes per second, or 0 for no limit.
+	SpeedLimit ByteSize `toml:"speed_limit"`
+	// CacheSize is the amount of downloaded data held in memory so that it can be written in
+	// large pieces. It defaults to downloader.DefaultCacheSize.
+	CacheSize ByteSize `toml:"cache_size"`
+
+	Servers     []Server    `toml:"servers"`
+	Categories  []Category  `toml:"categories"`
+	Feeds       []feed.Feed `toml:"feeds"`
+	API         API         `toml:"api"`
+	PostProcess PostProcess `toml:"postprocess"`
+	Log         Log         `toml:"log"`
+}
+
+// A Server is an NNTP server to download from.
+type Server struct {
+	// Name identifies the server in environment variables and logs. It defaults to the host.
+	Name string `toml:"name"`
+	Host string `toml:"host"`
+	// Port defaults to 563 when using TLS, and 119 otherwise.
+	Port int `toml:"port"`
+	// TLS defaults to true.
+	TLS  *bool  `toml:"tls"`
+	User string `toml:"user"`
+	// Password is the password itself. At most one of Password, PasswordFile, PasswordEnv and
+	// PasswordCommand may be set; see ResolveCredentials.
+	Password credentials.Secret `toml:"password"`
+	// PasswordFile is a file holding the password, such as a Docker secret.
+	PasswordFile string `toml:"password_file"`
+	// PasswordEnv is the name of an environment variable holding the password.
+	PasswordEnv string `toml:"password_env"`
+	// PasswordCommand is a helper command, with its arguments, which prints the password.
+	PasswordCommand []string `toml:"password_command"`
+	// Netrc is the netrc file to look the password up in when no other source is given. It
+	// defaults to $NETRC, or ~/.netrc.
+	Netrc string `toml:"netrc"`
+	// Connections is the maximum number of simultaneous connections to open. It defaults to 1.
+	Connections int `toml:"connections"`
+	// Priority orders the servers: articles are fetched from servers with lower numbers first,
+	// and only from the others if those don't have them.
+	Priority int `toml:"priority"`
+}
+
+// A Category groups jobs, and can give them their own destination directory.
+type Category struct {
+	Name string `toml:"name"`
+	// Dir is where finished jobs in the category are moved to. A relative directory is within
+	// CompleteDir. If empty, it is a subdirectory of CompleteDir named after the category.
+	Dir string `toml:"dir"`
+}
+
+// API configures the HTTP interfaces of the daemon.
+type API struct {
+	// Listen is the address to serve the HTTP API on. Addresses other machines can reach, such
+	// as 0.0.0.0:8080, are only allowed if Key is set.
+	Listen string `toml:"listen"`
+	// Key is the API key required by the JSON and SABnzbd-compatible APIs, which are disabled if
+	// it is empty.
+	Key string `toml:"key"`
+	// MetricsListen, if set, is a separate address to serve Prometheus metrics on.
+	MetricsListen string `toml:"metrics_listen"`
+}
+
+// PostProcess configures what happens to jobs once they have been downloaded.
+type PostProcess struct {
+	// Stages are the names of the post-processing stages to run, in order. If empty, jobs are
+	// not post-processed.
+	Stages []string `toml:"stages"`
+	// Scripts are user scripts to run for each job.
+	Scripts []string `toml:"scripts"`
+	// ScriptEvents are the events to run scripts for.
+	ScriptEvents []string `toml:"script_events"`
+	// ScriptTimeout is how long scripts may run for before they are killed.
+	ScriptTimeout time.Duration `toml:"script_timeout"`
+}
+
+// Log configures logging.
+type Log struct {
+	// Level is the minimum level of messages to log: debug, info, warn or error.
+	Level string `toml:"level"`
+	// Format is text or json.
+	Format string `toml:"format"`
+}
+
+// Default returns the settings used for anything a configuration file leaves out.
+func Default() Config {
+	return Config{
+		OutputDir:    ".",
+		StateDir:     ".",
+		FeedInterval: feed.DefaultInterval,
+		API:          API{Listen: "127.0.0.1:8080"},
+		PostProcess: PostProcess{
+			Stages:        append([]string(nil), postprocess.DefaultStages...),
+			ScriptEvents:  []string{string(hooks.Finished)},
+			ScriptTimeout: hooks.DefaultTimeout,
+		},
+		Log: Log{Level: "info", Format: "text"},
+	}
+}
+
+// A FieldError is a problem with a single setting.
+type FieldError struct {
+	// Key is the setting's key, such as servers[1].port, or the environment variable it was
+	// read from.
+	Key string
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Load reads the configuration file at path, applies overrides from the environment and checks
+// the result. Every problem found is reported, each as a *FieldError naming the setting.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	meta, err := toml.DecodeFile(path, &cfg)
+	if err != nil {
+		return Config{}, fmt.Errorf("Could not parse %s: %w", path, err)
+	}
+	var errs []error
+	for _, key := range meta.Undecoded() {
+		errs = append(errs, &FieldError{Key: key.String(), Err: errors.New("unknown setting")})
+	}
+	errs = append(errs, applyEnv(&cfg, EnvPrefix, lookupEnv)...)
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, fmt.Errorf("Invalid configuration in %s:\n%w", path, err)
+	}
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("Invalid configuration in %s:\n%w", path, err)
+	}
+	return cfg, nil
+}
+
+// FromEnv returns the default settings with overrides from the environment, for when there is no
+// configuration file.
+func FromEnv() (Config, error) {
+	cfg := Default()
+	if err := errors.Join(applyEnv(&cfg, EnvPrefix, lookupEnv)...); err != nil {
+		return Config{}, fmt.Errorf("Invalid configuration in environment:\n%w", err)
+	}
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("Invalid configuration in environment:\n%w", err)
+	}
+	return cfg, nil
+}
+
+// setDefaults fills in the defaults of each server, which depend on its other settings.
+func (c *Config) setDefaults() {
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		if s.TLS == nil {
+			tls := true
+			s.TLS = &tls
+		}
+		if s.Port == 0 {
+			s.Port = 119
+			if *s.TLS {
+				s.Port = 563
+			}
+		}
+		if s.Connections == 0 {
+			s.Connections = 1
+		}
+		if s.Name == "" {
+			s.Name = s.Host
+		}
+	}
+}
+
+// Validate checks every setting, returning an error describing all of the problems found.
+func (c Config) Validate() error {
+	var errs []error
+	fail := func(key string, format string, args ...interface{}) {
+		errs = append(errs, &FieldError{Key: key, Err: fmt.Errorf(format, args...)})
+	}
+
+	if c.OutputDir == "" {
+		fail("output_dir", "must be set")
+	}
+	if c.FeedInterval <= 0 {
+		fail("feed_interval", "must be positive")
+	}
+
+	names := make(map[string]bool)
+	for i, s := range c.Servers {
+		key := fmt.Sprintf("servers[%d]", i)
+		if s.Host == "" {
+			fail(key+".host", "must be set")
+		}
+		if s.Port < 1 || s.Port > 65535 {
+			fail(key+".port", "%d is not a valid port", s.Port)
+		}
+		if s.Connections < 1 {
+			fail(key+".connections", "must be at least 1")
+		}
+		if err := s.credentials().Validate(); err != nil {
+			fail(key, "%v", err)
+		}
+		if s.User == "" && s.Password != "" {
+			fail(key+".user", "must be set with password")
+		}
+		if s.Name != "" && names[s.Name] {
+			fail(key+".name", "another server is named '%s'", s.Name)
+		}
+		names[s.Name] = true
+	}
+
+	categories := make(map[string]bool)
+	for i, category := range c.Categories {
+		key := fmt.Sprintf("categories[%d]", i)
+		if category.Name == "" {
+			fail(key+".name", "must be set")
+		} else if categories[category.Name] {
+			fail(key+".name", "another category is named '%s'", category.Name)
+		}
+		categories[category.Name] = true
+		if category.Dir != "" && !filepath.IsAbs(category.Dir) && c.CompleteDir == "" {
+			fail(key+".dir", "a relative directory needs complete_dir to be set")
+		}
+	}
+
+	for i, f := range c.Feeds {
+		key := fmt.Sprintf("feeds[%d]", i)
+		if f.URL == "" {
+			fail(key+".url", "must be set")
+		}
+		if _, err := feed.CompileFilters(f.Include); err != nil {
+			fail(key+".include", "%v", err)
+		}
+		if _, err := feed.CompileFilters(f.Exclude); err != nil {
+			fail(key+".exclude", "%v", err)
+		}
+		if f.MinSize < 0 {
+			fail(key+".min_size", "must not be negative")
+		}
+		if f.MaxSize < 0 {
+			fail(key+".max_size", "must not be negative")
+		} else if f.MaxSize > 0 && f.MaxSize < f.MinSize {
+			fail(key+".max_size", "must not be less than min_size")
+		}
+	}
+
+	if c.API.Listen == "" {
+		fail("api.listen", "must be set")
+	} else if c.API.Key == "" && !isLoopback(c.API.Listen) {
+		fail("api.listen", "listening on '%s', which other machines can reach, needs api.key to be set", c.API.Listen)
+	}
+
+	if _, err := postprocess.FromNames(c.PostProcess.Stages, c.CompleteDir); err != nil {
+		fail("postprocess.stages", "%v", err)
+	}
+	if _, err := hooks.ParseEvents(strings.Join(c.PostProcess.ScriptEvents, ",")); err != nil {
+		fail("postprocess.script_events", "%v", err)
+	}
+	if c.PostProcess.ScriptTimeout <= 0 {
+		fail("postprocess.script_timeout", "must be positive")
+	}
+
+	if _, err := logging.New(io.Discard, c.Log.Format, "info"); err != nil {
+		fail("log.format", "%v", err)
+	}
+	if _, err := logging.New(io.Discard, "text", c.Log.Level); err != nil {
+		fail("log.level", "%v", err)
+	}
+	return errors.Join(errs...)
+}
+
+// isLoopback returns whether a listen address only accepts connections from this machine.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// NNTPServers returns the servers to download from, in order of priority.
+func (c Config) NNTPServers() []nntp.Server {
+	servers := make([]Server, len(c.Servers))
+	copy(servers, c.Servers)
+	sort.SliceStable(servers, func(i, j int) bool {
+		return servers[i].Priority < servers[j].Priority
+	})
+	result := make([]nntp.Server, len(servers))
+	for i, s := range servers {
+		result[i] = s.NNTP()
+	}
+	return result
+}
+
+// ResolveCredentials looks up the password of each server from wherever it is configured to be
+// found, running helper commands and reading files as needed. It is separate from Load so that
+// commands which don't connect to servers don't need their credentials.
+func (c *Config) ResolveCredentials(ctx context.Context) error {
+	var errs []error
+	for i := range c.Servers {
+		s := &c.Servers[i]
+		key := fmt.Sprintf("servers[%d]", i)
+		user, password, err := s.credentials().Resolve(ctx)
+		if err != nil {
+			errs = append(errs, &FieldError{Key: key, Err: err})
+			continue
+		}
+		if user != "" && password == "" {
+			errs = append(errs, &FieldError{Key: key, Err: fmt.Errorf("no password found for user '%s'", user)})
+			continue
+		}
+		s.User, s.Password = user, password
+		s.PasswordFile, s.PasswordEnv, s.PasswordCommand = "", "", nil
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("Could not resolve server credentials:\n%w", err)
+	}
+	return nil
+}
+
+// credentials returns where to find the server's credentials.
+func (s Server) credentials() credentials.Source {
+	return credentials.Source{
+		Host:     s.Host,
+		User:     s.User,
+		Password: s.Password,
+		File:     s.PasswordFile,
+		Env:      s.PasswordEnv,
+		Command:  s.PasswordCommand,
+		Netrc:    s.Netrc,
+	}
+}
+
+// ServerAt returns a server at address, given as host:port as on the command line, with the other
+// settings left at their defaults.
+func ServerAt(address string) (Server, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return Server{}, fmt.Errorf("Invalid server address '%s': %w", address, err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return Server{}, fmt.Errorf("Invalid port in server address '%s'", address)
+	}
+	tls := true
+	return Server{Name: host, Host: host, Port: port, TLS: &tls, Connections: 1}, nil
+}
+
+// NNTP returns the server in the form the nntp package connects to. Only a password given directly
+// is used, so ResolveCredentials must be called first for the others.
+func (s Server) NNTP() nntp.Server {
+	return nntp.Server{
+		Address:     net.JoinHostPort(s.Host, strconv.Itoa(s.Port)),
+		TLS:         s.TLS == nil || *s.TLS,
+		User:        s.User,
+		Password:    s.Password,
+		Connections: s.Connections,
+	}
+}
+
+// CategoryNames returns the names of the configured categories.
+func (c Config) CategoryNames() []string {
+	names := make([]string, len(c.Categories))
+	for i, category := range c.Categories {
+		names[i] = category.Name
+	}
+	return names
+}
+
+// CategoryDirs maps each category with its own directory to that directory.
+func (c Config) CategoryDirs() map[string]string {
+	dirs := make(map[string]string)
+	for _, category := range c.Categories {
+		switch {
+		case category.Dir == "":
+		case filepath.IsAbs(category.Dir):
+			dirs[category.Name] = category.Dir
+		default:
+			dirs[category.Name] = filepath.Join(c.CompleteDir, category.Dir)
+		}
+	}
+	return dirs
+}
+
+// Pipeline returns the post-processing pipeline to run on finished jobs, or nil if there are no
+// stages to run.
+func (c Config) Pipeline() (*postprocess.Pipeline, error) {
+	if len(c.PostProcess.Stages) == 0 {
+		return nil, nil
+	}
+	return postprocess.FromNames(c.PostProcess.Stages, c.CompleteDir)
+}
+
+// Scripts returns the user scripts to run for each job. Environment variables holding server
+// passwords are hidden from them, so it must be called before ResolveCredentials, which forgets
+// where the passwords came from.
+func (c Config) Scripts() ([]hooks.Script, error) {
+	events, err := hooks.ParseEvents(strings.Join(c.PostProcess.ScriptEvents, ","))
+	if err != nil {
+		return nil, err
+	}
+	// Scripts are never given USENET_* variables, but passwords may be in others too.
+	var hide []string
+	for _, s := range c.Servers {
+		if s.PasswordEnv != "" {
+			hide = append(hide, s.PasswordEnv)
+		}
+	}
+	scripts := make([]hooks.Script, len(c.PostProcess.Scripts))
+	for i, path := range c.PostProcess.Scripts {
+		scripts[i] = hooks.Script{Path: path, Events: events, Timeout: c.PostProcess.ScriptTimeout, HideEnv: hide}
+	}
+	return scripts, nil
+}
+
+// Logger creates a logger writing to w as configured.
+func (c Config) Logger(w io.Writer) (*slog.Logger, error) {
+	return logging.New(w, c.Log.Format, c.Log.Level)
+}
+
+// A ByteSize is a number of bytes, which may be written with a K, M or G suffix for multiples of
+// 1024, such as "512K" or "1.5M".
+type ByteSize int64
+
+// ParseByteSize parses a number of bytes with an optional K, M or G suffix.
+func ParseByteSize(s string) (ByteSize, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	upper = strings.TrimSuffix(upper, "B")
+	multiplier := 1.0
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(upper, suffix) {
+			multiplier = float64(int64(1) << (10 * (i + 1)))
+			upper = strings.TrimSuffix(upper, suffix)
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(upper, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return ByteSize(value * multiplier), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, parsing a size as ParseByteSize does.
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	size, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// UnmarshalTOML implements toml.Unmarshaler, accepting either a plain number of bytes or a string
+// with a suffix.
+func (b *ByteSize) UnmarshalTOML(value interface{}) error {
+	switch v := value.(type) {
+	case int64:
+		if v < 0 {
+			return fmt.Errorf("invalid size %d", v)
+		}
+		*b = ByteSize(v)
+		return nil
+	case string:
+		return b.UnmarshalText([]byte(v))
+	}
+	return fmt.Errorf("invalid size %v", value)
+}
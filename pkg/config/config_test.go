@@ -0,0 +1,394 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esteth/usenet/pkg/feed"
+	"github.com/esteth/usenet/pkg/hooks"
+	"github.com/esteth/usenet/pkg/nntp"
+	"github.com/esteth/usenet/pkg/postprocess"
+	"github.com/esteth/usenet/pkg/queue"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "usenet.toml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Could not write config: %v", err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+output_dir = "/downloads/incomplete"
+complete_dir = "/downloads/complete"
+speed_limit = "1.5M"
+cache_size = "256M"
+
+[[servers]]
+name = "backup"
+host = "backup.example.com"
+tls = false
+priority = 1
+
+[[servers]]
+name = "primary"
+host = "news.example.com"
+user = "me"
+password = "secret"
+connections = 20
+
+[[categories]]
+name = "tv"
+dir = "/media/tv"
+
+[[categories]]
+name = "movies"
+dir = "films"
+
+[[categories]]
+name = "music"
+
+[[feeds]]
+name = "indexer"
+url = "https://indexer.example.com/rss"
+category = "tv"
+priority = 1
+include = ["1080p"]
+max_size = 4294967296
+
+[postprocess]
+stages = ["verify", "repair"]
+script_timeout = "30s"
+
+[log]
+level = "debug"
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Could not load config: %v", err)
+	}
+
+	servers := cfg.NNTPServers()
+	expected := []nntp.Server{
+		{Address: "news.example.com:563", TLS: true, User: "me", Password: "secret", Connections: 20},
+		{Address: "backup.example.com:119", TLS: false, Connections: 1},
+	}
+	if !reflect.DeepEqual(servers, expected) {
+		t.Errorf("Unexpected servers %+v", servers)
+	}
+	if cfg.SpeedLimit != 1536*1024 {
+		t.Errorf("Unexpected speed limit %d", cfg.SpeedLimit)
+	}
+	if cfg.CacheSize != 256<<20 {
+		t.Errorf("Unexpected cache size %d", cfg.CacheSize)
+	}
+	dirs := cfg.CategoryDirs()
+	expectedDirs := map[string]string{"tv": "/media/tv", "movies": "/downloads/complete/films"}
+	if !reflect.DeepEqual(dirs, expectedDirs) {
+		t.Errorf("Unexpected category directories %v", dirs)
+	}
+	expectedFeeds := []feed.Feed{{
+		Name:     "indexer",
+		URL:      "https://indexer.example.com/rss",
+		Category: "tv",
+		Priority: queue.High,
+		Include:  []string{"1080p"},
+		MaxSize:  4 << 30,
+	}}
+	if !reflect.DeepEqual(cfg.Feeds, expectedFeeds) {
+		t.Errorf("Unexpected feeds %+v", cfg.Feeds)
+	}
+	if cfg.PostProcess.ScriptTimeout != 30*time.Second || cfg.Log.Level != "debug" || cfg.Log.Format != "text" {
+		t.Errorf("Unexpected settings %+v %+v", cfg.PostProcess, cfg.Log)
+	}
+	pipeline, err := cfg.Pipeline()
+	if err != nil {
+		t.Fatalf("Could not create pipeline: %v", err)
+	}
+	if !reflect.DeepEqual(pipeline.Stages(), []string{"verify", "repair"}) {
+		t.Errorf("Unexpected stages %v", pipeline.Stages())
+	}
+	if !reflect.DeepEqual(postprocess.DefaultStages, []string{"verify", "repair", "deobfuscate", "unpack", "cleanup", "move"}) {
+		t.Errorf("Loading a config changed the default stages to %v", postprocess.DefaultStages)
+	}
+}
+
+func TestEnvironmentOverrides(t *testing.T) {
+	path := writeConfig(t, `
+[[servers]]
+name = "primary"
+host = "news.example.com"
+user = "me"
+
+[[servers]]
+host = "backup.example.com"
+
+[[feeds]]
+name = "indexer"
+url = "https://indexer.example.com/rss"
+`)
+	t.Setenv("USENET_SERVERS_PRIMARY_PASSWORD", "from-env")
+	t.Setenv("USENET_FEEDS_INDEXER_MIN_SIZE", "1000000")
+	t.Setenv("USENET_SERVERS_1_PORT", "443")
+	t.Setenv("USENET_SERVERS_1_TLS", "false")
+	t.Setenv("USENET_POSTPROCESS_STAGES", "verify,unpack")
+	t.Setenv("USENET_SPEED_LIMIT", "100K")
+	t.Setenv("USENET_LOG_FORMAT", "json")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Could not load config: %v", err)
+	}
+	if cfg.Servers[0].Password != "from-env" {
+		t.Errorf("Password was not read from the environment")
+	}
+	if cfg.Servers[1].Port != 443 || *cfg.Servers[1].TLS {
+		t.Errorf("Unexpected backup server %+v", cfg.Servers[1])
+	}
+	if !reflect.DeepEqual(cfg.PostProcess.Stages, []string{"verify", "unpack"}) {
+		t.Errorf("Unexpected stages %v", cfg.PostProcess.Stages)
+	}
+	if cfg.Feeds[0].MinSize != 1000000 {
+		t.Errorf("Unexpected feed %+v", cfg.Feeds[0])
+	}
+	if cfg.SpeedLimit != 100*1024 || cfg.Log.Format != "json" {
+		t.Errorf("Unexpected settings %d %s", cfg.SpeedLimit, cfg.Log.Format)
+	}
+}
+
+func TestErrorsNameTheSetting(t *testing.T) {
+	path := writeConfig(t, `
+[[servers]]
+host = "news.example.com"
+
+[[servers]]
+port = 70000
+user = "me"
+password = "secret"
+password_file = "/run/secrets/news"
+
+[[feeds]]
+url = "https://indexer.example.com/rss"
+
+[[feeds]]
+include = ["("]
+min_size = 100
+max_size = 10
+
+[postprocess]
+stages = ["verify", "transcode"]
+
+[log]
+level = "loud"
+`)
+	_, err := Load(path)
+	if err == nil {
+		t.Fatalf("Expected an invalid config to fail to load")
+	}
+	for _, key := range []string{"servers[1].host:", "servers[1].port:", "servers[1]:", "feeds[1].url:", "feeds[1].include:", "feeds[1].max_size:", "postprocess.stages:", "log.level:"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Error does not mention %s: %v", key, err)
+		}
+	}
+	if strings.Contains(err.Error(), "servers[0]") || strings.Contains(err.Error(), "feeds[0]") {
+		t.Errorf("Error mentions a valid server or feed: %v", err)
+	}
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) {
+		t.Errorf("Expected a FieldError, got %T", err)
+	}
+}
+
+func TestUnknownSetting(t *testing.T) {
+	path := writeConfig(t, `
+output_dir = "/downloads"
+
+[[servers]]
+host = "news.example.com"
+pasword = "typo"
+`)
+	_, err := Load(path)
+	if err == nil || !strings.Contains(err.Error(), "servers.pasword: unknown setting") {
+		t.Errorf("Expected an unknown setting error, got %v", err)
+	}
+}
+
+func TestInvalidEnvironmentOverride(t *testing.T) {
+	path := writeConfig(t, `
+[[servers]]
+host = "news.example.com"
+`)
+	t.Setenv("USENET_SERVERS_0_CONNECTIONS", "many")
+	_, err := Load(path)
+	if err == nil || !strings.Contains(err.Error(), "USENET_SERVERS_0_CONNECTIONS: invalid integer 'many'") {
+		t.Errorf("Expected an invalid override error, got %v", err)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]ByteSize{
+		"0":    0,
+		"1000": 1000,
+		"512K": 512 * 1024,
+		"10M":  10 * 1024 * 1024,
+		"2gb":  2 * 1024 * 1024 * 1024,
+	}
+	for s, expected := range cases {
+		size, err := ParseByteSize(s)
+		if err != nil {
+			t.Errorf("Could not parse %s: %v", s, err)
+		} else if size != expected {
+			t.Errorf("Parsed %s as %d, expected %d", s, size, expected)
+		}
+	}
+	if _, err := ParseByteSize("-1M"); err == nil {
+		t.Errorf("Expected a negative size to be rejected")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("USENET_API_LISTEN", "0.0.0.0:8080")
+	t.Setenv("USENET_API_KEY", "0123456789abcdef")
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("Could not load config: %v", err)
+	}
+	if cfg.API.Listen != "0.0.0.0:8080" || cfg.OutputDir != "." || len(cfg.Servers) != 0 {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+}
+
+func TestIgnoresScriptVariables(t *testing.T) {
+	path := writeConfig(t, `
+output_dir = "/downloads"
+
+[[categories]]
+name = "tv"
+dir = "/downloads/tv"
+`)
+	expected, err := Load(path)
+	if err != nil {
+		t.Fatalf("Could not load config: %v", err)
+	}
+
+	// Run usenet as a script would, with the variables describing its job.
+	script := filepath.Join(t.TempDir(), "env.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nenv | grep '^USENET_'\n"), 0755); err != nil {
+		t.Fatalf("Could not write script: %v", err)
+	}
+	result := hooks.Script{Path: script}.Run(context.Background(), hooks.Info{
+		Event: hooks.Finished, ID: "1", Name: "release", Category: "movies", Dir: "/elsewhere", Status: "Failed",
+	})
+	if result.Err != nil || len(result.Output) == 0 {
+		t.Fatalf("Could not run script: %v", result.Err)
+	}
+	for _, v := range result.Output {
+		name, value, _ := strings.Cut(v, "=")
+		t.Setenv(name, value)
+	}
+	if _, ok := lookupEnv(hooks.EnvPrefix + "CATEGORY"); ok {
+		t.Errorf("Expected the variables describing a job not to be looked up")
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Could not load config: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("Expected the job's variables not to change the settings, got %+v", cfg)
+	}
+}
+
+func TestResolveCredentials(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	os.WriteFile(secret, []byte("from-file\n"), 0600)
+	netrc := filepath.Join(dir, "netrc")
+	os.WriteFile(netrc, []byte("machine backup.example.com login other password from-netrc\n"), 0600)
+	t.Setenv("NETRC", filepath.Join(dir, "missing"))
+	path := writeConfig(t, `
+[[servers]]
+host = "news.example.com"
+user = "me"
+password_file = "`+secret+`"
+
+[[servers]]
+host = "backup.example.com"
+netrc = "`+netrc+`"
+
+[[servers]]
+host = "open.example.com"
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Could not load config: %v", err)
+	}
+	if err := cfg.ResolveCredentials(context.Background()); err != nil {
+		t.Fatalf("Could not resolve credentials: %v", err)
+	}
+	servers := cfg.NNTPServers()
+	if servers[0].User != "me" || servers[0].Password.Reveal() != "from-file" {
+		t.Errorf("Unexpected credentials for the first server: %s, %q", servers[0].User, servers[0].Password.Reveal())
+	}
+	if servers[1].User != "other" || servers[1].Password.Reveal() != "from-netrc" {
+		t.Errorf("Unexpected credentials for the second server: %s, %q", servers[1].User, servers[1].Password.Reveal())
+	}
+	if servers[2].User != "" || servers[2].Password != "" {
+		t.Errorf("Expected no credentials for the third server, got %s", servers[2].User)
+	}
+
+	cfg.Servers[2].User = "nobody"
+	err = cfg.ResolveCredentials(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "servers[2]:") {
+		t.Errorf("Expected a user without a password to fail, got %v", err)
+	}
+}
+
+func TestScriptsHidePasswordVariables(t *testing.T) {
+	path := writeConfig(t, `
+[[servers]]
+host = "news.example.com"
+user = "me"
+password_env = "NEWS_PASSWORD"
+
+[postprocess]
+scripts = ["/scripts/notify.sh"]
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Could not load config: %v", err)
+	}
+	scripts, err := cfg.Scripts()
+	if err != nil {
+		t.Fatalf("Could not create scripts: %v", err)
+	}
+	if len(scripts) != 1 || !reflect.DeepEqual(scripts[0].HideEnv, []string{"NEWS_PASSWORD"}) {
+		t.Errorf("Expected scripts to hide NEWS_PASSWORD, got %+v", scripts)
+	}
+}
+
+func TestPublicListenNeedsKey(t *testing.T) {
+	for listen, ok := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"localhost:8080": true,
+		"[::1]:8080":     true,
+		"0.0.0.0:8080":   false,
+		":8080":          false,
+	} {
+		t.Setenv("USENET_API_LISTEN", listen)
+		_, err := FromEnv()
+		if ok != (err == nil) {
+			t.Errorf("Unexpected result listening on %s without a key: %v", listen, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "api.listen:") {
+			t.Errorf("Error does not mention api.listen: %v", err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/esteth/usenet/pkg/hooks"
+)
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// lookupEnv looks up an environment variable overriding a setting. The variables describing a
+// job to the scripts run for it are ignored, as a script may run usenet.
+func lookupEnv(name string) (string, bool) {
+	if strings.HasPrefix(name, hooks.EnvPrefix) {
+		return "", false
+	}
+	return os.LookupEnv(name)
+}
+
+// applyEnv overrides the settings in the struct v points to with the environment variables,
+// found with lookup, named after their keys. Each variable name starts with prefix.
+//
+// Elements of arrays of tables are named by their index, and also by their name field if they
+// have one.
+func applyEnv(v interface{}, prefix string, lookup func(string) (string, bool)) []error {
+	return applyEnvValue(reflect.ValueOf(v).Elem(), prefix, lookup)
+}
+
+func applyEnvValue(v reflect.Value, prefix string, lookup func(string) (string, bool)) []error {
+	var errs []error
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("toml")
+		if key == "" {
+			continue
+		}
+		name := prefix + "_" + envName(key)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			errs = append(errs, applyEnvValue(field, name, lookup)...)
+			continue
+		}
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct {
+			for j := 0; j < field.Len(); j++ {
+				elem := field.Index(j)
+				errs = append(errs, applyEnvValue(elem, fmt.Sprintf("%s_%d", name, j), lookup)...)
+				if n := elem.FieldByName("Name"); n.IsValid() && n.String() != "" {
+					errs = append(errs, applyEnvValue(elem, name+"_"+envName(n.String()), lookup)...)
+				}
+			}
+			continue
+		}
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setFromString(field, value); err != nil {
+			errs = append(errs, &FieldError{Key: name, Err: err})
+		}
+	}
+	return errs
+}
+
+// envName turns a key or name into the form used in environment variable names.
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// setFromString sets v from the text of an environment variable. Lists are separated by commas.
+func setFromString(v reflect.Value, s string) error {
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration '%s'", s)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer '%s'", s)
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean '%s'", s)
+		}
+		v.SetBool(b)
+	case reflect.Pointer:
+		elem := reflect.New(v.Type().Elem())
+		if err := setFromString(elem.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Slice:
+		var items []string
+		if s != "" {
+			items = strings.Split(s, ",")
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Package credentials resolves the user and password to authenticate to a server with, from the
+// configuration, a file such as a Docker secret, an environment variable, a helper command or a
+// netrc file, and keeps passwords out of logs.
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CommandTimeout is how long a credential helper command may run for.
+const CommandTimeout = 30 * time.Second
+
+// redacted is shown in place of a secret.
+const redacted = "[redacted]"
+
+// A Secret is a string, such as a password, which must not be revealed by accident. It formats as
+// [redacted] with fmt and log/slog, whatever the verb; Reveal returns its value.
+type Secret string
+
+// Reveal returns the secret's value.
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// String implements fmt.Stringer, hiding the secret.
+func (s Secret) String() string {
+	return redacted
+}
+
+// GoString implements fmt.GoStringer, hiding the secret from the %#v verb.
+func (s Secret) GoString() string {
+	return redacted
+}
+
+// Format implements fmt.Formatter, hiding the secret whatever the verb.
+func (s Secret) Format(f fmt.State, verb rune) {
+	f.Write([]byte(redacted))
+}
+
+// LogValue implements slog.LogValuer, hiding the secret from structured logs.
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+// MarshalText implements encoding.TextMarshaler, so that encoding a secret, such as to JSON,
+// doesn't reveal it either.
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(redacted), nil
+}
+
+// A Source describes where to find the credentials for a server. At most one of Password, File,
+// Env and Command may be set; if none are, the password is looked up in a netrc file.
+type Source struct {
+	// Host is the server's host name, which netrc entries are matched against.
+	Host string
+	// User is the user to authenticate as. If empty, it is taken from the netrc entry.
+	User string
+	// Password is given directly.
+	Password Secret
+	// File is read for the password, such as a Docker secret. Surrounding whitespace is ignored.
+	File string
+	// Env is the name of an environment variable holding the password.
+	Env string
+	// Command is a credential helper to run, with its arguments, which prints the password. It
+	// is run with USENET_HOST and USENET_USER set to the server's host and the user.
+	Command []string
+	// Netrc is the netrc file to look the host up in. It defaults to $NETRC, or ~/.netrc.
+	Netrc string
+}
+
+// Validate checks that the source doesn't give the password in more than one way.
+func (s Source) Validate() error {
+	given := 0
+	for _, set := range []bool{s.Password != "", s.File != "", s.Env != "", len(s.Command) > 0} {
+		if set {
+			given++
+		}
+	}
+	if given > 1 {
+		return errors.New("only one of password, password_file, password_env and password_command may be given")
+	}
+	return nil
+}
+
+// Resolve returns the user and password to authenticate with. Both are empty if the source
+// gives no password and there is no matching netrc entry.
+//
+// Errors never include the password, or the output of a credential helper.
+func (s Source) Resolve(ctx context.Context) (string, Secret, error) {
+	if err := s.Validate(); err != nil {
+		return "", "", err
+	}
+	switch {
+	case s.Password != "":
+		return s.User, s.Password, nil
+	case s.File != "":
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", "", fmt.Errorf("Could not read password file: %w", err)
+		}
+		return s.User, Secret(strings.TrimSpace(string(data))), nil
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", "", fmt.Errorf("Password environment variable %s is not set", s.Env)
+		}
+		return s.User, Secret(value), nil
+	case len(s.Command) > 0:
+		password, err := s.runCommand(ctx)
+		return s.User, password, err
+	}
+	return s.fromNetrc()
+}
+
+func (s Source) runCommand(ctx context.Context) (Secret, error) {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Env = append(os.Environ(), "USENET_HOST="+s.Host, "USENET_USER="+s.User)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Password command %s failed: %w", filepath.Base(s.Command[0]), err)
+	}
+	// Only the first line is the password, as with git credential helpers which print more.
+	password, _, _ := strings.Cut(stdout.String(), "\n")
+	password = strings.TrimRight(password, "\r")
+	if password == "" {
+		return "", fmt.Errorf("Password command %s printed no password", filepath.Base(s.Command[0]))
+	}
+	return Secret(password), nil
+}
+
+func (s Source) fromNetrc() (string, Secret, error) {
+	path := s.Netrc
+	explicit := path != ""
+	if !explicit {
+		path = defaultNetrc()
+	}
+	if path == "" {
+		return s.User, "", nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return s.User, "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Could not open netrc file: %w", err)
+	}
+	defer f.Close()
+	entries, err := ParseNetrc(f)
+	if err != nil {
+		return "", "", fmt.Errorf("Could not parse %s: %w", path, err)
+	}
+	if entry, ok := FindNetrc(entries, s.Host, s.User); ok {
+		user := s.User
+		if user == "" {
+			user = entry.Login
+		}
+		return user, entry.Password, nil
+	}
+	return s.User, "", nil
+}
+
+// defaultNetrc returns the netrc file to use when none is configured.
+func defaultNetrc() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
@@ -0,0 +1,128 @@
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSecretIsNotRevealed(t *testing.T) {
+	type server struct {
+		User     string
+		Password Secret
+	}
+	s := server{User: "me", Password: "hunter2"}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x"} {
+		if out := fmt.Sprintf(format, s); strings.Contains(out, "hunter2") || strings.Contains(out, "68756e74657232") {
+			t.Errorf("%s revealed the secret: %s", format, out)
+		}
+	}
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Info("test", "password", s.Password, "server", s)
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("Logging revealed the secret: %s", buf.String())
+	}
+	data, _ := json.Marshal(s)
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("JSON revealed the secret: %s", data)
+	}
+	if s.Password.Reveal() != "hunter2" {
+		t.Errorf("Reveal returned %q", s.Password.Reveal())
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "secret")
+	os.WriteFile(file, []byte("from-file\n"), 0600)
+	t.Setenv("TEST_NNTP_PASSWORD", "from-env")
+
+	cases := map[string]Source{
+		"given":     {User: "me", Password: "given"},
+		"from-file": {User: "me", File: file},
+		"from-env":  {User: "me", Env: "TEST_NNTP_PASSWORD"},
+	}
+	if runtime.GOOS != "windows" {
+		cases["from-command-news.example.com-me"] = Source{Host: "news.example.com", User: "me",
+			Command: []string{"sh", "-c", `echo "from-command-$USENET_HOST-$USENET_USER"; echo other`}}
+	}
+	for expected, source := range cases {
+		user, password, err := source.Resolve(context.Background())
+		if err != nil {
+			t.Errorf("Could not resolve %s: %v", expected, err)
+			continue
+		}
+		if user != "me" || password.Reveal() != expected {
+			t.Errorf("Resolved %s as %s, %q", expected, user, password.Reveal())
+		}
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	if err := (Source{Password: "a", File: "b"}).Validate(); err == nil {
+		t.Errorf("Expected giving two passwords to be rejected")
+	}
+	if _, _, err := (Source{Env: "TEST_NNTP_UNSET"}).Resolve(context.Background()); err == nil {
+		t.Errorf("Expected an unset environment variable to fail")
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	_, _, err := (Source{Command: []string{"sh", "-c", "echo hunter2; exit 1"}}).Resolve(context.Background())
+	if err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Expected a failing command to fail without revealing its output, got %v", err)
+	}
+}
+
+func TestNetrc(t *testing.T) {
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	os.WriteFile(netrc, []byte(`# servers
+machine news.example.com login me password first
+macdef init
+cd /pub
+
+machine backup.example.com
+    login other
+    password second
+default login anonymous password guest
+`), 0600)
+
+	cases := []struct {
+		host, user               string
+		expectUser, expectSecret string
+	}{
+		{"news.example.com", "", "me", "first"},
+		{"BACKUP.example.com", "other", "other", "second"},
+		{"news.example.com", "someone", "someone", ""},
+		{"unknown.example.com", "", "anonymous", "guest"},
+	}
+	for _, c := range cases {
+		user, password, err := Source{Host: c.host, User: c.user, Netrc: netrc}.Resolve(context.Background())
+		if err != nil {
+			t.Fatalf("Could not resolve from netrc: %v", err)
+		}
+		if user != c.expectUser || password.Reveal() != c.expectSecret {
+			t.Errorf("Resolved %s as %s, %q", c.host, user, password.Reveal())
+		}
+	}
+
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "missing"))
+	user, password, err := Source{Host: "news.example.com", User: "me"}.Resolve(context.Background())
+	if err != nil || user != "me" || password != "" {
+		t.Errorf("Expected a missing default netrc to be ignored, got %s, %q, %v", user, password.Reveal(), err)
+	}
+}
+
+func TestParseNetrcErrorsHideContents(t *testing.T) {
+	_, err := ParseNetrc(strings.NewReader("machine news login me password two words\n"))
+	if err == nil || strings.Contains(err.Error(), "words") {
+		t.Errorf("Expected an error not quoting the file, got %v", err)
+	}
+}
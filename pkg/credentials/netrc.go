@@ -0,0 +1,93 @@
+package credentials
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A NetrcEntry is the login for one machine in a netrc file.
+type NetrcEntry struct {
+	// Machine is the host name the entry is for, or empty for the default entry.
+	Machine  string
+	Login    string
+	Password Secret
+}
+
+// ParseNetrc parses a netrc file, as read by ftp and curl. Macro definitions are skipped, and
+// errors never include the file's contents.
+func ParseNetrc(r io.Reader) ([]NetrcEntry, error) {
+	var entries []NetrcEntry
+	var current *NetrcEntry
+	scanner := bufio.NewScanner(r)
+	inMacro := false
+	for number := 1; scanner.Scan(); number++ {
+		line := scanner.Text()
+		if inMacro {
+			// A macro definition runs until the next empty line.
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			token := fields[i]
+			if strings.HasPrefix(token, "#") {
+				break
+			}
+			switch token {
+			case "machine", "login", "password", "account", "macdef":
+				if i+1 >= len(fields) {
+					return nil, fmt.Errorf("line %d: %s is missing its value", number, token)
+				}
+			}
+			switch token {
+			case "machine":
+				i++
+				entries = append(entries, NetrcEntry{Machine: fields[i]})
+				current = &entries[len(entries)-1]
+			case "default":
+				entries = append(entries, NetrcEntry{})
+				current = &entries[len(entries)-1]
+			case "login", "password", "account":
+				i++
+				if current == nil {
+					return nil, fmt.Errorf("line %d: %s given before any machine", number, token)
+				}
+				if token == "login" {
+					current.Login = fields[i]
+				} else if token == "password" {
+					current.Password = Secret(fields[i])
+				}
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			default:
+				// The token isn't quoted in the error, as it may be part of a password.
+				return nil, fmt.Errorf("line %d: unexpected token", number)
+			}
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// FindNetrc returns the entry for machine, falling back to the default entry. If user is not
+// empty, only entries for that login match.
+func FindNetrc(entries []NetrcEntry, machine string, user string) (NetrcEntry, bool) {
+	var fallback *NetrcEntry
+	for i, entry := range entries {
+		if user != "" && entry.Login != user {
+			continue
+		}
+		if entry.Machine != "" && strings.EqualFold(entry.Machine, machine) {
+			return entry, true
+		}
+		if entry.Machine == "" && fallback == nil {
+			fallback = &entries[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return NetrcEntry{}, false
+}
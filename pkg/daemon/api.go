@@ -0,0 +1,433 @@
+package daemon
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/queue"
+)
+
+// maxUploadSize is the largest NZB file accepted by the API.
+const maxUploadSize = 64 << 20
+
+// jobView is the JSON representation of a job returned by the API.
+type jobView struct {
+	ID              string         `json:"id"`
+	Name            string         `json:"name"`
+	Category        string         `json:"category,omitempty"`
+	Priority        queue.Priority `json:"priority"`
+	Status          queue.Status   `json:"status"`
+	TotalBytes      int64          `json:"totalBytes"`
+	DownloadedBytes int64          `json:"downloadedBytes"`
+	Segments        int            `json:"segments,omitempty"`
+	SegmentsDone    int            `json:"segmentsDone,omitempty"`
+	Added           time.Time      `json:"added"`
+	Finished        *time.Time     `json:"finished,omitempty"`
+	Error           string         `json:"error,omitempty"`
+	Storage         string         `json:"storage,omitempty"`
+	PostProcessing  []stageView    `json:"postProcessing,omitempty"`
+	Scripts         []scriptView   `json:"scripts,omitempty"`
+}
+
+// stageView is the JSON representation of the result of a post-processing stage.
+type stageView struct {
+	Stage   string    `json:"stage"`
+	Status  string    `json:"status"`
+	Log     []string  `json:"log,omitempty"`
+	Started time.Time `json:"started"`
+	Seconds float64   `json:"seconds"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// scriptView is the JSON representation of a user script run for a job.
+type scriptView struct {
+	Script   string    `json:"script"`
+	Event    string    `json:"event"`
+	ExitCode int       `json:"exitCode"`
+	Output   []string  `json:"output,omitempty"`
+	Started  time.Time `json:"started"`
+	Seconds  float64   `json:"seconds"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func newJobView(j queue.Job) jobView {
+	v := jobView{
+		ID:              j.ID,
+		Name:            j.Name,
+		Category:        j.Category,
+		Priority:        j.Priority,
+		Status:          j.Status,
+		TotalBytes:      j.TotalBytes,
+		DownloadedBytes: j.DownloadedBytes,
+		Segments:        j.Segments(),
+		SegmentsDone:    len(j.Done),
+		Added:           j.Added,
+		Error:           j.Error,
+		Storage:         j.Storage,
+	}
+	for _, r := range j.PostProcessing {
+		v.PostProcessing = append(v.PostProcessing, stageView{
+			Stage:   r.Stage,
+			Status:  r.Status,
+			Log:     r.Log,
+			Started: r.Started,
+			Seconds: r.Duration.Seconds(),
+			Error:   r.Error,
+		})
+	}
+	for _, r := range j.Scripts {
+		v.Scripts = append(v.Scripts, scriptView{
+			Script:   r.Script,
+			Event:    r.Event,
+			ExitCode: r.ExitCode,
+			Output:   r.Output,
+			Started:  r.Started,
+			Seconds:  r.Duration.Seconds(),
+			Error:    r.Error,
+		})
+	}
+	if !j.Finished.IsZero() {
+		finished := j.Finished
+		v.Finished = &finished
+	}
+	return v
+}
+
+// addRequest is the JSON body accepted when adding a job from a path on the daemon's filesystem.
+type addRequest struct {
+	Path     string         `json:"path"`
+	Name     string         `json:"name"`
+	Category string         `json:"category"`
+	Priority queue.Priority `json:"priority"`
+}
+
+// Handler returns an http.Handler serving the daemon's JSON API.
+//
+// Every request must give the daemon's API key, either in the X-Api-Key header or as the apikey
+// parameter. If the daemon has no API key, every request is refused.
+//
+// The API provides:
+//
+//	GET    /api/queue             the queued jobs, and whether the queue is paused
+//	GET    /api/history           finished jobs
+//	POST   /api/jobs              add an NZB, either uploaded as the multipart form file "nzb" or
+//	                              as a JSON body {"path": ..., "name": ..., "category": ..., "priority": ...}
+//	                              naming a file within the daemon's NZB directory
+//	GET    /api/jobs/{id}         a single job
+//	DELETE /api/jobs/{id}         delete a job from the queue or history
+//	POST   /api/jobs/{id}/pause   pause a job
+//	POST   /api/jobs/{id}/resume  resume a job
+//	POST   /api/jobs/{id}/priority change a job's priority, given as JSON {"priority": ...}
+//	POST   /api/pause             pause the whole queue
+//	POST   /api/resume            resume the whole queue
+//	GET    /api/speed             the speed limit in bytes per second, as JSON {"limit": ...}
+//	PUT    /api/speed             set the speed limit, given as JSON {"limit": ...}. 0 is unlimited.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/queue", d.handleQueue)
+	mux.HandleFunc("/api/history", d.handleHistory)
+	mux.HandleFunc("/api/jobs", d.handleJobs)
+	mux.HandleFunc("/api/jobs/", d.handleJob)
+	mux.HandleFunc("/api/pause", d.handlePauseAll)
+	mux.HandleFunc("/api/resume", d.handleResumeAll)
+	mux.HandleFunc("/api/speed", d.handleSpeed)
+	return d.requireKey(mux)
+}
+
+// requireKey wraps h, refusing requests which don't give the daemon's API key.
+func (d *Daemon) requireKey(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.apiKey == "" {
+			writeError(w, http.StatusForbidden, errors.New("the API is disabled, as no API key is configured"))
+			return
+		}
+		key := r.Header.Get("X-Api-Key")
+		if key == "" {
+			key = r.URL.Query().Get("apikey")
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(d.apiKey)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or incorrect API key"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (d *Daemon) handleQueue(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	jobs := d.queue.Jobs()
+	views := make([]jobView, len(jobs))
+	for i, j := range jobs {
+		views[i] = newJobView(j)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"paused":     d.queue.Paused(),
+		"speedLimit": d.SpeedLimit(),
+		"jobs":       views,
+	})
+}
+
+func (d *Daemon) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	jobs := d.queue.History()
+	views := make([]jobView, len(jobs))
+	for i, j := range jobs {
+		views[i] = newJobView(j)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"jobs": views,
+	})
+}
+
+func (d *Daemon) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req addRequest
+	var n nzb.Nzb
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, header, err := r.FormFile("nzb")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("could not read uploaded NZB: %w", err))
+			return
+		}
+		defer file.Close()
+		n, err = nzb.FromReader(file)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("could not parse uploaded NZB: %w", err))
+			return
+		}
+		req.Name = r.FormValue("name")
+		if req.Name == "" {
+			req.Name = header.Filename
+		}
+		req.Category = r.FormValue("category")
+		if p := r.FormValue("priority"); p != "" {
+			if _, err = fmt.Sscanf(p, "%d", &req.Priority); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid priority '%s'", p))
+				return
+			}
+		}
+	} else {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("could not parse request: %w", err))
+			return
+		}
+		if req.Path == "" {
+			writeError(w, http.StatusBadRequest, errors.New("request must contain an uploaded NZB or a path"))
+			return
+		}
+		path, err := d.NZBPath(req.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		n, err = nzb.FromFile(path)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Name == "" {
+			req.Name = filepath.Base(req.Path)
+		}
+	}
+
+	job, err := d.Add(n, strings.TrimSuffix(req.Name, ".nzb"), req.Category, req.Priority)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newJobView(job))
+}
+
+func (d *Daemon) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, action := path.Split(strings.TrimPrefix(r.URL.Path, "/api/jobs/"))
+	id = strings.TrimSuffix(id, "/")
+	if id == "" {
+		// There is no action, only the job ID.
+		id, action = action, ""
+	}
+
+	var err error
+	switch action {
+	case "":
+		if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if err = d.Delete(id); err == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+	case "pause":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		err = d.Pause(id)
+	case "resume":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		err = d.Resume(id)
+	case "priority":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		var req struct {
+			Priority queue.Priority `json:"priority"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("could not parse request: %w", err))
+			return
+		}
+		err = d.queue.SetPriority(id, req.Priority)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action '%s'", action))
+		return
+	}
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+
+	job, err := d.queue.Get(id)
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newJobView(job))
+}
+
+func (d *Daemon) handlePauseAll(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if err := d.PauseAll(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) handleResumeAll(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if err := d.ResumeAll(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) handleSpeed(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	var req struct {
+		Limit int64 `json:"limit"`
+	}
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("could not parse request: %w", err))
+			return
+		}
+		if req.Limit < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must not be negative"))
+			return
+		}
+		d.SetSpeedLimit(req.Limit)
+	}
+	req.Limit = d.SpeedLimit()
+	writeJSON(w, http.StatusOK, req)
+}
+
+// NZBPath resolves the path of an NZB file to add a job from, which must be within the daemon's
+// NZB directory. Relative paths are taken to be relative to it. The error wraps fs.ErrNotExist
+// if the path is within the directory but doesn't exist.
+//
+// The path is checked before anything is looked up, so that paths outside the directory are
+// refused without revealing whether they exist, and checked again once symlinks are resolved.
+func (d *Daemon) NZBPath(p string) (string, error) {
+	if d.nzbDir == "" {
+		return "", errors.New("adding jobs by path is disabled, as no NZB directory is configured")
+	}
+	dir, err := filepath.Abs(d.nzbDir)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve NZB directory: %w", err)
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	p = filepath.Clean(p)
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve NZB directory: %w", err)
+	}
+	outside := fmt.Errorf("'%s' is not within the NZB directory", p)
+	if !within(dir, p) && !within(resolvedDir, p) {
+		return "", outside
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	if !within(resolvedDir, resolved) {
+		return "", outside
+	}
+	return resolved, nil
+}
+
+// within returns true if the path p is dir, or within it.
+func within(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// allowMethods writes a 405 response and returns false if r does not use one of the given methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func writeQueueError(w http.ResponseWriter, err error) {
+	if errors.Is(err, queue.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
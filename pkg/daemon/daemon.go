@@ -0,0 +1,425 @@
+// Package daemon implements a long-running downloader which works through a
+// persistent queue of NZBs, controlled over an HTTP JSON API.
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/esteth/usenet/pkg/downloader"
+	"github.com/esteth/usenet/pkg/hooks"
+	"github.com/esteth/usenet/pkg/logging"
+	"github.com/esteth/usenet/pkg/nntp"
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/postprocess"
+	"github.com/esteth/usenet/pkg/queue"
+)
+
+// flushInterval is how often download progress is persisted to disk.
+const flushInterval = 5 * time.Second
+
+// Config configures a Daemon.
+type Config struct {
+	// Servers are the NNTP servers to download from, in order of priority. Each article is
+	// fetched from the first server, and only requested from the next if the previous one
+	// could not provide it.
+	Servers []nntp.Server
+	// QueuePath is the file the queue is persisted to.
+	QueuePath string
+	// OutputDir is the directory downloads are written to. Each job is written
+	// to a subdirectory named after the job.
+	OutputDir string
+	// CacheSize is the number of bytes of downloaded data held in memory before being written.
+	// It defaults to downloader.DefaultCacheSize.
+	CacheSize int64
+	// PostProcess is run on each job once it has been downloaded. If nil, jobs are finished as
+	// soon as their segments have been written.
+	PostProcess *postprocess.Pipeline
+	// CategoryDirs maps categories to the directory post-processing moves their jobs into. Jobs
+	// in other categories are moved to a subdirectory of the complete directory.
+	CategoryDirs map[string]string
+	// Scripts are user scripts to run when jobs are added, start downloading or finish.
+	Scripts []hooks.Script
+	// APIKey must be given with every request to the JSON API. The API is disabled if it is empty.
+	APIKey string
+	// NZBDir is the directory the JSON API may add jobs from by path, such as a watch directory.
+	// If it is empty, jobs can only be added through the API by uploading them.
+	NZBDir string
+	// Logger receives diagnostics about jobs. It also receives a debug-level trace of NNTP
+	// commands to each server which doesn't have its own logger.
+	Logger logging.Logger
+}
+
+// A Daemon downloads the jobs in its queue, one at a time, using a pool of
+// connections to each server which are kept open between jobs.
+type Daemon struct {
+	queue        *queue.Queue
+	downloader   *downloader.Downloader
+	limiter      rateLimiter
+	outputDir    string
+	pipeline     *postprocess.Pipeline
+	categoryDirs map[string]string
+	scripts      []hooks.Script
+	apiKey       string
+	nzbDir       string
+	metrics      *daemonMetrics
+	log          logging.Logger
+
+	mu sync.Mutex
+	// cancels holds the function to stop each job currently being downloaded, keyed by job ID.
+	cancels map[string]context.CancelFunc
+}
+
+// New creates a new Daemon, loading its queue from disk.
+func New(cfg Config) (*Daemon, error) {
+	d := &Daemon{
+		outputDir:    cfg.OutputDir,
+		pipeline:     cfg.PostProcess,
+		categoryDirs: cfg.CategoryDirs,
+		scripts:      cfg.Scripts,
+		apiKey:       cfg.APIKey,
+		nzbDir:       cfg.NZBDir,
+		metrics:      newDaemonMetrics(),
+		log:          logging.OrDiscard(cfg.Logger),
+		cancels:      make(map[string]context.CancelFunc),
+	}
+	var err error
+	d.downloader, err = downloader.New(downloader.Config{
+		Servers:   cfg.Servers,
+		CacheSize: cfg.CacheSize,
+		Throttle:  d.limiter.Reader,
+		Logger:    cfg.Logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if d.queue, err = queue.Open(cfg.QueuePath); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Queue returns the daemon's queue.
+func (d *Daemon) Queue() *queue.Queue {
+	return d.queue
+}
+
+// Run downloads jobs from the queue until ctx is done.
+func (d *Daemon) Run(ctx context.Context) error {
+	defer d.downloader.Close()
+	defer d.queue.Flush()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		if job, ok := d.queue.Next(); ok {
+			d.runJob(ctx, job)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.queue.Changed():
+		case <-ticker.C:
+			d.queue.Flush()
+		}
+	}
+}
+
+// Add adds an NZB to the queue.
+func (d *Daemon) Add(n nzb.Nzb, name string, category string, priority queue.Priority) (queue.Job, error) {
+	job, err := d.queue.Add(n, name, category, priority)
+	if err != nil {
+		return job, err
+	}
+	go d.runScripts(context.Background(), d.scriptInfo(hooks.Added, job))
+	return job, nil
+}
+
+// Pause pauses a job, stopping it if it is being downloaded.
+func (d *Daemon) Pause(id string) error {
+	if err := d.queue.Pause(id); err != nil {
+		return err
+	}
+	d.cancel(id)
+	return nil
+}
+
+// PauseAll pauses the whole queue, stopping the current download unless it has Force priority.
+func (d *Daemon) PauseAll() error {
+	if err := d.queue.PauseAll(); err != nil {
+		return err
+	}
+	for _, job := range d.queue.Jobs() {
+		if job.Status == queue.Downloading && job.Priority < queue.Force {
+			d.cancel(job.ID)
+		}
+	}
+	return nil
+}
+
+// ResumeAll resumes the queue after PauseAll.
+func (d *Daemon) ResumeAll() error {
+	return d.queue.ResumeAll()
+}
+
+// Resume resumes a paused job.
+func (d *Daemon) Resume(id string) error {
+	return d.queue.Resume(id)
+}
+
+// Delete removes a job from the queue or history, stopping it if it is being downloaded.
+func (d *Daemon) Delete(id string) error {
+	if err := d.queue.Delete(id); err != nil {
+		return err
+	}
+	d.cancel(id)
+	return nil
+}
+
+// SetSpeedLimit limits the total download speed to the given number of bytes per second.
+// A limit of 0 removes the limit.
+func (d *Daemon) SetSpeedLimit(bytesPerSecond int64) {
+	d.limiter.SetLimit(bytesPerSecond)
+}
+
+// SpeedLimit returns the download speed limit in bytes per second, or 0 if there is no limit.
+func (d *Daemon) SpeedLimit() int64 {
+	return d.limiter.Limit()
+}
+
+// Speed returns the current download speed in bytes per second.
+func (d *Daemon) Speed() int64 {
+	return d.limiter.meter.rate()
+}
+
+// Dir returns the directory the given job is downloaded to, or the directory it was moved to by
+// post-processing.
+func (d *Daemon) Dir(job queue.Job) string {
+	if job.Storage != "" {
+		return job.Storage
+	}
+	return filepath.Join(d.outputDir, nzb.SafeName(job.Name))
+}
+
+// OutputDir returns the directory downloads are written to.
+func (d *Daemon) OutputDir() string {
+	return d.outputDir
+}
+
+func (d *Daemon) cancel(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cancel, ok := d.cancels[id]; ok {
+		cancel()
+	}
+}
+
+// runJob downloads every outstanding segment of job, post-processes it, then moves it to the history.
+//
+// If the job is paused or deleted part way through, it is left in the queue.
+func (d *Daemon) runJob(ctx context.Context, job queue.Job) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	d.mu.Lock()
+	d.cancels[job.ID] = cancel
+	d.mu.Unlock()
+	// The job may have been paused or deleted before it could be cancelled.
+	if status, err := d.queue.Status(job.ID); err != nil || status != queue.Downloading {
+		cancel()
+	}
+	defer func() {
+		d.mu.Lock()
+		delete(d.cancels, job.ID)
+		d.mu.Unlock()
+		cancel()
+	}()
+
+	dir := d.Dir(job)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		d.log.Error("Could not create output directory", "job", job.ID, "dir", dir, "error", err)
+		d.queue.Finish(job.ID, fmt.Errorf("could not create output directory: %w", err))
+		return
+	}
+	d.log.Info("Downloading job", "job", job.ID, "name", job.Name, "segments", job.Segments(), "done", len(job.Done))
+	go d.runScripts(ctx, d.scriptInfo(hooks.Started, job))
+
+	result, downloadErr := d.downloader.Download(jobCtx, downloader.Job{
+		Nzb:  job.Nzb,
+		Dir:  dir,
+		Done: job.Done,
+		OnEvent: func(event downloader.Event) {
+			switch event.Type {
+			case downloader.ArticleRead:
+				d.metrics.bytes.Add(float64(event.Bytes), event.Server)
+				d.metrics.articles.Inc(event.Server)
+			case downloader.ArticleFailed:
+				d.metrics.bytes.Add(float64(event.Bytes), event.Server)
+				d.metrics.articleError(event.Server, event.Err)
+			case downloader.SegmentDone:
+				d.queue.SegmentDone(job.ID, event.Segment.ID, int64(event.Segment.Bytes))
+			case downloader.SegmentFailed:
+				d.log.Warn("Could not download segment", "job", job.ID, "segment", event.Segment.ID, "error", event.Err)
+			case downloader.FileDone:
+				if event.Err != nil {
+					d.log.Warn("Could not finish file", "job", job.ID, "file", job.Nzb.Files[event.File].Subject, "error", event.Err)
+				}
+			}
+		},
+		// Downloading the rest of a job which can't be repaired only holds up the jobs behind it.
+		OnUnrepairable: func(damage downloader.Damage) bool {
+			d.log.Warn("Abandoning job which can't be repaired", "job", job.ID, "name", job.Name, "damage", damage.String())
+			return true
+		},
+	})
+	failed := result.Failed()
+
+	if jobCtx.Err() != nil {
+		// The job was paused, deleted, or the daemon is shutting down.
+		d.log.Info("Stopped job", "job", job.ID, "name", job.Name)
+		d.queue.Stop(job.ID)
+		d.queue.Flush()
+		return
+	}
+	var err error
+	if failed > 0 {
+		err = fmt.Errorf("%d of %d segments could not be downloaded", failed, job.Segments())
+	} else if corrupt := result.Corrupt(); corrupt > 0 {
+		err = fmt.Errorf("%d of %d files do not match their checksums", corrupt, len(result.Files))
+	}
+	unrepairable := errors.Is(downloadErr, downloader.ErrUnrepairable)
+	if unrepairable {
+		err = fmt.Errorf("abandoned after %d of %d segments could not be downloaded: %w", failed, job.Segments(), downloadErr)
+	}
+	info := d.scriptInfo(hooks.Finished, job)
+	info.FailedSegments = failed
+	info.Par2Status = string(postprocess.Skipped)
+	info.UnpackStatus = string(postprocess.Skipped)
+	if d.pipeline != nil && !unrepairable {
+		err = d.postProcess(jobCtx, job, dir, err, &info)
+		if jobCtx.Err() != nil {
+			d.queue.Stop(job.ID)
+			d.queue.Flush()
+			return
+		}
+	}
+	info.Status = string(queue.Completed)
+	if err != nil {
+		info.Status = string(queue.Failed)
+		info.Error = err.Error()
+	}
+	d.runScripts(ctx, info)
+	d.metrics.jobsFinished.Inc(info.Status)
+	if err != nil {
+		d.log.Warn("Job failed", "job", job.ID, "name", job.Name, "error", err)
+	} else {
+		d.log.Info("Job completed", "job", job.ID, "name", job.Name, "dir", info.Dir)
+	}
+	d.queue.Finish(job.ID, err)
+}
+
+// postProcess runs the post-processing pipeline on a downloaded job, recording the result of each
+// stage in the queue.
+//
+// downloadErr is the error from downloading the job. It is forgiven if PAR2 verification shows
+// that every file is intact, as the missing segments will have been repaired. The outcome of
+// verifying and unpacking the job, and where it ended up, are filled in to info.
+func (d *Daemon) postProcess(ctx context.Context, job queue.Job, dir string, downloadErr error, info *hooks.Info) error {
+	d.queue.Processing(job.ID)
+	pj := &postprocess.Job{
+		Name:        job.Name,
+		Category:    job.Category,
+		Destination: d.categoryDirs[job.Category],
+		Dir:         dir,
+		Password:    job.Nzb.Password(),
+		Logger:      d.log,
+	}
+	err := d.pipeline.Run(ctx, pj, func(r postprocess.Result) {
+		result := queue.StageResult{
+			Stage:    r.Stage,
+			Status:   string(r.Status),
+			Log:      r.Log,
+			Started:  r.Started,
+			Duration: r.Duration,
+		}
+		if r.Err != nil {
+			result.Error = r.Err.Error()
+		}
+		d.queue.StageDone(job.ID, result)
+		if !r.Started.IsZero() {
+			d.metrics.stageDuration.Observe(r.Duration.Seconds(), r.Stage)
+		}
+		if r.Err != nil {
+			d.log.Warn("Post-processing stage failed", "job", job.ID, "stage", r.Stage, "error", r.Err)
+		} else {
+			d.log.Debug("Post-processing stage finished", "job", job.ID, "stage", r.Stage,
+				"status", r.Status, "duration", r.Duration)
+		}
+
+		switch r.Stage {
+		case "verify":
+			info.Par2Status = string(r.Status)
+		case "repair":
+			// Repair only runs if verification found damage, and then decides the outcome.
+			if r.Status != postprocess.Skipped {
+				info.Par2Status = string(r.Status)
+			}
+		case "unpack":
+			info.UnpackStatus = string(r.Status)
+		}
+	})
+	if pj.Storage != "" {
+		d.queue.SetStorage(job.ID, pj.Storage)
+		info.Dir = pj.Storage
+	}
+	if err != nil {
+		return err
+	}
+	if pj.Verified {
+		return nil
+	}
+	return downloadErr
+}
+
+// scriptInfo describes a job to the scripts run for event.
+func (d *Daemon) scriptInfo(event hooks.Event, job queue.Job) hooks.Info {
+	return hooks.Info{
+		Event:    event,
+		ID:       job.ID,
+		Name:     job.Name,
+		Category: job.Category,
+		Dir:      d.Dir(job),
+		Status:   string(job.Status),
+	}
+}
+
+// runScripts runs each user script which handles the event described by info, one at a time,
+// recording the results in the job's history.
+func (d *Daemon) runScripts(ctx context.Context, info hooks.Info) {
+	for _, s := range d.scripts {
+		if !s.Handles(info.Event) {
+			continue
+		}
+		r := s.Run(ctx, info)
+		result := queue.ScriptResult{
+			Script:   r.Script,
+			Event:    string(r.Event),
+			ExitCode: r.ExitCode,
+			Output:   r.Output,
+			Started:  r.Started,
+			Duration: r.Duration,
+		}
+		if r.Err != nil {
+			result.Error = r.Err.Error()
+			d.log.Warn("Script failed", "job", info.ID, "script", r.Script, "event", r.Event,
+				"exitCode", r.ExitCode, "error", r.Err)
+		} else {
+			d.log.Debug("Script finished", "job", info.ID, "script", r.Script, "event", r.Event)
+		}
+		d.queue.ScriptDone(info.ID, result)
+	}
+}
@@ -0,0 +1,516 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esteth/usenet/pkg/hooks"
+	"github.com/esteth/usenet/pkg/nntp"
+	"github.com/esteth/usenet/pkg/nntp/nntptest"
+	"github.com/esteth/usenet/pkg/postprocess"
+)
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+const testAPIKey = "0123456789abcdef"
+
+// withKey wraps the API handler h, giving every request the test API key, so that tests which
+// aren't about authentication needn't give it themselves.
+func withKey(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("X-Api-Key", testAPIKey)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func newTestDaemon(t *testing.T, server *nntptest.Server) (*Daemon, string) {
+	dir := t.TempDir()
+	d, err := New(Config{
+		Servers:   []nntp.Server{{Address: server.Addr, Connections: 2}},
+		QueuePath: filepath.Join(dir, "queue.json"),
+		APIKey:    testAPIKey,
+		OutputDir: filepath.Join(dir, "complete"),
+	})
+	if err != nil {
+		t.Fatalf("Could not create daemon: %v", err)
+	}
+	return d, filepath.Join(dir, "complete")
+}
+
+func upload(t *testing.T, url string, filename string, content []byte) jobView {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("nzb", filename)
+	if err != nil {
+		t.Fatalf("Could not create form: %v", err)
+	}
+	part.Write(content)
+	form.WriteField("category", "tv")
+	form.Close()
+
+	resp, err := http.Post(url+"/api/jobs", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("Could not upload NZB: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload returned status %d", resp.StatusCode)
+	}
+	var job jobView
+	if err = json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatalf("Could not decode response: %v", err)
+	}
+	return job
+}
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Could not GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s returned status %d", url, resp.StatusCode)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("Could not decode response from %s: %v", url, err)
+	}
+}
+
+func waitForHistory(t *testing.T, url string, count int) []jobView {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var history struct {
+			Jobs []jobView `json:"jobs"`
+		}
+		getJSON(t, url+"/api/history", &history)
+		if len(history.Jobs) >= count {
+			return history.Jobs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d jobs to finish", count)
+	return nil
+}
+
+func TestDownloadUploadedNzb(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	data := testData(10000)
+	nzbContent := server.Post("file.bin", data, 3000)
+
+	d, outputDir := newTestDaemon(t, server)
+	api := httptest.NewServer(withKey(d.Handler()))
+	defer api.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	job := upload(t, api.URL, "release.nzb", nzbContent)
+	if job.Name != "release" || job.Category != "tv" || job.Segments != 4 {
+		t.Errorf("Unexpected job added: %+v", job)
+	}
+
+	history := waitForHistory(t, api.URL, 1)
+	if history[0].Status != "Completed" {
+		t.Fatalf("Job did not complete: %+v", history[0])
+	}
+	written, err := os.ReadFile(filepath.Join(outputDir, "release", "file.bin"))
+	if err != nil {
+		t.Fatalf("Could not read downloaded file: %v", err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("Downloaded file does not match posted file")
+	}
+}
+
+func TestPostProcessing(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	data := testData(10000)
+	nzbContent := server.Post("file.bin", data, 3000)
+
+	dir := t.TempDir()
+	complete := filepath.Join(dir, "complete")
+	d, err := New(Config{
+		Servers:     []nntp.Server{{Address: server.Addr, Connections: 2}},
+		QueuePath:   filepath.Join(dir, "queue.json"),
+		APIKey:      testAPIKey,
+		OutputDir:   filepath.Join(dir, "incomplete"),
+		PostProcess: postprocess.Default(complete),
+	})
+	if err != nil {
+		t.Fatalf("Could not create daemon: %v", err)
+	}
+	api := httptest.NewServer(withKey(d.Handler()))
+	defer api.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	upload(t, api.URL, "release.nzb", nzbContent)
+	history := waitForHistory(t, api.URL, 1)
+	if history[0].Status != "Completed" {
+		t.Fatalf("Job did not complete: %+v", history[0])
+	}
+	storage := filepath.Join(complete, "tv", "release")
+	if history[0].Storage != storage {
+		t.Errorf("Job was stored in %s, expected %s", history[0].Storage, storage)
+	}
+	if len(history[0].PostProcessing) != len(postprocess.DefaultStages) {
+		t.Errorf("Expected a result for every stage, got %+v", history[0].PostProcessing)
+	}
+	written, err := os.ReadFile(filepath.Join(storage, "file.bin"))
+	if err != nil {
+		t.Fatalf("Could not read moved file: %v", err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("Moved file does not match posted file")
+	}
+}
+
+func TestScriptRunsWhenJobFinishes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Scripts are shell scripts")
+	}
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	nzbContent := server.Post("file.bin", testData(10000), 3000)
+	server.RemoveArticle("file.bin.2@nntptest")
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "notify.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\necho \"$USENET_JOB_STATUS $USENET_JOB_FAILED_SEGMENTS $7\"\nexit 1\n"), 0755)
+	d, err := New(Config{
+		Servers:   []nntp.Server{{Address: server.Addr, Connections: 2}},
+		QueuePath: filepath.Join(dir, "queue.json"),
+		APIKey:    testAPIKey,
+		OutputDir: filepath.Join(dir, "complete"),
+		Scripts:   []hooks.Script{{Path: script}},
+	})
+	if err != nil {
+		t.Fatalf("Could not create daemon: %v", err)
+	}
+	api := httptest.NewServer(withKey(d.Handler()))
+	defer api.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	upload(t, api.URL, "release.nzb", nzbContent)
+	history := waitForHistory(t, api.URL, 1)
+	if len(history[0].Scripts) != 1 {
+		t.Fatalf("Expected the script to run once, got %+v", history[0].Scripts)
+	}
+	result := history[0].Scripts[0]
+	if result.Event != "finished" || result.ExitCode != 1 || result.Error == "" {
+		t.Errorf("Script result was not recorded: %+v", result)
+	}
+	if len(result.Output) != 1 || result.Output[0] != "Failed 1 -1" {
+		t.Errorf("Script was not passed the job's details: %q", result.Output)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	nzbContent := server.Post("file.bin", testData(10000), 3000)
+	server.RemoveArticle("file.bin.2@nntptest")
+
+	d, _ := newTestDaemon(t, server)
+	api := httptest.NewServer(withKey(d.Handler()))
+	defer api.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	upload(t, api.URL, "release.nzb", nzbContent)
+	waitForHistory(t, api.URL, 1)
+
+	w := httptest.NewRecorder()
+	d.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, expected := range []string{
+		`usenet_nntp_articles_total{server="` + server.Addr + `"} 3`,
+		`usenet_nntp_article_errors_total{server="` + server.Addr + `",code="430"} 1`,
+		`usenet_jobs_finished_total{status="Failed"} 1`,
+		`usenet_queue_jobs{status="Queued"} 0`,
+		`usenet_nntp_bytes_total{server="` + server.Addr + `"}`,
+	} {
+		if !strings.Contains(w.Body.String(), expected+"\n") && !strings.Contains(w.Body.String(), expected+" ") {
+			t.Errorf("Metrics did not contain %s:\n%s", expected, w.Body.String())
+		}
+	}
+}
+
+func TestMissingArticlesFailJob(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	nzbContent := server.Post("file.bin", testData(10000), 3000)
+	server.RemoveArticle("file.bin.2@nntptest")
+
+	d, _ := newTestDaemon(t, server)
+	api := httptest.NewServer(withKey(d.Handler()))
+	defer api.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	upload(t, api.URL, "release.nzb", nzbContent)
+	history := waitForHistory(t, api.URL, 1)
+	if history[0].Status != "Failed" || history[0].Error == "" {
+		t.Errorf("Job with missing articles did not fail: %+v", history[0])
+	}
+}
+
+func TestCorruptFileFailsJob(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	nzbContent := server.Post("file.bin", testData(10000), 3000)
+	// The article is intact, but belongs to a different post of the file.
+	server.AddArticle("file.bin.2@nntptest", nntptest.EncodePart("file.bin", 2, 4, 10000, 3000, make([]byte, 3000)))
+
+	d, _ := newTestDaemon(t, server)
+	api := httptest.NewServer(withKey(d.Handler()))
+	defer api.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	upload(t, api.URL, "release.nzb", nzbContent)
+	history := waitForHistory(t, api.URL, 1)
+	if history[0].Status != "Failed" || !strings.Contains(history[0].Error, "checksums") {
+		t.Errorf("Job with a corrupt file did not fail: %+v", history[0])
+	}
+}
+
+func TestPausedQueue(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	nzbContent := server.Post("file.bin", testData(1000), 300)
+
+	d, _ := newTestDaemon(t, server)
+	api := httptest.NewServer(withKey(d.Handler()))
+	defer api.Close()
+
+	resp, err := http.Post(api.URL+"/api/pause", "", nil)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Could not pause queue: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	job := upload(t, api.URL, "release.nzb", nzbContent)
+	time.Sleep(100 * time.Millisecond)
+	var queueResponse struct {
+		Paused bool      `json:"paused"`
+		Jobs   []jobView `json:"jobs"`
+	}
+	getJSON(t, api.URL+"/api/queue", &queueResponse)
+	if !queueResponse.Paused || len(queueResponse.Jobs) != 1 || queueResponse.Jobs[0].Status != "Queued" {
+		t.Fatalf("Paused queue started downloading: %+v", queueResponse)
+	}
+
+	resp, err = http.Post(api.URL+"/api/resume", "", nil)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Could not resume queue: %v", err)
+	}
+	history := waitForHistory(t, api.URL, 1)
+	if history[0].ID != job.ID || history[0].Status != "Completed" {
+		t.Errorf("Job did not complete after resuming: %+v", history[0])
+	}
+}
+
+func TestSpeedLimit(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	d, _ := newTestDaemon(t, server)
+	api := httptest.NewServer(withKey(d.Handler()))
+	defer api.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, api.URL+"/api/speed", strings.NewReader(`{"limit": 1048576}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Could not set speed limit: %v", err)
+	}
+	var speed struct {
+		Limit int64 `json:"limit"`
+	}
+	getJSON(t, api.URL+"/api/speed", &speed)
+	if speed.Limit != 1048576 {
+		t.Errorf("Expected speed limit 1048576, was %d", speed.Limit)
+	}
+}
+
+func TestUnknownJob(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	d, _ := newTestDaemon(t, server)
+	api := httptest.NewServer(withKey(d.Handler()))
+	defer api.Close()
+
+	resp, err := http.Post(api.URL+"/api/jobs/42/pause", "", nil)
+	if err != nil {
+		t.Fatalf("Could not send request: %v", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown job, got %d", resp.StatusCode)
+	}
+}
+
+func TestAPIKeyRequired(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	d, _ := newTestDaemon(t, server)
+	api := httptest.NewServer(d.Handler())
+	defer api.Close()
+
+	for key, expected := range map[string]int{
+		"":                      http.StatusUnauthorized,
+		"wrong":                 http.StatusUnauthorized,
+		testAPIKey:              http.StatusOK,
+		"?apikey=wrong":         http.StatusUnauthorized,
+		"?apikey=" + testAPIKey: http.StatusOK,
+	} {
+		url := api.URL + "/api/queue"
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if strings.HasPrefix(key, "?") {
+			req, _ = http.NewRequest(http.MethodGet, url+key, nil)
+		} else if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Could not send request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected %d with key '%s', got %d", expected, key, resp.StatusCode)
+		}
+	}
+
+	// A daemon without an API key refuses every request.
+	noKey, err := New(Config{
+		Servers:   []nntp.Server{{Address: server.Addr, Connections: 1}},
+		QueuePath: filepath.Join(t.TempDir(), "queue.json"),
+	})
+	if err != nil {
+		t.Fatalf("Could not create daemon: %v", err)
+	}
+	w := httptest.NewRecorder()
+	noKey.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/queue?apikey=", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 from a daemon without an API key, got %d", w.Code)
+	}
+}
+
+func TestAddByPathConfinedToNZBDir(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	nzbContent := server.Post("file.bin", testData(1000), 300)
+
+	dir := t.TempDir()
+	nzbDir := filepath.Join(dir, "watch")
+	os.Mkdir(nzbDir, 0755)
+	os.WriteFile(filepath.Join(nzbDir, "inside.nzb"), nzbContent, 0644)
+	os.WriteFile(filepath.Join(dir, "outside.nzb"), nzbContent, 0644)
+	os.Symlink(filepath.Join(dir, "outside.nzb"), filepath.Join(nzbDir, "link.nzb"))
+	d, err := New(Config{
+		Servers:   []nntp.Server{{Address: server.Addr, Connections: 1}},
+		QueuePath: filepath.Join(dir, "queue.json"),
+		APIKey:    testAPIKey,
+		NZBDir:    nzbDir,
+	})
+	if err != nil {
+		t.Fatalf("Could not create daemon: %v", err)
+	}
+	api := httptest.NewServer(withKey(d.Handler()))
+	defer api.Close()
+
+	for path, expected := range map[string]int{
+		filepath.Join(nzbDir, "inside.nzb"):  http.StatusCreated,
+		"inside.nzb":                         http.StatusCreated,
+		filepath.Join(dir, "outside.nzb"):    http.StatusForbidden,
+		"../outside.nzb":                     http.StatusForbidden,
+		"link.nzb":                           http.StatusForbidden,
+		filepath.Join(nzbDir, "missing.nzb"): http.StatusBadRequest,
+		// Whether files outside the directory exist isn't revealed.
+		filepath.Join(dir, "missing.nzb"): http.StatusForbidden,
+		"../missing.nzb":                  http.StatusForbidden,
+	} {
+		body, _ := json.Marshal(map[string]string{"path": path})
+		resp, err := http.Post(api.URL+"/api/jobs", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Could not send request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected %d adding '%s', got %d", expected, path, resp.StatusCode)
+		}
+	}
+}
+
+func TestBackupServerProvidesMissingArticles(t *testing.T) {
+	primary := nntptest.NewServer(nil)
+	defer primary.Close()
+	backup := nntptest.NewServer(nil)
+	defer backup.Close()
+	data := testData(10000)
+	nzbContent := primary.Post("file.bin", data, 3000)
+	backup.Post("file.bin", data, 3000)
+	primary.RemoveArticle("file.bin.2@nntptest")
+
+	dir := t.TempDir()
+	d, err := New(Config{
+		Servers: []nntp.Server{
+			{Address: primary.Addr, Connections: 2},
+			{Address: backup.Addr, Connections: 1},
+		},
+		QueuePath: filepath.Join(dir, "queue.json"),
+		APIKey:    testAPIKey,
+		OutputDir: dir,
+	})
+	if err != nil {
+		t.Fatalf("Could not create daemon: %v", err)
+	}
+	api := httptest.NewServer(withKey(d.Handler()))
+	defer api.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	upload(t, api.URL, "release.nzb", nzbContent)
+	history := waitForHistory(t, api.URL, 1)
+	if history[0].Status != "Completed" {
+		t.Fatalf("Job did not complete: %+v", history[0])
+	}
+	written, err := os.ReadFile(filepath.Join(dir, "release", "file.bin"))
+	if err != nil {
+		t.Fatalf("Could not read downloaded file: %v", err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("Downloaded file does not match posted file")
+	}
+	if backup.Requests("file.bin.2@nntptest") != 1 {
+		t.Errorf("Missing article was requested from the backup server %d times", backup.Requests("file.bin.2@nntptest"))
+	}
+	if backup.Requests("file.bin.1@nntptest") != 0 {
+		t.Errorf("Backup server was asked for an article the primary server has")
+	}
+}
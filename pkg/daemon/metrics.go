@@ -0,0 +1,116 @@
+package daemon
+
+import (
+	"errors"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"sync"
+
+	"github.com/esteth/usenet/pkg/metrics"
+	"github.com/esteth/usenet/pkg/queue"
+	"github.com/esteth/usenet/pkg/yenc"
+)
+
+// daemonMetrics are the metrics exposed about the daemon's downloads, for Prometheus to scrape.
+type daemonMetrics struct {
+	registry      *metrics.Registry
+	bytes         *metrics.Counter
+	articles      *metrics.Counter
+	articleErrors *metrics.Counter
+	crcFailures   *metrics.Counter
+	reconnects    *metrics.Counter
+	connections   *metrics.Gauge
+	idle          *metrics.Gauge
+	queueJobs     *metrics.Gauge
+	queueBytes    *metrics.Gauge
+	jobsFinished  *metrics.Counter
+	stageDuration *metrics.Histogram
+
+	mu sync.Mutex
+	// lastReconnects is each server's reconnect count when it was last scraped.
+	lastReconnects map[string]int64
+}
+
+func newDaemonMetrics() *daemonMetrics {
+	r := metrics.NewRegistry()
+	return &daemonMetrics{
+		registry:       r,
+		lastReconnects: make(map[string]int64),
+		bytes: r.NewCounter("usenet_nntp_bytes_total",
+			"Bytes of article bodies downloaded from the server.", "server"),
+		articles: r.NewCounter("usenet_nntp_articles_total",
+			"Articles successfully downloaded from the server.", "server"),
+		articleErrors: r.NewCounter("usenet_nntp_article_errors_total",
+			"Articles which could not be downloaded, by NNTP response code, or \"connection\" for network errors.",
+			"server", "code"),
+		crcFailures: r.NewCounter("usenet_yenc_crc_failures_total",
+			"Articles whose decoded data did not match their yEnc CRC32 checksum.", "server"),
+		reconnects: r.NewCounter("usenet_nntp_reconnects_total",
+			"Connections dialed to replace ones which were broken.", "server"),
+		connections: r.NewGauge("usenet_nntp_connections",
+			"Connections open to the server, whether idle or in use.", "server"),
+		idle: r.NewGauge("usenet_nntp_connections_idle",
+			"Connections open to the server which are not in use.", "server"),
+		queueJobs: r.NewGauge("usenet_queue_jobs",
+			"Jobs in the queue, by status.", "status"),
+		queueBytes: r.NewGauge("usenet_queue_remaining_bytes",
+			"Bytes left to download for the jobs in the queue."),
+		jobsFinished: r.NewCounter("usenet_jobs_finished_total",
+			"Jobs moved to the history, by status.", "status"),
+		stageDuration: r.NewHistogram("usenet_postprocess_stage_duration_seconds",
+			"How long post-processing stages, such as PAR2 verify and repair, took to run.",
+			metrics.DurationBuckets, "stage"),
+	}
+}
+
+// articleError records that an article could not be downloaded from server.
+func (m *daemonMetrics) articleError(server string, err error) {
+	var protoErr *textproto.Error
+	switch {
+	case errors.Is(err, yenc.ErrChecksum):
+		m.crcFailures.Inc(server)
+	case errors.As(err, &protoErr):
+		m.articleErrors.Inc(server, strconv.Itoa(protoErr.Code))
+	default:
+		m.articleErrors.Inc(server, "connection")
+	}
+}
+
+// MetricsHandler returns an http.Handler serving the daemon's metrics in the Prometheus text format.
+func (d *Daemon) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.updateMetrics()
+		d.metrics.registry.ServeHTTP(w, r)
+	})
+}
+
+// updateMetrics updates the metrics which are read from the pools and queue, rather than counted
+// as things happen.
+func (d *Daemon) updateMetrics() {
+	m := d.metrics
+	for _, pool := range d.downloader.Pools() {
+		server := pool.Server().Address
+		stats := pool.Stats()
+		m.connections.Set(float64(stats.Open), server)
+		m.idle.Set(float64(stats.Idle), server)
+
+		m.mu.Lock()
+		m.reconnects.Add(float64(stats.Reconnects-m.lastReconnects[server]), server)
+		m.lastReconnects[server] = stats.Reconnects
+		m.mu.Unlock()
+	}
+
+	counts := map[queue.Status]int{queue.Queued: 0, queue.Paused: 0, queue.Downloading: 0, queue.Processing: 0}
+	var remaining int64
+	for _, job := range d.queue.Jobs() {
+		counts[job.Status]++
+		if left := job.TotalBytes - job.DownloadedBytes; left > 0 {
+			remaining += left
+		}
+	}
+	for status, count := range counts {
+		m.queueJobs.Set(float64(count), string(status))
+	}
+	m.queueBytes.Set(float64(remaining))
+}
@@ -0,0 +1,122 @@
+package daemon
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A rateLimiter limits the rate at which bytes are read across any number of readers.
+type rateLimiter struct {
+	mu sync.Mutex
+	// limit is the maximum number of bytes per second, or 0 for no limit.
+	limit  int64
+	tokens float64
+	last   time.Time
+	// meter measures the bytes read through the limiter, regardless of whether there is a limit.
+	meter speedMeter
+}
+
+// SetLimit changes the maximum number of bytes per second. A limit of 0 disables limiting.
+func (l *rateLimiter) SetLimit(limit int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit < 0 {
+		limit = 0
+	}
+	l.limit = limit
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// Limit returns the maximum number of bytes per second, or 0 if there is no limit.
+func (l *rateLimiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// wait blocks until n bytes may be consumed without exceeding the limit.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	if l.limit == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.limit)
+	// Allow bursts of at most one second's worth of data.
+	if l.tokens > float64(l.limit) {
+		l.tokens = float64(l.limit)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	limit := l.limit
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / float64(limit) * float64(time.Second)))
+	}
+}
+
+// Reader returns a reader which reads from r no faster than the limit allows.
+func (l *rateLimiter) Reader(r io.Reader) io.Reader {
+	return &limitedReader{r: r, l: l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		lr.l.wait(n)
+		lr.l.meter.add(n)
+	}
+	return n, err
+}
+
+// meterWindow is the number of seconds the download speed is averaged over.
+const meterWindow = 5
+
+// A speedMeter measures the rate bytes are downloaded at over the last few seconds.
+type speedMeter struct {
+	mu      sync.Mutex
+	buckets [meterWindow]int64
+	// second is the Unix time of the most recent bucket.
+	second int64
+}
+
+func (m *speedMeter) add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advanceLocked(time.Now().Unix())
+	m.buckets[m.second%meterWindow] += int64(n)
+}
+
+// rate returns the average number of bytes per second over the window.
+func (m *speedMeter) rate() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advanceLocked(time.Now().Unix())
+	var total int64
+	for _, b := range m.buckets {
+		total += b
+	}
+	return total / meterWindow
+}
+
+// advanceLocked clears the buckets for any seconds which have passed since the last update.
+func (m *speedMeter) advanceLocked(now int64) {
+	if now-m.second >= meterWindow {
+		m.buckets = [meterWindow]int64{}
+	} else {
+		for s := m.second + 1; s <= now; s++ {
+			m.buckets[s%meterWindow] = 0
+		}
+	}
+	m.second = now
+}
@@ -0,0 +1,238 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"github.com/esteth/usenet/pkg/nntp"
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/storage"
+)
+
+// A CheckResult reports which of an NZB's articles each server has.
+type CheckResult struct {
+	// Servers holds the address of each server, in order of priority.
+	Servers []string
+	// Files holds the availability of each file in the NZB, in the same order.
+	Files []FileCheck
+	// Damage estimates what PAR2 would have to repair, from the segments which no server has. It
+	// is nil if no PAR2 index file in the NZB could be downloaded and read, or if the subjects of
+	// the NZB's files don't name them well enough to tell which are PAR2 volumes.
+	Damage *Damage
+}
+
+// Missing returns the number of segments which no server has.
+func (r CheckResult) Missing() int {
+	missing := 0
+	for _, f := range r.Files {
+		missing += f.Missing()
+	}
+	return missing
+}
+
+// Complete returns true if every segment is available from at least one server.
+func (r CheckResult) Complete() bool {
+	return r.Missing() == 0
+}
+
+// Repairable returns true if the files could be downloaded intact, either because every segment
+// is available or because PAR2 is estimated to be able to repair what isn't.
+func (r CheckResult) Repairable() bool {
+	return r.Complete() || r.Damage != nil && r.Damage.Repairable()
+}
+
+// FileCheck reports which of a file's articles each server has.
+type FileCheck struct {
+	File nzb.File
+	// Segments holds the availability of each of the file's segments, in the same order.
+	Segments []SegmentCheck
+}
+
+// Missing returns the number of the file's segments which no server has.
+func (f FileCheck) Missing() int {
+	missing := 0
+	for _, s := range f.Segments {
+		if !s.Available() {
+			missing++
+		}
+	}
+	return missing
+}
+
+// AvailableOn returns the number of the file's segments which the server at the given index in
+// CheckResult.Servers has.
+func (f FileCheck) AvailableOn(server int) int {
+	available := 0
+	for _, s := range f.Segments {
+		if s.Servers[server].Reason == "" {
+			available++
+		}
+	}
+	return available
+}
+
+// SegmentCheck reports which servers have a segment's article.
+type SegmentCheck struct {
+	Segment nzb.Segment
+	// Servers holds the answer from each server, in the same order as CheckResult.Servers. The
+	// Reason is empty if the server has the article.
+	Servers []Attempt
+}
+
+// Available returns true if at least one server has the article. Articles which couldn't be
+// checked, such as because the server timed out, are not available.
+func (s SegmentCheck) Available() bool {
+	for _, a := range s.Servers {
+		if a.Reason == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Check asks every server whether it has each segment of n, without downloading them, so that
+// it can be decided whether n is worth downloading. The servers are checked at the same time,
+// each using as many connections as it allows.
+//
+// If any segments are missing, Check downloads the PAR2 index files in n to estimate whether
+// the damage could be repaired.
+func (d *Downloader) Check(ctx context.Context, n nzb.Nzb) (CheckResult, error) {
+	result := CheckResult{Files: make([]FileCheck, len(n.Files))}
+	for _, pool := range d.pools {
+		result.Servers = append(result.Servers, pool.Server().Address)
+	}
+	var tasks []task
+	for i, file := range n.Files {
+		result.Files[i] = FileCheck{File: file, Segments: make([]SegmentCheck, len(file.Segments))}
+		for j, segment := range file.Segments {
+			result.Files[i].Segments[j] = SegmentCheck{Segment: segment, Servers: make([]Attempt, len(d.pools))}
+			tasks = append(tasks, task{i, j})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for p, pool := range d.pools {
+		p, pool := p, pool
+		queue := make(chan task)
+		go func() {
+			defer close(queue)
+			for _, t := range tasks {
+				select {
+				case queue <- t:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		workers := pool.Server().Connections
+		if workers < 1 {
+			workers = 1
+		}
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for t := range queue {
+					// Each worker writes only to its own server's answers, so no locking is needed.
+					s := &result.Files[t.file].Segments[t.segment]
+					s.Servers[p] = d.stat(ctx, pool, s.Segment.ID)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	if result.Complete() {
+		return result, nil
+	}
+	damage, err := d.checkDamage(ctx, result)
+	result.Damage = damage
+	return result, err
+}
+
+// stat asks the server behind pool whether it has an article, retrying failures which may not
+// happen again.
+func (d *Downloader) stat(ctx context.Context, pool *nntp.Pool, messageID string) Attempt {
+	attempt := Attempt{Server: pool.Server().Address}
+	for tries := 1; ; tries++ {
+		err := d.statFrom(ctx, pool, messageID)
+		if err == nil {
+			return Attempt{Server: attempt.Server}
+		}
+		attempt.Reason, attempt.Err = Classify(err), err
+		if !attempt.Reason.transient() || tries >= d.retry.Attempts || !sleep(ctx, d.retry.backoff(tries)) {
+			return attempt
+		}
+	}
+}
+
+// statFrom sends a single STAT command for an article to the server behind pool.
+func (d *Downloader) statFrom(ctx context.Context, pool *nntp.Pool, messageID string) error {
+	conn, err := pool.Get(ctx)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(d.timeout))
+	err = conn.Stat(messageID)
+	conn.SetDeadline(time.Time{})
+	// The server rejecting the article leaves the connection usable, but other failures do not.
+	var protoErr *textproto.Error
+	if err == nil || errors.As(err, &protoErr) {
+		pool.Put(conn)
+	} else {
+		pool.Discard(conn)
+	}
+	return err
+}
+
+// checkDamage estimates the damage done by the segments which no server has. It downloads the
+// intact PAR2 index files to learn the recovery set, returning nil if none of them can be read,
+// or if the subjects of the other files don't say enough about them to count the damage.
+func (d *Downloader) checkDamage(ctx context.Context, result CheckResult) (*Damage, error) {
+	files := make([]nzb.File, len(result.Files))
+	names := make([]string, len(result.Files))
+	var indexes nzb.Nzb
+	for i, f := range result.Files {
+		files[i], names[i] = f.File, f.File.Name()
+		if isPar2Index(names[i]) && f.Missing() == 0 {
+			indexes.Files = append(indexes.Files, f.File)
+		}
+	}
+	if len(indexes.Files) == 0 {
+		return nil, nil
+	}
+	tracker := newDamageTracker(files)
+	for i, f := range result.Files {
+		for j, s := range f.Segments {
+			if !s.Available() {
+				tracker.fail(i, j)
+			}
+		}
+	}
+
+	// Index files are small, so they are kept in memory.
+	store := storage.NewMemory()
+	if _, err := d.Download(ctx, Job{Nzb: indexes, Storage: store}); err != nil {
+		return nil, err
+	}
+	entries, err := store.ReadDir(".")
+	if err != nil {
+		return nil, fmt.Errorf("Could not list PAR2 files: %w", err)
+	}
+	for _, entry := range entries {
+		if !tracker.load(store, entry.Name()) {
+			continue
+		}
+		if damage, known := tracker.damage(names); known {
+			return &damage, nil
+		}
+	}
+	return nil, nil
+}
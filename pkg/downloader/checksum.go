@@ -0,0 +1,72 @@
+package downloader
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/esteth/usenet/pkg/yenc"
+)
+
+// fileChecksum collects the checksums of a file's segments as they are written, so that the file
+// can be checked against the checksum of the whole file which its articles give, without reading
+// it back.
+type fileChecksum struct {
+	// segments holds the checksum of each of the file's segments which has been written, by index.
+	segments []segmentChecksum
+	// size is the size of the whole file.
+	size int64
+	// crc is the checksum of the whole file, if known is set because an article gave it.
+	crc   uint32
+	known bool
+}
+
+// segmentChecksum is the checksum of a segment's data, and where it was written in its file.
+type segmentChecksum struct {
+	offset, size int64
+	crc          uint32
+	// written is set once the segment has been written.
+	written bool
+}
+
+func newFileChecksum(segments int) *fileChecksum {
+	return &fileChecksum{segments: make([]segmentChecksum, segments)}
+}
+
+// add records that the segment at index has been written. size is the size of the whole file,
+// and crc its checksum if known is set.
+func (c *fileChecksum) add(index int, segment segmentChecksum, size int64, crc uint32, known bool) {
+	c.segments[index] = segment
+	c.size = size
+	if known {
+		c.crc, c.known = crc, true
+	}
+}
+
+// verify checks the checksums of the segments, combined in order, against that of the whole
+// file, returning an error wrapping yenc.ErrChecksum if they differ.
+//
+// The file can only be checked if every one of its segments was written this time, and together
+// they cover it exactly, so verify returns nil if they didn't or no article gave the checksum.
+func (c *fileChecksum) verify() error {
+	if !c.known {
+		return nil
+	}
+	segments := append([]segmentChecksum(nil), c.segments...)
+	sort.Slice(segments, func(i, j int) bool { return segments[i].offset < segments[j].offset })
+	var crc uint32
+	var end int64
+	for _, s := range segments {
+		if !s.written || s.offset != end {
+			return nil
+		}
+		crc = yenc.CombineCRC(crc, s.crc, s.size)
+		end += s.size
+	}
+	if end != c.size {
+		return nil
+	}
+	if crc != c.crc {
+		return fmt.Errorf("File does not match its checksum. Expected %08x, Actual %08x: %w", c.crc, crc, yenc.ErrChecksum)
+	}
+	return nil
+}
@@ -0,0 +1,636 @@
+// Package downloader fetches the files described by an NZB from NNTP servers, decoding each
+// article and writing it into place, so that downloads can be embedded in other programs.
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/esteth/usenet/pkg/logging"
+	"github.com/esteth/usenet/pkg/nntp"
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/par2"
+	"github.com/esteth/usenet/pkg/storage"
+	"github.com/esteth/usenet/pkg/yenc"
+)
+
+// DefaultTimeout is the Timeout of downloaders which don't set one.
+const DefaultTimeout = time.Minute
+
+// Config configures a Downloader.
+type Config struct {
+	// Servers are the NNTP servers to download from, in order of priority. Each article is
+	// fetched from the first server, and only requested from the next if the previous one
+	// could not provide it.
+	Servers []nntp.Server
+	// Workers is the number of segments to download at once. A segment only holds a connection
+	// while its article is read, so it defaults to twice the number of connections to the first
+	// server, which is where most articles come from, to keep the connections busy while articles
+	// are decoded.
+	Workers int
+	// Retry decides how segments are retried after failing. It defaults to DefaultRetry.
+	Retry RetryPolicy
+	// Timeout is how long a server may go without sending anything while an article is being
+	// downloaded before the attempt fails. It defaults to DefaultTimeout.
+	Timeout time.Duration
+	// CacheSize is the number of bytes of decoded segments which may be held in memory before
+	// being written, so that adjacent segments can be written together. Workers wait for room once
+	// it is full. It defaults to DefaultCacheSize.
+	CacheSize int64
+	// Throttle, if set, wraps the body of each article as it is read from a server, such as to
+	// limit the download speed.
+	Throttle func(io.Reader) io.Reader
+	// Logger receives a debug-level trace of NNTP commands to each server which doesn't have its
+	// own logger.
+	Logger logging.Logger
+}
+
+// A Downloader downloads NZBs using a pool of connections to each server, which are kept open
+// between downloads. It is safe to run several downloads at once, which then share the
+// connections.
+type Downloader struct {
+	pools     []*nntp.Pool
+	workers   int
+	retry     RetryPolicy
+	timeout   time.Duration
+	cacheSize int64
+	throttle  func(io.Reader) io.Reader
+}
+
+// New creates a Downloader. Connections are made as they are needed.
+func New(cfg Config) (*Downloader, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("no servers to download from")
+	}
+	pools := make([]*nntp.Pool, len(cfg.Servers))
+	for i, server := range cfg.Servers {
+		if server.Logger == nil {
+			server.Logger = cfg.Logger
+		}
+		pools[i] = nntp.NewPool(server)
+	}
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 2 * cfg.Servers[0].Connections
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	retry := cfg.Retry
+	if retry.Attempts < 1 {
+		retry = DefaultRetry
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	cacheSize := cfg.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = DefaultCacheSize
+	}
+	return &Downloader{
+		pools:     pools,
+		workers:   workers,
+		retry:     retry,
+		timeout:   timeout,
+		cacheSize: cacheSize,
+		throttle:  cfg.Throttle,
+	}, nil
+}
+
+// Pools returns the connection pool for each server, in order of priority.
+func (d *Downloader) Pools() []*nntp.Pool {
+	return d.pools
+}
+
+// Close closes the connections to every server. Downloads still running fail as they next need a
+// connection.
+func (d *Downloader) Close() error {
+	for _, pool := range d.pools {
+		pool.Close()
+	}
+	return nil
+}
+
+// A Job is a single download.
+type Job struct {
+	// Nzb describes the files to download.
+	Nzb nzb.Nzb
+	// Dir is the directory the files are written to, under the names given in their articles.
+	// It must already exist.
+	Dir string
+	// Storage, if set, is where the files are written instead of Dir.
+	Storage storage.Storage
+	// Done holds the message IDs of segments which have already been downloaded, which are
+	// skipped.
+	Done map[string]bool
+	// OnEvent, if set, is called as the download progresses. Events are delivered one at a time,
+	// so OnEvent should return quickly.
+	OnEvent func(Event)
+	// OnUnrepairable, if set, is called once if the segments which failed damage more of the
+	// files than the PAR2 volumes in the NZB can repair. No more segments are started while it
+	// runs, so it may wait for someone to decide what to do. If it returns true, the download is
+	// stopped and Download returns ErrUnrepairable; otherwise the download carries on.
+	//
+	// The damage can only be estimated once a PAR2 file describing the files has been
+	// downloaded, so PAR2 index files are downloaded first.
+	OnUnrepairable func(Damage) bool
+	// OnWrite, if set, is called with each run of data written to a file, such as to hash or
+	// unpack it without reading it back. name is the file's own name, rather than its partial
+	// one. OnWrite may be called from several goroutines at once, and must not keep data after
+	// it returns.
+	OnWrite func(name string, offset int64, data []byte)
+}
+
+// storage returns where the job's files are written.
+func (job Job) storage() storage.Storage {
+	if job.Storage != nil {
+		return job.Storage
+	}
+	return storage.Dir(job.Dir)
+}
+
+// Download downloads every segment of job, returning what happened to each of them. Segments
+// which can't be downloaded from any server, even after retrying, are recorded as failed and don't
+// stop the rest of the download.
+//
+// If ctx is done, Download stops starting new segments and returns ctx's error once those in
+// progress have stopped, along with the result so far.
+func (d *Downloader) Download(ctx context.Context, job Job) (Result, error) {
+	r := &run{
+		Downloader:   d,
+		job:          job,
+		remaining:    make([]int, len(job.Nzb.Files)),
+		buffered:     make([]int, len(job.Nzb.Files)),
+		names:        make([]string, len(job.Nzb.Files)),
+		checksums:    make([]*fileChecksum, len(job.Nzb.Files)),
+		damage:       newDamageTracker(job.Nzb.Files),
+		unrepairable: make(chan Damage, 1),
+		decodes:      make(chan decodeRequest),
+		outputs:      newOutputs(job.storage(), d.cacheSize, job.OnWrite),
+	}
+	r.result.Files = make([]FileResult, len(job.Nzb.Files))
+	for i, file := range job.Nzb.Files {
+		r.result.Files[i] = FileResult{File: file, Segments: make([]SegmentResult, len(file.Segments))}
+		for j, segment := range file.Segments {
+			r.result.Files[i].Segments[j].Segment = segment
+		}
+		r.remaining[i] = len(file.Segments)
+		r.names[i] = file.Name()
+		r.checksums[i] = newFileChecksum(len(file.Segments))
+	}
+
+	var queue []task
+	for _, i := range dispatchOrder(job.Nzb) {
+		for j, segment := range job.Nzb.Files[i].Segments {
+			if job.Done[segment.ID] {
+				r.finish(task{i, j}, Skipped, nil)
+			} else {
+				queue = append(queue, task{i, j})
+			}
+		}
+	}
+
+	// Segments are downloaded in stages: the workers read articles from the servers, the decoders
+	// decode them, and the cache writes them out.
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		go r.decoder()
+	}
+	defer close(r.decodes)
+
+	downloadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tasks := make(chan task)
+	var wg sync.WaitGroup
+	for w := 0; w < d.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tasks {
+				r.download(downloadCtx, t)
+			}
+		}()
+	}
+	workersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+
+	var err error
+	closed := false
+	stopped := downloadCtx.Done()
+	decide := func(damage Damage) {
+		if job.OnUnrepairable(damage) {
+			err = fmt.Errorf("%v: %w", damage, ErrUnrepairable)
+			cancel()
+			queue, stopped = nil, nil
+		}
+	}
+	for {
+		// Damage is handled before anything else, so that no more segments are started once it is
+		// known to be unrepairable.
+		select {
+		case damage := <-r.unrepairable:
+			decide(damage)
+		default:
+		}
+		var send chan<- task
+		var next task
+		if len(queue) > 0 {
+			send, next = tasks, queue[0]
+		} else if !closed {
+			close(tasks)
+			closed = true
+		}
+		select {
+		case send <- next:
+			queue = queue[1:]
+		case damage := <-r.unrepairable:
+			decide(damage)
+		case <-stopped:
+			queue, stopped = nil, nil
+		case <-workersDone:
+			// Segments which were downloaded before the download stopped are kept, but files are
+			// only left open if it was stopped, so they are left partial to be resumed.
+			r.outputs.flushAll()
+			// The damage may only have become known as the last files were written.
+			select {
+			case damage := <-r.unrepairable:
+				decide(damage)
+			default:
+			}
+			if err == nil {
+				err = ctx.Err()
+			}
+			if closeErr := r.outputs.close(); err == nil {
+				err = closeErr
+			}
+			return r.result, err
+		}
+	}
+}
+
+// task identifies a segment by the index of its file in the NZB, and its index in the file.
+type task struct {
+	file, segment int
+}
+
+// run is the state of a single call to Download.
+type run struct {
+	*Downloader
+	job Job
+
+	mu     sync.Mutex
+	result Result
+	// remaining counts the segments of each file which haven't finished.
+	remaining []int
+	// buffered counts the segments of each file which are waiting in the cache to be written.
+	buffered []int
+	// names holds the name of each file, from its articles once one has been downloaded, or
+	// else from its subject.
+	names []string
+	// checksums collects the checksums of each file's segments, to check the file once it is
+	// finished.
+	checksums []*fileChecksum
+	// damage tracks the damage done by failed segments.
+	damage *damageTracker
+	// unrepairable receives the damage once it is found to be too much to repair.
+	unrepairable chan Damage
+	// decodes receives the articles for the decoders to decode.
+	decodes chan decodeRequest
+	outputs *outputs
+}
+
+// download fetches a single segment, trying each server in turn until one of them provides it.
+// Transient failures are retried on the same server, with a backoff, before moving on.
+//
+// A segment which is downloaded only finishes once its data has been written out of the cache.
+func (r *run) download(ctx context.Context, t task) {
+	segment := r.job.Nzb.Files[t.file].Segments[t.segment]
+	var attempts []Attempt
+	for _, pool := range r.pools {
+		server := pool.Server().Address
+		for tries := 1; ; tries++ {
+			succeeded := append(attempts[:len(attempts):len(attempts)], Attempt{Server: server})
+			written := func(err error) {
+				if err != nil {
+					err = fmt.Errorf("Could not write data to file: %w", &storageError{err})
+					r.finish(t, Failed, append(attempts, Attempt{Server: server, Reason: Storage, Err: err}))
+					return
+				}
+				r.finish(t, Done, succeeded)
+			}
+			err := r.downloadFrom(ctx, pool, t, segment, written)
+			if err == nil {
+				return
+			}
+			if ctx.Err() != nil {
+				// The download was stopped, so the segment is left as it was for another attempt.
+				return
+			}
+			reason := Classify(err)
+			attempts = append(attempts, Attempt{Server: server, Reason: reason, Err: err})
+			if reason == Storage {
+				r.finish(t, Failed, attempts)
+				return
+			}
+			if !reason.transient() || tries >= r.retry.Attempts {
+				break
+			}
+			if !sleep(ctx, r.retry.backoff(tries)) {
+				return
+			}
+		}
+	}
+	r.finish(t, Failed, attempts)
+}
+
+// downloadFrom fetches a single segment from the server behind pool, and has it decoded and put in
+// the cache to be written. written is called once it has been written, unless downloadFrom fails.
+//
+// The connection is only held while the article is read, and is free for another segment while
+// this one is decoded.
+func (r *run) downloadFrom(ctx context.Context, pool *nntp.Pool, t task, segment nzb.Segment, written func(error)) error {
+	conn, err := pool.Get(ctx)
+	if err != nil {
+		return err
+	}
+	server := pool.Server().Address
+	article := articles.Get().(*bytes.Buffer)
+	defer func() {
+		article.Reset()
+		articles.Put(article)
+	}()
+	n, reusable, err := r.fetch(conn, segment.ID, article)
+	if reusable {
+		pool.Put(conn)
+	} else {
+		pool.Discard(conn)
+	}
+	if err == nil {
+		err = r.decode(t, article.Bytes(), written)
+	}
+	event := Event{Type: ArticleRead, File: t.file, Segment: segment, Server: server, Bytes: n}
+	if err != nil {
+		event.Type, event.Reason, event.Err = ArticleFailed, Classify(err), err
+	}
+	r.emit(event)
+	return err
+}
+
+// articles holds buffers for the bodies of articles as they are read from servers.
+var articles = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// fetch reads the body of the article with the given message ID over conn into article.
+//
+// It returns the number of bytes read from the server, and whether conn is still in a state where
+// it can be used for further commands. A connection which sent an article without its yEnc footer
+// isn't reused, so that the article is retried on a new one.
+func (r *run) fetch(conn *nntp.Conn, messageID string, article *bytes.Buffer) (int64, bool, error) {
+	conn.SetDeadline(time.Now().Add(r.timeout))
+	defer conn.SetDeadline(time.Time{})
+	body, err := conn.ReadMessage(messageID)
+	if err != nil {
+		// The server rejecting the article leaves the connection usable, but other failures do not.
+		var protoErr *textproto.Error
+		return 0, errors.As(err, &protoErr), err
+	}
+	counted := &countingReader{r: body, conn: conn, timeout: r.timeout}
+	var reader io.Reader = counted
+	if r.throttle != nil {
+		reader = r.throttle(reader)
+	}
+	if _, err := article.ReadFrom(reader); err != nil {
+		return counted.n, false, fmt.Errorf("Could not read article: %w", err)
+	}
+	return counted.n, hasFooter(article.Bytes()), nil
+}
+
+// hasFooter reports whether a yEnc article ends with its yend line. Articles without one fail to
+// decode as Truncated.
+func hasFooter(article []byte) bool {
+	article = bytes.TrimRight(article, "\r\n")
+	start := bytes.LastIndexByte(article, '\n') + 1
+	return bytes.HasPrefix(article[start:], []byte("=yend"))
+}
+
+// decodeRequest asks a decoder to decode an article, and put it in the cache to be written.
+type decodeRequest struct {
+	t       task
+	article []byte
+	written func(error)
+	result  chan error
+}
+
+// results holds channels for decoders to answer requests on.
+var results = sync.Pool{New: func() any { return make(chan error, 1) }}
+
+// decode has one of the run's decoders decode an article read from a server, and put it in the
+// cache to be written, recording the name of the file it belongs to. written is called once it has
+// been written, unless decode fails.
+func (r *run) decode(t task, article []byte, written func(error)) error {
+	result := results.Get().(chan error)
+	defer results.Put(result)
+	r.decodes <- decodeRequest{t, article, written, result}
+	return <-result
+}
+
+// decoder decodes articles until r.decodes is closed, reusing the same reader and buffers for
+// each of them.
+func (r *run) decoder() {
+	var yencReader yenc.Reader
+	var body bytes.Reader
+	for req := range r.decodes {
+		body.Reset(req.article)
+		req.result <- r.write(&yencReader, req.t, &body, req.written)
+	}
+}
+
+// finish records the outcome of a segment, and reports it along with the end of its file. Once
+// every segment of a file has finished, the file is given its own name.
+func (r *run) finish(t task, status Status, attempts []Attempt) {
+	var server string
+	var err error
+	if len(attempts) > 0 {
+		last := attempts[len(attempts)-1]
+		server, err = last.Server, last.Err
+	}
+	r.mu.Lock()
+	s := &r.result.Files[t.file].Segments[t.segment]
+	s.Status, s.Server, s.Err, s.Attempts = status, server, err, attempts
+	r.remaining[t.file]--
+	fileDone := r.remaining[t.file] == 0
+	name := nzb.SafeName(r.names[t.file])
+	readIndex := fileDone && r.job.OnUnrepairable != nil && r.damage.sliceSize == 0 && isPar2Index(name)
+	r.mu.Unlock()
+
+	var fileErr error
+	var recoverySet *par2.Archive
+	if fileDone {
+		fileErr = r.outputs.finish(name, t.file)
+		if fileErr == nil {
+			r.mu.Lock()
+			fileErr = r.checksums[t.file].verify()
+			r.mu.Unlock()
+		}
+		// The recovery set is read without holding r.mu, so that the other workers aren't held
+		// up while it is parsed.
+		if readIndex {
+			if archive, err := par2.FromStorage(r.outputs.store, name); err == nil {
+				recoverySet = &archive
+			}
+		}
+	}
+	if status == Failed {
+		// The rest of the file's segments may now all be waiting in the cache.
+		r.settle(t.file, name)
+	}
+	r.mu.Lock()
+	if fileErr != nil {
+		r.result.Files[t.file].Err = fileErr
+	}
+	if r.job.OnUnrepairable != nil {
+		r.track(t, status, recoverySet)
+	}
+	r.mu.Unlock()
+
+	if status != Skipped {
+		event := Event{Type: SegmentDone, File: t.file, Segment: s.Segment, Server: server, Err: err}
+		if status == Failed {
+			event.Type = SegmentFailed
+		}
+		r.emit(event)
+	}
+	if fileDone {
+		r.emit(Event{Type: FileDone, File: t.file, Err: fileErr})
+	}
+}
+
+// track records a finished segment in the damage tracker, along with the recovery set read from
+// the segment's file if it finished a PAR2 index, and reports the damage once it is too much to
+// repair. r.mu must be held.
+func (r *run) track(t task, status Status, recoverySet *par2.Archive) {
+	if status == Failed {
+		r.damage.fail(t.file, t.segment)
+	}
+	if recoverySet != nil && r.damage.sliceSize == 0 {
+		r.damage.install(*recoverySet)
+	}
+	if r.damage.reported {
+		return
+	}
+	if damage, known := r.damage.damage(r.names); known && !damage.Repairable() {
+		r.damage.reported = true
+		r.unrepairable <- damage
+	}
+}
+
+// emit delivers an event to the job's OnEvent, one at a time.
+func (r *run) emit(event Event) {
+	if r.job.OnEvent == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.job.OnEvent(event)
+}
+
+// decodedBuffers holds buffers for decoded articles, which are returned once they have been
+// written.
+var decodedBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// write decodes the yEnc article in body with yencReader, and puts it in the cache to be written
+// into place in the file it names, recording the file's name. written is called once it has been
+// written, unless write fails.
+func (r *run) write(yencReader *yenc.Reader, t task, body io.Reader, written func(error)) error {
+	if err := yencReader.Reset(body); err != nil {
+		return fmt.Errorf("Could not create reader: %w", err)
+	}
+	filename, err := yencReader.Filename()
+	if err != nil {
+		return fmt.Errorf("Could not get filename: %w", err)
+	}
+	filename = nzb.SafeName(filename)
+	// The name is recorded before the segment can finish, so that finishing the file uses it.
+	r.mu.Lock()
+	r.names[t.file] = filename
+	r.damage.named(t.file)
+	r.mu.Unlock()
+	offset, err := yencReader.Offset()
+	if err != nil {
+		return fmt.Errorf("Could not read offset from file: %w", err)
+	}
+	size, err := yencReader.Size()
+	if err != nil {
+		return fmt.Errorf("Could not read size of file: %w", err)
+	}
+	decoded := decodedBuffers.Get().(*bytes.Buffer)
+	decoded.Reset()
+	if _, err = decoded.ReadFrom(yencReader); err != nil {
+		decodedBuffers.Put(decoded)
+		return fmt.Errorf("Could not decode article: %w", err)
+	}
+
+	// The reader is reused for another article before the segment is written, so the checksums
+	// are taken now.
+	checksum := segmentChecksum{offset: offset, size: int64(decoded.Len()), crc: yencReader.CRC(), written: true}
+	fileCRC, knownCRC := yencReader.FileCRC()
+
+	if err := r.outputs.open(filename, t.file, size); err != nil {
+		decodedBuffers.Put(decoded)
+		return fmt.Errorf("Could not open output file: %w", &storageError{err})
+	}
+	r.mu.Lock()
+	r.buffered[t.file]++
+	r.mu.Unlock()
+	r.outputs.add(filename, offset, decoded.Bytes(), func(err error) {
+		r.mu.Lock()
+		r.buffered[t.file]--
+		if err == nil {
+			r.checksums[t.file].add(t.segment, checksum, size, fileCRC, knownCRC)
+		}
+		r.mu.Unlock()
+		decodedBuffers.Put(decoded)
+		written(err)
+	})
+	r.settle(t.file, filename)
+	return nil
+}
+
+// settle writes out the file with the given name, which the NZB file at index file is written to,
+// once all of its segments which haven't finished are waiting in the cache. Nothing else would
+// make room for them to join, and they can't finish until they are written.
+func (r *run) settle(file int, name string) {
+	r.mu.Lock()
+	waiting := r.buffered[file] > 0 && r.buffered[file] == r.remaining[file]
+	r.mu.Unlock()
+	if waiting {
+		r.outputs.flushFile(name)
+	}
+}
+
+// countingReader counts the bytes of an article read through it, extending conn's deadline by
+// timeout whenever anything is read.
+type countingReader struct {
+	r       io.Reader
+	n       int64
+	conn    *nntp.Conn
+	timeout time.Duration
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,743 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/esteth/usenet/pkg/nntp"
+	"github.com/esteth/usenet/pkg/nntp/nntptest"
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/par2"
+	"github.com/esteth/usenet/pkg/storage"
+	"github.com/esteth/usenet/pkg/yenc"
+)
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+// newServer starts a test server, which is closed after any downloader created later.
+func newServer(t *testing.T) *nntptest.Server {
+	server := nntptest.NewServer(nil)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func post(t *testing.T, server *nntptest.Server, files map[string][]byte) nzb.Nzb {
+	n, err := nzb.FromReader(bytes.NewReader(server.PostFiles(files, 3000)))
+	if err != nil {
+		t.Fatalf("Could not parse NZB: %v", err)
+	}
+	return n
+}
+
+func newDownloader(t *testing.T, servers ...*nntptest.Server) *Downloader {
+	return newDownloaderWith(t, Config{}, servers...)
+}
+
+// newDownloaderWith creates a downloader configured by cfg, connecting to the given servers.
+func newDownloaderWith(t *testing.T, cfg Config, servers ...*nntptest.Server) *Downloader {
+	for _, server := range servers {
+		cfg.Servers = append(cfg.Servers, nntp.Server{Address: server.Addr, Connections: 2})
+	}
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Could not create downloader: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestDownload(t *testing.T) {
+	server := newServer(t)
+	files := map[string][]byte{"a.bin": testData(10000), "b.bin": testData(5000)}
+	n := post(t, server, files)
+
+	dir := t.TempDir()
+	events := make(map[EventType]int)
+	result, err := newDownloader(t, server).Download(context.Background(), Job{
+		Nzb: n,
+		Dir: dir,
+		OnEvent: func(event Event) {
+			events[event.Type]++
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	if !result.Complete() || result.Failed() != 0 {
+		t.Errorf("Download was not complete: %+v", result)
+	}
+	for name, data := range files {
+		written, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Could not read downloaded file: %v", err)
+		}
+		if !bytes.Equal(written, data) {
+			t.Errorf("Downloaded %s does not match posted file", name)
+		}
+	}
+	if events[ArticleRead] != 6 || events[SegmentDone] != 6 || events[FileDone] != 2 || events[SegmentFailed] != 0 {
+		t.Errorf("Unexpected events %v", events)
+	}
+}
+
+func TestDownloadToStorage(t *testing.T) {
+	server := newServer(t)
+	files := map[string][]byte{"a.bin": testData(10000), "b.bin": testData(5000)}
+	n := post(t, server, files)
+
+	store := storage.NewMemory()
+	result, err := newDownloader(t, server).Download(context.Background(), Job{Nzb: n, Storage: store})
+	if err != nil || !result.Complete() {
+		t.Fatalf("Could not download: %v", err)
+	}
+	entries, err := store.ReadDir(".")
+	if err != nil || len(entries) != len(files) {
+		t.Fatalf("Expected only the downloaded files in storage, got %v", entries)
+	}
+	for name, data := range files {
+		written, err := storage.ReadFile(store, name)
+		if err != nil || !bytes.Equal(written, data) {
+			t.Errorf("Downloaded %s does not match posted file: %v", name, err)
+		}
+	}
+}
+
+func TestFailedSegments(t *testing.T) {
+	primary := newServer(t)
+	backup := newServer(t)
+	n := post(t, primary, map[string][]byte{"a.bin": testData(10000)})
+	post(t, backup, map[string][]byte{"a.bin": testData(10000)})
+	primary.RemoveArticle("a.bin.2@nntptest")
+	primary.RemoveArticle("a.bin.3@nntptest")
+	backup.RemoveArticle("a.bin.3@nntptest")
+
+	result, err := newDownloader(t, primary, backup).Download(context.Background(), Job{Nzb: n, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	if result.Complete() || result.Failed() != 1 {
+		t.Fatalf("Expected one failed segment, got %+v", result)
+	}
+	segments := result.Files[0].Segments
+	if segments[1].Status != Done || segments[1].Server != backup.Addr {
+		t.Errorf("Expected the backup server to provide segment 2, got %+v", segments[1])
+	}
+	var protoErr *textproto.Error
+	failed := result.Files[0].Failed()
+	if failed[0].Segment.Number != 3 || !errors.As(failed[0].Err, &protoErr) || protoErr.Code != 430 {
+		t.Errorf("Unexpected failed segment %+v", failed[0])
+	}
+	if len(failed[0].Attempts) != 2 || failed[0].Attempts[0].Reason != Missing {
+		t.Errorf("Expected missing articles not to be retried, got %+v", failed[0].Attempts)
+	}
+}
+
+func TestSkipsDoneSegments(t *testing.T) {
+	server := newServer(t)
+	n := post(t, server, map[string][]byte{"a.bin": testData(10000)})
+
+	result, err := newDownloader(t, server).Download(context.Background(), Job{
+		Nzb:  n,
+		Dir:  t.TempDir(),
+		Done: map[string]bool{"a.bin.1@nntptest": true},
+	})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	if server.Requests("a.bin.1@nntptest") != 0 || result.Files[0].Segments[0].Status != Skipped {
+		t.Errorf("Segment which was already done was downloaded again")
+	}
+	if !result.Complete() {
+		t.Errorf("Download was not complete: %+v", result)
+	}
+}
+
+func TestCancelledDownload(t *testing.T) {
+	server := newServer(t)
+	n := post(t, server, map[string][]byte{"a.bin": testData(10000)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := newDownloader(t, server).Download(ctx, Job{Nzb: n, Dir: t.TempDir()})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the download to be cancelled, got %v", err)
+	}
+	if result.Complete() || result.Failed() != 0 {
+		t.Errorf("Expected segments to be left pending, got %+v", result)
+	}
+}
+
+// fastRetry retries quickly, so that tests of failures don't take long.
+var fastRetry = Config{Retry: RetryPolicy{Attempts: 3, Backoff: time.Millisecond}, Timeout: 200 * time.Millisecond}
+
+// reasons returns the reason for each attempt to download a segment.
+func reasons(s SegmentResult) []Reason {
+	var reasons []Reason
+	for _, a := range s.Attempts {
+		reasons = append(reasons, a.Reason)
+	}
+	return reasons
+}
+
+func TestRetriesTransientFailures(t *testing.T) {
+	server := newServer(t)
+	n := post(t, server, map[string][]byte{"a.bin": testData(10000)})
+	server.Fail("a.bin.1@nntptest", nntptest.Disconnect, 1)
+	server.Fail("a.bin.2@nntptest", nntptest.Truncate, 2)
+	server.Fail("a.bin.3@nntptest", nntptest.Stall, 1)
+
+	result, err := newDownloaderWith(t, fastRetry, server).Download(context.Background(), Job{Nzb: n, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	if !result.Complete() {
+		t.Fatalf("Download was not complete: %+v", result)
+	}
+	expected := [][]Reason{
+		{ConnectionLost, ""},
+		{Truncated, Truncated, ""},
+		{Timeout, ""},
+		{""},
+	}
+	for i, s := range result.Files[0].Segments {
+		if !reflect.DeepEqual(reasons(s), expected[i]) {
+			t.Errorf("Expected segment %d to be attempted with %q, got %q", i+1, expected[i], reasons(s))
+		}
+	}
+}
+
+func TestTruncatedArticleRetriedOnNewConnection(t *testing.T) {
+	server := newServer(t)
+	n := post(t, server, map[string][]byte{"a.bin": testData(1000)})
+	server.Fail("a.bin.1@nntptest", nntptest.Truncate, 2)
+
+	result, err := newDownloaderWith(t, fastRetry, server).Download(context.Background(), Job{Nzb: n, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	if !result.Complete() {
+		t.Fatalf("Download was not complete: %+v", result)
+	}
+	if connections := server.Connections(); connections != 3 {
+		t.Errorf("Expected each attempt to use a new connection, got %d connections for 3 attempts", connections)
+	}
+}
+
+func TestGivesUpAfterAttempts(t *testing.T) {
+	server := newServer(t)
+	n := post(t, server, map[string][]byte{"a.bin": testData(10000)})
+	server.Fail("a.bin.1@nntptest", nntptest.Disconnect, 10)
+
+	result, err := newDownloaderWith(t, fastRetry, server).Download(context.Background(), Job{Nzb: n, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	s := result.Files[0].Segments[0]
+	if s.Status != Failed || server.Requests("a.bin.1@nntptest") != 3 {
+		t.Errorf("Expected the segment to fail after 3 attempts, got %+v", s)
+	}
+	if !reflect.DeepEqual(reasons(s), []Reason{ConnectionLost, ConnectionLost, ConnectionLost}) {
+		t.Errorf("Unexpected attempts %q", reasons(s))
+	}
+}
+
+func TestChecksumFailureTriesNextServer(t *testing.T) {
+	primary := newServer(t)
+	backup := newServer(t)
+	data := testData(5000)
+	for _, server := range []*nntptest.Server{primary, backup} {
+		server.AddArticle("a.bin@nntptest", nntptest.Encode("a.bin", data))
+	}
+	primary.Fail("a.bin@nntptest", nntptest.Corrupt, 1)
+	n := nzb.Nzb{Files: []nzb.File{{Subject: "a.bin", Segments: []nzb.Segment{{Number: 1, ID: "a.bin@nntptest"}}}}}
+
+	dir := t.TempDir()
+	result, err := newDownloaderWith(t, fastRetry, primary, backup).Download(context.Background(), Job{Nzb: n, Dir: dir})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	s := result.Files[0].Segments[0]
+	if !reflect.DeepEqual(reasons(s), []Reason{Checksum, ""}) || s.Server != backup.Addr {
+		t.Errorf("Expected the backup server to be tried after a checksum failure, got %+v", s.Attempts)
+	}
+	written, err := os.ReadFile(filepath.Join(dir, "a.bin"))
+	if err != nil || !bytes.Equal(written, data) {
+		t.Errorf("Downloaded file does not match posted file")
+	}
+}
+
+// postRecoverySet posts a.bin along with a PAR2 index and a volume of four recovery slices of 1000
+// bytes, which covers a.bin's ten segments.
+func postRecoverySet(t *testing.T, server *nntptest.Server) nzb.Nzb {
+	dir := t.TempDir()
+	files := map[string][]byte{"a.bin": testData(30000)}
+	if err := os.WriteFile(filepath.Join(dir, "a.bin"), files["a.bin"], 0666); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	paths, err := par2.Create(dir, "a", []string{"a.bin"}, 1000, []int{4})
+	if err != nil {
+		t.Fatalf("Could not create recovery set: %v", err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Could not read recovery file: %v", err)
+		}
+		files[filepath.Base(path)] = data
+	}
+	return post(t, server, files)
+}
+
+func TestAbortsUnrepairableDownload(t *testing.T) {
+	server := newServer(t)
+	n := postRecoverySet(t, server)
+	for _, id := range []string{"a.bin.3@nntptest", "a.bin.4@nntptest", "a.bin.5@nntptest"} {
+		server.RemoveArticle(id)
+	}
+	// Articles take a moment to arrive, as they would from a real server, so that the PAR2 index is
+	// written while the rest are downloaded.
+	server.SetLatency(5 * time.Millisecond)
+
+	var reported []Damage
+	d := newDownloaderWith(t, Config{Workers: 1}, server)
+	result, err := d.Download(context.Background(), Job{
+		Nzb: n,
+		Dir: t.TempDir(),
+		OnUnrepairable: func(damage Damage) bool {
+			reported = append(reported, damage)
+			return true
+		},
+	})
+	if !errors.Is(err, ErrUnrepairable) {
+		t.Fatalf("Expected the download to be abandoned, got %v", err)
+	}
+	if len(reported) != 1 || reported[0].Repairable() || reported[0].RecoverySlices != 4 {
+		t.Errorf("Unexpected damage reported: %+v", reported)
+	}
+	for _, f := range result.Files {
+		if f.File.Name() == "a.vol0+4.par2" && f.Segments[0].Status != Pending {
+			t.Errorf("Expected the recovery volume not to be downloaded, got %+v", f.Segments[0])
+		}
+	}
+	if server.Requests("a.bin.10@nntptest") != 0 {
+		t.Errorf("Expected the download to stop once the damage was found")
+	}
+}
+
+func TestContinuesRepairableDownload(t *testing.T) {
+	server := newServer(t)
+	n := postRecoverySet(t, server)
+	server.RemoveArticle("a.bin.3@nntptest")
+
+	result, err := newDownloader(t, server).Download(context.Background(), Job{
+		Nzb: n,
+		Dir: t.TempDir(),
+		OnUnrepairable: func(damage Damage) bool {
+			t.Errorf("Repairable damage was reported: %v", damage)
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	if result.Failed() != 1 {
+		t.Errorf("Expected one failed segment, got %+v", result)
+	}
+}
+
+// obfuscate replaces the subjects of the files in n whose names are given, or of every file if
+// none are, with ones which don't give their names.
+func obfuscate(n nzb.Nzb, names ...string) {
+	for i, f := range n.Files {
+		if len(names) == 0 || slices.Contains(names, f.Name()) {
+			n.Files[i].Subject = fmt.Sprintf("[%d/%d] - yEnc (1/%d)", i+1, len(n.Files), len(f.Segments))
+		}
+	}
+}
+
+func TestNamesFilesFromArticles(t *testing.T) {
+	server := newServer(t)
+	files := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("%02d.bin", i)] = testData(1000 + i)
+	}
+	n := post(t, server, files)
+	obfuscate(n)
+
+	dir := t.TempDir()
+	result, err := newDownloader(t, server).Download(context.Background(), Job{Nzb: n, Dir: dir})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	if !result.Complete() {
+		t.Fatalf("Download was not complete: %+v", result)
+	}
+	for name, data := range files {
+		written, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(written, data) {
+			t.Errorf("Expected %s to be written under the name in its articles: %v", name, err)
+		}
+	}
+}
+
+func TestContinuesRepairableObfuscatedDownload(t *testing.T) {
+	server := newServer(t)
+	n := postRecoverySet(t, server)
+	obfuscate(n)
+	server.RemoveArticle("a.bin.3@nntptest")
+	// The PAR2 index is read before the recovery volume is downloaded, while only its subject
+	// describes it.
+	server.SetLatency(5 * time.Millisecond)
+
+	result, err := newDownloaderWith(t, Config{Workers: 1}, server).Download(context.Background(), Job{
+		Nzb: n,
+		Dir: t.TempDir(),
+		OnUnrepairable: func(damage Damage) bool {
+			t.Errorf("Repairable damage was reported: %v", damage)
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	if result.Failed() != 1 {
+		t.Errorf("Expected one failed segment, got %+v", result)
+	}
+}
+
+func TestAbortsUnrepairableObfuscatedDownload(t *testing.T) {
+	server := newServer(t)
+	n := postRecoverySet(t, server)
+	obfuscate(n)
+	for _, id := range []string{"a.bin.3@nntptest", "a.bin.4@nntptest", "a.bin.5@nntptest"} {
+		server.RemoveArticle(id)
+	}
+
+	var reported []Damage
+	_, err := newDownloaderWith(t, Config{Workers: 1}, server).Download(context.Background(), Job{
+		Nzb: n,
+		Dir: t.TempDir(),
+		OnUnrepairable: func(damage Damage) bool {
+			reported = append(reported, damage)
+			return true
+		},
+	})
+	if !errors.Is(err, ErrUnrepairable) {
+		t.Fatalf("Expected the download to be abandoned, got %v", err)
+	}
+	if len(reported) != 1 || reported[0].RecoverySlices != 4 {
+		t.Errorf("Expected the damage to count the recovery volume, got %+v", reported)
+	}
+}
+
+func TestAbortsDownloadMissingAnUnnamedFile(t *testing.T) {
+	server := newServer(t)
+	n := postRecoverySet(t, server)
+	obfuscate(n, "a.bin")
+	for i := 1; i <= 10; i++ {
+		server.RemoveArticle(fmt.Sprintf("a.bin.%d@nntptest", i))
+	}
+
+	var reported []Damage
+	_, err := newDownloaderWith(t, Config{Workers: 1}, server).Download(context.Background(), Job{
+		Nzb: n,
+		Dir: t.TempDir(),
+		OnUnrepairable: func(damage Damage) bool {
+			reported = append(reported, damage)
+			return true
+		},
+	})
+	if !errors.Is(err, ErrUnrepairable) {
+		t.Fatalf("Expected the download to be abandoned, got %v", err)
+	}
+	if len(reported) != 1 || reported[0].DamagedSlices != 30 {
+		t.Errorf("Expected every slice of the missing file to be damaged, got %+v", reported)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	primary := newServer(t)
+	backup := newServer(t)
+	n := post(t, primary, map[string][]byte{"a.bin": testData(10000)})
+	post(t, backup, map[string][]byte{"a.bin": testData(10000)})
+	primary.RemoveArticle("a.bin.2@nntptest")
+	primary.RemoveArticle("a.bin.3@nntptest")
+	backup.RemoveArticle("a.bin.3@nntptest")
+
+	result, err := newDownloader(t, primary, backup).Check(context.Background(), n)
+	if err != nil {
+		t.Fatalf("Could not check: %v", err)
+	}
+	f := result.Files[0]
+	if f.AvailableOn(0) != 2 || f.AvailableOn(1) != 3 || f.Missing() != 1 {
+		t.Errorf("Unexpected availability %+v", f)
+	}
+	if result.Complete() || result.Repairable() || result.Damage != nil {
+		t.Errorf("Expected the check to find damage it can't estimate, got %+v", result)
+	}
+	if s := f.Segments[2].Servers[0]; s.Reason != Missing || s.Server != primary.Addr {
+		t.Errorf("Unexpected answer for missing segment %+v", s)
+	}
+}
+
+func TestCheckEstimatesDamage(t *testing.T) {
+	for _, test := range []struct {
+		missing    []string
+		repairable bool
+	}{
+		{[]string{"a.bin.3@nntptest"}, true},
+		{[]string{"a.bin.3@nntptest", "a.bin.4@nntptest", "a.bin.5@nntptest"}, false},
+	} {
+		server := newServer(t)
+		n := postRecoverySet(t, server)
+		for _, id := range test.missing {
+			server.RemoveArticle(id)
+		}
+		result, err := newDownloader(t, server).Check(context.Background(), n)
+		if err != nil {
+			t.Fatalf("Could not check: %v", err)
+		}
+		if result.Damage == nil || result.Damage.RecoverySlices != 4 || result.Repairable() != test.repairable {
+			t.Errorf("Expected repairable to be %v with %v missing, got %+v", test.repairable, test.missing, result.Damage)
+		}
+	}
+}
+
+func TestCheckObfuscatedVolume(t *testing.T) {
+	server := newServer(t)
+	n := postRecoverySet(t, server)
+	obfuscate(n, "a.vol0+4.par2")
+	server.RemoveArticle("a.bin.3@nntptest")
+
+	result, err := newDownloader(t, server).Check(context.Background(), n)
+	if err != nil {
+		t.Fatalf("Could not check: %v", err)
+	}
+	if result.Damage != nil {
+		t.Errorf("Expected damage not to be estimated without the recovery volume's name, got %+v", result.Damage)
+	}
+}
+
+func TestResumesPartialFile(t *testing.T) {
+	server := newServer(t)
+	data := testData(10000)
+	n := post(t, server, map[string][]byte{"a.bin": data})
+	// With a cache too small to hold two segments, each is written as soon as it is downloaded, so
+	// that the download can be stopped part way through the file.
+	d := newDownloaderWith(t, Config{Workers: 1, CacheSize: 1}, server)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result, err := d.Download(ctx, Job{
+		Nzb: n,
+		Dir: dir,
+		OnEvent: func(event Event) {
+			if event.Type == SegmentDone {
+				cancel()
+			}
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the download to be cancelled, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the unfinished file to be left partial, got %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "a.bin"+PartialSuffix))
+	if err != nil || info.Size() != int64(len(data)) {
+		t.Fatalf("Expected the partial file to be allocated in full, got %v", err)
+	}
+
+	done := make(map[string]bool)
+	for _, s := range result.Files[0].Segments {
+		if s.Status == Done {
+			done[s.Segment.ID] = true
+		}
+	}
+	result, err = d.Download(context.Background(), Job{Nzb: n, Dir: dir, Done: done})
+	if err != nil || !result.Complete() {
+		t.Fatalf("Could not resume download: %v", err)
+	}
+	written, err := os.ReadFile(filepath.Join(dir, "a.bin"))
+	if err != nil || !bytes.Equal(written, data) {
+		t.Errorf("Resumed file does not match posted file")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.bin"+PartialSuffix)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the partial file to be renamed, got %v", err)
+	}
+}
+
+func TestCoalescesWrites(t *testing.T) {
+	server := newServer(t)
+	data := testData(30000)
+	n := post(t, server, map[string][]byte{"a.bin": data})
+
+	var mu sync.Mutex
+	written := make([]byte, len(data))
+	writes := 0
+	result, err := newDownloader(t, server).Download(context.Background(), Job{
+		Nzb:     n,
+		Storage: storage.NewMemory(),
+		OnWrite: func(name string, offset int64, data []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			copy(written[offset:], data)
+			writes++
+		},
+	})
+	if err != nil || !result.Complete() {
+		t.Fatalf("Could not download: %v", err)
+	}
+	if writes != 1 {
+		t.Errorf("Expected the file's 10 segments to be written at once, got %d writes", writes)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("Data passed to OnWrite does not match posted file")
+	}
+}
+
+func TestCacheBackpressure(t *testing.T) {
+	server := newServer(t)
+	files := map[string][]byte{"a.bin": testData(30000), "b.bin": testData(20000)}
+	n := post(t, server, files)
+
+	var mu sync.Mutex
+	var largest, writes int
+	store := storage.NewMemory()
+	d := newDownloaderWith(t, Config{Workers: 8, CacheSize: 7000}, server)
+	result, err := d.Download(context.Background(), Job{
+		Nzb:     n,
+		Storage: store,
+		OnWrite: func(name string, offset int64, data []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			largest = max(largest, len(data))
+			writes++
+		},
+	})
+	if err != nil || !result.Complete() {
+		t.Fatalf("Could not download: %v", err)
+	}
+	if largest > 7000 || writes < 8 {
+		t.Errorf("Expected writes to be bounded by the cache, got %d writes of up to %d bytes", writes, largest)
+	}
+	for name, data := range files {
+		written, err := storage.ReadFile(store, name)
+		if err != nil || !bytes.Equal(written, data) {
+			t.Errorf("Downloaded %s does not match posted file: %v", name, err)
+		}
+	}
+}
+
+// failingStorage is a Storage whose files can't be written to.
+type failingStorage struct {
+	*storage.Memory
+}
+
+func (s failingStorage) Create(name string) (storage.File, error) {
+	f, err := s.Memory.Create(name)
+	return failingFile{f}, err
+}
+
+type failingFile struct {
+	storage.File
+}
+
+func (f failingFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWriteFailure(t *testing.T) {
+	server := newServer(t)
+	n := post(t, server, map[string][]byte{"a.bin": testData(10000)})
+
+	result, err := newDownloader(t, server).Download(context.Background(), Job{
+		Nzb:     n,
+		Storage: failingStorage{storage.NewMemory()},
+	})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	for _, s := range result.Files[0].Segments {
+		if s.Status != Failed || !reflect.DeepEqual(reasons(s), []Reason{Storage}) {
+			t.Errorf("Expected segment to fail to be written, got %v %v", s.Status, reasons(s))
+		}
+	}
+}
+
+func TestFileChecksumMismatch(t *testing.T) {
+	server := newServer(t)
+	n := post(t, server, map[string][]byte{"a.bin": testData(10000)})
+	// The second segment comes from another post of the same file, so it matches its own checksum
+	// but not that of the whole file.
+	other := bytes.Repeat([]byte{1}, 3000)
+	server.AddArticle(n.Files[0].Segments[1].ID, nntptest.EncodePart("a.bin", 2, 4, 10000, 3000, other))
+
+	store := storage.NewMemory()
+	result, err := newDownloader(t, server).Download(context.Background(), Job{Nzb: n, Storage: store})
+	if err != nil {
+		t.Fatalf("Could not download: %v", err)
+	}
+	if result.Failed() != 0 {
+		t.Errorf("Expected every segment to download, got %d failed", result.Failed())
+	}
+	if result.Complete() || !errors.Is(result.Files[0].Err, yenc.ErrChecksum) {
+		t.Errorf("Expected the file to fail its checksum, got %v", result.Files[0].Err)
+	}
+	if _, err := store.Stat("a.bin"); err != nil {
+		t.Errorf("Expected the file to be finished for repair: %v", err)
+	}
+}
+
+// BenchmarkDownload downloads 32MiB, posted in articles of a typical size, from a local server
+// with four connections. The server either answers at once, or after a delay like a distant one,
+// and the segments are downloaded either one per connection, so that a connection waits while its
+// article is decoded, or with the default number of workers.
+func BenchmarkDownload(b *testing.B) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	data := testData(32 << 20)
+	n, err := nzb.FromReader(bytes.NewReader(server.Post("a.bin", data, 700<<10)))
+	if err != nil {
+		b.Fatalf("Could not parse NZB: %v", err)
+	}
+
+	for _, latency := range []time.Duration{0, 20 * time.Millisecond} {
+		for _, workers := range []int{4, 0} {
+			b.Run(fmt.Sprintf("latency=%v/workers=%d", latency, workers), func(b *testing.B) {
+				server.SetLatency(latency)
+				d, err := New(Config{Servers: []nntp.Server{{Address: server.Addr, Connections: 4}}, Workers: workers})
+				if err != nil {
+					b.Fatalf("Could not create downloader: %v", err)
+				}
+				defer d.Close()
+
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					result, err := d.Download(context.Background(), Job{Nzb: n, Storage: storage.NewMemory()})
+					if err != nil || !result.Complete() {
+						b.Fatalf("Could not download: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"sync"
+
+	"github.com/esteth/usenet/pkg/storage"
+)
+
+// PartialSuffix is added to the names of files while they are being downloaded. They are only
+// given their own names once every one of their segments has been downloaded or has failed, so a
+// file under its own name is never missing data which could still be downloaded.
+const PartialSuffix = ".partial"
+
+// DefaultCacheSize is the CacheSize of downloaders which don't set one.
+const DefaultCacheSize = 64 << 20
+
+// maxFlush is the size at which a run of adjacent segments in the cache is written out without
+// waiting for more to join it.
+const maxFlush = 4 << 20
+
+// outputs keeps the files of a download open while their segments are written, so that each is
+// opened once however many segments it has.
+//
+// Decoded segments are held in a cache of bounded size before being written, and segments which
+// are adjacent in a file are joined up so that they take a single, larger write. The writes are
+// made one at a time by a goroutine of their own, so that whoever adds a segment to the cache
+// doesn't wait for the disk unless the cache is full.
+type outputs struct {
+	store storage.Storage
+	// size is the number of bytes the cache may hold, and flushSize the size at which a run is
+	// written out.
+	size, flushSize int64
+	// onWrite, if set, is called with the data of every write.
+	onWrite func(name string, offset int64, data []byte)
+
+	mu sync.Mutex
+	// written is signalled whenever data leaves the cache, and queued whenever there is something
+	// new to write.
+	written, queued *sync.Cond
+	files           map[string]*output
+	// used is the number of bytes in the cache, including those being written.
+	used int64
+	// queue holds the data taken out of the cache to be written, and unwritten counts the extents
+	// in it or being written.
+	queue     []queuedWrite
+	unwritten int
+	stopping  bool
+	stopped   chan struct{}
+	// staging is where the writer joins up the chunks of an extent, so that they take a single
+	// write. It is kept between writes, and only used by the writer.
+	staging []byte
+}
+
+// queuedWrite is data taken out of the cache to be written to a file.
+type queuedWrite struct {
+	name    string
+	out     *output
+	extents []*extent
+}
+
+// output is a file being written.
+type output struct {
+	file storage.File
+	// writers holds the indices of the NZB files writing to the file. NZBs occasionally hold
+	// the same file more than once, and it must stay open until they have all finished.
+	writers map[int]bool
+	// extents holds the data waiting to be written to the file, in order of offset. No two of them
+	// are adjacent.
+	extents []*extent
+}
+
+// An extent is a run of data in the cache. Its data is kept in the chunks it was added in, which
+// aren't copied until it is written.
+type extent struct {
+	offset int64
+	size   int64
+	chunks [][]byte
+	// done holds a function for each segment in the extent, to be called once it is written.
+	done []func(error)
+}
+
+func (e *extent) end() int64 {
+	return e.offset + e.size
+}
+
+func newOutputs(store storage.Storage, size int64, onWrite func(string, int64, []byte)) *outputs {
+	o := &outputs{
+		store:     store,
+		size:      size,
+		flushSize: min(size/4, maxFlush),
+		onWrite:   onWrite,
+		files:     make(map[string]*output),
+		stopped:   make(chan struct{}),
+	}
+	o.written = sync.NewCond(&o.mu)
+	o.queued = sync.NewCond(&o.mu)
+	go o.writer()
+	return o
+}
+
+// writer writes the queued data until close is called.
+func (o *outputs) writer() {
+	defer close(o.stopped)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for {
+		for len(o.queue) == 0 && !o.stopping {
+			o.queued.Wait()
+		}
+		if len(o.queue) == 0 {
+			return
+		}
+		w := o.queue[0]
+		o.queue = o.queue[1:]
+		o.mu.Unlock()
+		o.flush(w.name, w.out, w.extents)
+		o.mu.Lock()
+		o.unwritten -= len(w.extents)
+		o.written.Broadcast()
+	}
+}
+
+// enqueue queues extents taken out of the file's cache to be written. o.mu must be held.
+func (o *outputs) enqueue(name string, out *output, extents ...*extent) {
+	o.unwritten += len(extents)
+	o.queue = append(o.queue, queuedWrite{name, out, extents})
+	o.queued.Signal()
+}
+
+// open opens the file with the given name for the NZB file at index writer to write to. The file
+// is created under its partial name if it doesn't exist, and space is allocated for size bytes so
+// that writing segments out of order doesn't fragment it.
+func (o *outputs) open(name string, writer int, size int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if out, ok := o.files[name]; ok {
+		out.writers[writer] = true
+		return nil
+	}
+	file, err := o.store.Create(name + PartialSuffix)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() < size {
+		err = storage.Allocate(file, size)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	o.files[name] = &output{file: file, writers: map[int]bool{writer: true}}
+	return nil
+}
+
+// add puts the data of a segment at offset in the open file with the given name into the cache,
+// joining it to any adjacent data. done is called once the data has been written, with the error
+// from writing it, and data must not be changed until then.
+//
+// If the cache is full, add queues what is in it to be written, and waits until there is room. A
+// segment is always let in to an empty cache, however large it is.
+func (o *outputs) add(name string, offset int64, data []byte, done func(error)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for o.used > 0 && o.used+int64(len(data)) > o.size {
+		o.evict()
+		o.written.Wait()
+	}
+	o.used += int64(len(data))
+	out := o.files[name]
+	e := out.insert(&extent{offset: offset, size: int64(len(data)), chunks: [][]byte{data}, done: []func(error){done}})
+	if e.size >= o.flushSize {
+		out.remove(e)
+		o.enqueue(name, out, e)
+	}
+}
+
+// evict queues the largest extent in the cache to be written, if there is one which isn't
+// already. o.mu must be held.
+func (o *outputs) evict() {
+	var name string
+	var largest *output
+	var e *extent
+	for file, out := range o.files {
+		for _, candidate := range out.extents {
+			if e == nil || candidate.size > e.size {
+				name, largest, e = file, out, candidate
+			}
+		}
+	}
+	if e != nil {
+		largest.remove(e)
+		o.enqueue(name, largest, e)
+	}
+}
+
+// insert adds e to the file's extents, joining it to those adjacent to it, and returns the extent
+// it ended up in.
+func (out *output) insert(e *extent) *extent {
+	i := sort.Search(len(out.extents), func(i int) bool { return out.extents[i].offset >= e.offset })
+	if i < len(out.extents) && out.extents[i].offset == e.end() {
+		next := out.extents[i]
+		e.size += next.size
+		e.chunks = append(e.chunks, next.chunks...)
+		e.done = append(e.done, next.done...)
+		out.extents = append(out.extents[:i], out.extents[i+1:]...)
+	}
+	if i > 0 && out.extents[i-1].end() == e.offset {
+		prev := out.extents[i-1]
+		prev.size += e.size
+		prev.chunks = append(prev.chunks, e.chunks...)
+		prev.done = append(prev.done, e.done...)
+		return prev
+	}
+	out.extents = append(out.extents, nil)
+	copy(out.extents[i+1:], out.extents[i:])
+	out.extents[i] = e
+	return e
+}
+
+// remove takes e out of the file's extents.
+func (out *output) remove(e *extent) {
+	for i, candidate := range out.extents {
+		if candidate == e {
+			out.extents = append(out.extents[:i], out.extents[i+1:]...)
+			return
+		}
+	}
+}
+
+// flushFile queues everything in the cache for the file with the given name to be written.
+func (o *outputs) flushFile(name string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.flushLocked(name)
+}
+
+// flushLocked queues everything in the cache for the file with the given name to be written.
+// o.mu must be held.
+func (o *outputs) flushLocked(name string) {
+	out, ok := o.files[name]
+	if !ok || len(out.extents) == 0 {
+		return
+	}
+	o.enqueue(name, out, out.extents...)
+	out.extents = nil
+}
+
+// flush writes extents which have been taken out of the cache to the file with the given name,
+// and then calls their done functions. It is only called by the writer.
+func (o *outputs) flush(name string, out *output, extents []*extent) {
+	errs := make([]error, len(extents))
+	var size int64
+	for i, e := range extents {
+		data := e.chunks[0]
+		if len(e.chunks) > 1 {
+			o.staging = o.staging[:0]
+			for _, chunk := range e.chunks {
+				o.staging = append(o.staging, chunk...)
+			}
+			data = o.staging
+		}
+		_, errs[i] = out.file.WriteAt(data, e.offset)
+		if errs[i] == nil && o.onWrite != nil {
+			o.onWrite(name, e.offset, data)
+		}
+		size += e.size
+	}
+	o.mu.Lock()
+	o.used -= size
+	o.written.Broadcast()
+	o.mu.Unlock()
+	for i, e := range extents {
+		for _, done := range e.done {
+			done(errs[i])
+		}
+	}
+}
+
+// flushAll writes out everything in the cache, returning once it has all been written and the
+// done functions have returned.
+func (o *outputs) flushAll() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for name := range o.files {
+		o.flushLocked(name)
+	}
+	for o.unwritten > 0 {
+		o.written.Wait()
+	}
+}
+
+// finish records that the NZB file at index writer has finished writing to the file with the
+// given name. Once every writer has finished, the file is synced to disk, closed and renamed to
+// its own name.
+//
+// Segments only finish once they have been written, so by then none of the file's data is left
+// in the cache.
+//
+// A partial file left by an earlier download is renamed too, as its segments will have been
+// skipped this time.
+func (o *outputs) finish(name string, writer int) error {
+	o.mu.Lock()
+	out, ok := o.files[name]
+	if ok {
+		delete(out.writers, writer)
+		if len(out.writers) > 0 {
+			o.mu.Unlock()
+			return nil
+		}
+		delete(o.files, name)
+	}
+	o.mu.Unlock()
+
+	partial := name + PartialSuffix
+	if ok {
+		if err := closeOutput(out.file); err != nil {
+			return err
+		}
+	} else if _, err := o.store.Stat(partial); errors.Is(err, fs.ErrNotExist) {
+		// Nothing has been written to the file.
+		return nil
+	}
+	if err := o.store.Rename(partial, name); err != nil {
+		return fmt.Errorf("Could not rename finished file: %w", err)
+	}
+	return nil
+}
+
+// close stops the writer, and syncs and closes every file which is still open, leaving them under
+// their partial names so that the download can be resumed. Anything left in the cache must have
+// been flushed first.
+func (o *outputs) close() error {
+	o.mu.Lock()
+	o.stopping = true
+	o.queued.Signal()
+	o.mu.Unlock()
+	<-o.stopped
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var errs []error
+	for name, out := range o.files {
+		errs = append(errs, closeOutput(out.file))
+		delete(o.files, name)
+	}
+	return errors.Join(errs...)
+}
+
+// closeOutput syncs a file to disk and closes it.
+func closeOutput(file storage.File) error {
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("Could not sync output file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("Could not close output file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/par2"
+	"github.com/esteth/usenet/pkg/storage"
+)
+
+// ErrUnrepairable is returned by Download when it is stopped because more data is missing than
+// the PAR2 recovery files in the NZB can restore.
+var ErrUnrepairable = errors.New("more data is missing than PAR2 can repair")
+
+// recoveryPacketOverhead is the size of a PAR2 recovery slice packet, less the slice itself: a
+// 64 byte packet header and a 4 byte exponent.
+const recoveryPacketOverhead = 68
+
+// boundaryMargin is the fraction of a segment ignored at each end when estimating which slices it
+// covers, as its position in the file is only estimated.
+const boundaryMargin = 0.01
+
+// volumeName matches the name of a PAR2 volume, capturing the number of recovery slices in it.
+var volumeName = regexp.MustCompile(`(?i)\.vol\d+\+(\d+)\.par2$`)
+
+// Damage estimates how much of a download's PAR2 recovery set has been lost to segments which
+// failed, against how much PAR2 can repair.
+type Damage struct {
+	// DamagedSlices is the number of slices of the recovery set which the failed segments
+	// certainly overlap.
+	DamagedSlices int
+	// RecoverySlices is the number of recovery slices in the NZB's PAR2 volumes which haven't
+	// been lost.
+	RecoverySlices int
+	// MissingBytes is the size of the failed segments, as given by the NZB.
+	MissingBytes int64
+}
+
+// Repairable returns true if PAR2 could repair the damage.
+func (d Damage) Repairable() bool {
+	return d.DamagedSlices <= d.RecoverySlices
+}
+
+func (d Damage) String() string {
+	return fmt.Sprintf("%d slices are damaged, but only %d recovery slices are available", d.DamagedSlices, d.RecoverySlices)
+}
+
+// isPar2Index returns true if name is a PAR2 index file, rather than a volume of recovery slices.
+func isPar2Index(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".par2") && !volumeName.MatchString(name)
+}
+
+// recoveryBlocks returns the number of recovery slices in a PAR2 volume, from its name.
+func recoveryBlocks(name string) int {
+	match := volumeName.FindStringSubmatch(name)
+	if match == nil {
+		return 0
+	}
+	blocks, _ := strconv.Atoi(match[1])
+	return blocks
+}
+
+// dispatchOrder returns the order to download the files of n in: PAR2 index files first, so that
+// the recovery set is known as early as possible, then the files being protected, then the PAR2
+// volumes, which are only needed if something is missing. Files are told apart by the names in
+// their subjects, so files whose subjects don't give one are downloaded in the order of the NZB,
+// after any index files.
+func dispatchOrder(n nzb.Nzb) []int {
+	rank := func(f nzb.File) int {
+		switch name := f.Name(); {
+		case isPar2Index(name):
+			return 0
+		case volumeName.MatchString(name):
+			return 2
+		}
+		return 1
+	}
+	order := make([]int, len(n.Files))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rank(n.Files[order[i]]) < rank(n.Files[order[j]])
+	})
+	return order
+}
+
+// damageTracker estimates the damage done to a download's recovery set by the segments which
+// failed, once it has read the recovery set from a downloaded PAR2 file.
+type damageTracker struct {
+	files []nzb.File
+	// sliceSize is the recovery set's slice size, or 0 if it isn't known yet.
+	sliceSize int64
+	// lengths maps the name of each file in the recovery set to its length.
+	lengths map[string]int64
+	// decoded marks the files whose names have been read from their articles, rather than taken
+	// from their subjects.
+	decoded map[int]bool
+	// failed holds the indices of the segments of each file which failed.
+	failed map[int][]int
+	// reported is set once the damage has been found to be unrepairable.
+	reported bool
+}
+
+func newDamageTracker(files []nzb.File) *damageTracker {
+	return &damageTracker{files: files, decoded: make(map[int]bool), failed: make(map[int][]int)}
+}
+
+// load reads the recovery set from the named PAR2 file in store. It returns false if the file
+// can't be read.
+func (d *damageTracker) load(store storage.Storage, name string) bool {
+	archive, err := par2.FromStorage(store, name)
+	if err != nil {
+		return false
+	}
+	d.install(archive)
+	return true
+}
+
+// install records the recovery set read from a PAR2 file.
+func (d *damageTracker) install(archive par2.Archive) {
+	d.lengths = make(map[string]int64)
+	for _, file := range archive.Files() {
+		d.lengths[file.Name] = int64(file.Length)
+	}
+	d.sliceSize = int64(archive.SliceSize())
+}
+
+// named records that a file's name has been read from one of its articles.
+func (d *damageTracker) named(file int) {
+	d.decoded[file] = true
+}
+
+// fail records that a segment failed.
+func (d *damageTracker) fail(file int, segment int) {
+	d.failed[file] = append(d.failed[file], segment)
+}
+
+// damage estimates the damage done by the failed segments so far, given the name of each file, and
+// whether it is known. It is only known once the recovery set has been read and what each file
+// is can be told from its name.
+//
+// A name taken from a file's subject is only trusted if it is that of a PAR2 file or a file in
+// the recovery set, as obfuscated subjects may hide a PAR2 volume, which can't be counted until
+// its real name has been read from its articles. A file which failed entirely may never be named,
+// so every slice of a file in the recovery set which no name matches is counted as damaged.
+func (d *damageTracker) damage(names []string) (Damage, bool) {
+	var damage Damage
+	for i, segments := range d.failed {
+		for _, s := range segments {
+			damage.MissingBytes += int64(d.files[i].Segments[s].Bytes)
+		}
+	}
+	if d.sliceSize == 0 {
+		return damage, false
+	}
+	matched := make(map[string]bool)
+	for i, name := range names {
+		file, failed := d.files[i], d.failed[i]
+		if blocks := recoveryBlocks(name); blocks > 0 {
+			packetSize := d.sliceSize + recoveryPacketOverhead
+			lost := min(len(covered(file, failed, int64(blocks)*packetSize, packetSize)), blocks)
+			damage.RecoverySlices += blocks - lost
+		} else if length, ok := d.lengths[name]; ok {
+			damage.DamagedSlices += len(covered(file, failed, length, d.sliceSize))
+			matched[name] = true
+		} else if !d.decoded[i] && !isPar2Index(name) && len(failed) < len(file.Segments) {
+			return damage, false
+		}
+	}
+	for name, length := range d.lengths {
+		if !matched[name] {
+			damage.DamagedSlices += int((length + d.sliceSize - 1) / d.sliceSize)
+		}
+	}
+	return damage, true
+}
+
+// covered returns the indices of the blocks of blockSize which the given segments of file overlap,
+// estimating where each segment lies in the file from its share of the file's length.
+func covered(file nzb.File, segments []int, length int64, blockSize int64) map[int64]bool {
+	blocks := make(map[int64]bool)
+	total := file.Bytes()
+	if len(segments) == 0 || total == 0 || blockSize == 0 {
+		return blocks
+	}
+	ratio := float64(length) / float64(total)
+	starts := make([]int64, len(file.Segments)+1)
+	for i, s := range file.Segments {
+		starts[i+1] = starts[i] + int64(s.Bytes)
+	}
+	for _, s := range segments {
+		start, end := float64(starts[s])*ratio, float64(starts[s+1])*ratio
+		margin := (end - start) * boundaryMargin
+		first, last := int64(start+margin)/blockSize, int64(end-margin)/blockSize
+		if last*blockSize >= length {
+			last = (length - 1) / blockSize
+		}
+		for b := first; b <= last; b++ {
+			blocks[b] = true
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,143 @@
+package downloader
+
+import (
+	"errors"
+
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/yenc"
+)
+
+// Status is what happened to a segment.
+type Status string
+
+const (
+	// Pending segments were not attempted, because the download was stopped.
+	Pending Status = ""
+	// Done segments were downloaded and written.
+	Done Status = "Done"
+	// Skipped segments had already been downloaded.
+	Skipped Status = "Skipped"
+	// Failed segments could not be downloaded from any server.
+	Failed Status = "Failed"
+)
+
+// Result is the outcome of a download.
+type Result struct {
+	// Files holds the outcome for each file in the NZB, in the same order.
+	Files []FileResult
+}
+
+// Failed returns the number of segments which could not be downloaded.
+func (r Result) Failed() int {
+	failed := 0
+	for _, f := range r.Files {
+		failed += len(f.Failed())
+	}
+	return failed
+}
+
+// Corrupt returns the number of files which were downloaded, but don't match the checksum of the
+// whole file given by their articles.
+func (r Result) Corrupt() int {
+	corrupt := 0
+	for _, f := range r.Files {
+		if errors.Is(f.Err, yenc.ErrChecksum) {
+			corrupt++
+		}
+	}
+	return corrupt
+}
+
+// Complete returns true if every segment has been downloaded.
+func (r Result) Complete() bool {
+	for _, f := range r.Files {
+		if !f.Complete() {
+			return false
+		}
+	}
+	return true
+}
+
+// FileResult is the outcome of downloading a single file.
+type FileResult struct {
+	File nzb.File
+	// Segments holds the outcome for each of the file's segments, in the same order.
+	Segments []SegmentResult
+	// Err is why the file could not be finished once its segments were, such as failing to
+	// rename it from its partial name, or why it is damaged even though they were all downloaded,
+	// such as not matching the checksum of the whole file given by its articles.
+	Err error
+}
+
+// Failed returns the segments which could not be downloaded.
+func (f FileResult) Failed() []SegmentResult {
+	var failed []SegmentResult
+	for _, s := range f.Segments {
+		if s.Status == Failed {
+			failed = append(failed, s)
+		}
+	}
+	return failed
+}
+
+// Complete returns true if every segment of the file has been downloaded, and the file finished
+// intact.
+func (f FileResult) Complete() bool {
+	if f.Err != nil {
+		return false
+	}
+	for _, s := range f.Segments {
+		if s.Status != Done && s.Status != Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+// SegmentResult is the outcome of downloading a single segment.
+type SegmentResult struct {
+	Segment nzb.Segment
+	Status  Status
+	// Server is the address of the server the segment was downloaded from, or the last one tried
+	// if it failed.
+	Server string
+	// Err is why the segment failed, from the last server tried.
+	Err error
+	// Attempts records each time the segment was requested, in order.
+	Attempts []Attempt
+}
+
+// EventType identifies what an Event reports.
+type EventType string
+
+const (
+	// ArticleRead is sent when a segment's article has been read from a server and written.
+	ArticleRead EventType = "ArticleRead"
+	// ArticleFailed is sent when a server could not provide a segment's article. Another server
+	// may still provide it.
+	ArticleFailed EventType = "ArticleFailed"
+	// SegmentDone is sent when a segment has been downloaded.
+	SegmentDone EventType = "SegmentDone"
+	// SegmentFailed is sent when a segment could not be downloaded from any server.
+	SegmentFailed EventType = "SegmentFailed"
+	// FileDone is sent once every segment of a file has finished, whether or not they failed.
+	FileDone EventType = "FileDone"
+)
+
+// An Event reports the progress of a download.
+type Event struct {
+	Type EventType
+	// File is the index of the file the event is about in the NZB.
+	File int
+	// Segment is the segment the event is about, unless it is a FileDone event.
+	Segment nzb.Segment
+	// Server is the address of the server an article was read from.
+	Server string
+	// Bytes is the number of bytes read from the server for an ArticleRead or ArticleFailed
+	// event, before decoding.
+	Bytes int64
+	// Reason classifies why an article failed.
+	Reason Reason
+	// Err is why an article or segment failed, or why a file could not be finished.
+	Err error
+}
@@ -0,0 +1,137 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/esteth/usenet/pkg/yenc"
+)
+
+// A RetryPolicy decides how often, and how quickly, segments are retried after failures which may
+// not happen again, such as timeouts.
+type RetryPolicy struct {
+	// Attempts is the most times a segment is requested from each server. Once they are used up,
+	// the next server is tried.
+	Attempts int
+	// Backoff is how long to wait before the first retry. It doubles before each retry after that.
+	Backoff time.Duration
+	// MaxBackoff is the longest to wait between retries.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetry is the RetryPolicy of downloaders which don't set one.
+var DefaultRetry = RetryPolicy{Attempts: 3, Backoff: time.Second, MaxBackoff: 30 * time.Second}
+
+// backoff returns how long to wait after the given number of failed attempts.
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < attempts && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+// A Reason classifies why an attempt to download a segment failed, which decides whether and where
+// it is retried.
+type Reason string
+
+const (
+	// Missing articles aren't on the server, so they are requested from the next server.
+	Missing Reason = "missing"
+	// Rejected requests were refused by the server for another reason, such as failing to
+	// authenticate, so the next server is tried.
+	Rejected Reason = "rejected"
+	// Timeout means the server stopped responding. The segment is retried on a new connection.
+	Timeout Reason = "timeout"
+	// ConnectionLost means the connection failed, such as by being reset. The segment is retried
+	// on a new connection.
+	ConnectionLost Reason = "connection"
+	// Truncated articles ended before their yEnc footer. They are retried on a new connection.
+	Truncated Reason = "truncated"
+	// Checksum means the article didn't match its yEnc CRC32 checksum. The server's copy is
+	// likely to be damaged, so the next server is tried.
+	Checksum Reason = "checksum"
+	// Invalid articles could not be decoded, so the next server is tried.
+	Invalid Reason = "invalid"
+	// Storage means the segment could not be written. It isn't retried, as no server can help.
+	Storage Reason = "storage"
+)
+
+// transient returns true if a failure for this reason may not happen if the segment is requested
+// from the same server again.
+func (r Reason) transient() bool {
+	return r == Timeout || r == ConnectionLost || r == Truncated
+}
+
+// Classify returns the reason for an error from downloading a segment.
+func Classify(err error) Reason {
+	var protoErr *textproto.Error
+	var netErr net.Error
+	var storageErr *storageError
+	switch {
+	case errors.As(err, &storageErr):
+		return Storage
+	case errors.Is(err, yenc.ErrChecksum):
+		return Checksum
+	case errors.Is(err, yenc.ErrTruncated):
+		return Truncated
+	case errors.As(err, &protoErr):
+		// 423 and 430 mean there is no such article, by number and by message ID.
+		if protoErr.Code == 423 || protoErr.Code == 430 {
+			return Missing
+		}
+		return Rejected
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return Timeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.As(err, &netErr):
+		return ConnectionLost
+	}
+	return Invalid
+}
+
+// An Attempt records a single request for a segment.
+type Attempt struct {
+	// Server is the address of the server the segment was requested from.
+	Server string
+	// Reason is why the attempt failed, or empty if it succeeded.
+	Reason Reason
+	Err    error
+}
+
+// storageError wraps an error from writing a segment, to tell it apart from errors reading it.
+type storageError struct {
+	err error
+}
+
+func (e *storageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *storageError) Unwrap() error {
+	return e.err
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,272 @@
+// Package feed polls indexer RSS feeds and queues releases which match filters.
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/esteth/usenet/pkg/newznab"
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/queue"
+)
+
+// DefaultInterval is how often feeds are read if no interval is configured.
+const DefaultInterval = 15 * time.Minute
+
+// grabbedRetention is how long grabbed releases are remembered. It should be
+// longer than any release stays in a feed.
+const grabbedRetention = 90 * 24 * time.Hour
+
+// An Enqueuer accepts NZBs to download. It is implemented by *daemon.Daemon.
+type Enqueuer interface {
+	Add(n nzb.Nzb, name string, category string, priority queue.Priority) (queue.Job, error)
+}
+
+// A Feed describes an RSS feed to follow.
+type Feed struct {
+	// Name identifies the feed in errors.
+	Name string `toml:"name"`
+	// URL is the address of the feed, including any API key it requires.
+	URL string `toml:"url"`
+	// Category and Priority are assigned to jobs queued from the feed.
+	Category string         `toml:"category"`
+	Priority queue.Priority `toml:"priority"`
+	// Include holds regular expressions matched case-insensitively against
+	// release titles. If any are given, a release must match at least one.
+	Include []string `toml:"include"`
+	// Exclude holds regular expressions matched case-insensitively against
+	// release titles. A release matching any of them is skipped.
+	Exclude []string `toml:"exclude"`
+	// MinSize and MaxSize bound the size of releases in bytes. Zero means no bound.
+	// Releases of unknown size are not filtered by size.
+	MinSize int64 `toml:"min_size"`
+	MaxSize int64 `toml:"max_size"`
+}
+
+// Config configures a Poller.
+type Config struct {
+	Feeds []Feed
+	// StatePath is the file releases which have been grabbed are remembered in.
+	StatePath string
+	// Interval is how often to read the feeds. Defaults to DefaultInterval.
+	Interval time.Duration
+	// Client is used to make requests. If nil, requests time out after newznab.DefaultTimeout.
+	Client *http.Client
+	// OnError, if non-nil, is called with errors encountered while polling.
+	OnError func(error)
+}
+
+// A Poller periodically reads feeds, queueing matching releases it has not grabbed before.
+type Poller struct {
+	cfg   Config
+	feeds []compiledFeed
+	queue Enqueuer
+
+	mu sync.Mutex
+	// grabbed maps the GUID of each release already queued to when it was queued.
+	grabbed map[string]time.Time
+}
+
+type compiledFeed struct {
+	Feed
+	client  *newznab.Client
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// New creates a Poller which adds releases to q, loading the record of grabbed releases from disk.
+func New(cfg Config, q Enqueuer) (*Poller, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	p := &Poller{
+		cfg:     cfg,
+		queue:   q,
+		grabbed: make(map[string]time.Time),
+	}
+	for i, f := range cfg.Feeds {
+		if f.Name == "" {
+			f.Name = fmt.Sprintf("feed %d", i+1)
+		}
+		compiled := compiledFeed{
+			Feed:   f,
+			client: newznab.NewClient(newznab.Indexer{Name: f.Name, URL: f.URL}, cfg.Client),
+		}
+		var err error
+		if compiled.include, err = CompileFilters(f.Include); err != nil {
+			return nil, fmt.Errorf("invalid include filter for %s: %w", f.Name, err)
+		}
+		if compiled.exclude, err = CompileFilters(f.Exclude); err != nil {
+			return nil, fmt.Errorf("invalid exclude filter for %s: %w", f.Name, err)
+		}
+		p.feeds = append(p.feeds, compiled)
+	}
+
+	data, err := os.ReadFile(cfg.StatePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read feed state '%s': %w", cfg.StatePath, err)
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &p.grabbed); err != nil {
+			return nil, fmt.Errorf("could not parse feed state '%s': %w", cfg.StatePath, err)
+		}
+	}
+	return p, nil
+}
+
+// CompileFilters compiles the Include or Exclude patterns of a Feed.
+func CompileFilters(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled[i] = re
+	}
+	return compiled, nil
+}
+
+// Run polls the feeds every interval until ctx is done.
+func (p *Poller) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := p.Poll(ctx); err != nil {
+			p.reportError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll reads every feed once, queueing matching releases which have not been grabbed before.
+//
+// It returns the errors encountered reading feeds or queueing releases; one
+// feed failing does not stop the others from being read.
+func (p *Poller) Poll(ctx context.Context) error {
+	var errs []error
+	for _, f := range p.feeds {
+		results, err := f.client.Feed(ctx, f.URL)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, r := range results {
+			if !f.matches(r) || p.isGrabbed(r) {
+				continue
+			}
+			if err = p.grab(ctx, f, r); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if err := p.save(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// grab queues the release r found in feed f.
+func (p *Poller) grab(ctx context.Context, f compiledFeed, r newznab.Result) error {
+	n, err := f.client.Fetch(ctx, r)
+	if err != nil {
+		return err
+	}
+	if _, err = p.queue.Add(n, r.Title, f.Category, f.Priority); err != nil {
+		return fmt.Errorf("could not queue %s: %w", r.Title, err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.grabbed[key(r)] = time.Now()
+	return nil
+}
+
+// matches returns true if r passes the feed's filters.
+func (f compiledFeed) matches(r newznab.Result) bool {
+	if len(f.include) > 0 {
+		included := false
+		for _, re := range f.include {
+			if re.MatchString(r.Title) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, re := range f.exclude {
+		if re.MatchString(r.Title) {
+			return false
+		}
+	}
+	if r.Size > 0 {
+		if f.MinSize > 0 && r.Size < f.MinSize {
+			return false
+		}
+		if f.MaxSize > 0 && r.Size > f.MaxSize {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Poller) isGrabbed(r newznab.Result) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.grabbed[key(r)]
+	return ok
+}
+
+// key identifies a release across polls.
+func key(r newznab.Result) string {
+	if r.GUID != "" {
+		return r.Indexer + "|" + r.GUID
+	}
+	return r.Indexer + "|" + r.Link
+}
+
+// save forgets releases grabbed long ago, and writes the remainder to disk.
+func (p *Poller) save() error {
+	if p.cfg.StatePath == "" {
+		return nil
+	}
+	p.mu.Lock()
+	for k, t := range p.grabbed {
+		if time.Since(t) > grabbedRetention {
+			delete(p.grabbed, k)
+		}
+	}
+	data, err := json.Marshal(p.grabbed)
+	p.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("could not serialize feed state: %w", err)
+	}
+
+	tmp := filepath.Join(filepath.Dir(p.cfg.StatePath), "."+filepath.Base(p.cfg.StatePath)+".tmp")
+	if err = os.WriteFile(tmp, data, 0666); err != nil {
+		return fmt.Errorf("could not save feed state: %w", err)
+	}
+	if err = os.Rename(tmp, p.cfg.StatePath); err != nil {
+		return fmt.Errorf("could not save feed state: %w", err)
+	}
+	return nil
+}
+
+func (p *Poller) reportError(err error) {
+	if p.cfg.OnError != nil {
+		p.cfg.OnError(err)
+	}
+}
@@ -0,0 +1,156 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/queue"
+)
+
+const testNzb = `<?xml version="1.0" encoding="utf-8"?>
+<nzb xmlns="http://www.newzbin.com/DTD/2003/nzb">
+<file subject="test"><segments><segment bytes="10" number="1">a@test</segment></segments></file>
+</nzb>`
+
+type release struct {
+	guid  string
+	title string
+	size  int64
+}
+
+// newTestFeed serves an RSS feed of the given releases, and their NZBs.
+func newTestFeed(t *testing.T, releases *[]release) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/getnzb/") {
+			w.Write([]byte(testNzb))
+			return
+		}
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:newznab="http://www.newznab.com/DTD/2010/feeds/attributes/"><channel>`)
+		for _, rel := range *releases {
+			fmt.Fprintf(w, `<item><title>%s</title><guid>%s</guid><link>%s/getnzb/%s</link>`, rel.title, rel.guid, server.URL, rel.guid)
+			if rel.size > 0 {
+				fmt.Fprintf(w, `<newznab:attr name="size" value="%d"/>`, rel.size)
+			}
+			fmt.Fprint(w, `</item>`)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+type fakeQueue struct {
+	added []string
+}
+
+func (q *fakeQueue) Add(n nzb.Nzb, name string, category string, priority queue.Priority) (queue.Job, error) {
+	q.added = append(q.added, fmt.Sprintf("%s|%s|%d", name, category, priority))
+	return queue.Job{Name: name}, nil
+}
+
+func TestFilters(t *testing.T) {
+	releases := []release{
+		{"1", "Show.S01E01.720p.WEB", 1 << 30},
+		{"2", "Show.S01E01.2160p.WEB", 8 << 30},
+		{"3", "Show.S01E01.720p.CAM", 1 << 30},
+		{"4", "Other.Show.S01E01.720p", 1 << 30},
+		{"5", "Show.S01E02.720p.WEB", 0},
+		{"6", "Show.S01E03.720p.WEB", 10 << 20},
+	}
+	server := newTestFeed(t, &releases)
+	q := &fakeQueue{}
+	p, err := New(Config{
+		Feeds: []Feed{{
+			Name:     "tv",
+			URL:      server.URL + "/rss?t=5000",
+			Category: "tv",
+			Priority: queue.High,
+			Include:  []string{`^show\.s\d+e\d+`},
+			Exclude:  []string{`\bcam\b`},
+			MinSize:  100 << 20,
+			MaxSize:  4 << 30,
+		}},
+		StatePath: filepath.Join(t.TempDir(), "feeds.json"),
+	}, q)
+	if err != nil {
+		t.Fatalf("Could not create poller: %v", err)
+	}
+
+	if err = p.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	sort.Strings(q.added)
+	expected := []string{"Show.S01E01.720p.WEB|tv|1", "Show.S01E02.720p.WEB|tv|1"}
+	if !reflect.DeepEqual(q.added, expected) {
+		t.Errorf("Expected %v to be queued, got %v", expected, q.added)
+	}
+}
+
+func TestRemembersGrabbed(t *testing.T) {
+	releases := []release{{"1", "Show.S01E01", 0}}
+	server := newTestFeed(t, &releases)
+	state := filepath.Join(t.TempDir(), "feeds.json")
+	cfg := Config{Feeds: []Feed{{Name: "all", URL: server.URL + "/rss"}}, StatePath: state}
+
+	q := &fakeQueue{}
+	p, err := New(cfg, q)
+	if err != nil {
+		t.Fatalf("Could not create poller: %v", err)
+	}
+	p.Poll(context.Background())
+	p.Poll(context.Background())
+	if len(q.added) != 1 {
+		t.Fatalf("Expected release to be grabbed once, got %v", q.added)
+	}
+
+	releases = append(releases, release{"2", "Show.S01E02", 0})
+	restarted, err := New(cfg, q)
+	if err != nil {
+		t.Fatalf("Could not recreate poller: %v", err)
+	}
+	if err = restarted.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if len(q.added) != 2 || !strings.HasPrefix(q.added[1], "Show.S01E02") {
+		t.Errorf("Expected only the new release to be grabbed after restarting, got %v", q.added)
+	}
+}
+
+func TestInvalidFilter(t *testing.T) {
+	_, err := New(Config{Feeds: []Feed{{Name: "bad", Include: []string{"("}}}}, &fakeQueue{})
+	if err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("Expected error naming feed with invalid filter, got %v", err)
+	}
+}
+
+func TestFailingFeedDoesNotStopOthers(t *testing.T) {
+	releases := []release{{"1", "Show.S01E01", 0}}
+	good := newTestFeed(t, &releases)
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+
+	q := &fakeQueue{}
+	p, err := New(Config{Feeds: []Feed{
+		{Name: "broken", URL: broken.URL + "/rss"},
+		{Name: "good", URL: good.URL + "/rss"},
+	}}, q)
+	if err != nil {
+		t.Fatalf("Could not create poller: %v", err)
+	}
+	if err = p.Poll(context.Background()); err == nil {
+		t.Errorf("Expected broken feed to be reported")
+	}
+	if len(q.added) != 1 {
+		t.Errorf("Working feed was not read: %v", q.added)
+	}
+}
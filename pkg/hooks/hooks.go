@@ -0,0 +1,248 @@
+// Package hooks runs user scripts when things happen to jobs, such as a download finishing, so
+// that they can notify media servers, rename content and so on.
+//
+// Scripts are passed details of the job both as arguments, in the same order as SABnzbd passes
+// them to its post-processing scripts, and as USENET_JOB_* environment variables.
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is how long a script may run for if its Timeout is zero.
+const DefaultTimeout = 10 * time.Minute
+
+// maxOutputLines is how many lines of a script's output are kept.
+const maxOutputLines = 50
+
+// maxOutputBytes is how much of the end of a script's output is held while it runs, to take the
+// last lines from.
+const maxOutputBytes = 64 << 10
+
+// EnvPrefix starts the name of each environment variable describing the job a script is run for.
+// Settings are never read from variables named like this, so scripts may run usenet themselves.
+const EnvPrefix = "USENET_JOB_"
+
+// An Event is something which happens to a job that scripts can be run for.
+type Event string
+
+const (
+	// Added is when a job is added to the queue.
+	Added Event = "added"
+	// Started is when a job starts downloading.
+	Started Event = "started"
+	// Finished is when a job has been downloaded and post-processed, whether or not it succeeded.
+	Finished Event = "finished"
+)
+
+// ParseEvents parses a comma-separated list of event names.
+func ParseEvents(s string) ([]Event, error) {
+	events := make([]Event, 0)
+	for _, name := range strings.Split(s, ",") {
+		switch e := Event(strings.TrimSpace(name)); e {
+		case Added, Started, Finished:
+			events = append(events, e)
+		case "":
+		default:
+			return nil, fmt.Errorf("Unknown script event '%s'", name)
+		}
+	}
+	return events, nil
+}
+
+// A Script is an executable to run when certain events happen.
+type Script struct {
+	Path string
+	// Events are the events to run the script for. If empty, it is run when jobs finish.
+	Events []Event
+	// Timeout is how long the script may run for before it is killed. If zero, DefaultTimeout is used.
+	Timeout time.Duration
+	// HideEnv names environment variables which aren't passed on to the script, such as ones
+	// holding passwords. Variables named USENET_*, which may hold settings and credentials, are
+	// never passed on.
+	HideEnv []string
+}
+
+// Handles reports whether the script should be run for event.
+func (s Script) Handles(event Event) bool {
+	if len(s.Events) == 0 {
+		return event == Finished
+	}
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Info describes the job a script is being run for.
+type Info struct {
+	Event    Event
+	ID       string
+	Name     string
+	Category string
+	// Dir is the job's final directory, or where it is being downloaded to if it has not finished.
+	Dir    string
+	Status string
+	// Par2Status and UnpackStatus are the outcomes of verifying and unpacking the job: one of
+	// "Succeeded", "Failed" or "Skipped". They are empty until the job has finished.
+	Par2Status     string
+	UnpackStatus   string
+	FailedSegments int
+	Error          string
+}
+
+// StatusCode returns the job's status as the number SABnzbd passes to its scripts: 0 if the job
+// succeeded, 1 if verification failed, 2 if unpacking failed, 3 if both failed, and -1 if it
+// failed for any other reason.
+func (i Info) StatusCode() int {
+	code := 0
+	if i.Par2Status == "Failed" {
+		code |= 1
+	}
+	if i.UnpackStatus == "Failed" {
+		code |= 2
+	}
+	if code == 0 && i.Error != "" {
+		code = -1
+	}
+	return code
+}
+
+// args returns the script's arguments: the final directory, the NZB name, the job name, the
+// indexer report number (always empty), the category, the newsgroup (always empty) and the
+// status code.
+func (i Info) args() []string {
+	return []string{i.Dir, i.Name + ".nzb", i.Name, "", i.Category, "", strconv.Itoa(i.StatusCode())}
+}
+
+func (i Info) environ() []string {
+	return []string{
+		EnvPrefix + "EVENT=" + string(i.Event),
+		EnvPrefix + "ID=" + i.ID,
+		EnvPrefix + "NZB_NAME=" + i.Name + ".nzb",
+		EnvPrefix + "NAME=" + i.Name,
+		EnvPrefix + "CATEGORY=" + i.Category,
+		EnvPrefix + "DIRECTORY=" + i.Dir,
+		EnvPrefix + "STATUS=" + i.Status,
+		EnvPrefix + "STATUS_CODE=" + strconv.Itoa(i.StatusCode()),
+		EnvPrefix + "PAR2_STATUS=" + i.Par2Status,
+		EnvPrefix + "UNPACK_STATUS=" + i.UnpackStatus,
+		EnvPrefix + "FAILED_SEGMENTS=" + strconv.Itoa(i.FailedSegments),
+		EnvPrefix + "ERROR=" + i.Error,
+	}
+}
+
+// A Result records the outcome of running a script.
+type Result struct {
+	Script string
+	Event  Event
+	// ExitCode is the script's exit code, or -1 if it could not be run or was killed.
+	ExitCode int
+	// Output is the last lines written by the script to stdout and stderr.
+	Output   []string
+	Started  time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// Run runs the script for the job described by info, waiting for it to exit.
+func (s Script) Run(ctx context.Context, info Info) Result {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	output := tailBuffer{max: maxOutputBytes}
+	cmd := exec.CommandContext(ctx, s.Path, info.args()...)
+	cmd.Env = s.environ(info)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Don't wait forever for output from processes the script left running in the background.
+	cmd.WaitDelay = time.Second
+	if st, err := os.Stat(info.Dir); err == nil && st.IsDir() {
+		cmd.Dir = info.Dir
+	}
+
+	result := Result{Script: s.Path, Event: info.Event, ExitCode: -1, Started: time.Now()}
+	err := cmd.Run()
+	result.Duration = time.Since(result.Started)
+	result.Output = lastLines(output.String(), maxOutputLines)
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("Script timed out after %v", timeout)
+	}
+	if err != nil {
+		result.Err = fmt.Errorf("Could not run %s: %w", s.Path, err)
+	}
+	return result
+}
+
+// environ returns the environment to run the script in: that of this process, without the
+// variables which may hold its settings and credentials, followed by the details of the job.
+func (s Script) environ(info Info) []string {
+	var env []string
+	for _, v := range os.Environ() {
+		name, _, _ := strings.Cut(v, "=")
+		if strings.HasPrefix(name, "USENET_") || slices.Contains(s.HideEnv, name) {
+			continue
+		}
+		env = append(env, v)
+	}
+	return append(env, info.environ()...)
+}
+
+// tailBuffer is an io.Writer which keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+	// truncated is set once anything has been dropped from the start.
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > b.max {
+		p = p[len(p)-b.max:]
+		b.buf, b.truncated = b.buf[:0], true
+	}
+	if over := len(b.buf) + len(p) - b.max; over > 0 {
+		b.buf, b.truncated = append(b.buf[:0], b.buf[over:]...), true
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+// String returns what has been kept, without the first line if only the end of it was.
+func (b *tailBuffer) String() string {
+	s := string(b.buf)
+	if _, rest, ok := strings.Cut(s, "\n"); ok && b.truncated {
+		s = rest
+	}
+	return s
+}
+
+// lastLines returns the last n lines of s, ignoring any newlines at its end.
+func lastLines(s string, n int) []string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
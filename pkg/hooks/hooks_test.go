@@ -0,0 +1,138 @@
+package hooks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, body string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("Scripts are shell scripts")
+	}
+	path := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatalf("Could not write script: %v", err)
+	}
+	return path
+}
+
+func TestRunPassesJobDetails(t *testing.T) {
+	script := Script{Path: writeScript(t, `echo "$1|$2|$5|$7"
+echo "$USENET_JOB_CATEGORY|$USENET_JOB_PAR2_STATUS|$USENET_JOB_FAILED_SEGMENTS"
+exit 3
+`)}
+	dir := t.TempDir()
+	result := script.Run(context.Background(), Info{
+		Event:          Finished,
+		Name:           "release",
+		Category:       "tv",
+		Dir:            dir,
+		Par2Status:     "Failed",
+		FailedSegments: 4,
+	})
+	if result.ExitCode != 3 || result.Err == nil {
+		t.Errorf("Expected exit code 3 and an error, got %d, %v", result.ExitCode, result.Err)
+	}
+	expected := []string{dir + "|release.nzb|tv|1", "tv|Failed|4"}
+	if !reflect.DeepEqual(result.Output, expected) {
+		t.Errorf("Script output %q, expected %q", result.Output, expected)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	script := Script{Path: writeScript(t, "sleep 10\n"), Timeout: 100 * time.Millisecond}
+	started := time.Now()
+	result := script.Run(context.Background(), Info{})
+	if result.Err == nil || result.ExitCode != -1 {
+		t.Errorf("Expected the script to be killed, got %d, %v", result.ExitCode, result.Err)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("Script was not killed after its timeout")
+	}
+}
+
+func TestRunHidesCredentials(t *testing.T) {
+	t.Setenv("USENET_SERVERS_0_PASSWORD", "secret")
+	t.Setenv("NEWS_PASSWORD", "secret")
+	t.Setenv("HOOKS_TEST_VISIBLE", "visible")
+	script := Script{
+		Path:    writeScript(t, `echo "$USENET_SERVERS_0_PASSWORD|$NEWS_PASSWORD|$HOOKS_TEST_VISIBLE|$USENET_JOB_NAME"`+"\n"),
+		HideEnv: []string{"NEWS_PASSWORD"},
+	}
+	result := script.Run(context.Background(), Info{Name: "release"})
+	if expected := []string{"||visible|release"}; !reflect.DeepEqual(result.Output, expected) {
+		t.Errorf("Script output %q, expected %q", result.Output, expected)
+	}
+}
+
+func TestRunKeepsEndOfLongOutput(t *testing.T) {
+	// The script writes far more than is kept, ending with numbered lines.
+	script := Script{Path: writeScript(t, `head -c 1000000 /dev/zero | tr '\0' x
+echo
+i=0
+while [ $i -lt 60 ]; do echo "line $i"; i=$((i+1)); done
+`)}
+	result := script.Run(context.Background(), Info{})
+	if result.Err != nil {
+		t.Fatalf("Could not run script: %v", result.Err)
+	}
+	if len(result.Output) != maxOutputLines || result.Output[0] != "line 10" || result.Output[maxOutputLines-1] != "line 59" {
+		t.Errorf("Unexpected output %q", result.Output)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := tailBuffer{max: 10}
+	b.Write([]byte("first\nsec"))
+	if b.String() != "first\nsec" {
+		t.Errorf("Unexpected contents %q", b.String())
+	}
+	// Once the start is dropped, the partial line left at the start is too.
+	b.Write([]byte("ond\nthird"))
+	if b.String() != "third" {
+		t.Errorf("Unexpected contents %q", b.String())
+	}
+	b.Write([]byte("a line longer than the buffer"))
+	if b.String() != "the buffer" {
+		t.Errorf("Unexpected contents %q", b.String())
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	for _, test := range []struct {
+		info Info
+		code int
+	}{
+		{Info{Par2Status: "Succeeded", UnpackStatus: "Succeeded"}, 0},
+		{Info{Par2Status: "Failed", UnpackStatus: "Skipped", Error: "broken"}, 1},
+		{Info{Par2Status: "Succeeded", UnpackStatus: "Failed", Error: "broken"}, 2},
+		{Info{Par2Status: "Failed", UnpackStatus: "Failed"}, 3},
+		{Info{Error: "3 of 10 segments could not be downloaded"}, -1},
+	} {
+		if code := test.info.StatusCode(); code != test.code {
+			t.Errorf("Status code of %+v was %d, expected %d", test.info, code, test.code)
+		}
+	}
+}
+
+func TestHandles(t *testing.T) {
+	if !(Script{}).Handles(Finished) || (Script{}).Handles(Added) {
+		t.Errorf("Scripts without events should only handle Finished")
+	}
+	events, err := ParseEvents("added, started")
+	if err != nil {
+		t.Fatalf("Could not parse events: %v", err)
+	}
+	s := Script{Events: events}
+	if !s.Handles(Added) || !s.Handles(Started) || s.Handles(Finished) {
+		t.Errorf("Script with events %v handled the wrong events", events)
+	}
+	if _, err := ParseEvents("added,deleted"); err == nil {
+		t.Errorf("Expected an unknown event to be rejected")
+	}
+}
@@ -0,0 +1,55 @@
+// Package logging defines the Logger the library packages write diagnostics to, and builds
+// log/slog loggers for the commands.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// A Logger records leveled, structured diagnostics. args are alternating keys and values, as
+// with log/slog, and *slog.Logger satisfies this interface.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Discard is a Logger which ignores everything written to it.
+var Discard Logger = slog.New(discardHandler{})
+
+// OrDiscard returns l, or Discard if l is nil, so that loggers can be left unset.
+func OrDiscard(l Logger) Logger {
+	if l == nil {
+		return Discard
+	}
+	return l
+}
+
+// New creates a logger writing records at level and above to w. format is "text" or "json",
+// and level is one of "debug", "info", "warn" or "error".
+func New(w io.Writer, format string, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("Unknown log level '%s'", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("Unknown log format '%s'", format)
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestNewJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "info")
+	if err != nil {
+		t.Fatalf("Could not create logger: %v", err)
+	}
+	logger.Debug("hidden")
+	logger.Info("shown", "job", "1")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "shown" || record["job"] != "1" || record["level"] != "INFO" {
+		t.Errorf("Unexpected record %v", record)
+	}
+}
+
+func TestNewRejectsUnknownOptions(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Errorf("Expected an unknown format to be rejected")
+	}
+	if _, err := New(&bytes.Buffer{}, "text", "loud"); err == nil {
+		t.Errorf("Expected an unknown level to be rejected")
+	}
+}
+
+func TestOrDiscard(t *testing.T) {
+	// Logging to a nil logger's replacement must not panic.
+	OrDiscard(nil).Error("ignored", "key", "value")
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_bytes_total", "Bytes read.", "server")
+	c.Add(100, "news.example.com")
+	c.Inc("other \"quoted\"")
+	c.Add(50, "news.example.com")
+	g := r.NewGauge("test_connections", "Open connections.")
+	g.Set(3)
+	h := r.NewHistogram("test_duration_seconds", "How long it took.", []float64{1, 10}, "stage")
+	h.Observe(0.5, "verify")
+	h.Observe(5, "verify")
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatalf("Could not write metrics: %v", err)
+	}
+	expected := `# HELP test_bytes_total Bytes read.
+# TYPE test_bytes_total counter
+test_bytes_total{server="news.example.com"} 150
+test_bytes_total{server="other \"quoted\""} 1
+# HELP test_connections Open connections.
+# TYPE test_connections gauge
+test_connections 3
+# HELP test_duration_seconds How long it took.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{stage="verify",le="1"} 1
+test_duration_seconds_bucket{stage="verify",le="10"} 2
+test_duration_seconds_bucket{stage="verify",le="+Inf"} 2
+test_duration_seconds_sum{stage="verify"} 5.5
+test_duration_seconds_count{stage="verify"} 2
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "A test.").Inc()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %s", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "test_total 1\n") {
+		t.Errorf("Metric missing from response: %s", w.Body.String())
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected giving the wrong number of label values to panic")
+		}
+	}()
+	NewRegistry().NewCounter("test_total", "A test.", "server").Inc()
+}
@@ -0,0 +1,545 @@
+// Package newznab implements a client for the Newznab indexer API.
+package newznab
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esteth/usenet/pkg/nzb"
+)
+
+// maxResponseSize is the largest response accepted from an indexer.
+const maxResponseSize = 64 << 20
+
+// DefaultTimeout is how long a request to an indexer may take, including reading its response,
+// unless NewClient is given an http.Client of its own.
+const DefaultTimeout = time.Minute
+
+// defaultClient is used by clients which aren't given one, so that an indexer which stops
+// responding can't hold up its caller forever.
+var defaultClient = &http.Client{Timeout: DefaultTimeout}
+
+// An Indexer describes a Newznab indexer.
+type Indexer struct {
+	// Name identifies the indexer in results and errors.
+	Name string
+	// URL is the base URL of the indexer. Requests are made to URL + "/api".
+	URL string
+	// APIKey is sent with every request.
+	APIKey string
+}
+
+// A Client makes requests to a single Newznab indexer.
+type Client struct {
+	indexer Indexer
+	http    *http.Client
+}
+
+// NewClient creates a client for the given indexer. If httpClient is nil, a client whose requests
+// time out after DefaultTimeout is used.
+func NewClient(indexer Indexer, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = defaultClient
+	}
+	if indexer.Name == "" {
+		indexer.Name = indexer.URL
+	}
+	return &Client{indexer: indexer, http: httpClient}
+}
+
+// Indexer returns the indexer the client makes requests to.
+func (c *Client) Indexer() Indexer {
+	return c.indexer
+}
+
+// An Error is an error reported by the indexer.
+type Error struct {
+	Code        int    `xml:"code,attr"`
+	Description string `xml:"description,attr"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("newznab error %d: %s", e.Code, e.Description)
+}
+
+// A Query is a free text search.
+type Query struct {
+	// Q is the text to search for.
+	Q string
+	// Categories restricts results to the given category IDs.
+	Categories []int
+	// Limit is the maximum number of results to return. The indexer's default is used if zero.
+	Limit int
+	// Offset skips the given number of results, for paging.
+	Offset int
+}
+
+func (q Query) values() url.Values {
+	v := url.Values{}
+	if q.Q != "" {
+		v.Set("q", q.Q)
+	}
+	if len(q.Categories) > 0 {
+		cats := make([]string, len(q.Categories))
+		for i, c := range q.Categories {
+			cats[i] = strconv.Itoa(c)
+		}
+		v.Set("cat", strings.Join(cats, ","))
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Offset > 0 {
+		v.Set("offset", strconv.Itoa(q.Offset))
+	}
+	return v
+}
+
+// A TVQuery searches for TV episodes.
+type TVQuery struct {
+	Query
+	Season  string
+	Episode string
+	// TVDBID, TVMazeID, RageID and IMDBID identify the show on the respective sites.
+	TVDBID   string
+	TVMazeID string
+	RageID   string
+	IMDBID   string
+}
+
+func (q TVQuery) values() url.Values {
+	v := q.Query.values()
+	setIfPresent(v, "season", q.Season)
+	setIfPresent(v, "ep", q.Episode)
+	setIfPresent(v, "tvdbid", q.TVDBID)
+	setIfPresent(v, "tvmazeid", q.TVMazeID)
+	setIfPresent(v, "rid", q.RageID)
+	setIfPresent(v, "imdbid", q.IMDBID)
+	return v
+}
+
+// A MovieQuery searches for movies.
+type MovieQuery struct {
+	Query
+	// IMDBID identifies the movie on IMDb, without the leading "tt".
+	IMDBID string
+}
+
+func (q MovieQuery) values() url.Values {
+	v := q.Query.values()
+	setIfPresent(v, "imdbid", strings.TrimPrefix(q.IMDBID, "tt"))
+	return v
+}
+
+func setIfPresent(v url.Values, key string, value string) {
+	if value != "" {
+		v.Set(key, value)
+	}
+}
+
+// A Result is a single release returned by a search or feed.
+type Result struct {
+	// Indexer is the name of the indexer which returned the result.
+	Indexer string
+	Title   string
+	// GUID uniquely identifies the result on its indexer.
+	GUID string
+	// Link is the URL to download the result's NZB from.
+	Link     string
+	Comments string
+	PubDate  time.Time
+	// Size is the size of the release in bytes, or 0 if unknown.
+	Size       int64
+	Categories []int
+	// Attrs holds all newznab:attr values of the result. Attributes which
+	// appear multiple times, such as "category", hold the first value.
+	Attrs map[string]string
+}
+
+// Search performs a free text search.
+func (c *Client) Search(ctx context.Context, q Query) ([]Result, error) {
+	return c.search(ctx, "search", q.values())
+}
+
+// TVSearch searches for TV episodes.
+func (c *Client) TVSearch(ctx context.Context, q TVQuery) ([]Result, error) {
+	return c.search(ctx, "tvsearch", q.values())
+}
+
+// MovieSearch searches for movies.
+func (c *Client) MovieSearch(ctx context.Context, q MovieQuery) ([]Result, error) {
+	return c.search(ctx, "movie", q.values())
+}
+
+func (c *Client) search(ctx context.Context, function string, params url.Values) ([]Result, error) {
+	body, err := c.call(ctx, function, params)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	results, err := ParseFeed(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s results from %s: %w", function, c.indexer.Name, err)
+	}
+	for i := range results {
+		results[i].Indexer = c.indexer.Name
+	}
+	return results, nil
+}
+
+// Feed reads the RSS feed at feedURL, which is usually an indexer's /rss endpoint.
+func (c *Client) Feed(ctx context.Context, feedURL string) ([]Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid feed URL for %s: %w", c.indexer.Name, redact(err))
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	results, err := ParseFeed(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse feed from %s: %w", c.indexer.Name, err)
+	}
+	for i := range results {
+		results[i].Indexer = c.indexer.Name
+	}
+	return results, nil
+}
+
+// Get downloads the NZB of the result with the given GUID.
+func (c *Client) Get(ctx context.Context, guid string) (nzb.Nzb, error) {
+	body, err := c.call(ctx, "get", url.Values{"id": {guid}})
+	if err != nil {
+		return nzb.Nzb{}, err
+	}
+	defer body.Close()
+	n, err := nzb.FromReader(body)
+	if err != nil {
+		return nzb.Nzb{}, fmt.Errorf("could not parse NZB %s from %s: %w", guid, c.indexer.Name, err)
+	}
+	return n, nil
+}
+
+// Fetch downloads the NZB of a result, from its link if it has one.
+func (c *Client) Fetch(ctx context.Context, r Result) (nzb.Nzb, error) {
+	if r.Link == "" {
+		return c.Get(ctx, r.GUID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.Link, nil)
+	if err != nil {
+		return nzb.Nzb{}, fmt.Errorf("invalid link for %s: %w", r.Title, redact(err))
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return nzb.Nzb{}, err
+	}
+	defer body.Close()
+	n, err := nzb.FromReader(body)
+	if err != nil {
+		return nzb.Nzb{}, fmt.Errorf("could not parse NZB for %s from %s: %w", r.Title, c.indexer.Name, err)
+	}
+	return n, nil
+}
+
+// call makes an API request for the given function, returning the response body.
+func (c *Client) call(ctx context.Context, function string, params url.Values) (io.ReadCloser, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.indexer.URL, "/") + "/api")
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL for indexer %s: %w", c.indexer.Name, err)
+	}
+	params.Set("t", function)
+	if c.indexer.APIKey != "" {
+		params.Set("apikey", c.indexer.APIKey)
+	}
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request to %s: %w", c.indexer.Name, redact(err))
+	}
+	return c.do(req)
+}
+
+// do sends req, returning the response body if the indexer did not report an error.
+func (c *Client) do(req *http.Request) (io.ReadCloser, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %w", c.indexer.Name, redact(err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("request to %s failed: %s", c.indexer.Name, resp.Status)
+	}
+
+	// Errors are reported with a 200 status and an <error> document, so peek at the body.
+	body := struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, maxResponseSize), resp.Body}
+	peeked := make([]byte, 512)
+	n, err := io.ReadFull(body, peeked)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not read response from %s: %w", c.indexer.Name, err)
+	}
+	peeked = peeked[:n]
+	if apiErr := parseError(peeked); apiErr != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("request to %s failed: %w", c.indexer.Name, apiErr)
+	}
+	body.Reader = io.MultiReader(bytes.NewReader(peeked), body.Reader)
+	return body, nil
+}
+
+// parseError returns the error described by the start of a response, or nil if it is not an error document.
+func parseError(start []byte) *Error {
+	decoder := xml.NewDecoder(bytes.NewReader(start))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		if element, ok := token.(xml.StartElement); ok {
+			if element.Name.Local != "error" {
+				return nil
+			}
+			apiErr := &Error{}
+			for _, attr := range element.Attr {
+				switch attr.Name.Local {
+				case "code":
+					apiErr.Code, _ = strconv.Atoi(attr.Value)
+				case "description":
+					apiErr.Description = attr.Value
+				}
+			}
+			return apiErr
+		}
+	}
+}
+
+// redact removes query parameters, which may contain the API key, from URL errors.
+func redact(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		redacted := *urlErr
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+			u.RawQuery = ""
+			redacted.URL = u.String()
+		} else {
+			redacted.URL = ""
+		}
+		return &redacted
+	}
+	return err
+}
+
+// rss is the structure of a Newznab results feed.
+type rss struct {
+	Channel struct {
+		Items []item `xml:"item"`
+	} `xml:"channel"`
+}
+
+type item struct {
+	Title      string   `xml:"title"`
+	GUID       string   `xml:"guid"`
+	Link       string   `xml:"link"`
+	Comments   string   `xml:"comments"`
+	PubDate    string   `xml:"pubDate"`
+	Categories []string `xml:"category"`
+	Enclosure  struct {
+		URL    string `xml:"url,attr"`
+		Length int64  `xml:"length,attr"`
+	} `xml:"enclosure"`
+	Attrs []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:"attr"`
+}
+
+// ParseFeed parses a Newznab RSS document, as returned by searches and RSS feeds.
+func ParseFeed(r io.Reader) ([]Result, error) {
+	var feed rss
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	if err := decoder.Decode(&feed); err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, 0, len(feed.Channel.Items))
+	for _, it := range feed.Channel.Items {
+		result := Result{
+			Title:    strings.TrimSpace(it.Title),
+			GUID:     strings.TrimSpace(it.GUID),
+			Link:     strings.TrimSpace(it.Link),
+			Comments: strings.TrimSpace(it.Comments),
+			Size:     it.Enclosure.Length,
+			Attrs:    make(map[string]string, len(it.Attrs)),
+		}
+		if it.Enclosure.URL != "" {
+			result.Link = it.Enclosure.URL
+		}
+		if t, err := time.Parse(time.RFC1123Z, strings.TrimSpace(it.PubDate)); err == nil {
+			result.PubDate = t
+		} else if t, err = time.Parse(time.RFC1123, strings.TrimSpace(it.PubDate)); err == nil {
+			result.PubDate = t
+		}
+		for _, attr := range it.Attrs {
+			if _, exists := result.Attrs[attr.Name]; !exists {
+				result.Attrs[attr.Name] = attr.Value
+			}
+			switch attr.Name {
+			case "size":
+				if size, err := strconv.ParseInt(attr.Value, 10, 64); err == nil {
+					result.Size = size
+				}
+			case "category":
+				if cat, err := strconv.Atoi(attr.Value); err == nil {
+					result.Categories = append(result.Categories, cat)
+				}
+			case "guid":
+				result.GUID = attr.Value
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// A Category is a category of results supported by an indexer.
+type Category struct {
+	ID            int        `xml:"id,attr"`
+	Name          string     `xml:"name,attr"`
+	Subcategories []Category `xml:"subcat"`
+}
+
+// A SearchCapability describes whether a type of search is supported.
+type SearchCapability struct {
+	Available       bool
+	SupportedParams []string
+}
+
+// Caps describes the capabilities of an indexer.
+type Caps struct {
+	// MaxLimit and DefaultLimit are the maximum and default number of results per search.
+	MaxLimit     int
+	DefaultLimit int
+	Search       SearchCapability
+	TVSearch     SearchCapability
+	MovieSearch  SearchCapability
+	Categories   []Category
+}
+
+type capsDocument struct {
+	Limits struct {
+		Max     int `xml:"max,attr"`
+		Default int `xml:"default,attr"`
+	} `xml:"limits"`
+	Searching struct {
+		Search      searchingDocument `xml:"search"`
+		TVSearch    searchingDocument `xml:"tv-search"`
+		MovieSearch searchingDocument `xml:"movie-search"`
+	} `xml:"searching"`
+	Categories []Category `xml:"categories>category"`
+}
+
+type searchingDocument struct {
+	Available       string `xml:"available,attr"`
+	SupportedParams string `xml:"supportedParams,attr"`
+}
+
+func (s searchingDocument) capability() SearchCapability {
+	c := SearchCapability{Available: s.Available == "yes"}
+	if s.SupportedParams != "" {
+		c.SupportedParams = strings.Split(s.SupportedParams, ",")
+	}
+	return c
+}
+
+// Caps returns the capabilities of the indexer.
+func (c *Client) Caps(ctx context.Context) (Caps, error) {
+	body, err := c.call(ctx, "caps", url.Values{})
+	if err != nil {
+		return Caps{}, err
+	}
+	defer body.Close()
+	var doc capsDocument
+	if err = xml.NewDecoder(body).Decode(&doc); err != nil {
+		return Caps{}, fmt.Errorf("could not parse caps from %s: %w", c.indexer.Name, err)
+	}
+	return Caps{
+		MaxLimit:     doc.Limits.Max,
+		DefaultLimit: doc.Limits.Default,
+		Search:       doc.Searching.Search.capability(),
+		TVSearch:     doc.Searching.TVSearch.capability(),
+		MovieSearch:  doc.Searching.MovieSearch.capability(),
+		Categories:   doc.Categories,
+	}, nil
+}
+
+// Multi searches several indexers at once.
+type Multi []*Client
+
+// Search performs a free text search on every indexer, returning the combined
+// results, newest first.
+//
+// If some indexers fail, the results from the others are returned along with
+// an error describing the failures.
+func (m Multi) Search(ctx context.Context, q Query) ([]Result, error) {
+	return m.each(func(c *Client) ([]Result, error) { return c.Search(ctx, q) })
+}
+
+// TVSearch searches for TV episodes on every indexer, as with Search.
+func (m Multi) TVSearch(ctx context.Context, q TVQuery) ([]Result, error) {
+	return m.each(func(c *Client) ([]Result, error) { return c.TVSearch(ctx, q) })
+}
+
+// MovieSearch searches for movies on every indexer, as with Search.
+func (m Multi) MovieSearch(ctx context.Context, q MovieQuery) ([]Result, error) {
+	return m.each(func(c *Client) ([]Result, error) { return c.MovieSearch(ctx, q) })
+}
+
+// Fetch downloads the NZB of a result from the indexer which returned it.
+func (m Multi) Fetch(ctx context.Context, r Result) (nzb.Nzb, error) {
+	for _, c := range m {
+		if c.indexer.Name == r.Indexer {
+			return c.Fetch(ctx, r)
+		}
+	}
+	return nzb.Nzb{}, fmt.Errorf("unknown indexer '%s'", r.Indexer)
+}
+
+func (m Multi) each(search func(*Client) ([]Result, error)) ([]Result, error) {
+	var wg sync.WaitGroup
+	results := make([][]Result, len(m))
+	errs := make([]error, len(m))
+	for i, c := range m {
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+			results[i], errs[i] = search(c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	combined := make([]Result, 0)
+	for _, r := range results {
+		combined = append(combined, r...)
+	}
+	sort.SliceStable(combined, func(i, j int) bool {
+		return combined[i].PubDate.After(combined[j].PubDate)
+	})
+	return combined, errors.Join(errs...)
+}
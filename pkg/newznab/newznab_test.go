@@ -0,0 +1,254 @@
+package newznab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom" xmlns:newznab="http://www.newznab.com/DTD/2010/feeds/attributes/">
+<channel>
+<title>test indexer</title>
+<item>
+  <title>Show.S01E02.720p</title>
+  <guid isPermaLink="true">https://indexer.test/details/abc123</guid>
+  <link>%[1]s/getnzb/abc123.nzb</link>
+  <comments>https://indexer.test/details/abc123#comments</comments>
+  <pubDate>Tue, 02 Jan 2024 15:04:05 +0000</pubDate>
+  <category>TV &gt; HD</category>
+  <enclosure url="%[1]s/getnzb/abc123.nzb" length="1234567" type="application/x-nzb"/>
+  <newznab:attr name="category" value="5000"/>
+  <newznab:attr name="category" value="5040"/>
+  <newznab:attr name="size" value="1234567"/>
+  <newznab:attr name="guid" value="abc123"/>
+  <newznab:attr name="season" value="S01"/>
+</item>
+<item>
+  <title>Show.S01E01.720p</title>
+  <guid isPermaLink="false">def456</guid>
+  <link>%[1]s/getnzb/def456.nzb</link>
+  <pubDate>Mon, 01 Jan 2024 15:04:05 +0000</pubDate>
+  <enclosure url="%[1]s/getnzb/def456.nzb" length="7654321" type="application/x-nzb"/>
+</item>
+</channel>
+</rss>`
+
+const testCaps = `<?xml version="1.0" encoding="UTF-8"?>
+<caps>
+  <server version="1.0" title="test"/>
+  <limits max="100" default="50"/>
+  <searching>
+    <search available="yes" supportedParams="q"/>
+    <tv-search available="yes" supportedParams="q,season,ep,tvdbid"/>
+    <movie-search available="no" supportedParams="q,imdbid"/>
+  </searching>
+  <categories>
+    <category id="5000" name="TV">
+      <subcat id="5040" name="HD"/>
+    </category>
+  </categories>
+</caps>`
+
+const testNzb = `<?xml version="1.0" encoding="utf-8"?>
+<nzb xmlns="http://www.newzbin.com/DTD/2003/nzb">
+<file subject="test"><segments><segment bytes="10" number="1">a@test</segment></segments></file>
+</nzb>`
+
+// newTestIndexer starts a fake indexer, recording the query parameters of each API request.
+func newTestIndexer(t *testing.T, apiKey string, requests *[]map[string]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/getnzb/") {
+			w.Write([]byte(testNzb))
+			return
+		}
+		params := make(map[string]string)
+		for key := range r.URL.Query() {
+			params[key] = r.URL.Query().Get(key)
+		}
+		if requests != nil {
+			*requests = append(*requests, params)
+		}
+		if params["apikey"] != apiKey {
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><error code="100" description="Incorrect user credentials"/>`))
+			return
+		}
+		switch params["t"] {
+		case "caps":
+			w.Write([]byte(testCaps))
+		case "search", "tvsearch", "movie":
+			fmt.Fprintf(w, testFeed, server.URL)
+		case "get":
+			w.Write([]byte(testNzb))
+		default:
+			w.Write([]byte(`<error code="202" description="No such function"/>`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSearch(t *testing.T) {
+	var requests []map[string]string
+	server := newTestIndexer(t, "key", &requests)
+	client := NewClient(Indexer{Name: "test", URL: server.URL, APIKey: "key"}, nil)
+
+	results, err := client.Search(context.Background(), Query{Q: "show", Categories: []int{5000, 5040}, Limit: 10})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	expectedParams := map[string]string{"t": "search", "q": "show", "cat": "5000,5040", "limit": "10", "apikey": "key"}
+	if !reflect.DeepEqual(requests[0], expectedParams) {
+		t.Errorf("Unexpected request parameters: %v", requests[0])
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	r := results[0]
+	if r.Indexer != "test" || r.Title != "Show.S01E02.720p" || r.GUID != "abc123" || r.Size != 1234567 {
+		t.Errorf("Unexpected result: %+v", r)
+	}
+	if r.Link != server.URL+"/getnzb/abc123.nzb" {
+		t.Errorf("Unexpected link: %s", r.Link)
+	}
+	if !reflect.DeepEqual(r.Categories, []int{5000, 5040}) || r.Attrs["season"] != "S01" {
+		t.Errorf("Unexpected attributes: %v, %v", r.Categories, r.Attrs)
+	}
+	if r.PubDate.Year() != 2024 || r.PubDate.Day() != 2 {
+		t.Errorf("Unexpected publish date: %v", r.PubDate)
+	}
+	if results[1].GUID != "def456" || results[1].Size != 7654321 {
+		t.Errorf("Result without attributes not parsed from standard RSS fields: %+v", results[1])
+	}
+}
+
+func TestTVAndMovieSearchParameters(t *testing.T) {
+	var requests []map[string]string
+	server := newTestIndexer(t, "key", &requests)
+	client := NewClient(Indexer{URL: server.URL, APIKey: "key"}, nil)
+
+	if _, err := client.TVSearch(context.Background(), TVQuery{Query: Query{Q: "show"}, Season: "1", Episode: "2", TVDBID: "1234"}); err != nil {
+		t.Fatalf("TV search failed: %v", err)
+	}
+	if _, err := client.MovieSearch(context.Background(), MovieQuery{IMDBID: "tt0111161"}); err != nil {
+		t.Fatalf("Movie search failed: %v", err)
+	}
+
+	expected := []map[string]string{
+		{"t": "tvsearch", "q": "show", "season": "1", "ep": "2", "tvdbid": "1234", "apikey": "key"},
+		{"t": "movie", "imdbid": "0111161", "apikey": "key"},
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("Unexpected request parameters: %v", requests)
+	}
+}
+
+func TestCaps(t *testing.T) {
+	server := newTestIndexer(t, "key", nil)
+	client := NewClient(Indexer{URL: server.URL, APIKey: "key"}, nil)
+
+	caps, err := client.Caps(context.Background())
+	if err != nil {
+		t.Fatalf("Caps failed: %v", err)
+	}
+	if caps.MaxLimit != 100 || caps.DefaultLimit != 50 {
+		t.Errorf("Unexpected limits: %+v", caps)
+	}
+	if !caps.TVSearch.Available || caps.MovieSearch.Available {
+		t.Errorf("Unexpected search availability: %+v", caps)
+	}
+	if !reflect.DeepEqual(caps.TVSearch.SupportedParams, []string{"q", "season", "ep", "tvdbid"}) {
+		t.Errorf("Unexpected supported params: %v", caps.TVSearch.SupportedParams)
+	}
+	if len(caps.Categories) != 1 || caps.Categories[0].Subcategories[0].ID != 5040 {
+		t.Errorf("Unexpected categories: %+v", caps.Categories)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	server := newTestIndexer(t, "key", nil)
+	client := NewClient(Indexer{URL: server.URL, APIKey: "wrong"}, nil)
+
+	_, err := client.Search(context.Background(), Query{Q: "show"})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != 100 {
+		t.Fatalf("Expected newznab error 100, got %v", err)
+	}
+	if strings.Contains(err.Error(), "wrong") {
+		t.Errorf("Error message contains API key: %v", err)
+	}
+}
+
+func TestConnectionErrorRedactsKey(t *testing.T) {
+	server := newTestIndexer(t, "secret", nil)
+	server.Close()
+	client := NewClient(Indexer{URL: server.URL, APIKey: "secret"}, nil)
+
+	_, err := client.Search(context.Background(), Query{Q: "show"})
+	if err == nil {
+		t.Fatalf("Expected request to closed server to fail")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("Error message contains API key: %v", err)
+	}
+}
+
+func TestDefaultClientTimesOut(t *testing.T) {
+	if timeout := NewClient(Indexer{URL: "http://indexer.example"}, nil).http.Timeout; timeout != DefaultTimeout {
+		t.Errorf("Expected requests to time out after %v, got %v", DefaultTimeout, timeout)
+	}
+}
+
+func TestGetAndFetch(t *testing.T) {
+	server := newTestIndexer(t, "key", nil)
+	client := NewClient(Indexer{URL: server.URL, APIKey: "key"}, nil)
+
+	n, err := client.Get(context.Background(), "abc123")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if len(n.Files) != 1 || n.Files[0].Segments[0].ID != "a@test" {
+		t.Errorf("Unexpected NZB: %+v", n)
+	}
+
+	results, err := client.Search(context.Background(), Query{Q: "show"})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if n, err = client.Fetch(context.Background(), results[0]); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(n.Files) != 1 {
+		t.Errorf("Unexpected NZB: %+v", n)
+	}
+}
+
+func TestMultiSearch(t *testing.T) {
+	good := newTestIndexer(t, "key", nil)
+	bad := newTestIndexer(t, "other", nil)
+	m := Multi{
+		NewClient(Indexer{Name: "good", URL: good.URL, APIKey: "key"}, nil),
+		NewClient(Indexer{Name: "bad", URL: bad.URL, APIKey: "key"}, nil),
+	}
+
+	results, err := m.Search(context.Background(), Query{Q: "show"})
+	if err == nil {
+		t.Errorf("Expected failure from one indexer to be reported")
+	}
+	if len(results) != 2 || results[0].Indexer != "good" {
+		t.Fatalf("Expected results from working indexer, got %+v", results)
+	}
+	if !results[0].PubDate.After(results[1].PubDate) {
+		t.Errorf("Results not sorted newest first")
+	}
+	if _, err = m.Fetch(context.Background(), results[0]); err != nil {
+		t.Errorf("Fetch from combined results failed: %v", err)
+	}
+}
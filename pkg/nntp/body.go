@@ -0,0 +1,92 @@
+package nntp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// bodyReader reads a dot-encoded message body, as textproto's DotReader does, but a line at a
+// time rather than a byte at a time. Article bodies are large enough for this to matter.
+//
+// Lines are returned with a bare "\n" ending, and the leading dot of lines which start with one is
+// removed. The body ends at a line holding a single dot.
+type bodyReader struct {
+	r *bufio.Reader
+	// pending is what is left of the current line, within r's buffer.
+	pending []byte
+	// midLine is true when the last piece read didn't reach the end of its line.
+	midLine bool
+	// cr is true when the last piece read ended with a carriage return, which was held back in
+	// case the next piece starts with the line feed that ends the line.
+	cr bool
+	// held is a piece to return once pending has been, as the carriage return held back before it
+	// turned out not to end its line.
+	held []byte
+	err  error
+}
+
+// carriageReturn is returned on its own when a carriage return held back at the end of one piece
+// isn't followed by a line feed.
+var carriageReturn = []byte("\r")
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(b.pending) == 0 {
+			if b.held != nil {
+				b.pending, b.held = b.held, nil
+				continue
+			}
+			if b.err != nil {
+				break
+			}
+			b.next()
+			continue
+		}
+		copied := copy(p[n:], b.pending)
+		b.pending = b.pending[copied:]
+		n += copied
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, b.err
+	}
+	return n, nil
+}
+
+// next reads the next piece of the body into pending, which must be empty, as pending points into
+// r's buffer until it has been consumed.
+func (b *bodyReader) next() {
+	line, err := b.r.ReadSlice('\n')
+	startOfLine := !b.midLine
+	b.midLine = err == bufio.ErrBufferFull
+	if err != nil && err != bufio.ErrBufferFull {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		b.err = err
+	}
+	if startOfLine && len(line) > 0 && line[0] == '.' {
+		if !b.midLine && (bytes.Equal(line, []byte(".\r\n")) || bytes.Equal(line, []byte(".\n"))) {
+			b.pending, b.err = nil, io.EOF
+			return
+		}
+		line = line[1:]
+	}
+	if n := len(line); !b.midLine && n >= 2 && line[n-2] == '\r' && line[n-1] == '\n' {
+		// The line has been read, so its ending can be rewritten in place in r's buffer.
+		line[n-2] = '\n'
+		line = line[:n-1]
+	}
+	cr := b.cr
+	// A line ending split between pieces is held back, so that it too is returned as a bare "\n".
+	b.cr = b.midLine && len(line) > 0 && line[len(line)-1] == '\r'
+	if b.cr {
+		line = line[:len(line)-1]
+	}
+	if cr && (len(line) == 0 || line[0] != '\n') {
+		b.pending, b.held = carriageReturn, line
+		return
+	}
+	b.pending = line
+}
@@ -1,31 +1,45 @@
 package nntp
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 	"net/textproto"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/esteth/usenet/pkg/logging"
 	"github.com/esteth/usenet/pkg/yenc"
 )
 
 // Conn represents an NNTP connection
 type Conn struct {
 	*textproto.Conn
+	netConn net.Conn
+	log     logging.Logger
+	// body reads the body of the last message requested. It is reused, as only one message can
+	// be read at a time.
+	body bodyReader
 }
 
 // Dial will establish a connection to an NNTP server.
 func Dial(address string) (*Conn, error) {
-	conn := new(Conn)
-	var err error
+	return dial(context.Background(), address, nil)
+}
 
-	conn.Conn, err = textproto.Dial("tcp", address)
+func dial(ctx context.Context, address string, log logging.Logger) (*Conn, error) {
+	conn := &Conn{log: logging.OrDiscard(log)}
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to connect to %s: %w", address, err)
 	}
+	conn.Conn, conn.netConn = textproto.NewConn(netConn), netConn
 
-	_, _, err = conn.ReadCodeLine(20)
+	_, _, err = conn.readCodeLine(20)
 	if err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("Could not read 20X while establishing connection: %w", err)
@@ -36,14 +50,19 @@ func Dial(address string) (*Conn, error) {
 
 // DialTLS will establish a TLS connection to an NNTP server.
 func DialTLS(address string) (*Conn, error) {
-	conn := new(Conn)
-	tlsConn, err := tls.Dial("tcp", address, nil)
+	return dialTLS(context.Background(), address, nil)
+}
+
+func dialTLS(ctx context.Context, address string, log logging.Logger) (*Conn, error) {
+	conn := &Conn{log: logging.OrDiscard(log)}
+	var dialer tls.Dialer
+	tlsConn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to establish TLS connection: %w", err)
 	}
-	conn.Conn = textproto.NewConn(tlsConn)
+	conn.Conn, conn.netConn = textproto.NewConn(tlsConn), tlsConn
 
-	_, _, err = conn.ReadCodeLine(20)
+	_, _, err = conn.readCodeLine(20)
 	if err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("Could not read 20X while establshing TLS connection: %w", err)
@@ -52,14 +71,49 @@ func DialTLS(address string) (*Conn, error) {
 	return conn, nil
 }
 
+// SetDeadline sets the time after which reading from or writing to the server fails with a
+// timeout. A zero time means there is no deadline.
+func (conn *Conn) SetDeadline(t time.Time) error {
+	return conn.netConn.SetDeadline(t)
+}
+
+// SetLogger sets the logger that commands sent and responses received are traced to, at debug
+// level. Passwords are not logged.
+func (conn *Conn) SetLogger(log logging.Logger) {
+	conn.log = logging.OrDiscard(log)
+}
+
+// cmd sends a command, tracing it with any password redacted.
+func (conn *Conn) cmd(format string, args ...any) (uint, error) {
+	line := fmt.Sprintf(format, args...)
+	traced := line
+	if strings.HasPrefix(strings.ToUpper(line), "AUTHINFO PASS") {
+		traced = "AUTHINFO PASS [redacted]"
+	}
+	conn.logger().Debug("NNTP command", "command", traced)
+	return conn.Cmd("%s", line)
+}
+
+// readCodeLine reads a response status line, tracing it.
+func (conn *Conn) readCodeLine(expectCode int) (int, string, error) {
+	code, message, err := conn.ReadCodeLine(expectCode)
+	conn.logger().Debug("NNTP response", "code", code, "message", message)
+	return code, message, err
+}
+
+// logger returns the connection's logger, allowing for Conns which were not created by Dial.
+func (conn *Conn) logger() logging.Logger {
+	return logging.OrDiscard(conn.log)
+}
+
 // Authenticate will authenticate with the server using the given username and password
 func (conn *Conn) Authenticate(user string, pass string) error {
-	id, err := conn.Cmd("AUTHINFO USER %s", user)
+	id, err := conn.cmd("AUTHINFO USER %s", user)
 	if err != nil {
 		return fmt.Errorf("Failed to send username: %w", err)
 	}
 	conn.StartResponse(id)
-	code, _, err := conn.ReadCodeLine(381)
+	code, _, err := conn.readCodeLine(381)
 	conn.EndResponse(id)
 
 	switch code {
@@ -74,12 +128,12 @@ func (conn *Conn) Authenticate(user string, pass string) error {
 	default:
 		return fmt.Errorf("Failed reading 381 while authenticating: %w", err)
 	}
-	id, err = conn.Cmd("AUTHINFO PASS %s", pass)
+	id, err = conn.cmd("AUTHINFO PASS %s", pass)
 	if err != nil {
 		return fmt.Errorf("Failed to send password: %w", err)
 	}
 	conn.StartResponse(id)
-	code, _, err = conn.ReadCodeLine(281)
+	code, _, err = conn.readCodeLine(281)
 	conn.EndResponse(id)
 	if err != nil {
 		return fmt.Errorf("Failed reading 281 while authenticating: %w", err)
@@ -90,18 +144,36 @@ func (conn *Conn) Authenticate(user string, pass string) error {
 
 // ReadMessage will return a Reader onto the body of a message
 func (conn *Conn) ReadMessage(messageID string) (io.Reader, error) {
-	id, err := conn.Cmd("BODY <%s>", messageID)
+	id, err := conn.cmd("BODY <%s>", messageID)
 	conn.StartResponse(id)
 	defer conn.EndResponse(id)
 	if err != nil {
 		return nil, fmt.Errorf("BODY command failed: %w", err)
 	}
 
-	_, _, err = conn.ReadCodeLine(222)
+	_, _, err = conn.readCodeLine(222)
 	if err != nil {
 		return nil, fmt.Errorf("Could not read 222: %w", err)
 	}
-	return conn.DotReader(), nil
+	conn.body = bodyReader{r: conn.R}
+	return &conn.body, nil
+}
+
+// Stat asks the server whether it has a message, without downloading it. It returns a
+// *textproto.Error with code 430 if the server doesn't have it.
+func (conn *Conn) Stat(messageID string) error {
+	id, err := conn.cmd("STAT <%s>", messageID)
+	conn.StartResponse(id)
+	defer conn.EndResponse(id)
+	if err != nil {
+		return fmt.Errorf("STAT command failed: %w", err)
+	}
+
+	_, _, err = conn.readCodeLine(223)
+	if err != nil {
+		return fmt.Errorf("Could not read 223: %w", err)
+	}
+	return nil
 }
 
 // ReadMessageToFile downloads and writes the appropriate segment of the file the message represents.
@@ -121,22 +193,23 @@ func (conn *Conn) ReadMessageToFile(messageID string) (int64, error) {
 		return 0, fmt.Errorf("Could not get filename: %w", err)
 	}
 
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0666)
-	defer file.Close()
-	if err != nil {
-		return 0, fmt.Errorf("Could not open output file: %w", err)
-	}
-
 	offset, err := yencReader.Offset()
 	if err != nil {
 		return 0, fmt.Errorf("Could not read offset from file: %w", err)
 	}
-	file.Seek(offset, 0)
 
-	bytesWritten, err := io.Copy(file, yencReader)
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
+		return 0, fmt.Errorf("Could not open output file: %w", err)
+	}
+	bytesWritten, err := io.Copy(io.NewOffsetWriter(file, offset), yencReader)
+	if err != nil {
+		file.Close()
 		return 0, fmt.Errorf("Could not copy data to file: %w", err)
 	}
+	if err = file.Close(); err != nil {
+		return 0, fmt.Errorf("Could not close output file: %w", err)
+	}
 
 	return bytesWritten, nil
 }
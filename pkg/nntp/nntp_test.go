@@ -2,12 +2,19 @@ package nntp
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/textproto"
 	"regexp"
+	"strings"
 	"testing"
+
+	"github.com/esteth/usenet/pkg/nntp/nntptest"
 )
 
 func TestConnect(t *testing.T) {
@@ -69,3 +76,182 @@ func TestConnect(t *testing.T) {
 		t.Fatalf("failed to read message: %v", err)
 	}
 }
+
+func TestStat(t *testing.T) {
+	server := nntptest.NewServer(map[string][]byte{"a@test": []byte("content")})
+	defer server.Close()
+
+	conn, err := Dial(server.Addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.Stat("a@test"); err != nil {
+		t.Errorf("expected article to exist, got %v", err)
+	}
+	var protoErr *textproto.Error
+	if err := conn.Stat("b@test"); !errors.As(err, &protoErr) || protoErr.Code != 430 {
+		t.Errorf("expected missing article to return 430, got %v", err)
+	}
+	if err := conn.Stat("a@test"); err != nil {
+		t.Errorf("expected connection to be usable after a missing article, got %v", err)
+	}
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	server := nntptest.NewServer(map[string][]byte{"a@test": []byte("content")})
+	defer server.Close()
+	server.RequireAuth("user", "pass")
+
+	pool := NewPool(Server{Address: server.Addr, User: "user", Password: "pass", Connections: 2})
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, err := pool.Get(context.Background())
+		if err != nil {
+			t.Fatalf("failed to get connection: %v", err)
+		}
+		reader, err := conn.ReadMessage("a@test")
+		if err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		io.Copy(io.Discard, reader)
+		pool.Put(conn)
+	}
+
+	if server.Connections() != 1 {
+		t.Errorf("expected 1 connection to be reused, but %d were opened", server.Connections())
+	}
+}
+
+func TestPoolBlocksWhenExhausted(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+
+	pool := NewPool(Server{Address: server.Addr, Connections: 1})
+	defer pool.Close()
+
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get connection: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = pool.Get(ctx); err != context.Canceled {
+		t.Errorf("expected exhausted pool to wait for context, got %v", err)
+	}
+	pool.Discard(conn)
+
+	if conn, err = pool.Get(context.Background()); err != nil {
+		t.Fatalf("failed to get connection after discarding: %v", err)
+	}
+	pool.Put(conn)
+}
+
+func TestPoolStats(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+
+	pool := NewPool(Server{Address: server.Addr, Connections: 2})
+	defer pool.Close()
+
+	first, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get connection: %v", err)
+	}
+	second, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get connection: %v", err)
+	}
+	pool.Put(first)
+	pool.Discard(second)
+
+	// Taking both connections reuses the idle one, and replaces the discarded one.
+	if first, err = pool.Get(context.Background()); err != nil {
+		t.Fatalf("failed to get connection: %v", err)
+	}
+	if second, err = pool.Get(context.Background()); err != nil {
+		t.Fatalf("failed to get connection: %v", err)
+	}
+	pool.Put(first)
+	pool.Put(second)
+
+	stats := pool.Stats()
+	expected := PoolStats{Open: 2, Idle: 2, Dials: 3, Reconnects: 1}
+	if stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestTraceRedactsPassword(t *testing.T) {
+	server := nntptest.NewServer(map[string][]byte{"a@test": []byte("content")})
+	defer server.Close()
+	server.RequireAuth("user", "secret")
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	conn, err := Server{Address: server.Addr, User: "user", Password: "secret", Logger: logger}.Dial()
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err = conn.ReadMessage("a@test"); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+
+	if strings.Contains(logs.String(), "secret") {
+		t.Errorf("password was logged: %s", logs.String())
+	}
+	for _, expected := range []string{"AUTHINFO USER user", "AUTHINFO PASS [redacted]", "BODY <a@test>", `"code":222`} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("expected trace to contain %s: %s", expected, logs.String())
+		}
+	}
+}
+
+func TestBodyReader(t *testing.T) {
+	body := "first line\r\n..dotted\r\n..\r\nthis line is longer than the buffer\r\n.. also long enough to split\r\nlast\r\n.\r\nafter"
+	expected, err := io.ReadAll(textproto.NewReader(bufio.NewReader(strings.NewReader(body))).DotReader())
+	if err != nil {
+		t.Fatalf("could not read with DotReader: %v", err)
+	}
+	// The smallest buffer splits long lines across reads.
+	r := bufio.NewReaderSize(strings.NewReader(body), 16)
+	got, err := io.ReadAll(&bodyReader{r: r})
+	if err != nil {
+		t.Fatalf("could not read body: %v", err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "after" {
+		t.Errorf("expected reading to stop after the body, got %q left", rest)
+	}
+
+	if _, err := io.ReadAll(&bodyReader{r: bufio.NewReader(strings.NewReader("cut short\r\n"))}); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected a body without its terminator to be truncated, got %v", err)
+	}
+}
+
+func TestBodyReaderSplitLineEnding(t *testing.T) {
+	// With a 16 byte buffer, the first piece of a long line is its first 16 bytes, and the next
+	// piece is the 16 after that.
+	for _, body := range []string{
+		"fifteen chars..\r\n.\r\n",
+		"thirty-one chars, two pieces...\r\n.\r\n",
+		"a bare return..\rin the middle\r\n.\r\n",
+		"fifteen chars..\r\nfifteen chars..\r\n..fifteen chars\r\n.\r\n",
+	} {
+		expected, err := io.ReadAll(textproto.NewReader(bufio.NewReader(strings.NewReader(body))).DotReader())
+		if err != nil {
+			t.Fatalf("could not read with DotReader: %v", err)
+		}
+		got, err := io.ReadAll(&bodyReader{r: bufio.NewReaderSize(strings.NewReader(body), 16)})
+		if err != nil {
+			t.Fatalf("could not read body %q: %v", body, err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("expected %q, got %q", expected, got)
+		}
+	}
+}
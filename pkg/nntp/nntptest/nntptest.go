@@ -0,0 +1,401 @@
+// Package nntptest provides utilities for testing code which talks to NNTP servers.
+package nntptest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"html"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Server is an NNTP server listening on the loopback interface, serving
+// a fixed set of articles.
+type Server struct {
+	// Addr is the host:port the server is listening on.
+	Addr string
+
+	listener net.Listener
+	user     string
+	password string
+
+	mu       sync.Mutex
+	articles map[string][]byte
+	requests map[string]int
+	faults   map[string]faults
+	conns    int
+	latency  time.Duration
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server which serves the given article bodies, keyed by message ID.
+//
+// The caller should call Close when finished, to shut it down.
+func NewServer(articles map[string][]byte) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("nntptest: failed to listen: %v", err))
+	}
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+		articles: make(map[string][]byte, len(articles)),
+		requests: make(map[string]int),
+		faults:   make(map[string]faults),
+	}
+	for id, body := range articles {
+		s.articles[id] = body
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// RequireAuth makes the server reject article requests on connections which
+// have not authenticated with the given credentials.
+func (s *Server) RequireAuth(user, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = user
+	s.password = password
+}
+
+// AddArticle adds or replaces an article served by the server.
+func (s *Server) AddArticle(messageID string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.articles[messageID] = body
+}
+
+// RemoveArticle removes an article, causing requests for it to fail with 430.
+func (s *Server) RemoveArticle(messageID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.articles, messageID)
+}
+
+// SetLatency makes the server wait for the given time before answering each BODY request, as a
+// distant server would.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// A Fault is a way for the server to fail a request for an article.
+type Fault int
+
+const (
+	// Disconnect closes the connection instead of sending the article.
+	Disconnect Fault = iota + 1
+	// Stall sends nothing in response, as if the server had hung.
+	Stall
+	// Truncate sends the article with the end of its body, including the yEnc footer, cut off.
+	Truncate
+	// Corrupt sends the article with a byte of its data changed, so that it fails its checksum.
+	Corrupt
+)
+
+// faults is a fault to apply to some number of requests for an article.
+type faults struct {
+	fault Fault
+	count int
+}
+
+// Fail makes the next count BODY requests for an article fail with the given fault.
+func (s *Server) Fail(messageID string, fault Fault, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[messageID] = faults{fault: fault, count: count}
+}
+
+// Requests returns the number of BODY and STAT commands received for the given message ID.
+func (s *Server) Requests(messageID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[messageID]
+}
+
+// Connections returns the number of connections the server has accepted.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// Close shuts down the server and waits for all connections to finish.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(c)
+		}()
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	defer c.Close()
+	conn := textproto.NewConn(c)
+	// 200 is server ready, posting allowed.
+	conn.PrintfLine("200 nntptest ready")
+
+	s.mu.Lock()
+	authenticated := s.user == ""
+	s.mu.Unlock()
+	user := ""
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "AUTHINFO":
+			kind, value, _ := strings.Cut(arg, " ")
+			switch strings.ToUpper(kind) {
+			case "USER":
+				user = value
+				conn.PrintfLine("381 password required")
+			case "PASS":
+				s.mu.Lock()
+				ok := user == s.user && value == s.password
+				s.mu.Unlock()
+				if ok {
+					authenticated = true
+					conn.PrintfLine("281 authentication accepted")
+				} else {
+					conn.PrintfLine("481 authentication failed")
+				}
+			default:
+				conn.PrintfLine("501 unknown AUTHINFO command")
+			}
+		case "BODY", "STAT":
+			if !authenticated {
+				conn.PrintfLine("480 authentication required")
+				continue
+			}
+			id := strings.TrimSuffix(strings.TrimPrefix(arg, "<"), ">")
+			s.mu.Lock()
+			s.requests[id]++
+			body, ok := s.articles[id]
+			latency := s.latency
+			s.mu.Unlock()
+			if !ok {
+				conn.PrintfLine("430 no such article")
+				continue
+			}
+			if strings.ToUpper(cmd) == "STAT" {
+				conn.PrintfLine("223 0 <%s>", id)
+				continue
+			}
+			time.Sleep(latency)
+			switch s.nextFault(id) {
+			case Disconnect:
+				return
+			case Stall:
+				continue
+			case Truncate:
+				if end := bytes.Index(body, []byte("=yend")); end >= 0 {
+					body = body[:end/2]
+					body = body[:bytes.LastIndexByte(body, '\n')+1]
+				}
+			case Corrupt:
+				body = corrupt(body)
+			}
+			conn.PrintfLine("222 0 <%s>", id)
+			writeBody(conn.W, body)
+		case "QUIT":
+			conn.PrintfLine("205 closing connection")
+			return
+		default:
+			conn.PrintfLine("500 unknown command")
+		}
+	}
+}
+
+// writeBody sends an article body dot-encoded, as textproto's DotWriter does, but a line at a time
+// so that serving large articles is cheap.
+func writeBody(w *bufio.Writer, body []byte) error {
+	for len(body) > 0 {
+		line := body
+		if end := bytes.IndexByte(body, '\n'); end >= 0 {
+			line = body[:end+1]
+		}
+		body = body[len(line):]
+		if line[0] == '.' {
+			w.WriteByte('.')
+		}
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		w.Write(line)
+		w.WriteString("\r\n")
+	}
+	w.WriteString(".\r\n")
+	return w.Flush()
+}
+
+// nextFault returns the fault to apply to a request for an article, if any.
+func (s *Server) nextFault(messageID string) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.faults[messageID]
+	if !ok {
+		return 0
+	}
+	if f.count--; f.count <= 0 {
+		delete(s.faults, messageID)
+	} else {
+		s.faults[messageID] = f
+	}
+	return f.fault
+}
+
+// corrupt returns a copy of a yEnc article body with the first byte of its data changed.
+func corrupt(body []byte) []byte {
+	body = bytes.Clone(body)
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if len(line) > 0 && line[0] != '=' {
+			// Neither replacement needs escaping, so the article still decodes.
+			if line[0] == 'a' {
+				line[0] = 'b'
+			} else {
+				line[0] = 'a'
+			}
+			break
+		}
+	}
+	return body
+}
+
+// lineLength is the number of encoded bytes written per line by the yEnc encoding helpers.
+const lineLength = 128
+
+// Encode returns data yEnc encoded as a single-part article body.
+func Encode(name string, data []byte) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "=ybegin line=%d size=%d name=%s\r\n", lineLength, len(data), name)
+	encodeLines(&b, data)
+	fmt.Fprintf(&b, "=yend size=%d crc32=%08x\r\n", len(data), crc32.ChecksumIEEE(data))
+	return []byte(b.String())
+}
+
+// EncodePart returns the part of a file beginning at offset yEnc encoded as one
+// article body of a multi-part post.
+//
+// part is 1-indexed, and fileSize is the size of the whole file.
+func EncodePart(name string, part int, total int, fileSize int64, offset int64, data []byte) []byte {
+	return encodePart(name, part, total, fileSize, offset, data, "")
+}
+
+// encodePart encodes a part as EncodePart does, adding extra to the end of its yend footer.
+func encodePart(name string, part int, total int, fileSize int64, offset int64, data []byte, extra string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "=ybegin part=%d total=%d line=%d size=%d name=%s\r\n", part, total, lineLength, fileSize, name)
+	fmt.Fprintf(&b, "=ypart begin=%d end=%d\r\n", offset+1, offset+int64(len(data)))
+	encodeLines(&b, data)
+	fmt.Fprintf(&b, "=yend size=%d part=%d pcrc32=%08x%s\r\n", len(data), part, crc32.ChecksumIEEE(data), extra)
+	return []byte(b.String())
+}
+
+// Split splits data into articles of at most partSize bytes, returning them in
+// order as yEnc encoded article bodies of a multi-part post. The footer of the last
+// part also gives the checksum of the whole file.
+func Split(name string, data []byte, partSize int) [][]byte {
+	total := (len(data) + partSize - 1) / partSize
+	parts := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		start := i * partSize
+		end := start + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		var extra string
+		if i == total-1 {
+			extra = fmt.Sprintf(" crc32=%08x", crc32.ChecksumIEEE(data))
+		}
+		parts = append(parts, encodePart(name, i+1, total, int64(len(data)), int64(start), data[start:end], extra))
+	}
+	return parts
+}
+
+func encodeLines(b *strings.Builder, data []byte) {
+	column := 0
+	for _, c := range data {
+		e := c + 42
+		switch e {
+		case 0, '\n', '\r', '=':
+			b.WriteByte('=')
+			e += 64
+			column++
+		}
+		b.WriteByte(e)
+		column++
+		if column >= lineLength {
+			b.WriteString("\r\n")
+			column = 0
+		}
+	}
+	if column > 0 {
+		b.WriteString("\r\n")
+	}
+}
+
+// Post splits data into articles of at most partSize bytes, adds them to the
+// server, and returns an NZB file describing them.
+func (s *Server) Post(name string, data []byte, partSize int) []byte {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	b.WriteString(`<nzb xmlns="http://www.newzbin.com/DTD/2003/nzb">` + "\n")
+	s.writeFile(&b, name, data, partSize)
+	b.WriteString("</nzb>\n")
+	return []byte(b.String())
+}
+
+// PostFiles posts each of the given files as with Post, returning a single NZB describing all of them.
+func (s *Server) PostFiles(files map[string][]byte, partSize int) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	b.WriteString(`<nzb xmlns="http://www.newzbin.com/DTD/2003/nzb">` + "\n")
+	for _, name := range names {
+		s.writeFile(&b, name, files[name], partSize)
+	}
+	b.WriteString("</nzb>\n")
+	return []byte(b.String())
+}
+
+func (s *Server) writeFile(b *strings.Builder, name string, data []byte, partSize int) {
+	fmt.Fprintf(b, `<file poster="nntptest" subject="&quot;%s&quot; yEnc">`+"\n", html.EscapeString(name))
+	b.WriteString("<groups><group>alt.binaries.test</group></groups>\n<segments>\n")
+	for i, part := range Split(name, data, partSize) {
+		id := fmt.Sprintf("%s.%d@nntptest", url.PathEscape(name), i+1)
+		s.AddArticle(id, part)
+		fmt.Fprintf(b, `<segment bytes="%d" number="%d">%s</segment>`+"\n", len(part), i+1, html.EscapeString(id))
+	}
+	b.WriteString("</segments>\n</file>\n")
+}
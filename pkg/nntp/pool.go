@@ -0,0 +1,155 @@
+package nntp
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrPoolClosed is returned when requesting a connection from a closed Pool.
+var ErrPoolClosed = errors.New("connection pool is closed")
+
+// A Pool keeps a bounded set of authenticated connections to a single server
+// open so that they can be reused across downloads.
+type Pool struct {
+	server Server
+	// idle holds connections which are open but not in use.
+	idle chan *Conn
+	// slots bounds the number of connections, idle or in use, to server.Connections.
+	slots chan struct{}
+
+	mu         sync.Mutex
+	closed     bool
+	dials      int64
+	reconnects int64
+	// broken counts discarded connections which have not yet been replaced by a new dial.
+	broken int
+}
+
+// PoolStats describes the connections of a Pool.
+type PoolStats struct {
+	// Open is the number of connections open or being dialed, whether idle or in use.
+	Open int
+	// Idle is the number of open connections not currently in use.
+	Idle int
+	// Dials is the number of connections dialed since the pool was created.
+	Dials int64
+	// Reconnects is how many of those dials replaced a connection which had been discarded.
+	Reconnects int64
+}
+
+// NewPool creates a new Pool of connections to the given server.
+//
+// Connections are established lazily as they are requested.
+func NewPool(server Server) *Pool {
+	size := server.Connections
+	if size < 1 {
+		size = 1
+	}
+	return &Pool{
+		server: server,
+		idle:   make(chan *Conn, size),
+		slots:  make(chan struct{}, size),
+	}
+}
+
+// Server returns the server this pool connects to.
+func (p *Pool) Server() Server {
+	return p.server
+}
+
+// Get returns a connection from the pool, dialing a new one if none are idle.
+//
+// Get blocks until a connection is available or ctx is done.
+// The connection must be returned with Put, or Discard if it is no longer usable.
+func (p *Pool) Get(ctx context.Context) (*Conn, error) {
+	if p.isClosed() {
+		return nil, ErrPoolClosed
+	}
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	default:
+	}
+
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	conn, err := p.server.DialContext(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	p.mu.Lock()
+	p.dials++
+	if p.broken > 0 {
+		p.broken--
+		p.reconnects++
+	}
+	p.mu.Unlock()
+	return conn, nil
+}
+
+// Put returns a healthy connection to the pool for reuse.
+func (p *Pool) Put(conn *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.close(conn)
+		return
+	}
+	// idle has capacity for every slot, so this never blocks.
+	p.idle <- conn
+}
+
+// Discard closes a connection which is no longer usable, freeing its slot in the pool.
+func (p *Pool) Discard(conn *Conn) {
+	p.mu.Lock()
+	p.broken++
+	p.mu.Unlock()
+	p.close(conn)
+}
+
+// close closes a connection and frees its slot in the pool.
+func (p *Pool) close(conn *Conn) {
+	conn.Close()
+	<-p.slots
+}
+
+// Stats returns the current state of the pool's connections.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{
+		Open:       len(p.slots),
+		Idle:       len(p.idle),
+		Dials:      p.dials,
+		Reconnects: p.reconnects,
+	}
+}
+
+// Close closes all idle connections. Connections currently in use are closed when they are returned.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	for {
+		select {
+		case conn := <-p.idle:
+			p.close(conn)
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *Pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
@@ -0,0 +1,52 @@
+package nntp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/esteth/usenet/pkg/credentials"
+	"github.com/esteth/usenet/pkg/logging"
+)
+
+// A Server describes how to reach and authenticate to an NNTP server.
+type Server struct {
+	// Address is the host:port of the server.
+	Address string
+	// TLS is true if connections to the server should be made over TLS.
+	TLS bool
+	// User and Password are used to authenticate, if both are non-empty.
+	User     string
+	Password credentials.Secret
+	// Connections is the maximum number of simultaneous connections to open.
+	Connections int
+	// Logger, if set, receives a debug-level trace of the commands sent to the server and its
+	// responses.
+	Logger logging.Logger
+}
+
+// Dial establishes a connection to the server, authenticating if credentials are configured.
+func (s Server) Dial() (*Conn, error) {
+	return s.DialContext(context.Background())
+}
+
+// DialContext is like Dial, but gives up connecting if ctx is done first.
+func (s Server) DialContext(ctx context.Context) (*Conn, error) {
+	var conn *Conn
+	var err error
+	if s.TLS {
+		conn, err = dialTLS(ctx, s.Address, s.Logger)
+	} else {
+		conn, err = dial(ctx, s.Address, s.Logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.User != "" && s.Password != "" {
+		if err = conn.Authenticate(s.User, s.Password.Reveal()); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Failed to Authenticate: %w", err)
+		}
+	}
+	return conn, nil
+}
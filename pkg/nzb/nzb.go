@@ -1,10 +1,13 @@
 package nzb
 
 import (
+	"compress/gzip"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 
 	"golang.org/x/net/html/charset"
@@ -12,9 +15,16 @@ import (
 
 // An Nzb represents the contents of an NZB file.
 type Nzb struct {
+	Meta  []Meta `xml:"head>meta"`
 	Files []File `xml:"file"`
 }
 
+// A Meta is a piece of metadata from the NZB's head, such as the title or archive password
+type Meta struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
 // A File is metadata regarding where to find data in usenet for a particular file
 type File struct {
 	Subject  string    `xml:"subject,attr"`
@@ -29,17 +39,38 @@ type Segment struct {
 }
 
 // FromFile creates a new Nzb struct by reading an nzb file from disk
+//
+// Files with a .gz extension are decompressed as they are read.
 func FromFile(filename string) (Nzb, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return Nzb{}, fmt.Errorf("could not open '%s': %w", filename, err)
 	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return Nzb{}, fmt.Errorf("could not decompress '%s': %w", filename, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	nzb, err := FromReader(r)
+	if err != nil {
+		return Nzb{}, fmt.Errorf("could not parse '%s' as NZB: %w", filename, err)
+	}
+	return nzb, nil
+}
+
+// FromReader creates a new Nzb struct by reading the contents of an nzb file from r
+func FromReader(r io.Reader) (Nzb, error) {
 	var nzb Nzb
-	decoder := xml.NewDecoder(file)
+	decoder := xml.NewDecoder(r)
 	decoder.CharsetReader = charset.NewReaderLabel
-	err = decoder.Decode(&nzb)
+	err := decoder.Decode(&nzb)
 	if err != nil {
-		return Nzb{}, fmt.Errorf("could not parse '%s' as NZB: %w", filename, err)
+		return Nzb{}, err
 	}
 
 	// Sort each file's segments into order
@@ -58,3 +89,60 @@ func FromFile(filename string) (Nzb, error) {
 
 	return nzb, nil
 }
+
+// Password returns the archive password given in the NZB's metadata, or "" if there is none.
+func (n Nzb) Password() string {
+	for _, m := range n.Meta {
+		if strings.EqualFold(m.Type, "password") {
+			return strings.TrimSpace(m.Value)
+		}
+	}
+	return ""
+}
+
+// Bytes returns the total size in bytes of all segments in the NZB, as reported by the NZB.
+func (n Nzb) Bytes() int64 {
+	var total int64
+	for _, f := range n.Files {
+		total += f.Bytes()
+	}
+	return total
+}
+
+// Name returns the file's name, as given in quotes in its subject by convention, or "" if the
+// subject doesn't quote one.
+func (f File) Name() string {
+	_, rest, ok := strings.Cut(f.Subject, "\"")
+	if !ok {
+		return ""
+	}
+	name, _, ok := strings.Cut(rest, "\"")
+	if !ok {
+		return ""
+	}
+	return name
+}
+
+// SafeName turns an untrusted name, such as one from an NZB or an article, into one which is safe
+// to use as a single path element.
+func SafeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// Bytes returns the total size in bytes of the file's segments, as reported by the NZB.
+func (f File) Bytes() int64 {
+	var total int64
+	for _, s := range f.Segments {
+		total += int64(s.Bytes)
+	}
+	return total
+}
@@ -1,7 +1,12 @@
 package nzb
 
 import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -42,4 +47,67 @@ func TestSegments(t *testing.T) {
 	}) {
 		t.Errorf("ids not as expected: %v", ids)
 	}
-}
\ No newline at end of file
+}
+func TestGzipFile(t *testing.T) {
+	content, err := os.ReadFile("./testdata/test.nzb")
+	if err != nil {
+		t.Fatalf("failed to read NZB: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "test.nzb.gz")
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(content)
+	writer.Close()
+	if err = os.WriteFile(path, compressed.Bytes(), 0666); err != nil {
+		t.Fatalf("failed to write compressed NZB: %v", err)
+	}
+
+	nzb, err := FromFile(path)
+	if err != nil {
+		t.Fatalf("failed to create NZB from compressed file: %v", err)
+	}
+	if len(nzb.Files) != 1 || len(nzb.Files[0].Segments) != 10 {
+		t.Errorf("compressed NZB not parsed as expected: %v", nzb)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	nzb, err := FromReader(strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<nzb xmlns="http://www.newzbin.com/DTD/2003/nzb">
+<head><meta type="title">Test</meta><meta type="password">secret</meta></head>
+<file subject="test"><segments><segment bytes="10" number="1">a@test</segment></segments></file>
+</nzb>`))
+	if err != nil {
+		t.Fatalf("failed to create NZB from reader: %v", err)
+	}
+	if nzb.Password() != "secret" {
+		t.Errorf("expected password 'secret', got '%s'", nzb.Password())
+	}
+}
+
+func TestName(t *testing.T) {
+	for subject, expected := range map[string]string{
+		`ezNZB-01-09-2013 Test.mp3 - "test.mp3" yEnc (1/10)`: "test.mp3",
+		`[01/12] - "release.vol03+04.par2" yEnc (1/3)`:       "release.vol03+04.par2",
+		`release.rar yEnc (1/3)`:                             "",
+	} {
+		if name := (File{Subject: subject}).Name(); name != expected {
+			t.Errorf("Expected name '%s' from subject '%s', got '%s'", expected, subject, name)
+		}
+	}
+}
+
+func TestSafeName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"release.mkv":      "release.mkv",
+		"../../etc/passwd": ".._.._etc_passwd",
+		`dir\file`:         "dir_file",
+		"tab\there":        "tab_here",
+		"":                 "_",
+		"..":               "_",
+	} {
+		if safe := SafeName(name); safe != expected {
+			t.Errorf("Expected '%s' to become '%s', got '%s'", name, expected, safe)
+		}
+	}
+}
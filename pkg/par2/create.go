@@ -0,0 +1,185 @@
+package par2
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/esteth/usenet/pkg/par2/gf"
+	"github.com/esteth/usenet/pkg/par2/reedsolomon"
+)
+
+const (
+	mainPacketType          = "PAR 2.0\000Main\000\000\000\000"
+	fileDescPacketType      = "PAR 2.0\000FileDesc"
+	sliceChecksumPacketType = "PAR 2.0\000IFSC\000\000\000\000"
+	recoverySlicePacketType = "PAR 2.0\000RecvSlic"
+	creatorPacketType       = "PAR 2.0\000Creator\000"
+)
+
+// creator identifies this package as the creator of the recovery sets it writes.
+const creator = "github.com/esteth/usenet"
+
+// inputFile is a file being protected by a recovery set that is being created.
+type inputFile struct {
+	id     [16]byte
+	name   string
+	length uint64
+	md516  [16]byte
+}
+
+// Create writes a PAR 2.0 recovery set protecting the named files in dir, in the layout
+// par2cmdline uses: an index file named base.par2 holding no recovery slices, followed by a
+// volume for each element of volumes holding that many recovery slices.
+//
+// sliceSize must be a positive multiple of 4. Create returns the paths of the files it wrote.
+func Create(dir string, base string, names []string, sliceSize int, volumes []int) ([]string, error) {
+	if sliceSize <= 0 || sliceSize%4 != 0 {
+		return nil, fmt.Errorf("Slice size %d is not a positive multiple of 4", sliceSize)
+	}
+	files := make([]inputFile, 0, len(names))
+	for _, name := range names {
+		f, err := describeFile(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	// Slices are numbered across the recovery set in the order of the files' IDs.
+	sort.Slice(files, func(i, j int) bool {
+		return bytes.Compare(files[i].id[:], files[j].id[:]) < 0
+	})
+
+	main := binary.LittleEndian.AppendUint64(nil, uint64(sliceSize))
+	main = binary.LittleEndian.AppendUint32(main, uint32(len(files)))
+	for _, f := range files {
+		main = append(main, f.id[:]...)
+	}
+	setID := md5.Sum(main)
+
+	totalSlices := 0
+	for _, f := range files {
+		totalSlices += int((f.length + uint64(sliceSize) - 1) / uint64(sliceSize))
+	}
+	recoveryCount := 0
+	for _, count := range volumes {
+		recoveryCount += count
+	}
+	recovery := make([][]uint16, recoveryCount)
+	for i := range recovery {
+		recovery[i] = make([]uint16, sliceSize/2)
+	}
+	constants := reedsolomon.Par2Constants(totalSlices)
+
+	common := packet(setID, mainPacketType, main)
+	slice := make([]byte, sliceSize)
+	var words []uint16
+	index := 0
+	for _, f := range files {
+		in, err := os.Open(filepath.Join(dir, f.name))
+		if err != nil {
+			return nil, fmt.Errorf("Could not open %s: %w", f.name, err)
+		}
+		fileHash := md5.New()
+		r := io.TeeReader(in, fileHash)
+		checksums := append([]byte(nil), f.id[:]...)
+		for offset := uint64(0); offset < f.length; offset += uint64(sliceSize) {
+			if err := readSlice(r, slice); err != nil {
+				in.Close()
+				return nil, fmt.Errorf("Could not read %s: %w", f.name, err)
+			}
+			sliceHash := md5.Sum(slice)
+			checksums = append(checksums, sliceHash[:]...)
+			checksums = binary.LittleEndian.AppendUint32(checksums, crc32.ChecksumIEEE(slice))
+
+			words = toWords(slice, words)
+			for exponent, sum := range recovery {
+				gf.MulAdd(sum, words, gf.Pow(constants[index], uint32(exponent)))
+			}
+			index++
+		}
+		in.Close()
+
+		desc := append([]byte(nil), f.id[:]...)
+		desc = append(desc, fileHash.Sum(nil)...)
+		desc = append(desc, f.md516[:]...)
+		desc = binary.LittleEndian.AppendUint64(desc, f.length)
+		desc = append(desc, pad([]byte(f.name))...)
+		common = append(common, packet(setID, fileDescPacketType, desc)...)
+		common = append(common, packet(setID, sliceChecksumPacketType, checksums)...)
+	}
+	common = append(common, packet(setID, creatorPacketType, pad([]byte(creator)))...)
+
+	indexPath := filepath.Join(dir, base+".par2")
+	if err := os.WriteFile(indexPath, common, 0666); err != nil {
+		return nil, fmt.Errorf("Could not write %s: %w", indexPath, err)
+	}
+	written := []string{indexPath}
+	exponent := 0
+	for _, count := range volumes {
+		var volume []byte
+		for i := 0; i < count; i++ {
+			body := binary.LittleEndian.AppendUint32(nil, uint32(exponent))
+			body = append(body, fromWords(recovery[exponent], make([]byte, sliceSize))...)
+			volume = append(volume, packet(setID, recoverySlicePacketType, body)...)
+			exponent++
+		}
+		volume = append(volume, common...)
+		path := filepath.Join(dir, fmt.Sprintf("%s.vol%d+%d.par2", base, exponent-count, count))
+		if err := os.WriteFile(path, volume, 0666); err != nil {
+			return nil, fmt.Errorf("Could not write %s: %w", path, err)
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+// describeFile works out the ID of the named file in dir, from its name, length and the hash of
+// its first 16KiB.
+func describeFile(dir string, name string) (inputFile, error) {
+	in, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return inputFile{}, fmt.Errorf("Could not open %s: %w", name, err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return inputFile{}, fmt.Errorf("Could not stat %s: %w", name, err)
+	}
+	head := md5.New()
+	if _, err := io.CopyN(head, in, md516Length); err != nil && err != io.EOF {
+		return inputFile{}, fmt.Errorf("Could not read %s: %w", name, err)
+	}
+	f := inputFile{name: name, length: uint64(info.Size())}
+	copy(f.md516[:], head.Sum(nil))
+	idData := append(f.md516[:], binary.LittleEndian.AppendUint64(nil, f.length)...)
+	f.id = md5.Sum(append(idData, name...))
+	return f, nil
+}
+
+// packet frames body as a PAR 2.0 packet of the given type.
+func packet(setID [16]byte, packetType string, body []byte) []byte {
+	p := make([]byte, 64, 64+len(body))
+	copy(p, "PAR2\000PKT")
+	binary.LittleEndian.PutUint64(p[8:], uint64(64+len(body)))
+	copy(p[32:], setID[:])
+	copy(p[48:], packetType)
+	p = append(p, body...)
+	hash := md5.Sum(p[32:])
+	copy(p[16:], hash[:])
+	return p
+}
+
+// pad pads b with zeroes to a multiple of 4 bytes, as packet bodies must be.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -34,3 +34,32 @@ func Div(a uint16, b uint16) uint16 {
 	}
 	return Gfilog[sum]
 }
+
+// Pow raises a to the power n.
+func Pow(a uint16, n uint32) uint16 {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return Gfilog[(uint64(Gflog[a])*uint64(n))%uint64(NWM1)]
+}
+
+// MulAdd multiplies every element of src by c, and adds the result to the matching element of dst.
+func MulAdd(dst []uint16, src []uint16, c uint16) {
+	if c == 0 {
+		return
+	}
+	logC := int32(Gflog[c])
+	for i, v := range src {
+		if v == 0 {
+			continue
+		}
+		sum := int32(Gflog[v]) + logC
+		if sum > int32(NWM1) {
+			sum -= int32(NWM1)
+		}
+		dst[i] ^= Gfilog[sum]
+	}
+}
@@ -69,3 +69,25 @@ func TestMulDivIdentity(t *testing.T) {
 		t.Fatalf("3 * (1 / 3) != 1. Actual: %d", res)
 	}
 }
+
+func TestPow(t *testing.T) {
+	expected := uint16(1)
+	for n := uint32(0); n < 20; n++ {
+		res := Pow(7, n)
+		if res != expected {
+			t.Fatalf("7 ^ %d != %d. Actual: %d", n, expected, res)
+		}
+		expected = Mul(expected, 7)
+	}
+}
+
+func TestMulAdd(t *testing.T) {
+	dst := []uint16{1, 2, 3}
+	MulAdd(dst, []uint16{11, 0, 3}, 7)
+	expected := []uint16{Add(1, Mul(11, 7)), 2, Add(3, Mul(3, 7))}
+	for i := range dst {
+		if dst[i] != expected[i] {
+			t.Fatalf("MulAdd result %v not equal to expected %v", dst, expected)
+		}
+	}
+}
@@ -2,52 +2,74 @@ package par2
 
 import (
 	"crypto/md5"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"reflect"
-	"unsafe"
+	"regexp"
+	"sort"
+	"time"
 
+	"github.com/esteth/usenet/pkg/logging"
+	"github.com/esteth/usenet/pkg/par2/gf"
 	"github.com/esteth/usenet/pkg/par2/reedsolomon"
 	"github.com/esteth/usenet/pkg/par2/scanner"
+	"github.com/esteth/usenet/pkg/storage"
 )
 
+// md516Length is the number of bytes at the start of a file covered by its MD5-16k hash.
+const md516Length = 16 * 1024
+
+// ErrNotEnoughRecovery is returned by Repair when there are fewer recovery slices than damaged slices.
+var ErrNotEnoughRecovery = errors.New("not enough recovery slices to repair")
+
+var par2File = regexp.MustCompile(`(?i)\.par2$`)
+
 // An Archive represents the contents of an PAR 2.0 archive.
 //
 // PAR 2.0 archives may be split across multiple files.
 type Archive struct {
-	// baseDirectory is the absolute path to the directory containing the recovery set.
-	baseDirectory string
-	// parFiles is the set of all PAR 2.0 files contained in the archive.
-	// Notably, it does not include the "recovery set", only the par2 files themselves.
-	parFiles []*os.File
+	// store holds the recovery set, and the PAR 2.0 files.
+	store storage.Storage
 	// sliceSize is the size of slices across the entire archive.
 	sliceSize uint64
 	// recoveryFileIDs is a slice containing all file IDs we expect to find in the archive.
 	recoveryFileIDs [][16]byte
 	// recoverySet is a map from file ID to metadata about that file.
 	recoverySet map[[16]byte]*recoveryFile
+	// recoverySlices is a map from exponent to the location of the recovery slice on disk.
+	recoverySlices map[uint32]recoveryData
 	// creator is the arbitrary text identifying the creator of the archive.
 	creator string
+	// log receives diagnostics about verification and repair.
+	log logging.Logger
+}
+
+// SetLogger sets the logger that progress verifying and repairing the recovery set is written to.
+func (a *Archive) SetLogger(log logging.Logger) {
+	a.log = log
 }
 
 // recoveryFile represents a single file from the archive's recovery set.
 type recoveryFile struct {
-	ID           [16]byte
-	MD5          [16]byte
-	MD516        [16]byte
-	Length       uint64
-	Name         string
-	SliceMD5s    [][16]byte
-	SliceCRC32s  [][4]byte
-	RecoveryData []recoveryData
+	ID          [16]byte
+	MD5         [16]byte
+	MD516       [16]byte
+	Length      uint64
+	Name        string
+	SliceMD5s   [][16]byte
+	SliceCRC32s [][4]byte
 }
 
-// recoveryData represents a single piece of recovery data on disk.
+// recoveryData represents a single piece of recovery data in a PAR 2.0 file.
 type recoveryData struct {
-	exponent   uint32
-	filePath   string
+	exponent uint32
+	// name is the name of the PAR 2.0 file holding the data in the archive's storage.
+	name       string
 	fileOffset uint32
 }
 
@@ -66,43 +88,34 @@ func (rf *recoveryFile) populateChecksums(fsc scanner.FileSliceChecksumPacket) {
 	rf.SliceCRC32s = fsc.SliceCRC32s
 }
 
-func (rf *recoveryFile) addRecoveryData(rs scanner.RecoverySlicePacket) {
-	rf.RecoveryData = append(rf.RecoveryData, recoveryData{
-		exponent:   rs.Exponent,
-		filePath:   rs.RecoveryDataFilePath,
-		fileOffset: rs.RecoveryDataFileOffset,
-	})
-}
-
 func (rf recoveryFile) sliceCount() int {
 	return len(rf.SliceMD5s)
 }
 
-// Validate verifies the checksums of the recovery file, returning nil iff all files are undamaged.
-func (rf recoveryFile) validate(baseDirectory string, sliceSize uint64) ([]int, error) {
+// Validate verifies the checksums of the recovery file, returning the indices of damaged slices.
+//
+// A missing file has every slice damaged, as does a file too short to contain them.
+func (rf recoveryFile) validate(store storage.Storage, sliceSize uint64) ([]int, error) {
 	badSlices := make([]int, 0)
 
-	f, err := os.Open(filepath.Join(baseDirectory, rf.Name))
+	f, err := store.Open(rf.Name)
+	if errors.Is(err, fs.ErrNotExist) {
+		for i := range rf.SliceMD5s {
+			badSlices = append(badSlices, i)
+		}
+		return badSlices, nil
+	}
 	if err != nil {
-		return badSlices, fmt.Errorf("Could not find expected file to validate at %s", rf.Name)
+		return badSlices, fmt.Errorf("Could not open file to validate at %s: %w", rf.Name, err)
 	}
 	defer f.Close()
 
+	r := storage.NewReader(f)
 	buf := make([]byte, sliceSize)
 	for i, expectedChecksum := range rf.SliceMD5s {
-		bytesRead, err := f.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return badSlices, fmt.Errorf("Could not read from recovery file %s: %w", rf.Name, err)
-			}
-		}
-		// The specification says that "empty" bytes should be zeroed.
-		for i := uint64(bytesRead); i < sliceSize; i++ {
-			buf[i] = 0
+		if err := readSlice(r, buf); err != nil {
+			return badSlices, fmt.Errorf("Could not read from recovery file %s: %w", rf.Name, err)
 		}
-
 		actualChecksum := md5.Sum(buf)
 		if !reflect.DeepEqual(actualChecksum, expectedChecksum) {
 			badSlices = append(badSlices, i)
@@ -111,64 +124,25 @@ func (rf recoveryFile) validate(baseDirectory string, sliceSize uint64) ([]int,
 	return badSlices, nil
 }
 
-func (rf recoveryFile) repair(baseDirectory string, sliceSize uint64, missingSlices []int) error {
-	brokenFile, err := os.Open(filepath.Join(baseDirectory, rf.Name))
-	if err != nil {
-		return fmt.Errorf("Could not find expected file to validate at %s", rf.Name)
-	}
-	defer brokenFile.Close()
-
-	rawData := make([]byte, sliceSize)
-	if _, err = io.ReadFull(brokenFile, rawData); err != nil {
-		return fmt.Errorf("Could not read raw data from input file: %w", err)
-	}
-
-	// reinterpret-cast the raw data into a []uint16
-	numUint16s := uintptr(len(rawData)) * unsafe.Sizeof(rawData[0]) / unsafe.Sizeof(uint16(0))
-	data := unsafe.Slice((*uint16)(unsafe.Pointer(&rawData[0])), numUint16s)
-
-	//	checksums := make([]byte)
-	checksums := []uint16{11, 60570, 57778}
-	identity, err := reedsolomon.IdentityMatrix(len(data))
-	if err != nil {
-		return fmt.Errorf("could not create identity matrix: %w", err)
-	}
-	vandermonde, err := reedsolomon.NewVandermondePar2Matrix(len(checksums), len(data))
-	if err != nil {
-		return fmt.Errorf("could not create vandermonde matrix: %w", err)
-	}
-	parityIdentity, err := identity.AugmentVertical(vandermonde)
-	if err != nil {
-		return fmt.Errorf("could not stack identity and vandermonde matrix: %w", err)
-	}
-	sourceColumn, err := reedsolomon.NewMatrixColumn(append(data, checksums...))
-	if err != nil {
-		return fmt.Errorf("could not create column with data and checksums: %w", err)
-	}
-	solve, err := parityIdentity.Augment(sourceColumn)
-	if err != nil {
-		return fmt.Errorf("could not create problem matrix: %w", err)
-	}
-
-	// Delete some rows to pretend we lost some data
-	solve = append(solve[:4], solve[7:]...)
-
-	err = solve.GaussianElimination()
-	if err != nil {
-		return fmt.Errorf("could not solve problem matrix: %w", err)
+// readSlice reads the next slice from r into buf.
+//
+// The specification says that "empty" bytes should be zeroed, so a slice cut short by the end of
+// the file is padded with zeroes.
+func readSlice(r io.Reader, buf []byte) error {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
 	}
-
-	recoveredData := make([]uint16, len(data))
-	for r, row := range solve {
-		recoveredData[r] = row[len(row)-1]
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
 	}
-
-	// TODO: Do something with the recoveredData.
-
-	return nil
+	return err
 }
 
-// Validate verifies the checksums of the recovery set files, returning nil iff all files are undamaged.
+// Validate verifies the checksums of the recovery set files, returning the indices of damaged slices.
+//
+// Slices are numbered across the whole recovery set, in the order of the set's file IDs. An empty
+// result means every file is intact.
 func (a *Archive) Validate() ([]int, error) {
 	badSlices := make([]int, 0)
 	sliceOffset := 0
@@ -177,7 +151,11 @@ func (a *Archive) Validate() ([]int, error) {
 		if !exists {
 			return badSlices, fmt.Errorf("Could not find checksum data for file ID %v", id)
 		}
-		badFileSlices, err := recoveryFile.validate(a.baseDirectory, a.sliceSize)
+		badFileSlices, err := recoveryFile.validate(a.store, a.sliceSize)
+		if len(badFileSlices) > 0 {
+			logging.OrDiscard(a.log).Debug("Found damaged slices",
+				"file", recoveryFile.Name, "damaged", len(badFileSlices), "slices", len(recoveryFile.SliceMD5s))
+		}
 		for i := range badFileSlices {
 			badFileSlices[i] = badFileSlices[i] + sliceOffset
 		}
@@ -190,53 +168,356 @@ func (a *Archive) Validate() ([]int, error) {
 	return badSlices, nil
 }
 
-// Repair attempts to repair the recovery set files if they are damaged.
+// RecoverySlices returns the number of recovery slices available to repair the recovery set.
+func (a *Archive) RecoverySlices() int {
+	return len(a.recoverySlices)
+}
+
+// SliceSize returns the size in bytes of the slices the recovery set is divided into.
+func (a *Archive) SliceSize() uint64 {
+	return a.sliceSize
+}
+
+// A File is a file protected by a recovery set.
+type File struct {
+	Name   string
+	Length uint64
+}
+
+// Files returns the files protected by the recovery set, in the order their slices are numbered.
+// Files whose descriptions are missing from the PAR2 files are left out.
+func (a *Archive) Files() []File {
+	files := make([]File, 0, len(a.recoveryFileIDs))
+	for _, id := range a.recoveryFileIDs {
+		if rf, ok := a.recoverySet[id]; ok && rf.Name != "" {
+			files = append(files, File{Name: rf.Name, Length: rf.Length})
+		}
+	}
+	return files
+}
+
+// Repair rebuilds the given damaged slices of the recovery set files from the recovery slices,
+// and truncates each file to its expected length.
 //
 // It returns an error if it was unable to complete the repairs.
 func (a *Archive) Repair(missingSlices []int) error {
-	firstSliceInFile := 0
+	if len(missingSlices) == 0 {
+		return nil
+	}
+	if len(missingSlices) > len(a.recoverySlices) {
+		return fmt.Errorf("%w: %d slices are damaged, but only %d recovery slices are available",
+			ErrNotEnoughRecovery, len(missingSlices), len(a.recoverySlices))
+	}
+	log := logging.OrDiscard(a.log)
+	log.Info("Repairing recovery set", "damaged", len(missingSlices), "recovery", len(a.recoverySlices))
+	started := time.Now()
+
+	files := make([]*recoveryFile, 0, len(a.recoveryFileIDs))
 	for _, id := range a.recoveryFileIDs {
 		recoveryFile, exists := a.recoverySet[id]
 		if !exists {
 			return fmt.Errorf("Could not find checksum data for file ID %v", id)
 		}
+		files = append(files, recoveryFile)
+	}
+	totalSlices := 0
+	for _, rf := range files {
+		totalSlices += rf.sliceCount()
+	}
+	constants := reedsolomon.Par2Constants(totalSlices)
 
-		// TODO: Optimize this to subslice missingSlices instead of copying.
-		lastSliceInFile := firstSliceInFile + recoveryFile.sliceCount() - 1
-		missingFileSlices := make([]int, 0)
-		for _, missingSlice := range missingSlices {
-			if missingSlice >= firstSliceInFile && missingSlice <= lastSliceInFile {
-				missingFileSlices = append(missingFileSlices, missingSlice)
-			}
+	exponents := make([]uint32, 0, len(a.recoverySlices))
+	for exponent := range a.recoverySlices {
+		exponents = append(exponents, exponent)
+	}
+	sort.Slice(exponents, func(i, j int) bool { return exponents[i] < exponents[j] })
+	exponents = exponents[:len(missingSlices)]
+
+	// Each recovery slice is the sum of every input slice multiplied by a power of its constant.
+	// Subtracting the contribution of the intact slices leaves a system of linear equations in
+	// the missing slices.
+	recovery := make([][]uint16, len(exponents))
+	buf := make([]byte, a.sliceSize)
+	for j, exponent := range exponents {
+		if err := a.readRecoverySlice(a.recoverySlices[exponent], buf); err != nil {
+			return err
+		}
+		recovery[j] = toWords(buf, nil)
+	}
+
+	missing := make(map[int]bool, len(missingSlices))
+	for _, s := range missingSlices {
+		missing[s] = true
+	}
+	words := make([]uint16, a.sliceSize/2)
+	slice := 0
+	for _, rf := range files {
+		if err := a.subtractIntactSlices(rf, slice, missing, constants, exponents, recovery, buf, words); err != nil {
+			return err
+		}
+		slice += rf.sliceCount()
+	}
+
+	rows := make([][]uint16, len(exponents))
+	for j, exponent := range exponents {
+		rows[j] = make([]uint16, len(missingSlices))
+		for i, s := range missingSlices {
+			rows[j][i] = gf.Pow(constants[s], exponent)
+		}
+	}
+	coefficients, err := reedsolomon.NewMatrixData(rows)
+	if err != nil {
+		return fmt.Errorf("Could not create repair matrix: %w", err)
+	}
+	inverse, err := coefficients.Invert()
+	if err != nil {
+		return fmt.Errorf("Could not invert repair matrix: %w", err)
+	}
+
+	for i, s := range missingSlices {
+		for w := range words {
+			words[w] = 0
+		}
+		for j := range exponents {
+			gf.MulAdd(words, recovery[j], inverse.Cell(i, j))
+		}
+		if err := a.writeSlice(files, s, fromWords(words, buf)); err != nil {
+			return err
 		}
-		firstSliceInFile += recoveryFile.sliceCount()
+	}
+
+	for _, rf := range files {
+		if err := a.truncate(rf); err != nil {
+			return err
+		}
+	}
+	log.Info("Repaired recovery set", "slices", len(missingSlices), "duration", time.Since(started))
+	return nil
+}
 
-		if err := recoveryFile.repair(a.baseDirectory, a.sliceSize, missingFileSlices); err != nil {
-			return fmt.Errorf("Could not validate recovery file %v: %w", id, err)
+// truncate cuts a repaired file to its expected length, as its last slice is written in full.
+func (a *Archive) truncate(rf *recoveryFile) error {
+	f, err := a.store.Create(rf.Name)
+	if err != nil {
+		return fmt.Errorf("Could not open repaired file %s: %w", rf.Name, err)
+	}
+	if err := f.Truncate(int64(rf.Length)); err != nil {
+		f.Close()
+		return fmt.Errorf("Could not truncate repaired file %s: %w", rf.Name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Could not close repaired file %s: %w", rf.Name, err)
+	}
+	return nil
+}
+
+// subtractIntactSlices removes the contribution of each of rf's intact slices from the recovery
+// slices. first is the index of rf's first slice within the recovery set.
+func (a *Archive) subtractIntactSlices(rf *recoveryFile, first int, missing map[int]bool, constants []uint16,
+	exponents []uint32, recovery [][]uint16, buf []byte, words []uint16) error {
+	f, err := a.store.Open(rf.Name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Could not open %s: %w", rf.Name, err)
+	}
+	defer f.Close()
+
+	r := storage.NewReader(f)
+	for i := 0; i < rf.sliceCount(); i++ {
+		if err := readSlice(r, buf); err != nil {
+			return fmt.Errorf("Could not read from %s: %w", rf.Name, err)
+		}
+		if missing[first+i] {
+			continue
+		}
+		toWords(buf, words)
+		for j, exponent := range exponents {
+			gf.MulAdd(recovery[j], words, gf.Pow(constants[first+i], exponent))
 		}
 	}
 	return nil
 }
 
-// FromFiles creates a new Archive struct by reading PAR 2.0 files from disk.
-func FromFiles(baseDirectory string, fs ...*os.File) (Archive, error) {
+// readRecoverySlice reads the recovery slice described by rd into buf.
+func (a *Archive) readRecoverySlice(rd recoveryData, buf []byte) error {
+	f, err := a.store.Open(rd.name)
+	if err != nil {
+		return fmt.Errorf("Could not open recovery file %s: %w", rd.name, err)
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(buf, int64(rd.fileOffset)); err != nil {
+		return fmt.Errorf("Could not read recovery slice %d from %s: %w", rd.exponent, rd.name, err)
+	}
+	return nil
+}
+
+// writeSlice writes the data for the given slice of the recovery set into the file it belongs to.
+func (a *Archive) writeSlice(files []*recoveryFile, slice int, data []byte) error {
+	for _, rf := range files {
+		if slice >= rf.sliceCount() {
+			slice -= rf.sliceCount()
+			continue
+		}
+		f, err := a.store.Create(rf.Name)
+		if err != nil {
+			return fmt.Errorf("Could not open %s for repair: %w", rf.Name, err)
+		}
+		if _, err := f.WriteAt(data, int64(slice)*int64(a.sliceSize)); err != nil {
+			f.Close()
+			return fmt.Errorf("Could not write repaired slice to %s: %w", rf.Name, err)
+		}
+		return f.Close()
+	}
+	return fmt.Errorf("Slice %d is not part of the recovery set", slice)
+}
+
+// toWords interprets data as little-endian 16-bit words, storing them in words if it is large enough.
+func toWords(data []byte, words []uint16) []uint16 {
+	if len(words) < len(data)/2 {
+		words = make([]uint16, len(data)/2)
+	}
+	for i := range words[:len(data)/2] {
+		words[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+	return words
+}
+
+// fromWords writes words into buf as little-endian bytes, returning buf.
+func fromWords(words []uint16, buf []byte) []byte {
+	for i, w := range words {
+		binary.LittleEndian.PutUint16(buf[2*i:], w)
+	}
+	return buf
+}
+
+// RestoreNames renames files in the root of the archive's storage which belong to the recovery set, but which
+// were posted under a different name. Files are matched by the hash of their first 16KiB.
+//
+// It returns the names of the files which were restored.
+func (a *Archive) RestoreNames() ([]string, error) {
+	wanted := make(map[[16]byte]*recoveryFile)
+	for _, rf := range a.recoverySet {
+		if _, err := a.store.Stat(rf.Name); errors.Is(err, fs.ErrNotExist) {
+			wanted[rf.MD516] = rf
+		}
+	}
+	if len(wanted) == 0 {
+		return nil, nil
+	}
+
+	entries, err := a.store.ReadDir(".")
+	if err != nil {
+		return nil, fmt.Errorf("Could not list files: %w", err)
+	}
+	restored := make([]string, 0)
+	buf := make([]byte, md516Length)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || par2File.MatchString(entry.Name()) {
+			continue
+		}
+		f, err := a.store.Open(entry.Name())
+		if err != nil {
+			continue
+		}
+		n, _ := io.ReadFull(storage.NewReader(f), buf)
+		f.Close()
+
+		rf, ok := wanted[md5.Sum(buf[:n])]
+		if !ok {
+			continue
+		}
+		// Recovery set names are untrusted, so only allow them to name files in the storage.
+		if !fs.ValidPath(rf.Name) {
+			continue
+		}
+		if err := a.store.Rename(entry.Name(), rf.Name); err != nil {
+			return restored, fmt.Errorf("Could not rename %s to %s: %w", entry.Name(), rf.Name, err)
+		}
+		delete(wanted, rf.MD516)
+		restored = append(restored, rf.Name)
+		logging.OrDiscard(a.log).Info("Restored file name", "from", entry.Name(), "to", rf.Name)
+	}
+	return restored, nil
+}
+
+// source is a PAR 2.0 file to read an archive from, with its name in the archive's storage.
+type source struct {
+	r    io.ReadSeeker
+	name string
+}
+
+// FromFiles creates a new Archive struct by reading PAR 2.0 files from disk. The recovery set is
+// found in baseDirectory, which must also hold the files.
+//
+// Damaged packets are skipped, so that a recovery set can be read as long as each of its packets
+// is intact in at least one of the files.
+func FromFiles(baseDirectory string, files ...*os.File) (Archive, error) {
 	baseDirectory, err := filepath.Abs(baseDirectory)
 	if err != nil {
 		return Archive{}, fmt.Errorf("Could not convert base directory %s to absolute path: %w", baseDirectory, err)
 	}
+	sources := make([]source, 0, len(files))
+	for _, f := range files {
+		path, err := filepath.Abs(f.Name())
+		if err != nil {
+			return Archive{}, fmt.Errorf("Could not convert %s to absolute path: %w", f.Name(), err)
+		}
+		name, err := filepath.Rel(baseDirectory, path)
+		if err != nil {
+			return Archive{}, fmt.Errorf("Could not find %s in %s: %w", f.Name(), baseDirectory, err)
+		}
+		sources = append(sources, source{r: f, name: filepath.ToSlash(name)})
+	}
+	return fromSources(storage.Dir(baseDirectory), sources)
+}
+
+// FromStorage creates a new Archive struct by reading the named PAR 2.0 files from store, which
+// also holds the recovery set.
+//
+// Damaged packets are skipped, as with FromFiles.
+func FromStorage(store storage.Storage, names ...string) (Archive, error) {
+	sources := make([]source, 0, len(names))
+	defer func() {
+		for _, s := range sources {
+			s.r.(io.Closer).Close()
+		}
+	}()
+	for _, name := range names {
+		f, err := store.Open(name)
+		if err != nil {
+			return Archive{}, fmt.Errorf("Could not open %s: %w", name, err)
+		}
+		sources = append(sources, source{r: readCloser{storage.NewReader(f), f}, name: name})
+	}
+	// The files are closed once read, as recovery data is opened by name when needed.
+	return fromSources(store, sources)
+}
+
+// readCloser reads a storage file in order, closing the file when it is closed.
+type readCloser struct {
+	io.ReadSeeker
+	io.Closer
+}
+
+// fromSources reads an archive from PAR 2.0 files, whose recovery set is in store.
+func fromSources(store storage.Storage, sources []source) (Archive, error) {
 	var sliceSize uint64 = 0
 	recoveryFileIDs := make([][16]byte, 0)
 	recoverySet := make(map[[16]byte]*recoveryFile)
+	recoverySlices := make(map[uint32]recoveryData)
 	creatorText := ""
 
-	for _, f := range fs {
-		parScanner := scanner.NewScanner(f)
+	for _, src := range sources {
+		parScanner := scanner.NewNamedScanner(src.r, src.name)
 		for parScanner.Scan() {
 			packet := parScanner.Packet()
 			if mainPacket, ok := packet.(scanner.MainPacket); ok {
-				sliceSize = mainPacket.SliceSize
-				for _, fileID := range mainPacket.RecoveryFileIDs {
-					recoveryFileIDs = append(recoveryFileIDs, fileID)
+				// Every PAR 2.0 file repeats the main packet, so only take the first.
+				if sliceSize == 0 {
+					sliceSize = mainPacket.SliceSize
+					recoveryFileIDs = append(recoveryFileIDs, mainPacket.RecoveryFileIDs...)
 				}
 			}
 			if fd, ok := packet.(scanner.FileDescriptionPacket); ok {
@@ -252,21 +533,47 @@ func FromFiles(baseDirectory string, fs ...*os.File) (Archive, error) {
 				recoverySet[fsc.FileID].populateChecksums(fsc)
 			}
 			if rsp, ok := packet.(scanner.RecoverySlicePacket); ok {
-				if rf, exists := recoverySet[rsp.FileID]; !exists {
-					rf.addRecoveryData(rsp)
+				recoverySlices[rsp.Exponent] = recoveryData{
+					exponent:   rsp.Exponent,
+					name:       rsp.RecoveryDataFilePath,
+					fileOffset: rsp.RecoveryDataFileOffset,
 				}
 			}
 			if creatorPacket, ok := packet.(scanner.CreatorPacket); ok {
 				creatorText = creatorPacket.Creator
 			}
 		}
+		// A damaged file is read as far as possible; whatever it was missing may be in another file.
+	}
+	if sliceSize == 0 {
+		return Archive{}, fmt.Errorf("Could not find a main packet in the PAR 2.0 files")
 	}
 	return Archive{
-		baseDirectory:   baseDirectory,
-		parFiles:        fs,
+		store:           store,
 		sliceSize:       sliceSize,
 		recoveryFileIDs: recoveryFileIDs,
 		recoverySet:     recoverySet,
+		recoverySlices:  recoverySlices,
 		creator:         creatorText,
 	}, nil
 }
+
+// FromDirectory creates a new Archive struct from every PAR 2.0 file in dir.
+//
+// It returns os.ErrNotExist if there are no PAR 2.0 files in dir.
+func FromDirectory(dir string) (Archive, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return Archive{}, fmt.Errorf("Could not list %s: %w", dir, err)
+	}
+	names := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() && par2File.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return Archive{}, fmt.Errorf("No PAR 2.0 files in %s: %w", dir, os.ErrNotExist)
+	}
+	return FromStorage(storage.Dir(dir), names...)
+}
@@ -2,11 +2,15 @@ package par2
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"testing"
+
+	"github.com/esteth/usenet/pkg/storage"
 )
 
 func copyFile(t *testing.T, src string, dst string) {
@@ -120,7 +124,18 @@ func TestValidateBrokenFiles(t *testing.T) {
 	}
 }
 
+// requireSamples skips the test unless the sample files it needs are in testdata. The samples are
+// too large to keep in the repository.
+func requireSamples(t *testing.T, names ...string) {
+	for _, name := range names {
+		if _, err := os.Stat(path.Join("testdata", name)); err != nil {
+			t.Skipf("Sample file %s is not available: %v", name, err)
+		}
+	}
+}
+
 func TestRepairValidArchive(t *testing.T) {
+	requireSamples(t, "sample.mp4")
 	f, err := os.Open("testdata/sample.mp4.par2")
 	defer f.Close()
 	if err != nil {
@@ -142,6 +157,7 @@ func TestRepairValidArchive(t *testing.T) {
 }
 
 func TestRepairBrokenFiles(t *testing.T) {
+	requireSamples(t, "sample.mp4", "sample.broken.mp4")
 	tempDir := t.TempDir()
 	copyFile(t, "testdata/sample.broken.mp4", tempDir)
 	copyFile(t, "testdata/sample.broken.mp4.par2", tempDir)
@@ -172,3 +188,232 @@ func TestRepairBrokenFiles(t *testing.T) {
 		t.Errorf("Repaired file contents not same as reference file")
 	}
 }
+
+// writePar2 writes a PAR 2.0 recovery set for files, which must already be written to dir.
+func writePar2(t *testing.T, dir string, base string, files map[string][]byte, sliceSize int, volumes []int) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	if _, err := Create(dir, base, names, sliceSize, volumes); err != nil {
+		t.Fatalf("Could not create par2 files: %v", err)
+	}
+}
+
+func testFiles() map[string][]byte {
+	files := map[string][]byte{
+		"first.bin":  make([]byte, 10000),
+		"second.bin": make([]byte, 3001),
+	}
+	for name, data := range files {
+		for i := range data {
+			data[i] = byte(i*31 + len(name))
+		}
+	}
+	return files
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string][]byte) {
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+	}
+}
+
+func TestRepairDamagedSlices(t *testing.T) {
+	dir := t.TempDir()
+	files := testFiles()
+	writeTestFiles(t, dir, files)
+	writePar2(t, dir, "set", files, 1024, []int{2, 2})
+
+	// Damage a slice in the middle of one file, and cut the last two slices off the other.
+	damaged := append([]byte(nil), files["first.bin"]...)
+	damaged[5000] ^= 0xFF
+	if err := os.WriteFile(filepath.Join(dir, "first.bin"), damaged, 0666); err != nil {
+		t.Fatalf("Could not damage file: %v", err)
+	}
+	if err := os.Truncate(filepath.Join(dir, "second.bin"), 1500); err != nil {
+		t.Fatalf("Could not truncate file: %v", err)
+	}
+
+	archive, err := FromDirectory(dir)
+	if err != nil {
+		t.Fatalf("Could not create Archive from directory: %v", err)
+	}
+	if archive.RecoverySlices() != 4 {
+		t.Errorf("Found %d recovery slices, expected 4", archive.RecoverySlices())
+	}
+	badSlices, err := archive.Validate()
+	if err != nil {
+		t.Fatalf("Could not validate archive: %v", err)
+	}
+	if len(badSlices) != 3 {
+		t.Fatalf("Found bad slices %v, expected 3", badSlices)
+	}
+	if err = archive.Repair(badSlices); err != nil {
+		t.Fatalf("Could not repair archive: %v", err)
+	}
+
+	for name, data := range files {
+		repaired, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Could not read repaired file: %v", err)
+		}
+		if !bytes.Equal(repaired, data) {
+			t.Errorf("Repaired %s not equal to original", name)
+		}
+	}
+	if badSlices, _ = archive.Validate(); len(badSlices) != 0 {
+		t.Errorf("Repaired archive has bad slices %v", badSlices)
+	}
+}
+
+func TestRepairInStorage(t *testing.T) {
+	dir := t.TempDir()
+	files := testFiles()
+	writeTestFiles(t, dir, files)
+	writePar2(t, dir, "set", files, 1024, []int{2, 2})
+
+	// Copy the recovery set into memory, leaving out one file and damaging the other.
+	store := storage.NewMemory()
+	for _, name := range []string{"set.par2", "set.vol0+2.par2", "set.vol2+2.par2", "first.bin"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Could not read %s: %v", name, err)
+		}
+		if name == "first.bin" {
+			data[100] ^= 0xFF
+		}
+		if err := storage.WriteFile(store, name, data); err != nil {
+			t.Fatalf("Could not write %s: %v", name, err)
+		}
+	}
+
+	archive, err := FromStorage(store, "set.par2", "set.vol0+2.par2", "set.vol2+2.par2")
+	if err != nil {
+		t.Fatalf("Could not create Archive from storage: %v", err)
+	}
+	badSlices, err := archive.Validate()
+	if err != nil {
+		t.Fatalf("Could not validate archive: %v", err)
+	}
+	if len(badSlices) != 4 {
+		t.Fatalf("Found bad slices %v, expected 4", badSlices)
+	}
+	if err = archive.Repair(badSlices); err != nil {
+		t.Fatalf("Could not repair archive: %v", err)
+	}
+	for name, data := range files {
+		repaired, err := storage.ReadFile(store, name)
+		if err != nil {
+			t.Fatalf("Could not read repaired file: %v", err)
+		}
+		if !bytes.Equal(repaired, data) {
+			t.Errorf("Repaired %s not equal to original", name)
+		}
+	}
+}
+
+func TestRepairMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	files := testFiles()
+	writeTestFiles(t, dir, files)
+	writePar2(t, dir, "set", files, 1024, []int{1, 2, 4})
+	os.Remove(filepath.Join(dir, "second.bin"))
+
+	archive, err := FromDirectory(dir)
+	if err != nil {
+		t.Fatalf("Could not create Archive from directory: %v", err)
+	}
+	badSlices, err := archive.Validate()
+	if err != nil {
+		t.Fatalf("Could not validate archive: %v", err)
+	}
+	if err = archive.Repair(badSlices); err != nil {
+		t.Fatalf("Could not repair archive: %v", err)
+	}
+	repaired, err := os.ReadFile(filepath.Join(dir, "second.bin"))
+	if err != nil {
+		t.Fatalf("Could not read repaired file: %v", err)
+	}
+	if !bytes.Equal(repaired, files["second.bin"]) {
+		t.Errorf("Repaired file not equal to original")
+	}
+}
+
+func TestRepairNotEnoughRecovery(t *testing.T) {
+	dir := t.TempDir()
+	files := testFiles()
+	writeTestFiles(t, dir, files)
+	writePar2(t, dir, "set", files, 1024, []int{2})
+	os.Remove(filepath.Join(dir, "first.bin"))
+
+	archive, err := FromDirectory(dir)
+	if err != nil {
+		t.Fatalf("Could not create Archive from directory: %v", err)
+	}
+	badSlices, err := archive.Validate()
+	if err != nil {
+		t.Fatalf("Could not validate archive: %v", err)
+	}
+	if err = archive.Repair(badSlices); !errors.Is(err, ErrNotEnoughRecovery) {
+		t.Errorf("Expected repair to fail for lack of recovery slices, got %v", err)
+	}
+}
+
+func TestRestoreNames(t *testing.T) {
+	dir := t.TempDir()
+	files := testFiles()
+	writeTestFiles(t, dir, files)
+	writePar2(t, dir, "set", files, 1024, nil)
+	if err := os.Rename(filepath.Join(dir, "second.bin"), filepath.Join(dir, "a1b2c3d4e5f6")); err != nil {
+		t.Fatalf("Could not rename file: %v", err)
+	}
+
+	archive, err := FromDirectory(dir)
+	if err != nil {
+		t.Fatalf("Could not create Archive from directory: %v", err)
+	}
+	restored, err := archive.RestoreNames()
+	if err != nil {
+		t.Fatalf("Could not restore names: %v", err)
+	}
+	if !reflect.DeepEqual(restored, []string{"second.bin"}) {
+		t.Errorf("Restored %v, expected [second.bin]", restored)
+	}
+	if badSlices, _ := archive.Validate(); len(badSlices) != 0 {
+		t.Errorf("Archive with restored names has bad slices %v", badSlices)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	files := testFiles()
+	writeTestFiles(t, dir, files)
+	written, err := Create(dir, "set", []string{"first.bin", "second.bin"}, 1024, []int{1, 2})
+	if err != nil {
+		t.Fatalf("Could not create par2 files: %v", err)
+	}
+	expected := []string{"set.par2", "set.vol0+1.par2", "set.vol1+2.par2"}
+	for i, path := range written {
+		if filepath.Dir(path) != dir || filepath.Base(path) != expected[i] {
+			t.Errorf("Unexpected file written %s", path)
+		}
+	}
+
+	archive, err := FromDirectory(dir)
+	if err != nil {
+		t.Fatalf("Could not create Archive from directory: %v", err)
+	}
+	if archive.SliceSize() != 1024 || archive.RecoverySlices() != 3 || archive.creator != creator {
+		t.Errorf("Unexpected archive: slice size %d, %d recovery slices, creator %q",
+			archive.SliceSize(), archive.RecoverySlices(), archive.creator)
+	}
+	if badSlices, err := archive.Validate(); err != nil || len(badSlices) != 0 {
+		t.Errorf("Freshly created archive has bad slices %v: %v", badSlices, err)
+	}
+	if _, err := Create(dir, "set", []string{"first.bin"}, 1022, nil); err == nil {
+		t.Errorf("Expected a slice size which isn't a multiple of 4 to be rejected")
+	}
+}
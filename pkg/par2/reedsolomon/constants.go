@@ -29,3 +29,13 @@ func (p *constantPool) Next() uint16 {
 	}
 	return p.currentValue
 }
+
+// Par2Constants returns the constants the PAR 2.0 specification assigns to the first n input slices.
+func Par2Constants(n int) []uint16 {
+	constants := make([]uint16, n)
+	pool := newConstantPool()
+	for i := range constants {
+		constants[i] = pool.Next()
+	}
+	return constants
+}
@@ -24,3 +24,13 @@ func TestFirstFewConstants(t *testing.T) {
 		}
 	}
 }
+
+func TestPar2Constants(t *testing.T) {
+	constants := Par2Constants(4)
+	expected := []uint16{2, 4, 16, 128}
+	for i := range expected {
+		if constants[i] != expected[i] {
+			t.Fatalf("failed at index %d: actually %d, expected %d", i, constants[i], expected[i])
+		}
+	}
+}
@@ -18,6 +18,11 @@ func (m matrix) cell(row, col int) uint16 {
 	return m.data[row*m.cols+col]
 }
 
+// Cell returns the value at the given row and column of the matrix.
+func (m matrix) Cell(row, col int) uint16 {
+	return m.cell(row, col)
+}
+
 func (m matrix) row(row int) []uint16 {
 	return m.data[row*m.cols : (row+1)*m.cols]
 }
@@ -213,3 +218,26 @@ func (m matrix) AugmentVertical(other matrix) (matrix, error) {
 	copy(newM.data[len(m.data):], other.data)
 	return newM, nil
 }
+
+// Invert returns the inverse of the square matrix m, modifying neither matrix in-place.
+func (m matrix) Invert() (matrix, error) {
+	if m.rows != m.cols {
+		return invalidMatrix, errColSizeMismatch
+	}
+	identity, err := IdentityMatrix(m.rows)
+	if err != nil {
+		return invalidMatrix, err
+	}
+	augmented, err := m.Augment(identity)
+	if err != nil {
+		return invalidMatrix, err
+	}
+	if err = augmented.GaussianElimination(); err != nil {
+		return invalidMatrix, err
+	}
+	inverse := NewMatrix(m.rows, m.cols)
+	for r := 0; r < m.rows; r++ {
+		copy(inverse.row(r), augmented.row(r)[m.cols:])
+	}
+	return inverse, nil
+}
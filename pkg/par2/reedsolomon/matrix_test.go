@@ -295,3 +295,31 @@ func BenchmarkAugmentVertical(b *testing.B) {
 		m1.AugmentVertical(m2)
 	}
 }
+
+func TestInvert(t *testing.T) {
+	m, err := NewMatrixData(
+		[][]uint16{
+			{1, 2, 3},
+			{2, 3, 5},
+			{3, 4, 9},
+		},
+	)
+	if err != nil {
+		t.Fatalf("could not create matrix: %v", err)
+	}
+	inverse, err := m.Invert()
+	if err != nil {
+		t.Fatalf("could not invert matrix: %v", err)
+	}
+	product, err := m.Mul(inverse)
+	if err != nil {
+		t.Fatalf("could not multiply: %v", err)
+	}
+	id, err := IdentityMatrix(3)
+	if err != nil {
+		t.Fatalf("could not create identity matrix: %v", err)
+	}
+	if !reflect.DeepEqual(product, id) {
+		t.Fatalf("matrix multiplied by its inverse is not the identity: %v", product)
+	}
+}
@@ -2,6 +2,7 @@ package scanner
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -22,8 +23,14 @@ type Scanner struct {
 
 // NewScanner creates a new Scanner reading the given file.
 func NewScanner(f *os.File) *Scanner {
+	return NewNamedScanner(f, f.Name())
+}
+
+// NewNamedScanner creates a new Scanner reading r, which holds the file with the given name. The
+// name is recorded in the recovery slice packets read from r, to find their data by.
+func NewNamedScanner(r io.ReadSeeker, name string) *Scanner {
 	z := new(Scanner)
-	z.reset(f)
+	z.reset(r, name)
 	return z
 }
 
@@ -39,50 +46,107 @@ type packetHeader struct {
 	packetType    [16]byte
 }
 
-func (s *Scanner) reset(f *os.File) {
+func (s *Scanner) reset(r io.ReadSeeker, name string) {
 	*s = Scanner{
-		source:   f,
-		filename: f.Name(),
+		source:   r,
+		filename: name,
 		packet:   nil,
 		err:      nil,
 	}
 }
 
+// Scan advances to the next packet, which is then available through Packet.
+//
+// Packets whose checksum does not match their contents are damaged, and are skipped.
+// It returns false when there are no more packets, or an error occurred.
 func (s *Scanner) Scan() bool {
-	magicSequenceBytes := make([]byte, 8)
-	if _, err := io.ReadFull(s.source, magicSequenceBytes); err != nil {
-		if err != io.EOF {
-			s.err = fmt.Errorf("could not peek for magic sequence: %w", err)
+	for {
+		start, err := s.source.Seek(0, io.SeekCurrent)
+		if err != nil {
+			s.err = fmt.Errorf("could not read current file position: %w", err)
+			return false
+		}
+		magicSequenceBytes := make([]byte, 8)
+		if _, err := io.ReadFull(s.source, magicSequenceBytes); err != nil {
+			if err != io.EOF {
+				s.err = fmt.Errorf("could not peek for magic sequence: %w", err)
+			}
+			return false
+		}
+		if bytes.Compare(magicSequenceBytes, magicSequence) != 0 {
+			s.err = fmt.Errorf("could not find magic packet header in data")
+			return false
+		}
+
+		header, err := readHeader(s.source)
+		if err != nil {
+			s.err = fmt.Errorf("could not read packet header: %w", err)
+			return false
+		}
+		if header.packetLength < HEADER_LENGTH || header.packetLength%4 != 0 {
+			s.err = fmt.Errorf("invalid packet length %d", header.packetLength)
+			return false
+		}
+
+		intact, err := s.verify(start, header)
+		if err != nil {
+			s.err = err
+			return false
+		}
+		if intact {
+			s.packet, s.err = s.scanPacket(header)
+			if s.err != nil {
+				return false
+			}
+		}
+
+		// Not every packet's body is read in full, so skip to the start of the next one.
+		if _, err := s.source.Seek(start+int64(header.packetLength), io.SeekStart); err != nil {
+			s.err = fmt.Errorf("could not seek to next packet: %w", err)
+			return false
+		}
+		if intact {
+			return true
 		}
-		return false
-	}
-	if bytes.Compare(magicSequenceBytes, magicSequence) != 0 {
-		s.err = fmt.Errorf("could not find magic packet header in data")
-		return false
 	}
+}
 
-	header, err := readHeader(s.source)
-	if err != nil {
-		s.err = fmt.Errorf("could not read packet header: %w", err)
-	}
-
-	packetTypeString := string(header.packetType[:])
-	if packetTypeString == mainPacketType {
-		s.packet, s.err = scanMainPacket(s.source, header)
-	} else if packetTypeString == fileDescriptionPacketType {
-		s.packet, s.err = scanFileDescriptionPacket(s.source, header)
-	} else if packetTypeString == fileSliceChecksumPacketType {
-		s.packet, s.err = scanFileSliceChecksumPacket(s.source, header)
-	} else if packetTypeString == recoverySlicePacketType {
-		s.packet, s.err = scanRecoverySlicePacket(s.source, s.filename)
-	} else if packetTypeString == creatorPacketType {
-		s.packet, s.err = scanCreatorPacket(s.source, header)
-	} else {
-		s.packet = &unknownPacket{
-			typ: packetTypeString,
+// verify checks the MD5 hash of the packet starting at start, leaving the source positioned at
+// the packet's body.
+func (s *Scanner) verify(start int64, header packetHeader) (bool, error) {
+	if _, err := s.source.Seek(start+32, io.SeekStart); err != nil {
+		return false, fmt.Errorf("could not seek to packet contents: %w", err)
+	}
+	hash := md5.New()
+	if _, err := io.CopyN(hash, s.source, int64(header.packetLength)-32); err != nil {
+		if err == io.EOF {
+			// The packet was cut short.
+			return false, nil
 		}
+		return false, fmt.Errorf("could not read packet contents: %w", err)
 	}
-	return true
+	if _, err := s.source.Seek(start+HEADER_LENGTH, io.SeekStart); err != nil {
+		return false, fmt.Errorf("could not seek to packet body: %w", err)
+	}
+	return bytes.Equal(hash.Sum(nil), header.md5Hash[:]), nil
+}
+
+func (s *Scanner) scanPacket(header packetHeader) (Packet, error) {
+	switch string(header.packetType[:]) {
+	case mainPacketType:
+		return scanMainPacket(s.source, header)
+	case fileDescriptionPacketType:
+		return scanFileDescriptionPacket(s.source, header)
+	case fileSliceChecksumPacketType:
+		return scanFileSliceChecksumPacket(s.source, header)
+	case recoverySlicePacketType:
+		return scanRecoverySlicePacket(s.source, s.filename)
+	case creatorPacketType:
+		return scanCreatorPacket(s.source, header)
+	}
+	return &unknownPacket{
+		typ: string(header.packetType[:]),
+	}, nil
 }
 
 // Err returns the first non-EOF error that was encountered by the scanner.
@@ -2,6 +2,7 @@ package scanner
 
 import (
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -138,3 +139,63 @@ func TestRecoverySlicePacket(t *testing.T) {
 		)
 	}
 }
+
+func TestScanPastRecoverySlices(t *testing.T) {
+	encodedFile, err := os.Open("testdata/sample.mp4.vol1+2.PAR2")
+	defer encodedFile.Close()
+	if err != nil {
+		t.Fatalf("Could not open encoded par2 file: %v", err)
+	}
+
+	scanner := NewScanner(encodedFile)
+	counts := make(map[string]int)
+	for scanner.Scan() {
+		counts[scanner.Packet().Type()]++
+	}
+
+	if scanner.Err() != nil {
+		t.Fatalf("Could not read packet: %v", scanner.Err())
+	}
+	if counts[recoverySlicePacketType] != 2 {
+		t.Errorf("Expected 2 recovery slice packets but found %d", counts[recoverySlicePacketType])
+	}
+	if counts[fileDescriptionPacketType] == 0 || counts[mainPacketType] == 0 {
+		t.Errorf("Expected to find packets after the recovery slices, found %v", counts)
+	}
+}
+
+func TestSkipDamagedPacket(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample.mp4.par2")
+	if err != nil {
+		t.Fatalf("Could not read encoded par2 file: %v", err)
+	}
+	// Damage the file name in the first packet, a file description packet.
+	data[HEADER_LENGTH+60] ^= 0xFF
+	path := filepath.Join(t.TempDir(), "damaged.par2")
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatalf("Could not write damaged par2 file: %v", err)
+	}
+	encodedFile, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open damaged par2 file: %v", err)
+	}
+	defer encodedFile.Close()
+
+	scanner := NewScanner(encodedFile)
+	packetTypes := make([]string, 0)
+	for scanner.Scan() {
+		packetTypes = append(packetTypes, scanner.Packet().Type())
+	}
+
+	if scanner.Err() != nil {
+		t.Fatalf("Could not read packet: %v", scanner.Err())
+	}
+	if !reflect.DeepEqual(
+		packetTypes,
+		[]string{
+			fileSliceChecksumPacketType,
+			mainPacketType,
+			creatorPacketType}) {
+		t.Errorf("Read packet types %q not equal to expected types", packetTypes)
+	}
+}
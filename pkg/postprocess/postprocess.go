@@ -0,0 +1,179 @@
+// Package postprocess implements what happens to a job once its segments have been downloaded:
+// verifying and repairing it with PAR2, restoring obfuscated file names, unpacking archives,
+// removing the leftovers and moving the result to its final destination.
+//
+// Each step is a Stage, and a Pipeline runs its stages in order, reporting a Result for each.
+// A failing stage stops the pipeline, and the stages after it are reported as skipped.
+package postprocess
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/esteth/usenet/pkg/logging"
+	"github.com/esteth/usenet/pkg/par2"
+)
+
+// A Status is the outcome of running a stage.
+type Status string
+
+const (
+	// Succeeded stages did their work.
+	Succeeded Status = "Succeeded"
+	// Failed stages could not complete, stopping the pipeline.
+	Failed Status = "Failed"
+	// Skipped stages had nothing to do, or were not run because an earlier stage failed.
+	Skipped Status = "Skipped"
+)
+
+// ErrSkipped is returned by a stage's Run function when there was nothing for it to do.
+var ErrSkipped = errors.New("stage skipped")
+
+// DefaultStages are the names of the stages run by Default, in order.
+var DefaultStages = []string{"verify", "repair", "deobfuscate", "unpack", "cleanup", "move"}
+
+// A Job is the downloaded files of a single NZB being post-processed.
+type Job struct {
+	// Name is the name of the job, used to name deobfuscated files and the destination directory.
+	Name string
+	// Category is the job's category, used to choose its destination directory.
+	Category string
+	// Destination, if set, is the directory the move stage moves the job into, instead of the
+	// subdirectory of the complete directory named after its category.
+	Destination string
+	// Dir is the directory the job was downloaded to.
+	Dir string
+	// Password is used to extract encrypted archives.
+	Password string
+	// Verified is set once every file in the job's PAR2 recovery set is known to be intact.
+	Verified bool
+	// Storage is the directory the job's files were moved to, once the move stage has run.
+	Storage string
+	// Logger, if set, receives diagnostics from the libraries the stages use.
+	Logger logging.Logger
+
+	logs      []string
+	archive   *par2.Archive
+	damaged   []int
+	extracted []string
+	unpacked  bool
+}
+
+// Logf adds a line to the log of the stage currently being run.
+func (j *Job) Logf(format string, args ...interface{}) {
+	j.logs = append(j.logs, fmt.Sprintf(format, args...))
+}
+
+// A Stage is a single step of post-processing.
+type Stage struct {
+	Name string
+	// Run does the stage's work on job. It returns ErrSkipped if there was nothing to do.
+	Run func(ctx context.Context, job *Job) error
+}
+
+// A Result records the outcome of running a stage on a job.
+type Result struct {
+	Stage    string
+	Status   Status
+	Log      []string
+	Started  time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// A Pipeline runs a sequence of stages on each job.
+type Pipeline struct {
+	stages []Stage
+}
+
+// New creates a pipeline running the given stages in order.
+func New(stages ...Stage) *Pipeline {
+	return &Pipeline{stages: stages}
+}
+
+// Default creates a pipeline running all of the DefaultStages. Completed jobs are moved into
+// completeDir; if completeDir is empty, they are left where they were downloaded.
+func Default(completeDir string) *Pipeline {
+	p, _ := FromNames(DefaultStages, completeDir)
+	return p
+}
+
+// FromNames creates a pipeline running the named stages, in the order given. The move stage
+// moves completed jobs into completeDir, and is left out if completeDir is empty.
+func FromNames(names []string, completeDir string) (*Pipeline, error) {
+	stages := make([]Stage, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case "verify":
+			stages = append(stages, Verify())
+		case "repair":
+			stages = append(stages, Repair())
+		case "deobfuscate":
+			stages = append(stages, Deobfuscate())
+		case "unpack":
+			stages = append(stages, Unpack())
+		case "cleanup":
+			stages = append(stages, Cleanup())
+		case "move":
+			if completeDir != "" {
+				stages = append(stages, Move(completeDir))
+			}
+		default:
+			return nil, fmt.Errorf("Unknown post-processing stage '%s'", name)
+		}
+	}
+	return New(stages...), nil
+}
+
+// Stages returns the names of the pipeline's stages, in the order they are run.
+func (p *Pipeline) Stages() []string {
+	names := make([]string, len(p.stages))
+	for i, s := range p.stages {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// Run runs each stage of the pipeline on job in turn, passing the result of each to report
+// as soon as it is known. report may be nil.
+//
+// It returns the error of the first stage to fail, or ctx's error if it is done before the
+// pipeline completes.
+func (p *Pipeline) Run(ctx context.Context, job *Job, report func(Result)) error {
+	if report == nil {
+		report = func(Result) {}
+	}
+	var failed error
+	for _, stage := range p.stages {
+		if failed == nil {
+			failed = ctx.Err()
+		}
+		if failed != nil {
+			report(Result{Stage: stage.Name, Status: Skipped})
+			continue
+		}
+
+		job.logs = nil
+		started := time.Now()
+		err := stage.Run(ctx, job)
+		result := Result{
+			Stage:    stage.Name,
+			Status:   Succeeded,
+			Log:      job.logs,
+			Started:  started,
+			Duration: time.Since(started),
+		}
+		switch {
+		case errors.Is(err, ErrSkipped):
+			result.Status = Skipped
+		case err != nil:
+			result.Status = Failed
+			result.Err = err
+			failed = fmt.Errorf("Could not %s: %w", stage.Name, err)
+		}
+		report(result)
+	}
+	return failed
+}
@@ -0,0 +1,204 @@
+package postprocess
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/esteth/usenet/pkg/par2"
+)
+
+func testStage(name string, err error) Stage {
+	return Stage{Name: name, Run: func(ctx context.Context, job *Job) error {
+		job.Logf("ran %s", name)
+		return err
+	}}
+}
+
+func statuses(results []Result) []Status {
+	s := make([]Status, len(results))
+	for i, r := range results {
+		s[i] = r.Status
+	}
+	return s
+}
+
+func TestPipelineShortCircuits(t *testing.T) {
+	broken := errors.New("broken")
+	p := New(testStage("first", nil), testStage("second", ErrSkipped), testStage("third", broken), testStage("fourth", nil))
+
+	var results []Result
+	err := p.Run(context.Background(), &Job{}, func(r Result) {
+		results = append(results, r)
+	})
+	if !errors.Is(err, broken) {
+		t.Errorf("Expected the failing stage's error, got %v", err)
+	}
+	expected := []Status{Succeeded, Skipped, Failed, Skipped}
+	if !reflect.DeepEqual(statuses(results), expected) {
+		t.Errorf("Stages finished as %v, expected %v", statuses(results), expected)
+	}
+	if !reflect.DeepEqual(results[2].Log, []string{"ran third"}) || results[2].Err != broken {
+		t.Errorf("Failed stage was not recorded correctly: %+v", results[2])
+	}
+	if results[3].Log != nil {
+		t.Errorf("Stage after the failure was run: %+v", results[3])
+	}
+}
+
+func TestPipelineCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var results []Result
+	err := New(testStage("first", nil)).Run(ctx, &Job{}, func(r Result) {
+		results = append(results, r)
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the pipeline to be cancelled, got %v", err)
+	}
+	if len(results) != 1 || results[0].Status != Skipped {
+		t.Errorf("Expected the stage to be skipped, got %+v", results)
+	}
+}
+
+func TestFromNames(t *testing.T) {
+	p, err := FromNames([]string{"verify", "unpack", "move"}, "")
+	if err != nil {
+		t.Fatalf("Could not create pipeline: %v", err)
+	}
+	if !reflect.DeepEqual(p.Stages(), []string{"verify", "unpack"}) {
+		t.Errorf("Unexpected stages %v", p.Stages())
+	}
+	if _, err := FromNames([]string{"verify", "transmogrify"}, ""); err == nil {
+		t.Errorf("Expected an unknown stage to be rejected")
+	}
+}
+
+func TestDefaultPipeline(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "download")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatalf("Could not create download directory: %v", err)
+	}
+	f, err := os.Create(filepath.Join(dir, "a1b2c3d4e5f6a7b8c9d0e1f2.zip"))
+	if err != nil {
+		t.Fatalf("Could not create zip: %v", err)
+	}
+	w := zip.NewWriter(f)
+	entry, _ := w.Create("movie.mkv")
+	entry.Write([]byte("movie"))
+	w.Close()
+	f.Close()
+
+	complete := filepath.Join(root, "complete")
+	job := &Job{Name: "Some.Release", Category: "movies", Dir: dir}
+	results := make(map[string]Result)
+	if err := Default(complete).Run(context.Background(), job, func(r Result) {
+		results[r.Stage] = r
+	}); err != nil {
+		t.Fatalf("Could not post-process job: %v", err)
+	}
+
+	for stage, expected := range map[string]Status{
+		"verify":      Skipped,
+		"repair":      Skipped,
+		"deobfuscate": Succeeded,
+		"unpack":      Succeeded,
+		"cleanup":     Succeeded,
+		"move":        Succeeded,
+	} {
+		if results[stage].Status != expected {
+			t.Errorf("Stage %s finished as %s, expected %s: %v", stage, results[stage].Status, expected, results[stage].Log)
+		}
+	}
+	storage := filepath.Join(complete, "movies", "Some.Release")
+	if job.Storage != storage {
+		t.Errorf("Job was moved to %s, expected %s", job.Storage, storage)
+	}
+	entries, err := os.ReadDir(storage)
+	if err != nil {
+		t.Fatalf("Could not list destination: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "movie.mkv" {
+		t.Errorf("Expected only the extracted file to be left, found %v", entries)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Download directory was left behind: %v", err)
+	}
+}
+
+func TestMoveAvoidsExistingDirectory(t *testing.T) {
+	root := t.TempDir()
+	complete := filepath.Join(root, "complete")
+	if err := os.MkdirAll(filepath.Join(complete, "job"), 0777); err != nil {
+		t.Fatalf("Could not create existing directory: %v", err)
+	}
+	dir := filepath.Join(root, "download")
+	os.Mkdir(dir, 0777)
+
+	job := &Job{Name: "job", Dir: dir}
+	if err := move(job, complete); err != nil {
+		t.Fatalf("Could not move job: %v", err)
+	}
+	if job.Storage != filepath.Join(complete, "job.1") {
+		t.Errorf("Job was moved to %s", job.Storage)
+	}
+}
+
+func TestMoveToDestination(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "download")
+	os.Mkdir(dir, 0777)
+	destination := filepath.Join(root, "tv")
+
+	job := &Job{Name: "job", Category: "tv", Destination: destination, Dir: dir}
+	if err := move(job, filepath.Join(root, "complete")); err != nil {
+		t.Fatalf("Could not move job: %v", err)
+	}
+	if job.Storage != filepath.Join(destination, "job") {
+		t.Errorf("Job was moved to %s", job.Storage)
+	}
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 20000)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file.bin"), data, 0666); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	if _, err := par2.Create(dir, "file", []string{"file.bin"}, 4096, []int{3}); err != nil {
+		t.Fatalf("Could not create par2 files: %v", err)
+	}
+	damaged := append([]byte(nil), data...)
+	damaged[100] ^= 0xFF
+	if err := os.WriteFile(filepath.Join(dir, "file.bin"), damaged[:15000], 0666); err != nil {
+		t.Fatalf("Could not damage file: %v", err)
+	}
+
+	job := &Job{Name: "job", Dir: dir}
+	var results []Result
+	err := New(Verify(), Repair()).Run(context.Background(), job, func(r Result) {
+		results = append(results, r)
+	})
+	if err != nil {
+		t.Fatalf("Could not verify and repair: %v", err)
+	}
+	if !reflect.DeepEqual(statuses(results), []Status{Succeeded, Succeeded}) || !job.Verified {
+		t.Errorf("Unexpected results %+v", results)
+	}
+	repaired, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+	if err != nil {
+		t.Fatalf("Could not read repaired file: %v", err)
+	}
+	if !bytes.Equal(repaired, data) {
+		t.Errorf("Repaired file not equal to original")
+	}
+}
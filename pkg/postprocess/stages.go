@@ -0,0 +1,303 @@
+package postprocess
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/par2"
+	"github.com/esteth/usenet/pkg/unpack"
+)
+
+var (
+	par2File = regexp.MustCompile(`(?i)\.par2$`)
+	// obfuscatedName matches names made of a long random-looking base, followed by any extensions.
+	obfuscatedName = regexp.MustCompile(`^([0-9A-Za-z]{24,})(\..*)?$`)
+	hasDigit       = regexp.MustCompile(`[0-9]`)
+	hasLetter      = regexp.MustCompile(`[A-Za-z]`)
+)
+
+// Verify returns a stage which checks the job's files against its PAR2 recovery set.
+//
+// Files which were posted under a different name to the one in the recovery set are renamed
+// first. The stage fails if there is more damage than the recovery set can repair, and is
+// skipped if the job has no PAR2 files.
+func Verify() Stage {
+	return Stage{Name: "verify", Run: func(ctx context.Context, job *Job) error {
+		return verify(job)
+	}}
+}
+
+// Repair returns a stage which repairs the damage found by the verify stage. It is skipped if
+// there was nothing to repair.
+func Repair() Stage {
+	return Stage{Name: "repair", Run: func(ctx context.Context, job *Job) error {
+		return repair(job)
+	}}
+}
+
+// Deobfuscate returns a stage which renames files posted under random-looking names after the
+// job, keeping their extensions so that archive volumes still form a set.
+func Deobfuscate() Stage {
+	return Stage{Name: "deobfuscate", Run: func(ctx context.Context, job *Job) error {
+		return deobfuscate(job)
+	}}
+}
+
+// Unpack returns a stage which joins split files and extracts archives into the job's directory.
+//
+// If an archive fails its checksums and the job has PAR2 files, the job is repaired and the
+// archives extracted again.
+func Unpack() Stage {
+	return Stage{Name: "unpack", Run: func(ctx context.Context, job *Job) error {
+		return unpackArchives(job)
+	}}
+}
+
+// Cleanup returns a stage which removes PAR2 files, and archives once they have been unpacked.
+func Cleanup() Stage {
+	return Stage{Name: "cleanup", Run: func(ctx context.Context, job *Job) error {
+		return cleanup(job)
+	}}
+}
+
+// Move returns a stage which moves the job's directory into completeDir, within a subdirectory
+// for its category if it has one, or into the job's Destination if it is set.
+func Move(completeDir string) Stage {
+	return Stage{Name: "move", Run: func(ctx context.Context, job *Job) error {
+		return move(job, completeDir)
+	}}
+}
+
+func verify(job *Job) error {
+	archive, err := par2.FromDirectory(job.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		job.Logf("No PAR2 files to verify with")
+		return ErrSkipped
+	}
+	if err != nil {
+		return err
+	}
+	job.archive = &archive
+	archive.SetLogger(job.Logger)
+
+	restored, err := archive.RestoreNames()
+	for _, name := range restored {
+		job.Logf("Restored %s", name)
+	}
+	if err != nil {
+		return err
+	}
+	damaged, err := archive.Validate()
+	if err != nil {
+		return err
+	}
+	job.damaged = damaged
+	if len(damaged) == 0 {
+		job.Verified = true
+		job.Logf("All files are intact")
+		return nil
+	}
+	job.Logf("%d slices are damaged, %d recovery slices are available", len(damaged), archive.RecoverySlices())
+	if len(damaged) > archive.RecoverySlices() {
+		return fmt.Errorf("%d slices are damaged: %w", len(damaged), par2.ErrNotEnoughRecovery)
+	}
+	return nil
+}
+
+func repair(job *Job) error {
+	if job.archive == nil || len(job.damaged) == 0 {
+		return ErrSkipped
+	}
+	if err := job.archive.Repair(job.damaged); err != nil {
+		return err
+	}
+	damaged, err := job.archive.Validate()
+	if err != nil {
+		return err
+	}
+	if len(damaged) > 0 {
+		return fmt.Errorf("%d slices are still damaged after repairing", len(damaged))
+	}
+	job.Logf("Repaired %d slices", len(job.damaged))
+	job.damaged = nil
+	job.Verified = true
+	return nil
+}
+
+func deobfuscate(job *Job) error {
+	name := nzb.SafeName(job.Name)
+	entries, err := os.ReadDir(job.Dir)
+	if err != nil {
+		return fmt.Errorf("Could not list %s: %w", job.Dir, err)
+	}
+	renamed := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || par2File.MatchString(entry.Name()) {
+			continue
+		}
+		m := obfuscatedName.FindStringSubmatch(entry.Name())
+		if m == nil || !hasDigit.MatchString(m[1]) || !hasLetter.MatchString(m[1]) {
+			continue
+		}
+		target := name + m[2]
+		if _, err := os.Stat(filepath.Join(job.Dir, target)); err == nil {
+			job.Logf("Not renaming %s, %s already exists", entry.Name(), target)
+			continue
+		}
+		if err := os.Rename(filepath.Join(job.Dir, entry.Name()), filepath.Join(job.Dir, target)); err != nil {
+			return fmt.Errorf("Could not rename %s: %w", entry.Name(), err)
+		}
+		job.Logf("Renamed %s to %s", entry.Name(), target)
+		renamed++
+	}
+	if renamed == 0 {
+		return ErrSkipped
+	}
+	return nil
+}
+
+func unpackArchives(job *Job) error {
+	joined, err := unpack.JoinSplits(job.Dir)
+	for _, path := range joined {
+		job.Logf("Joined %s", filepath.Base(path))
+	}
+	if err != nil {
+		return err
+	}
+
+	extracted, err := unpack.ExtractAll(job.Dir, job.Dir, job.Password)
+	var crcErr *unpack.CRCError
+	if errors.As(err, &crcErr) {
+		job.Logf("%v", err)
+		if verify(job) == nil && repair(job) == nil {
+			job.Logf("Extracting again after repairing")
+			extracted, err = unpack.ExtractAll(job.Dir, job.Dir, job.Password)
+		}
+	}
+	for _, path := range extracted {
+		rel, _ := filepath.Rel(job.Dir, path)
+		job.Logf("Extracted %s", rel)
+	}
+	job.extracted = append(job.extracted, extracted...)
+	if err != nil {
+		return err
+	}
+	if len(joined) == 0 && len(extracted) == 0 {
+		job.Logf("No archives to unpack")
+		return ErrSkipped
+	}
+	job.unpacked = true
+	return nil
+}
+
+func cleanup(job *Job) error {
+	keep := make(map[string]bool, len(job.extracted))
+	for _, path := range job.extracted {
+		keep[path] = true
+	}
+	entries, err := os.ReadDir(job.Dir)
+	if err != nil {
+		return fmt.Errorf("Could not list %s: %w", job.Dir, err)
+	}
+	removed := 0
+	for _, entry := range entries {
+		path := filepath.Join(job.Dir, entry.Name())
+		if !entry.Type().IsRegular() || keep[path] {
+			continue
+		}
+		if !par2File.MatchString(entry.Name()) && !(job.unpacked && unpack.IsArchive(entry.Name())) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("Could not remove %s: %w", entry.Name(), err)
+		}
+		job.Logf("Removed %s", entry.Name())
+		removed++
+	}
+	if removed == 0 {
+		return ErrSkipped
+	}
+	return nil
+}
+
+func move(job *Job, completeDir string) error {
+	parent := completeDir
+	switch {
+	case job.Destination != "":
+		parent = job.Destination
+	case job.Category != "":
+		parent = filepath.Join(completeDir, nzb.SafeName(job.Category))
+	}
+	if err := os.MkdirAll(parent, 0777); err != nil {
+		return fmt.Errorf("Could not create %s: %w", parent, err)
+	}
+	target := filepath.Join(parent, nzb.SafeName(job.Name))
+	for i := 1; exists(target); i++ {
+		target = filepath.Join(parent, fmt.Sprintf("%s.%d", nzb.SafeName(job.Name), i))
+	}
+
+	if err := os.Rename(job.Dir, target); err != nil {
+		// The destination may be on a different filesystem, which rename cannot move between.
+		if err := copyDir(job.Dir, target); err != nil {
+			os.RemoveAll(target)
+			return fmt.Errorf("Could not move %s to %s: %w", job.Dir, target, err)
+		}
+		if err := os.RemoveAll(job.Dir); err != nil {
+			return fmt.Errorf("Could not remove %s: %w", job.Dir, err)
+		}
+	}
+	job.Logf("Moved to %s", target)
+	job.Dir = target
+	job.Storage = target
+	return nil
+}
+
+// copyDir copies the regular files and directories within src to dst.
+func copyDir(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,503 @@
+// Package queue implements a persistent, prioritised queue of NZB download jobs.
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/esteth/usenet/pkg/nzb"
+)
+
+// A Priority orders jobs in the queue. Higher priorities are downloaded first.
+type Priority int
+
+const (
+	// Low priority jobs are downloaded after all others.
+	Low Priority = -1
+	// Normal is the default priority.
+	Normal Priority = 0
+	// High priority jobs are downloaded before Normal ones.
+	High Priority = 1
+	// Force priority jobs are downloaded first, even when the queue is paused.
+	Force Priority = 2
+)
+
+// A Status describes where a job is in its lifecycle.
+type Status string
+
+const (
+	// Queued jobs are waiting to be downloaded.
+	Queued Status = "Queued"
+	// Paused jobs will not be downloaded until resumed.
+	Paused Status = "Paused"
+	// Downloading jobs are currently being downloaded.
+	Downloading Status = "Downloading"
+	// Processing jobs have finished downloading and are being verified, repaired and unpacked.
+	Processing Status = "Processing"
+	// Completed jobs finished downloading successfully. They are kept in the history.
+	Completed Status = "Completed"
+	// Failed jobs could not be downloaded. They are kept in the history.
+	Failed Status = "Failed"
+)
+
+// ErrNotFound is returned when a job ID does not refer to a job in the queue.
+var ErrNotFound = errors.New("job not found")
+
+// A Job is a single NZB to be downloaded.
+type Job struct {
+	ID       string
+	Name     string
+	Category string
+	Priority Priority
+	Status   Status
+	// Nzb is the content of the NZB being downloaded. It is dropped once the job moves to the history.
+	Nzb nzb.Nzb `json:",omitempty"`
+	// Done holds the message IDs of segments which have already been downloaded.
+	Done            map[string]bool `json:",omitempty"`
+	TotalBytes      int64
+	DownloadedBytes int64
+	Added           time.Time
+	Finished        time.Time `json:",omitempty"`
+	Error           string    `json:",omitempty"`
+	// Storage is the directory the job's files were moved to by post-processing, if any.
+	Storage string `json:",omitempty"`
+	// PostProcessing records the outcome of each post-processing stage, in the order they ran.
+	PostProcessing []StageResult `json:",omitempty"`
+	// Scripts records the user scripts which were run for the job.
+	Scripts []ScriptResult `json:",omitempty"`
+}
+
+// A StageResult records the outcome of one post-processing stage of a job.
+type StageResult struct {
+	Stage string
+	// Status is one of "Succeeded", "Failed" or "Skipped".
+	Status   string
+	Log      []string `json:",omitempty"`
+	Started  time.Time
+	Duration time.Duration
+	Error    string `json:",omitempty"`
+}
+
+// A ScriptResult records a user script being run for a job.
+type ScriptResult struct {
+	Script   string
+	Event    string
+	ExitCode int
+	Output   []string `json:",omitempty"`
+	Started  time.Time
+	Duration time.Duration
+	Error    string `json:",omitempty"`
+}
+
+// Segments returns the total number of segments in the job.
+func (j Job) Segments() int {
+	count := 0
+	for _, f := range j.Nzb.Files {
+		count += len(f.Segments)
+	}
+	return count
+}
+
+// clone returns a copy of j which shares no mutable state with it.
+func (j *Job) clone() Job {
+	c := *j
+	if j.Done != nil {
+		c.Done = make(map[string]bool, len(j.Done))
+		for id := range j.Done {
+			c.Done[id] = true
+		}
+	}
+	if j.PostProcessing != nil {
+		c.PostProcessing = make([]StageResult, len(j.PostProcessing))
+		for i, r := range j.PostProcessing {
+			c.PostProcessing[i] = r
+			c.PostProcessing[i].Log = append([]string(nil), r.Log...)
+		}
+	}
+	if j.Scripts != nil {
+		c.Scripts = make([]ScriptResult, len(j.Scripts))
+		for i, r := range j.Scripts {
+			c.Scripts[i] = r
+			c.Scripts[i].Output = append([]string(nil), r.Output...)
+		}
+	}
+	return c
+}
+
+// A Queue is an ordered set of jobs waiting to be downloaded, and the history of finished jobs.
+//
+// All methods are safe for concurrent use. Changes are persisted to disk.
+type Queue struct {
+	mu      sync.Mutex
+	path    string
+	state   state
+	dirty   bool
+	changed chan struct{}
+}
+
+// state is the persisted content of a Queue.
+type state struct {
+	NextID  int
+	Paused  bool
+	Jobs    []*Job
+	History []*Job
+}
+
+// Open opens the queue persisted at path, creating an empty queue if the file does not exist.
+//
+// Jobs which were downloading or being post-processed when the queue was last saved are returned
+// to the queue. Segments which were already downloaded are not fetched again.
+func Open(path string) (*Queue, error) {
+	q := &Queue{
+		path:    path,
+		changed: make(chan struct{}, 1),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read queue '%s': %w", path, err)
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &q.state); err != nil {
+			return nil, fmt.Errorf("could not parse queue '%s': %w", path, err)
+		}
+	}
+	for _, j := range q.state.Jobs {
+		if j.Status == Downloading || j.Status == Processing {
+			j.Status = Queued
+			j.PostProcessing = nil
+		}
+	}
+	return q, nil
+}
+
+// Changed returns a channel which receives a value whenever the set of runnable jobs may have changed.
+func (q *Queue) Changed() <-chan struct{} {
+	return q.changed
+}
+
+// Add adds a new job downloading n to the queue, returning it.
+func (q *Queue) Add(n nzb.Nzb, name string, category string, priority Priority) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.state.NextID++
+	j := &Job{
+		ID:         strconv.Itoa(q.state.NextID),
+		Name:       name,
+		Category:   category,
+		Priority:   priority,
+		Status:     Queued,
+		Nzb:        n,
+		TotalBytes: n.Bytes(),
+		Added:      time.Now(),
+	}
+	q.state.Jobs = append(q.state.Jobs, j)
+	q.sortLocked()
+	q.notifyLocked()
+	if err := q.saveLocked(); err != nil {
+		return Job{}, err
+	}
+	return j.clone(), nil
+}
+
+// Jobs returns the jobs waiting in the queue, in the order they will be downloaded.
+func (q *Queue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, len(q.state.Jobs))
+	for i, j := range q.state.Jobs {
+		jobs[i] = j.clone()
+	}
+	return jobs
+}
+
+// History returns finished jobs, most recently finished first.
+func (q *Queue) History() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, len(q.state.History))
+	for i, j := range q.state.History {
+		jobs[len(jobs)-1-i] = j.clone()
+	}
+	return jobs
+}
+
+// Get returns the job with the given ID, from either the queue or the history.
+func (q *Queue) Get(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j, _ := q.findLocked(id); j != nil {
+		return j.clone(), nil
+	}
+	for _, j := range q.state.History {
+		if j.ID == id {
+			return j.clone(), nil
+		}
+	}
+	return Job{}, ErrNotFound
+}
+
+// Pause stops the job with the given ID from being downloaded until it is resumed.
+func (q *Queue) Pause(id string) error {
+	return q.update(id, func(j *Job) {
+		j.Status = Paused
+	})
+}
+
+// Resume allows a paused job to be downloaded again.
+func (q *Queue) Resume(id string) error {
+	return q.update(id, func(j *Job) {
+		if j.Status == Paused {
+			j.Status = Queued
+		}
+	})
+}
+
+// SetPriority changes the priority of the job with the given ID.
+func (q *Queue) SetPriority(id string, priority Priority) error {
+	return q.update(id, func(j *Job) {
+		j.Priority = priority
+	})
+}
+
+// Delete removes the job with the given ID from the queue or the history.
+func (q *Queue) Delete(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, i := q.findLocked(id); i >= 0 {
+		q.state.Jobs = append(q.state.Jobs[:i], q.state.Jobs[i+1:]...)
+		q.notifyLocked()
+		return q.saveLocked()
+	}
+	for i, j := range q.state.History {
+		if j.ID == id {
+			q.state.History = append(q.state.History[:i], q.state.History[i+1:]...)
+			return q.saveLocked()
+		}
+	}
+	return ErrNotFound
+}
+
+// PauseAll stops any job without Force priority from starting to download.
+func (q *Queue) PauseAll() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.state.Paused = true
+	return q.saveLocked()
+}
+
+// ResumeAll reverses PauseAll.
+func (q *Queue) ResumeAll() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.state.Paused = false
+	q.notifyLocked()
+	return q.saveLocked()
+}
+
+// Paused returns true if the whole queue is paused.
+func (q *Queue) Paused() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.state.Paused
+}
+
+// Next marks the first runnable job in the queue as Downloading, and returns it.
+//
+// It returns false if there are no jobs which can be downloaded.
+func (q *Queue) Next() (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.state.Jobs {
+		if j.Status != Queued || (q.state.Paused && j.Priority < Force) {
+			continue
+		}
+		j.Status = Downloading
+		q.dirty = true
+		return j.clone(), true
+	}
+	return Job{}, false
+}
+
+// Status returns the current status of the job with the given ID.
+func (q *Queue) Status(id string) (Status, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j, _ := q.findLocked(id); j != nil {
+		return j.Status, nil
+	}
+	for _, j := range q.state.History {
+		if j.ID == id {
+			return j.Status, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// SegmentDone records that the segment with the given message ID has been downloaded for a job.
+//
+// Progress is not saved immediately; call Flush to persist it.
+func (q *Queue) SegmentDone(id string, messageID string, bytes int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, _ := q.findLocked(id)
+	if j == nil {
+		return ErrNotFound
+	}
+	if j.Done == nil {
+		j.Done = make(map[string]bool)
+	}
+	j.Done[messageID] = true
+	j.DownloadedBytes += bytes
+	q.dirty = true
+	return nil
+}
+
+// Stop returns a job which was being downloaded or post-processed to the queue without finishing it.
+func (q *Queue) Stop(id string) error {
+	return q.update(id, func(j *Job) {
+		if j.Status == Downloading || j.Status == Processing {
+			j.Status = Queued
+		}
+	})
+}
+
+// Processing marks a job which has finished downloading as being post-processed.
+func (q *Queue) Processing(id string) error {
+	return q.update(id, func(j *Job) {
+		j.Status = Processing
+		j.PostProcessing = nil
+	})
+}
+
+// StageDone records the result of a post-processing stage for a job.
+func (q *Queue) StageDone(id string, result StageResult) error {
+	return q.update(id, func(j *Job) {
+		j.PostProcessing = append(j.PostProcessing, result)
+	})
+}
+
+// ScriptDone records that a user script was run for a job, which may be in the queue or the history.
+func (q *Queue) ScriptDone(id string, result ScriptResult) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, _ := q.findLocked(id)
+	for _, h := range q.state.History {
+		if j == nil && h.ID == id {
+			j = h
+		}
+	}
+	if j == nil {
+		return ErrNotFound
+	}
+	j.Scripts = append(j.Scripts, result)
+	return q.saveLocked()
+}
+
+// SetStorage records the directory a job's files were moved to.
+func (q *Queue) SetStorage(id string, dir string) error {
+	return q.update(id, func(j *Job) {
+		j.Storage = dir
+	})
+}
+
+// Finish moves a job from the queue to the history. If err is non-nil, the job is marked as Failed.
+func (q *Queue) Finish(id string, err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, i := q.findLocked(id)
+	if j == nil {
+		return ErrNotFound
+	}
+	q.state.Jobs = append(q.state.Jobs[:i], q.state.Jobs[i+1:]...)
+	j.Status = Completed
+	if err != nil {
+		j.Status = Failed
+		j.Error = err.Error()
+	}
+	j.Finished = time.Now()
+	j.Nzb = nzb.Nzb{}
+	j.Done = nil
+	q.state.History = append(q.state.History, j)
+	q.notifyLocked()
+	return q.saveLocked()
+}
+
+// Flush persists any progress which has not yet been saved.
+func (q *Queue) Flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.dirty {
+		return nil
+	}
+	return q.saveLocked()
+}
+
+// update applies f to the queued job with the given ID and saves the queue.
+func (q *Queue) update(id string, f func(*Job)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, _ := q.findLocked(id)
+	if j == nil {
+		return ErrNotFound
+	}
+	f(j)
+	q.sortLocked()
+	q.notifyLocked()
+	return q.saveLocked()
+}
+
+func (q *Queue) findLocked(id string) (*Job, int) {
+	for i, j := range q.state.Jobs {
+		if j.ID == id {
+			return j, i
+		}
+	}
+	return nil, -1
+}
+
+// sortLocked orders the queue by priority, keeping jobs of the same priority in the order they were added.
+func (q *Queue) sortLocked() {
+	sort.SliceStable(q.state.Jobs, func(a, b int) bool {
+		return q.state.Jobs[a].Priority > q.state.Jobs[b].Priority
+	})
+}
+
+func (q *Queue) notifyLocked() {
+	select {
+	case q.changed <- struct{}{}:
+	default:
+	}
+}
+
+// saveLocked atomically writes the queue to disk.
+func (q *Queue) saveLocked() error {
+	data, err := json.Marshal(q.state)
+	if err != nil {
+		return fmt.Errorf("could not serialize queue: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not save queue: %w", err)
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not save queue: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not save queue: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), q.path); err != nil {
+		return fmt.Errorf("could not save queue: %w", err)
+	}
+	q.dirty = false
+	return nil
+}
@@ -0,0 +1,200 @@
+package queue
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/esteth/usenet/pkg/nzb"
+)
+
+func testNzb() nzb.Nzb {
+	return nzb.Nzb{
+		Files: []nzb.File{{
+			Subject: "test",
+			Segments: []nzb.Segment{
+				{Number: 1, Bytes: 100, ID: "a@test"},
+				{Number: 2, Bytes: 50, ID: "b@test"},
+			},
+		}},
+	}
+}
+
+func jobNames(jobs []Job) []string {
+	names := make([]string, len(jobs))
+	for i, j := range jobs {
+		names[i] = j.Name
+	}
+	return names
+}
+
+func TestPriorityOrder(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.json"))
+	if err != nil {
+		t.Fatalf("Could not open queue: %v", err)
+	}
+	for _, add := range []struct {
+		name     string
+		priority Priority
+	}{{"normal1", Normal}, {"low", Low}, {"high", High}, {"normal2", Normal}, {"force", Force}} {
+		if _, err = q.Add(testNzb(), add.name, "", add.priority); err != nil {
+			t.Fatalf("Could not add job: %v", err)
+		}
+	}
+
+	names := jobNames(q.Jobs())
+	if !reflect.DeepEqual(names, []string{"force", "high", "normal1", "normal2", "low"}) {
+		t.Errorf("Jobs not in priority order: %v", names)
+	}
+}
+
+func TestNextSkipsPaused(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.json"))
+	if err != nil {
+		t.Fatalf("Could not open queue: %v", err)
+	}
+	first, _ := q.Add(testNzb(), "first", "", Normal)
+	second, _ := q.Add(testNzb(), "second", "", Normal)
+	if err = q.Pause(first.ID); err != nil {
+		t.Fatalf("Could not pause job: %v", err)
+	}
+
+	next, ok := q.Next()
+	if !ok || next.ID != second.ID {
+		t.Fatalf("Expected next job to be %s, was %s", second.ID, next.ID)
+	}
+	if next.Status != Downloading {
+		t.Errorf("Expected next job to be Downloading, was %s", next.Status)
+	}
+	if _, ok = q.Next(); ok {
+		t.Errorf("Expected no more runnable jobs")
+	}
+}
+
+func TestPauseAllAllowsForce(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.json"))
+	if err != nil {
+		t.Fatalf("Could not open queue: %v", err)
+	}
+	q.Add(testNzb(), "normal", "", Normal)
+	if err = q.PauseAll(); err != nil {
+		t.Fatalf("Could not pause queue: %v", err)
+	}
+	if _, ok := q.Next(); ok {
+		t.Fatalf("Paused queue returned a job")
+	}
+
+	q.Add(testNzb(), "forced", "", Force)
+	next, ok := q.Next()
+	if !ok || next.Name != "forced" {
+		t.Fatalf("Paused queue did not return forced job")
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	q, err := Open(path)
+	if err != nil {
+		t.Fatalf("Could not open queue: %v", err)
+	}
+	done, _ := q.Add(testNzb(), "done", "tv", Normal)
+	running, _ := q.Add(testNzb(), "running", "movies", High)
+	q.Next()
+	if err = q.SegmentDone(running.ID, "a@test", 100); err != nil {
+		t.Fatalf("Could not mark segment done: %v", err)
+	}
+	if err = q.Finish(done.ID, errors.New("broken")); err != nil {
+		t.Fatalf("Could not finish job: %v", err)
+	}
+	if err = q.Flush(); err != nil {
+		t.Fatalf("Could not flush queue: %v", err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Could not reopen queue: %v", err)
+	}
+	jobs := reopened.Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("Expected 1 job in reopened queue, found %d", len(jobs))
+	}
+	if jobs[0].Status != Queued {
+		t.Errorf("Expected interrupted job to be requeued, was %s", jobs[0].Status)
+	}
+	if !jobs[0].Done["a@test"] || jobs[0].DownloadedBytes != 100 {
+		t.Errorf("Progress was not persisted: %v, %d", jobs[0].Done, jobs[0].DownloadedBytes)
+	}
+	if jobs[0].Category != "movies" || len(jobs[0].Nzb.Files) != 1 {
+		t.Errorf("Job was not persisted correctly: %+v", jobs[0])
+	}
+
+	history := reopened.History()
+	if len(history) != 1 || history[0].Status != Failed || history[0].Error != "broken" {
+		t.Errorf("History was not persisted correctly: %+v", history)
+	}
+
+	// New jobs must not reuse IDs from before the queue was reopened.
+	added, _ := reopened.Add(testNzb(), "new", "", Normal)
+	if added.ID == done.ID || added.ID == running.ID {
+		t.Errorf("Reopened queue reused job ID %s", added.ID)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.json"))
+	if err != nil {
+		t.Fatalf("Could not open queue: %v", err)
+	}
+	job, _ := q.Add(testNzb(), "job", "", Normal)
+	if err = q.Delete(job.ID); err != nil {
+		t.Fatalf("Could not delete job: %v", err)
+	}
+	if _, err = q.Get(job.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected deleted job to be not found, got %v", err)
+	}
+	if err = q.Delete(job.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected deleting missing job to fail with ErrNotFound, got %v", err)
+	}
+}
+
+func TestPostProcessingHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	q, err := Open(path)
+	if err != nil {
+		t.Fatalf("Could not open queue: %v", err)
+	}
+	job, _ := q.Add(testNzb(), "job", "", Normal)
+	q.Next()
+	if err = q.Processing(job.ID); err != nil {
+		t.Fatalf("Could not mark job processing: %v", err)
+	}
+	result := StageResult{Stage: "verify", Status: "Succeeded", Log: []string{"all slices intact"}}
+	if err = q.StageDone(job.ID, result); err != nil {
+		t.Fatalf("Could not record stage: %v", err)
+	}
+	if err = q.SetStorage(job.ID, "/complete/job"); err != nil {
+		t.Fatalf("Could not set storage: %v", err)
+	}
+
+	// A job interrupted during post-processing is downloaded and processed again.
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Could not reopen queue: %v", err)
+	}
+	jobs := reopened.Jobs()
+	if len(jobs) != 1 || jobs[0].Status != Queued || jobs[0].PostProcessing != nil {
+		t.Errorf("Expected interrupted job to be requeued, got %+v", jobs)
+	}
+
+	if err = q.Finish(job.ID, nil); err != nil {
+		t.Fatalf("Could not finish job: %v", err)
+	}
+	history := q.History()
+	if len(history) != 1 || history[0].Storage != "/complete/job" {
+		t.Fatalf("Storage was not kept in the history: %+v", history)
+	}
+	if len(history[0].PostProcessing) != 1 || history[0].PostProcessing[0].Log[0] != "all slices intact" {
+		t.Errorf("Stage results were not kept in the history: %+v", history[0].PostProcessing)
+	}
+}
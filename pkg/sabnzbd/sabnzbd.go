@@ -0,0 +1,694 @@
+// Package sabnzbd serves a subset of the SABnzbd API on top of a daemon.Daemon,
+// so that tools which automate SABnzbd can use the daemon as their downloader.
+//
+// Only JSON output is supported.
+package sabnzbd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/esteth/usenet/pkg/daemon"
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/queue"
+)
+
+// Version is the SABnzbd version reported to clients. Clients use it to
+// decide which API features are available.
+const Version = "3.0.0"
+
+// maxUploadSize is the largest NZB file accepted by the API.
+const maxUploadSize = 64 << 20
+
+// SABnzbd priorities, which are passed as strings in requests.
+const (
+	defaultPriority = -100
+	pausedPriority  = -2
+)
+
+// Config configures the API.
+type Config struct {
+	// APIKey must be passed as the "apikey" parameter of every request except mode=version.
+	APIKey string
+	// Categories are the categories reported to clients, in addition to the default "*".
+	Categories []string
+	// Client is used to fetch NZBs for mode=addurl. If nil, http.DefaultClient is used, which
+	// has no timeout.
+	Client *http.Client
+}
+
+// An API serves SABnzbd API requests for a daemon.
+type API struct {
+	daemon *daemon.Daemon
+	cfg    Config
+}
+
+// New creates an API serving requests using d.
+func New(d *daemon.Daemon, cfg Config) *API {
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	return &API{daemon: d, cfg: cfg}
+}
+
+// errorResponse is the body returned for any failed request.
+type errorResponse struct {
+	Status bool   `json:"status"`
+	Error  string `json:"error"`
+}
+
+// statusResponse is the body returned for successful requests which return no data.
+type statusResponse struct {
+	Status bool `json:"status"`
+}
+
+// addResponse is the body returned when adding NZBs.
+type addResponse struct {
+	Status bool     `json:"status"`
+	NzoIDs []string `json:"nzo_ids"`
+}
+
+// ServeHTTP implements http.Handler, dispatching on the "mode" parameter.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("could not parse form: %w", err))
+			return
+		}
+	}
+	mode := r.FormValue("mode")
+	if output := r.FormValue("output"); output != "" && output != "json" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported output format '%s'", output))
+		return
+	}
+	if mode == "version" {
+		writeJSON(w, map[string]string{"version": Version})
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+
+	switch mode {
+	case "addfile":
+		a.addFile(w, r)
+	case "addurl":
+		a.addURL(w, r)
+	case "addlocalfile":
+		a.addLocalFile(w, r)
+	case "queue":
+		a.queue(w, r)
+	case "history":
+		a.history(w, r)
+	case "pause":
+		a.respond(w, a.daemon.PauseAll())
+	case "resume":
+		a.respond(w, a.daemon.ResumeAll())
+	case "config":
+		a.config(w, r)
+	case "get_config":
+		a.getConfig(w, r)
+	case "get_cats":
+		writeJSON(w, map[string][]string{"categories": a.categories()})
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown mode '%s'", mode))
+	}
+}
+
+// authorized writes an error response and returns false if r does not carry the API key.
+func (a *API) authorized(w http.ResponseWriter, r *http.Request) bool {
+	key := r.FormValue("apikey")
+	if key == "" {
+		key = r.Header.Get("X-Api-Key")
+	}
+	if key == "" {
+		writeError(w, http.StatusUnauthorized, errors.New("API Key Required"))
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(a.cfg.APIKey)) != 1 {
+		writeError(w, http.StatusForbidden, errors.New("API Key Incorrect"))
+		return false
+	}
+	return true
+}
+
+func (a *API) addFile(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("name")
+	if err != nil {
+		file, header, err = r.FormFile("nzbfile")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("could not read uploaded NZB: %w", err))
+		return
+	}
+	defer file.Close()
+	a.add(w, r, file, header.Filename)
+}
+
+func (a *API) addURL(w http.ResponseWriter, r *http.Request) {
+	rawURL := r.FormValue("name")
+	if rawURL == "" {
+		writeError(w, http.StatusBadRequest, errors.New("no URL given"))
+		return
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("'%s' is not an http or https URL", rawURL))
+		return
+	}
+	// The fetch stops if the client goes away.
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	resp, err := a.cfg.Client.Do(req)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Errorf("could not fetch NZB: %w", err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		writeError(w, http.StatusBadGateway, fmt.Errorf("could not fetch NZB: server returned %s", resp.Status))
+		return
+	}
+
+	filename := path.Base(resp.Request.URL.Path)
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		filename = params["filename"]
+	}
+	a.add(w, r, io.LimitReader(resp.Body, maxUploadSize), filename)
+}
+
+// addLocalFile adds an NZB file on the daemon's host, which must be within its NZB directory.
+func (a *API) addLocalFile(w http.ResponseWriter, r *http.Request) {
+	filename, err := a.daemon.NZBPath(r.FormValue("name"))
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	n, err := nzb.FromFile(filename)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.addNzb(w, r, n, path.Base(filename))
+}
+
+// add parses the NZB read from body and adds it to the queue.
+func (a *API) add(w http.ResponseWriter, r *http.Request, body io.Reader, filename string) {
+	n, err := nzb.FromReader(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("could not parse NZB: %w", err))
+		return
+	}
+	a.addNzb(w, r, n, filename)
+}
+
+// addNzb adds n to the queue, applying the name, category and priority parameters of r.
+func (a *API) addNzb(w http.ResponseWriter, r *http.Request, n nzb.Nzb, filename string) {
+	name := r.FormValue("nzbname")
+	if name == "" {
+		name = strings.TrimSuffix(filename, ".nzb")
+	}
+	category := r.FormValue("cat")
+	if category == "*" {
+		category = ""
+	}
+	sabPriority, err := parsePriority(r.FormValue("priority"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	priority := queue.Normal
+	if sabPriority != defaultPriority && sabPriority != pausedPriority {
+		priority = queue.Priority(sabPriority)
+	}
+
+	job, err := a.daemon.Add(n, name, category, priority)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if sabPriority == pausedPriority {
+		if err = a.daemon.Pause(job.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	writeJSON(w, addResponse{Status: true, NzoIDs: []string{job.ID}})
+}
+
+// queueSlot is a single job in the response to mode=queue.
+type queueSlot struct {
+	Index      int    `json:"index"`
+	NzoID      string `json:"nzo_id"`
+	Filename   string `json:"filename"`
+	Cat        string `json:"cat"`
+	Priority   string `json:"priority"`
+	Status     string `json:"status"`
+	MB         string `json:"mb"`
+	MBLeft     string `json:"mbleft"`
+	Size       string `json:"size"`
+	SizeLeft   string `json:"sizeleft"`
+	Percentage string `json:"percentage"`
+	TimeLeft   string `json:"timeleft"`
+}
+
+func (a *API) queue(w http.ResponseWriter, r *http.Request) {
+	if name := r.FormValue("name"); name != "" {
+		a.queueAction(w, r, name)
+		return
+	}
+
+	jobs := a.daemon.Queue().Jobs()
+	speed := a.daemon.Speed()
+	slots := make([]queueSlot, len(jobs))
+	var totalBytes, totalLeft int64
+	status := "Idle"
+	for i, j := range jobs {
+		left := j.TotalBytes - j.DownloadedBytes
+		if left < 0 {
+			left = 0
+		}
+		totalBytes += j.TotalBytes
+		totalLeft += left
+		percentage := 0
+		if j.TotalBytes > 0 {
+			percentage = int(j.DownloadedBytes * 100 / j.TotalBytes)
+		}
+		if j.Status == queue.Downloading {
+			status = "Downloading"
+		}
+		slots[i] = queueSlot{
+			Index:      i,
+			NzoID:      j.ID,
+			Filename:   j.Name,
+			Cat:        category(j.Category),
+			Priority:   priorityName(j.Priority),
+			Status:     string(j.Status),
+			MB:         megabytes(j.TotalBytes),
+			MBLeft:     megabytes(left),
+			Size:       formatSize(j.TotalBytes),
+			SizeLeft:   formatSize(left),
+			Percentage: strconv.Itoa(percentage),
+			TimeLeft:   timeLeft(totalLeft, speed),
+		}
+	}
+	paused := a.daemon.Queue().Paused()
+	if paused {
+		status = "Paused"
+	}
+	limit := a.daemon.SpeedLimit()
+	speedLimit := ""
+	if limit > 0 {
+		speedLimit = strconv.FormatInt(limit/1024, 10)
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"queue": map[string]interface{}{
+			"status":          status,
+			"paused":          paused,
+			"speedlimit_abs":  speedLimit,
+			"kbpersec":        fmt.Sprintf("%.2f", float64(speed)/1024),
+			"speed":           formatSize(speed),
+			"mb":              megabytes(totalBytes),
+			"mbleft":          megabytes(totalLeft),
+			"size":            formatSize(totalBytes),
+			"sizeleft":        formatSize(totalLeft),
+			"timeleft":        timeLeft(totalLeft, speed),
+			"noofslots":       len(slots),
+			"noofslots_total": len(slots),
+			"slots":           slots,
+			"version":         Version,
+		},
+	})
+}
+
+// queueAction handles mode=queue requests which modify the queue.
+func (a *API) queueAction(w http.ResponseWriter, r *http.Request, name string) {
+	ids := strings.Split(r.FormValue("value"), ",")
+	var err error
+	switch name {
+	case "delete":
+		if r.FormValue("value") == "all" {
+			ids = nil
+			for _, j := range a.daemon.Queue().Jobs() {
+				ids = append(ids, j.ID)
+			}
+		}
+		for _, id := range ids {
+			if err = a.daemon.Delete(id); err != nil {
+				break
+			}
+		}
+	case "pause":
+		for _, id := range ids {
+			if err = a.daemon.Pause(id); err != nil {
+				break
+			}
+		}
+	case "resume":
+		for _, id := range ids {
+			if err = a.daemon.Resume(id); err != nil {
+				break
+			}
+		}
+	case "priority":
+		var priority int
+		if priority, err = parsePriority(r.FormValue("value2")); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		for _, id := range ids {
+			if priority == pausedPriority {
+				err = a.daemon.Pause(id)
+			} else {
+				err = a.daemon.Queue().SetPriority(id, queue.Priority(priority))
+			}
+			if err != nil {
+				break
+			}
+		}
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown queue action '%s'", name))
+		return
+	}
+	a.respond(w, err)
+}
+
+// historySlot is a single job in the response to mode=history.
+type historySlot struct {
+	NzoID        string `json:"nzo_id"`
+	Name         string `json:"name"`
+	NzbName      string `json:"nzb_name"`
+	Category     string `json:"category"`
+	Status       string `json:"status"`
+	FailMessage  string `json:"fail_message"`
+	Bytes        int64  `json:"bytes"`
+	Size         string `json:"size"`
+	Storage      string `json:"storage"`
+	Completed    int64  `json:"completed"`
+	DownloadTime int64  `json:"download_time"`
+	// StageLog lists what each post-processing stage did.
+	StageLog []stageLog `json:"stage_log"`
+	// Script and ScriptLine are the name and last line of output of the last script run when
+	// the job finished.
+	Script     string `json:"script"`
+	ScriptLine string `json:"script_line"`
+}
+
+// stageLog is the log of a single post-processing stage in a historySlot.
+type stageLog struct {
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+func newStageLogs(results []queue.StageResult) []stageLog {
+	logs := make([]stageLog, 0, len(results))
+	for _, r := range results {
+		actions := append([]string{r.Status}, r.Log...)
+		if r.Error != "" {
+			actions = append(actions, r.Error)
+		}
+		logs = append(logs, stageLog{Name: r.Stage, Actions: actions})
+	}
+	return logs
+}
+
+func (a *API) history(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("name") == "delete" {
+		a.historyDelete(w, r)
+		return
+	}
+
+	jobs := a.daemon.Queue().History()
+	if category := r.FormValue("category"); category != "" {
+		filtered := jobs[:0]
+		for _, j := range jobs {
+			if j.Category == category {
+				filtered = append(filtered, j)
+			}
+		}
+		jobs = filtered
+	}
+	total := len(jobs)
+	jobs = page(jobs, r)
+
+	slots := make([]historySlot, len(jobs))
+	for i, j := range jobs {
+		slots[i] = historySlot{
+			NzoID:        j.ID,
+			Name:         j.Name,
+			NzbName:      j.Name + ".nzb",
+			Category:     category(j.Category),
+			Status:       string(j.Status),
+			FailMessage:  j.Error,
+			Bytes:        j.DownloadedBytes,
+			Size:         formatSize(j.DownloadedBytes),
+			Storage:      a.daemon.Dir(j),
+			Completed:    j.Finished.Unix(),
+			DownloadTime: int64(j.Finished.Sub(j.Added) / time.Second),
+			StageLog:     newStageLogs(j.PostProcessing),
+		}
+		for _, s := range j.Scripts {
+			if s.Event != "finished" {
+				continue
+			}
+			slots[i].Script = filepath.Base(s.Script)
+			slots[i].ScriptLine = ""
+			if len(s.Output) > 0 {
+				slots[i].ScriptLine = s.Output[len(s.Output)-1]
+			}
+			if s.Error != "" {
+				slots[i].ScriptLine = s.Error
+			}
+		}
+	}
+	writeJSON(w, map[string]interface{}{
+		"history": map[string]interface{}{
+			"noofslots": total,
+			"slots":     slots,
+			"version":   Version,
+		},
+	})
+}
+
+func (a *API) historyDelete(w http.ResponseWriter, r *http.Request) {
+	value := r.FormValue("value")
+	var ids []string
+	switch value {
+	case "all", "failed", "completed":
+		for _, j := range a.daemon.Queue().History() {
+			if value == "all" ||
+				(value == "failed" && j.Status == queue.Failed) ||
+				(value == "completed" && j.Status == queue.Completed) {
+				ids = append(ids, j.ID)
+			}
+		}
+	default:
+		ids = strings.Split(value, ",")
+	}
+	var err error
+	for _, id := range ids {
+		if err = a.daemon.Delete(id); err != nil {
+			break
+		}
+	}
+	a.respond(w, err)
+}
+
+// config handles mode=config, of which only name=speedlimit is supported.
+func (a *API) config(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("name") != "speedlimit" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported config '%s'", r.FormValue("name")))
+		return
+	}
+	limit, err := parseSpeed(r.FormValue("value"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.daemon.SetSpeedLimit(limit)
+	a.respond(w, nil)
+}
+
+// categoryConfig describes a category in the response to mode=get_config.
+type categoryConfig struct {
+	Name     string `json:"name"`
+	Order    int    `json:"order"`
+	PP       string `json:"pp"`
+	Script   string `json:"script"`
+	Dir      string `json:"dir"`
+	Priority int    `json:"priority"`
+}
+
+func (a *API) getConfig(w http.ResponseWriter, r *http.Request) {
+	categories := make([]categoryConfig, 0, len(a.cfg.Categories)+1)
+	for i, name := range a.categories() {
+		dir := name
+		if name == "*" {
+			dir = ""
+		}
+		categories = append(categories, categoryConfig{
+			Name:     name,
+			Order:    i,
+			PP:       "",
+			Script:   "None",
+			Dir:      dir,
+			Priority: defaultPriority,
+		})
+	}
+	writeJSON(w, map[string]interface{}{
+		"config": map[string]interface{}{
+			"misc": map[string]interface{}{
+				"complete_dir":      a.daemon.OutputDir(),
+				"download_dir":      a.daemon.OutputDir(),
+				"enable_tv_sorting": false,
+				"pre_check":         false,
+				"history_retention": "",
+				"tv_categories":     []string{},
+				"movie_categories":  []string{},
+			},
+			"categories": categories,
+			"servers":    []interface{}{},
+			"version":    Version,
+		},
+	})
+}
+
+func (a *API) categories() []string {
+	return append([]string{"*"}, a.cfg.Categories...)
+}
+
+// respond writes a successful status response, or an error response if err is non-nil.
+func (a *API) respond(w http.ResponseWriter, err error) {
+	if errors.Is(err, queue.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, statusResponse{Status: true})
+}
+
+// page applies the "start" and "limit" parameters of r to jobs.
+func page(jobs []queue.Job, r *http.Request) []queue.Job {
+	if start, err := strconv.Atoi(r.FormValue("start")); err == nil && start > 0 {
+		if start > len(jobs) {
+			start = len(jobs)
+		}
+		jobs = jobs[start:]
+	}
+	if limit, err := strconv.Atoi(r.FormValue("limit")); err == nil && limit > 0 && limit < len(jobs) {
+		jobs = jobs[:limit]
+	}
+	return jobs
+}
+
+// parsePriority parses a SABnzbd priority, where an empty string is the default priority.
+func parsePriority(s string) (int, error) {
+	if s == "" {
+		return defaultPriority, nil
+	}
+	p, err := strconv.Atoi(s)
+	if err != nil || (p != defaultPriority && (p < pausedPriority || p > int(queue.Force))) {
+		return 0, fmt.Errorf("invalid priority '%s'", s)
+	}
+	return p, nil
+}
+
+// parseSpeed parses a speed limit in KB/s, or with a K or M suffix. 0 or empty removes the limit.
+func parseSpeed(s string) (int64, error) {
+	multiplier := int64(1024)
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	if strings.HasSuffix(upper, "M") {
+		multiplier = 1024 * 1024
+		upper = strings.TrimSuffix(upper, "M")
+	} else {
+		upper = strings.TrimSuffix(upper, "K")
+	}
+	if upper == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(upper, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid speed limit '%s'", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+func priorityName(p queue.Priority) string {
+	switch p {
+	case queue.Low:
+		return "Low"
+	case queue.High:
+		return "High"
+	case queue.Force:
+		return "Force"
+	default:
+		return "Normal"
+	}
+}
+
+func category(c string) string {
+	if c == "" {
+		return "*"
+	}
+	return c
+}
+
+func megabytes(bytes int64) string {
+	return fmt.Sprintf("%.2f", float64(bytes)/(1024*1024))
+}
+
+func formatSize(bytes int64) string {
+	switch {
+	case bytes >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(bytes)/(1<<30))
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+	case bytes >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", bytes)
+	}
+}
+
+// timeLeft formats the time to download the given number of bytes at speed bytes per second as H:MM:SS.
+func timeLeft(bytes int64, speed int64) string {
+	if speed <= 0 {
+		return "0:00:00"
+	}
+	seconds := bytes / speed
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Status: false, Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,326 @@
+package sabnzbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/esteth/usenet/pkg/daemon"
+	"github.com/esteth/usenet/pkg/nntp"
+	"github.com/esteth/usenet/pkg/nntp/nntptest"
+)
+
+const testAPIKey = "0123456789abcdef"
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	return data
+}
+
+// newTestAPI starts a daemon downloading from server, and an HTTP server serving the API for it.
+func newTestAPI(t *testing.T, server *nntptest.Server) (*daemon.Daemon, *httptest.Server) {
+	dir := t.TempDir()
+	d, err := daemon.New(daemon.Config{
+		Servers:   []nntp.Server{{Address: server.Addr, Connections: 2}},
+		QueuePath: filepath.Join(dir, "queue.json"),
+		OutputDir: filepath.Join(dir, "complete"),
+	})
+	if err != nil {
+		t.Fatalf("Could not create daemon: %v", err)
+	}
+	api := httptest.NewServer(New(d, Config{APIKey: testAPIKey, Categories: []string{"tv", "movies"}}))
+	t.Cleanup(api.Close)
+	return d, api
+}
+
+func call(t *testing.T, api *httptest.Server, params url.Values, v interface{}) int {
+	resp, err := http.Get(api.URL + "/api?" + params.Encode())
+	if err != nil {
+		t.Fatalf("Could not call API: %v", err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Could not decode API response: %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func addFile(t *testing.T, api *httptest.Server, filename string, content []byte, params url.Values) addResponse {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("name", filename)
+	if err != nil {
+		t.Fatalf("Could not create form: %v", err)
+	}
+	part.Write(content)
+	form.Close()
+
+	params.Set("mode", "addfile")
+	params.Set("apikey", testAPIKey)
+	params.Set("output", "json")
+	resp, err := http.Post(api.URL+"/api?"+params.Encode(), form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("Could not upload NZB: %v", err)
+	}
+	defer resp.Body.Close()
+	var added addResponse
+	if err = json.NewDecoder(resp.Body).Decode(&added); err != nil {
+		t.Fatalf("Could not decode response: %v", err)
+	}
+	if !added.Status || len(added.NzoIDs) != 1 {
+		t.Fatalf("NZB was not added: %+v", added)
+	}
+	return added
+}
+
+type historyResponse struct {
+	History struct {
+		NoOfSlots int           `json:"noofslots"`
+		Slots     []historySlot `json:"slots"`
+	} `json:"history"`
+}
+
+func waitForHistory(t *testing.T, api *httptest.Server) historySlot {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var history historyResponse
+		call(t, api, url.Values{"mode": {"history"}, "apikey": {testAPIKey}}, &history)
+		if len(history.History.Slots) > 0 {
+			return history.History.Slots[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for job to finish")
+	return historySlot{}
+}
+
+func TestVersionWithoutKey(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	_, api := newTestAPI(t, server)
+
+	var version map[string]string
+	call(t, api, url.Values{"mode": {"version"}, "output": {"json"}}, &version)
+	if version["version"] != Version {
+		t.Errorf("Expected version %s, got %v", Version, version)
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	_, api := newTestAPI(t, server)
+
+	var resp errorResponse
+	if status := call(t, api, url.Values{"mode": {"queue"}}, &resp); status != http.StatusUnauthorized || resp.Status {
+		t.Errorf("Request without API key was not rejected: %d %+v", status, resp)
+	}
+	if status := call(t, api, url.Values{"mode": {"queue"}, "apikey": {"wrong"}}, &resp); status != http.StatusForbidden || resp.Error != "API Key Incorrect" {
+		t.Errorf("Request with wrong API key was not rejected: %d %+v", status, resp)
+	}
+}
+
+func TestAddFileAndDownload(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	data := testData(20000)
+	content := server.Post("show.mkv", data, 6000)
+
+	d, api := newTestAPI(t, server)
+	added := addFile(t, api, "Show.S01E01.nzb", content, url.Values{"cat": {"tv"}, "priority": {"-2"}})
+
+	var queueResp struct {
+		Queue struct {
+			Slots []queueSlot `json:"slots"`
+		} `json:"queue"`
+	}
+	call(t, api, url.Values{"mode": {"queue"}, "apikey": {testAPIKey}}, &queueResp)
+	slots := queueResp.Queue.Slots
+	if len(slots) != 1 || slots[0].NzoID != added.NzoIDs[0] || slots[0].Cat != "tv" || slots[0].Status != "Paused" {
+		t.Fatalf("Unexpected queue after adding paused job: %+v", slots)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+	var status statusResponse
+	call(t, api, url.Values{"mode": {"queue"}, "name": {"resume"}, "value": {added.NzoIDs[0]}, "apikey": {testAPIKey}}, &status)
+	if !status.Status {
+		t.Fatalf("Could not resume job")
+	}
+
+	slot := waitForHistory(t, api)
+	if slot.Status != "Completed" || slot.Name != "Show.S01E01" || slot.Category != "tv" {
+		t.Fatalf("Unexpected history entry: %+v", slot)
+	}
+	written, err := os.ReadFile(filepath.Join(slot.Storage, "show.mkv"))
+	if err != nil {
+		t.Fatalf("Could not read downloaded file from storage path: %v", err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("Downloaded file does not match posted file")
+	}
+
+	call(t, api, url.Values{"mode": {"history"}, "name": {"delete"}, "value": {"all"}, "apikey": {testAPIKey}}, &status)
+	var history historyResponse
+	call(t, api, url.Values{"mode": {"history"}, "apikey": {testAPIKey}}, &history)
+	if history.History.NoOfSlots != 0 {
+		t.Errorf("History was not deleted: %+v", history)
+	}
+}
+
+func TestAddURL(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	content := server.Post("movie.mkv", testData(1000), 600)
+	indexer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="Movie.2020.nzb"`)
+		w.Write(content)
+	}))
+	defer indexer.Close()
+
+	d, api := newTestAPI(t, server)
+	var added addResponse
+	call(t, api, url.Values{
+		"mode":   {"addurl"},
+		"name":   {indexer.URL + "/getnzb?id=1"},
+		"cat":    {"movies"},
+		"apikey": {testAPIKey},
+	}, &added)
+	if !added.Status || len(added.NzoIDs) != 1 {
+		t.Fatalf("NZB was not added from URL: %+v", added)
+	}
+	job, err := d.Queue().Get(added.NzoIDs[0])
+	if err != nil {
+		t.Fatalf("Added job not in queue: %v", err)
+	}
+	if job.Name != "Movie.2020" || job.Category != "movies" {
+		t.Errorf("Unexpected job added from URL: %+v", job)
+	}
+}
+
+func TestAddURLOnlyFetchesHTTP(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	_, api := newTestAPI(t, server)
+
+	for _, u := range []string{"file:///etc/passwd", "ftp://example.com/a.nzb", "/a.nzb"} {
+		var failed errorResponse
+		status := call(t, api, url.Values{"mode": {"addurl"}, "name": {u}, "apikey": {testAPIKey}}, &failed)
+		if status != http.StatusBadRequest || failed.Status {
+			t.Errorf("Expected fetching '%s' to be refused, got %d %+v", u, status, failed)
+		}
+	}
+}
+
+func TestAddLocalFileConfinedToNZBDir(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	content := server.Post("a.bin", testData(100), 100)
+
+	dir := t.TempDir()
+	nzbDir := filepath.Join(dir, "watch")
+	os.Mkdir(nzbDir, 0755)
+	os.WriteFile(filepath.Join(nzbDir, "inside.nzb"), content, 0644)
+	os.WriteFile(filepath.Join(dir, "outside.nzb"), content, 0644)
+	d, err := daemon.New(daemon.Config{
+		Servers:   []nntp.Server{{Address: server.Addr, Connections: 1}},
+		QueuePath: filepath.Join(dir, "queue.json"),
+		NZBDir:    nzbDir,
+	})
+	if err != nil {
+		t.Fatalf("Could not create daemon: %v", err)
+	}
+	api := httptest.NewServer(New(d, Config{APIKey: testAPIKey}))
+	defer api.Close()
+
+	for name, expected := range map[string]int{
+		filepath.Join(nzbDir, "inside.nzb"): http.StatusOK,
+		filepath.Join(dir, "outside.nzb"):   http.StatusForbidden,
+		filepath.Join(dir, "missing.nzb"):   http.StatusForbidden,
+		"../outside.nzb":                    http.StatusForbidden,
+		"missing.nzb":                       http.StatusBadRequest,
+	} {
+		status := call(t, api, url.Values{"mode": {"addlocalfile"}, "name": {name}, "apikey": {testAPIKey}}, nil)
+		if status != expected {
+			t.Errorf("Expected %d adding '%s', got %d", expected, name, status)
+		}
+	}
+}
+
+func TestQueueDeleteAndPriority(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	content := server.Post("a.bin", testData(100), 100)
+	d, api := newTestAPI(t, server)
+
+	first := addFile(t, api, "first.nzb", content, url.Values{})
+	second := addFile(t, api, "second.nzb", content, url.Values{})
+
+	var status statusResponse
+	call(t, api, url.Values{"mode": {"queue"}, "name": {"priority"}, "value": {second.NzoIDs[0]}, "value2": {"1"}, "apikey": {testAPIKey}}, &status)
+	jobs := d.Queue().Jobs()
+	if len(jobs) != 2 || jobs[0].ID != second.NzoIDs[0] {
+		t.Fatalf("Raising priority did not reorder queue: %+v", jobs)
+	}
+
+	call(t, api, url.Values{"mode": {"queue"}, "name": {"delete"}, "value": {first.NzoIDs[0]}, "apikey": {testAPIKey}}, &status)
+	jobs = d.Queue().Jobs()
+	if !status.Status || len(jobs) != 1 || jobs[0].ID != second.NzoIDs[0] {
+		t.Errorf("Job was not deleted: %+v", jobs)
+	}
+}
+
+func TestPauseResumeAndSpeedLimit(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	d, api := newTestAPI(t, server)
+
+	var status statusResponse
+	call(t, api, url.Values{"mode": {"pause"}, "apikey": {testAPIKey}}, &status)
+	if !status.Status || !d.Queue().Paused() {
+		t.Errorf("Queue was not paused")
+	}
+	call(t, api, url.Values{"mode": {"resume"}, "apikey": {testAPIKey}}, &status)
+	if !status.Status || d.Queue().Paused() {
+		t.Errorf("Queue was not resumed")
+	}
+
+	call(t, api, url.Values{"mode": {"config"}, "name": {"speedlimit"}, "value": {"2M"}, "apikey": {testAPIKey}}, &status)
+	if d.SpeedLimit() != 2*1024*1024 {
+		t.Errorf("Expected speed limit of 2MB/s, got %d", d.SpeedLimit())
+	}
+}
+
+func TestGetConfig(t *testing.T) {
+	server := nntptest.NewServer(nil)
+	defer server.Close()
+	_, api := newTestAPI(t, server)
+
+	var config struct {
+		Config struct {
+			Categories []categoryConfig `json:"categories"`
+		} `json:"config"`
+	}
+	call(t, api, url.Values{"mode": {"get_config"}, "apikey": {testAPIKey}}, &config)
+	names := make([]string, 0)
+	for _, c := range config.Config.Categories {
+		names = append(names, c.Name)
+	}
+	if len(names) != 3 || names[0] != "*" || names[1] != "tv" || names[2] != "movies" {
+		t.Errorf("Unexpected categories: %v", names)
+	}
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Dir is a Storage holding the files in a directory on disk. Names can't refer to files outside
+// the directory.
+type Dir string
+
+// path returns the path on disk of the named file.
+func (d Dir) path(op string, name string) (string, error) {
+	if err := checkName(op, name); err != nil {
+		return "", err
+	}
+	return filepath.Join(string(d), filepath.FromSlash(name)), nil
+}
+
+func (d Dir) Create(name string) (File, error) {
+	path, err := d.path("create", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return dirFile{f}, nil
+}
+
+func (d Dir) Open(name string) (File, error) {
+	path, err := d.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return dirFile{f}, nil
+}
+
+func (d Dir) Rename(oldname, newname string) error {
+	oldpath, err := d.path("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := d.path("rename", newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+func (d Dir) Stat(name string) (fs.FileInfo, error) {
+	path, err := d.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+func (d Dir) ReadDir(name string) ([]fs.DirEntry, error) {
+	path, err := d.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(path)
+}
+
+// dirFile is a file in a Dir.
+type dirFile struct {
+	*os.File
+}
+
+// Allocate allocates the disk space for the file to hold size bytes, growing it to that size.
+func (f dirFile) Allocate(size int64) error {
+	return preallocate(f.File, size)
+}
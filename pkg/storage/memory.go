@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Storage holding files in memory, such as for tests. Directories exist as long as
+// they hold files.
+type Memory struct {
+	mu    sync.Mutex
+	files map[string]*memData
+}
+
+// NewMemory creates an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]*memData)}
+}
+
+// memData is the contents of a file in a Memory, shared by every handle to it.
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func (m *Memory) Create(name string) (File, error) {
+	if err := checkName("create", name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isDir(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	}
+	d, ok := m.files[name]
+	if !ok {
+		d = &memData{modTime: time.Now()}
+		m.files[name] = d
+	}
+	return &memFile{data: d, name: name, writable: true}, nil
+}
+
+func (m *Memory) Open(name string) (File, error) {
+	if err := checkName("open", name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{data: d, name: name}, nil
+}
+
+func (m *Memory) Rename(oldname, newname string) error {
+	if err := checkName("rename", oldname); err != nil {
+		return err
+	}
+	if err := checkName("rename", newname); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.files[oldname]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldname)
+	m.files[newname] = d
+	return nil
+}
+
+func (m *Memory) Stat(name string) (fs.FileInfo, error) {
+	if err := checkName("stat", name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d, ok := m.files[name]; ok {
+		return d.info(name), nil
+	}
+	if m.isDir(name) {
+		return memInfo{name: path.Base(name), dir: true}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *Memory) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := checkName("readdir", name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isDir(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries := make(map[string]fs.DirEntry)
+	for file, d := range m.files {
+		rest, ok := within(name, file)
+		if !ok {
+			continue
+		}
+		if child, _, nested := strings.Cut(rest, "/"); nested {
+			entries[child] = fs.FileInfoToDirEntry(memInfo{name: child, dir: true})
+		} else {
+			entries[child] = fs.FileInfoToDirEntry(d.info(child))
+		}
+	}
+	list := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// isDir returns true if name is the root, or holds files. m.mu must be held.
+func (m *Memory) isDir(name string) bool {
+	if name == "." {
+		return true
+	}
+	for file := range m.files {
+		if _, ok := within(name, file); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// within returns the rest of the name of a file in dir, and whether it is in dir at all.
+func within(dir string, file string) (string, bool) {
+	if dir == "." {
+		return file, true
+	}
+	return strings.CutPrefix(file, dir+"/")
+}
+
+// info describes the file's contents under the given name.
+func (d *memData) info(name string) memInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return memInfo{name: path.Base(name), size: int64(len(d.data)), modTime: d.modTime}
+}
+
+// memFile is an open file in a Memory.
+type memFile struct {
+	data     *memData
+	name     string
+	writable bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: errClosed}
+	}
+	if write && !f.writable {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.data.mu.RLock()
+	defer f.data.mu.RUnlock()
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.data.data)) {
+		f.data.resize(end)
+	}
+	copy(f.data.data[off:], p)
+	f.data.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+	f.data.resize(size)
+	f.data.modTime = time.Now()
+	return nil
+}
+
+// resize changes the size of the file, zeroing any space it grows by. d.mu must be held.
+func (d *memData) resize(size int64) {
+	if size <= int64(len(d.data)) {
+		d.data = d.data[:size]
+		return
+	}
+	if size <= int64(cap(d.data)) {
+		old := len(d.data)
+		d.data = d.data[:size]
+		clear(d.data[old:])
+		return
+	}
+	grown := make([]byte, size, size+size/4)
+	copy(grown, d.data)
+	d.data = grown
+}
+
+func (f *memFile) Sync() error {
+	return f.check("sync", false)
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	if err := f.check("stat", false); err != nil {
+		return nil, err
+	}
+	return f.data.info(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: errClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// memInfo describes a file or directory in a Memory.
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() any           { return nil }
+
+func (i memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0777
+	}
+	return 0666
+}
@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// preallocate allocates the disk space for a file of size bytes, growing the file to that size.
+func preallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		// Some filesystems can't allocate space ahead of time, so the file is only grown.
+		return file.Truncate(size)
+	}
+	return err
+}
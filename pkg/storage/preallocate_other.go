@@ -0,0 +1,11 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+// preallocate grows a file to size bytes. There is no portable way to allocate its disk space
+// ahead of time, so the file may be sparse.
+func preallocate(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
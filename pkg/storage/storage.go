@@ -0,0 +1,101 @@
+// Package storage abstracts where downloads are written, so that they can be kept in a directory
+// on disk or, such as in tests, in memory.
+//
+// Files are named by slash-separated paths relative to the root of their Storage, which must be
+// valid according to fs.ValidPath.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// A File is an open file in a Storage. ReadAt and WriteAt may be called from several goroutines
+// at once.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	// Truncate changes the size of the file, filling any space it grows by with zeroes.
+	Truncate(size int64) error
+	// Sync commits the contents of the file to stable storage.
+	Sync() error
+	Stat() (fs.FileInfo, error)
+}
+
+// A Storage holds named files.
+type Storage interface {
+	// Create opens the named file for reading and writing, creating it if it doesn't exist. The
+	// contents of an existing file are kept.
+	Create(name string) (File, error)
+	// Open opens the named file for reading.
+	Open(name string) (File, error)
+	// Rename renames a file, replacing any file which already has the new name.
+	Rename(oldname, newname string) error
+	// Stat describes the named file.
+	Stat(name string) (fs.FileInfo, error)
+	// ReadDir lists the named directory, sorted by name. The root is named ".".
+	ReadDir(name string) ([]fs.DirEntry, error)
+}
+
+// Allocate grows f to size bytes. If f's storage can, the space is allocated ahead of time, so that
+// writing to the file out of order doesn't fragment it.
+func Allocate(f File, size int64) error {
+	if a, ok := f.(interface{ Allocate(size int64) error }); ok {
+		return a.Allocate(size)
+	}
+	return f.Truncate(size)
+}
+
+// ReadFile returns the contents of the named file.
+func ReadFile(s Storage, name string) ([]byte, error) {
+	f, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, info.Size())
+	if _, err := f.ReadAt(data, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteFile writes data to the named file, replacing its contents.
+func WriteFile(s Storage, name string, data []byte) error {
+	f, err := s.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// NewReader returns a reader of f from its start, for code which reads files in order.
+func NewReader(f File) io.ReadSeeker {
+	return io.NewSectionReader(f, 0, 1<<63-1)
+}
+
+// checkName returns an error if name isn't valid for op.
+func checkName(op string, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// errClosed is returned when using a file which has been closed.
+var errClosed = fmt.Errorf("file already closed: %w", fs.ErrClosed)
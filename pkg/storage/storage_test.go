@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// backends returns an empty Storage of each kind.
+func backends(t *testing.T) map[string]Storage {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0777); err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	return map[string]Storage{"dir": Dir(dir), "memory": NewMemory()}
+}
+
+func TestWriteAt(t *testing.T) {
+	for name, s := range backends(t) {
+		f, err := s.Create("a.bin")
+		if err != nil {
+			t.Fatalf("%s: Could not create file: %v", name, err)
+		}
+		if err := Allocate(f, 1000); err != nil {
+			t.Fatalf("%s: Could not allocate file: %v", name, err)
+		}
+		expected := make([]byte, 1000)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			part := bytes.Repeat([]byte{byte(i + 1)}, 100)
+			copy(expected[i*100:], part)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := f.WriteAt(part, int64(i*100)); err != nil {
+					t.Errorf("%s: Could not write: %v", name, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if err := f.Sync(); err != nil {
+			t.Errorf("%s: Could not sync: %v", name, err)
+		}
+		if err := f.Close(); err != nil {
+			t.Errorf("%s: Could not close: %v", name, err)
+		}
+
+		data, err := ReadFile(s, "a.bin")
+		if err != nil || !bytes.Equal(data, expected) {
+			t.Errorf("%s: Read back %d bytes which don't match those written: %v", name, len(data), err)
+		}
+	}
+}
+
+func TestCreateKeepsContents(t *testing.T) {
+	for name, s := range backends(t) {
+		if err := WriteFile(s, "a.bin", []byte("hello world")); err != nil {
+			t.Fatalf("%s: Could not write file: %v", name, err)
+		}
+		f, err := s.Create("a.bin")
+		if err != nil {
+			t.Fatalf("%s: Could not reopen file: %v", name, err)
+		}
+		f.WriteAt([]byte("HELLO"), 0)
+		f.Close()
+		if data, _ := ReadFile(s, "a.bin"); string(data) != "HELLO world" {
+			t.Errorf("%s: Expected the file's contents to be kept, got %q", name, data)
+		}
+	}
+}
+
+func TestRenameAndReadDir(t *testing.T) {
+	for name, s := range backends(t) {
+		for _, file := range []string{"b.bin.partial", "a.bin", "sub/c.bin"} {
+			if err := WriteFile(s, file, []byte(file)); err != nil {
+				t.Fatalf("%s: Could not write %s: %v", name, file, err)
+			}
+		}
+		if err := s.Rename("b.bin.partial", "b.bin"); err != nil {
+			t.Fatalf("%s: Could not rename: %v", name, err)
+		}
+		if _, err := s.Stat("b.bin.partial"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: Expected the old name not to exist, got %v", name, err)
+		}
+		if info, err := s.Stat("b.bin"); err != nil || info.Size() != int64(len("b.bin.partial")) {
+			t.Errorf("%s: Expected the new name to exist, got %v", name, err)
+		}
+
+		entries, err := s.ReadDir(".")
+		if err != nil {
+			t.Fatalf("%s: Could not list root: %v", name, err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if !reflect.DeepEqual(names, []string{"a.bin", "b.bin", "sub"}) || !entries[2].IsDir() {
+			t.Errorf("%s: Unexpected entries %v", name, names)
+		}
+	}
+}
+
+func TestRejectsInvalidNames(t *testing.T) {
+	for name, s := range backends(t) {
+		for _, file := range []string{"../a.bin", "/a.bin", "sub/../../a.bin", ""} {
+			if _, err := s.Create(file); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("%s: Expected %q to be rejected, got %v", name, file, err)
+			}
+		}
+	}
+}
+
+func TestOpenIsReadOnly(t *testing.T) {
+	for name, s := range backends(t) {
+		if err := WriteFile(s, "a.bin", []byte("data")); err != nil {
+			t.Fatalf("%s: Could not write file: %v", name, err)
+		}
+		f, err := s.Open("a.bin")
+		if err != nil {
+			t.Fatalf("%s: Could not open file: %v", name, err)
+		}
+		if _, err := f.WriteAt([]byte("x"), 0); err == nil {
+			t.Errorf("%s: Expected writing to a file opened for reading to fail", name)
+		}
+		f.Close()
+		if _, err := s.Open("missing.bin"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: Expected a missing file not to exist, got %v", name, err)
+		}
+	}
+}
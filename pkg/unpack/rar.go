@@ -0,0 +1,164 @@
+package unpack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/nwaples/rardecode/v2"
+)
+
+var (
+	partVolume = regexp.MustCompile(`(?i)^(.+)\.part(\d+)\.rar$`)
+	oldVolume  = regexp.MustCompile(`(?i)^(.+)\.r(\d\d+)$`)
+	rarFile    = regexp.MustCompile(`(?i)^(.+)\.rar$`)
+)
+
+// A Set is a group of RAR volumes that together make up a single archive.
+type Set struct {
+	// Name is the name of the set, without any volume numbering or extension.
+	Name string
+	// Volumes are the paths of the set's volumes, in order. The first volume is the one
+	// extraction starts from.
+	Volumes []string
+}
+
+// A CRCError reports that a file extracted from a set did not match its checksum, usually
+// because one of the volumes is damaged. The set should be repaired and extracted again.
+type CRCError struct {
+	Set  string
+	File string
+}
+
+func (e *CRCError) Error() string {
+	return fmt.Sprintf("CRC check failed for %s in %s", e.File, e.Set)
+}
+
+func (e *CRCError) Unwrap() error {
+	return rardecode.ErrBadFileChecksum
+}
+
+// FindRarSets returns the RAR volume sets found in dir, sorted by name.
+//
+// Sets whose first volume is missing are skipped, as extraction cannot start without it.
+func FindRarSets(dir string) ([]Set, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list %s: %w", dir, err)
+	}
+
+	type volume struct {
+		path   string
+		number int
+		first  bool
+	}
+	sets := make(map[string][]volume)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		if m := partVolume.FindStringSubmatch(name); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			// Most posters number the first part 1, but some start from 0.
+			sets[m[1]] = append(sets[m[1]], volume{path, n, n <= 1})
+		} else if m := oldVolume.FindStringSubmatch(name); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			sets[m[1]] = append(sets[m[1]], volume{path, n + 1, false})
+		} else if m := rarFile.FindStringSubmatch(name); m != nil {
+			sets[m[1]] = append(sets[m[1]], volume{path, 0, true})
+		}
+	}
+
+	result := make([]Set, 0, len(sets))
+	for name, volumes := range sets {
+		sort.Slice(volumes, func(i, j int) bool {
+			return volumes[i].number < volumes[j].number
+		})
+		if !volumes[0].first {
+			continue
+		}
+		set := Set{Name: name}
+		for _, v := range volumes {
+			set.Volumes = append(set.Volumes, v.path)
+		}
+		result = append(result, set)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// ExtractRar extracts the contents of the RAR set into dest, returning the paths of the extracted files.
+//
+// password is only used if the archive is encrypted. Entries that would be written outside of
+// dest, and links, are skipped.
+func ExtractRar(set Set, dest string, password string) ([]string, error) {
+	if len(set.Volumes) == 0 {
+		return nil, fmt.Errorf("Set %s has no volumes", set.Name)
+	}
+	var opts []rardecode.Option
+	if password != "" {
+		opts = append(opts, rardecode.Password(password))
+	}
+	r, err := rardecode.OpenReader(set.Volumes[0], opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open %s: %w", set.Name, classifyRar(err))
+	}
+	defer r.Close()
+
+	extracted := make([]string, 0)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return extracted, nil
+		}
+		if err != nil {
+			return extracted, fmt.Errorf("Could not read %s: %w", set.Name, classifyRar(err))
+		}
+
+		path, ok := localPath(dest, header.Name)
+		if !ok || header.Mode()&fs.ModeSymlink != 0 {
+			continue
+		}
+		if header.IsDir {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return extracted, fmt.Errorf("Could not create directory %s: %w", path, err)
+			}
+			continue
+		}
+
+		err = writeFile(path, r, header.ModificationTime)
+		if errors.Is(err, rardecode.ErrBadFileChecksum) && header.Encrypted {
+			// RAR 4 archives can't verify the password up front, so a wrong password
+			// surfaces as a checksum failure.
+			return extracted, fmt.Errorf("Could not extract %s from %s: %w", header.Name, set.Name, ErrPassword)
+		}
+		if errors.Is(err, rardecode.ErrBadFileChecksum) {
+			return extracted, &CRCError{Set: set.Name, File: header.Name}
+		}
+		if err != nil {
+			return extracted, fmt.Errorf("Could not extract %s from %s: %w", header.Name, set.Name, classifyRar(err))
+		}
+		extracted = append(extracted, path)
+	}
+}
+
+// classifyRar translates the RAR decoder's encryption errors into ErrPassword.
+func classifyRar(err error) error {
+	switch {
+	case errors.Is(err, rardecode.ErrArchiveEncrypted),
+		errors.Is(err, rardecode.ErrArchivedFileEncrypted),
+		errors.Is(err, rardecode.ErrBadPassword):
+		return fmt.Errorf("%w: %v", ErrPassword, err)
+	}
+	return err
+}
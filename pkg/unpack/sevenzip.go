@@ -0,0 +1,59 @@
+package unpack
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/bodgit/sevenzip"
+)
+
+// Extract7z extracts the contents of the 7z archive at path into dest, returning the paths of
+// the extracted files.
+//
+// Archives split into volumes are extracted by passing the path of the ".7z.001" volume.
+// password is only used if the archive is encrypted. Entries that would be written outside of
+// dest, and symbolic links, are skipped.
+func Extract7z(path string, dest string, password string) ([]string, error) {
+	r, err := sevenzip.OpenReaderWithPassword(path, password)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open %s: %w", path, classify7z(err))
+	}
+	defer r.Close()
+
+	extracted := make([]string, 0)
+	for _, f := range r.File {
+		target, ok := localPath(dest, f.Name)
+		if !ok || f.Mode()&fs.ModeSymlink != 0 {
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return extracted, fmt.Errorf("Could not create directory %s: %w", target, err)
+			}
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return extracted, fmt.Errorf("Could not extract %s from %s: %w", f.Name, path, classify7z(err))
+		}
+		err = writeFile(target, rc, f.Modified)
+		rc.Close()
+		if err != nil {
+			return extracted, fmt.Errorf("Could not extract %s from %s: %w", f.Name, path, classify7z(err))
+		}
+		extracted = append(extracted, target)
+	}
+	return extracted, nil
+}
+
+// classify7z translates the decoder's encryption errors into ErrPassword.
+func classify7z(err error) error {
+	var readErr *sevenzip.ReadError
+	if errors.As(err, &readErr) && readErr.Encrypted {
+		return fmt.Errorf("%w: %v", ErrPassword, err)
+	}
+	return err
+}
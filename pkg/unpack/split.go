@@ -0,0 +1,153 @@
+package unpack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/esteth/usenet/pkg/par2/scanner"
+)
+
+var (
+	splitPiece = regexp.MustCompile(`^(.+)\.(\d{3})$`)
+	par2File   = regexp.MustCompile(`(?i)\.par2$`)
+)
+
+// JoinSplits joins files in dir that were split into numbered pieces ("name.001", "name.002"...)
+// back into a single file ("name"), returning the paths of the joined files.
+//
+// Pieces are only joined if they are numbered consecutively from 001, and a file is not joined
+// again if it already exists. If the directory holds PAR2 files describing the joined file, its
+// length is checked against them. 7z volumes are left alone, as Extract7z reads them directly.
+func JoinSplits(dir string) ([]string, error) {
+	pieces, err := findFiles(dir, splitPiece)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list %s: %w", dir, err)
+	}
+
+	type piece struct {
+		path   string
+		number int
+	}
+	splits := make(map[string][]piece)
+	for _, path := range pieces {
+		m := splitPiece.FindStringSubmatch(filepath.Base(path))
+		if sevenZipFile.MatchString(m[1]) {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		splits[m[1]] = append(splits[m[1]], piece{path, n})
+	}
+	if len(splits) == 0 {
+		return nil, nil
+	}
+
+	lengths := par2Lengths(dir)
+	names := make([]string, 0, len(splits))
+	for name := range splits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	joined := make([]string, 0)
+	var errs []error
+	for _, name := range names {
+		parts := splits[name]
+		sort.Slice(parts, func(i, j int) bool {
+			return parts[i].number < parts[j].number
+		})
+		complete := true
+		paths := make([]string, len(parts))
+		for i, p := range parts {
+			complete = complete && p.number == i+1
+			paths[i] = p.path
+		}
+		target := filepath.Join(dir, name)
+		if !complete || exists(target) {
+			continue
+		}
+
+		expected, ok := lengths[name]
+		if !ok {
+			expected = -1
+		}
+		if err := join(target, paths, expected); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		joined = append(joined, target)
+	}
+	return joined, errors.Join(errs...)
+}
+
+// join concatenates pieces into target. If expected isn't negative, the joined file must be
+// that many bytes long.
+func join(target string, pieces []string, expected int64) error {
+	tmp := target + ".joining"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("Could not create %s: %w", tmp, err)
+	}
+	defer os.Remove(tmp)
+
+	var written int64
+	for _, path := range pieces {
+		in, err := os.Open(path)
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("Could not open %s: %w", path, err)
+		}
+		n, err := io.Copy(out, in)
+		in.Close()
+		written += n
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("Could not join %s: %w", path, err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("Could not write %s: %w", tmp, err)
+	}
+	if expected >= 0 && written != expected {
+		return fmt.Errorf("Joined %s is %d bytes, but PAR2 expects %d", target, written, expected)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return fmt.Errorf("Could not rename %s: %w", tmp, err)
+	}
+	return nil
+}
+
+// par2Lengths returns the lengths of the files described by the PAR2 files in dir, keyed by name.
+//
+// Damaged PAR2 files are read as far as possible, as this is only used as a sanity check.
+func par2Lengths(dir string) map[string]int64 {
+	lengths := make(map[string]int64)
+	paths, err := findFiles(dir, par2File)
+	if err != nil {
+		return lengths
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		s := scanner.NewScanner(f)
+		for s.Scan() {
+			if fd, ok := s.Packet().(scanner.FileDescriptionPacket); ok {
+				lengths[fd.FileName] = int64(fd.FileLength)
+			}
+		}
+		f.Close()
+	}
+	return lengths
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,123 @@
+// Package unpack extracts the archives that downloads are commonly posted as.
+//
+// RAR volume sets (both the modern "name.partNN.rar" and the older "name.rar, name.r00..."
+// naming schemes), 7z archives (including ".7z.001" volumes), and zip archives are supported, as
+// are files split into numbered ".001", ".002"... pieces.
+package unpack
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// ErrPassword is returned when an archive is encrypted and the password is missing or wrong.
+var ErrPassword = errors.New("archive is encrypted and the password is missing or incorrect")
+
+var (
+	sevenZipFile = regexp.MustCompile(`(?i)\.7z(\.0*1)?$`)
+	zipFile      = regexp.MustCompile(`(?i)\.zip$`)
+)
+
+// ExtractAll extracts every archive found in dir into dest, returning the paths of the extracted
+// files. Archives which were split into numbered pieces must be joined with JoinSplits first.
+//
+// Extraction continues past archives that fail, and the errors are returned together.
+func ExtractAll(dir string, dest string, password string) ([]string, error) {
+	var errs []error
+	sets, err := FindRarSets(dir)
+	if err != nil {
+		return nil, err
+	}
+	extracted := make([]string, 0)
+	for _, set := range sets {
+		files, err := ExtractRar(set, dest, password)
+		extracted = append(extracted, files...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, pattern := range []*regexp.Regexp{sevenZipFile, zipFile} {
+		archives, err := findFiles(dir, pattern)
+		if err != nil {
+			return extracted, err
+		}
+		for _, archive := range archives {
+			var files []string
+			if pattern == zipFile {
+				files, err = ExtractZip(archive, dest)
+			} else {
+				files, err = Extract7z(archive, dest, password)
+			}
+			extracted = append(extracted, files...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return extracted, errors.Join(errs...)
+}
+
+// IsArchive reports whether name is an archive, archive volume or split file piece of the kind
+// ExtractAll reads, and so is no longer needed once it has been extracted.
+func IsArchive(name string) bool {
+	for _, pattern := range []*regexp.Regexp{partVolume, oldVolume, rarFile, sevenZipFile, zipFile, splitPiece} {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// findFiles returns the paths of the files in dir whose names match pattern, sorted by name.
+func findFiles(dir string, pattern *regexp.Regexp) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() && pattern.MatchString(entry.Name()) {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// localPath returns where the archive entry name should be extracted to within dest, or false
+// if the entry would be written outside of dest.
+func localPath(dest string, name string) (string, bool) {
+	name = filepath.FromSlash(name)
+	if !filepath.IsLocal(name) {
+		return "", false
+	}
+	return filepath.Join(dest, name), true
+}
+
+// writeFile writes the contents of r to path, creating any missing directories.
+func writeFile(path string, r io.Reader, modified time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if !modified.IsZero() {
+		os.Chtimes(path, modified, modified)
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+package unpack
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const (
+	fileEncrypted = 0x0004
+	dosTime       = (2020-1980)<<25 | 1<<21 | 2<<16 | 3<<11 | 4<<5 | 3
+)
+
+// rarHeader builds a RAR 4 block header, filling in the size and header CRC.
+func rarHeader(headType byte, flags uint16, fields []byte) []byte {
+	h := make([]byte, 7, 7+len(fields))
+	h[2] = headType
+	binary.LittleEndian.PutUint16(h[3:], flags)
+	binary.LittleEndian.PutUint16(h[5:], uint16(7+len(fields)))
+	h = append(h, fields...)
+	binary.LittleEndian.PutUint16(h[0:], uint16(crc32.ChecksumIEEE(h[2:])))
+	return h
+}
+
+// writeRar writes a stored (uncompressed) RAR 4 archive holding a single file, split evenly
+// across the given volumes.
+func writeRar(t *testing.T, volumes []string, name string, data []byte, fileFlags uint16) {
+	multi := len(volumes) > 1
+	chunk := (len(data) + len(volumes) - 1) / len(volumes)
+	for i, volume := range volumes {
+		part := data[min(i*chunk, len(data)):min((i+1)*chunk, len(data))]
+
+		var buf bytes.Buffer
+		buf.Write([]byte{0x52, 0x61, 0x72, 0x21, 0x1A, 0x07, 0x00})
+
+		var arcFlags uint16
+		if multi {
+			arcFlags = 0x0001 | 0x0010
+			if i == 0 {
+				arcFlags |= 0x0100
+			}
+		}
+		buf.Write(rarHeader(0x73, arcFlags, make([]byte, 6)))
+
+		flags := 0x8000 | fileFlags
+		if i > 0 {
+			flags |= 0x0001
+		}
+		if i < len(volumes)-1 {
+			flags |= 0x0002
+		}
+		fields := binary.LittleEndian.AppendUint32(nil, uint32(len(part)))
+		fields = binary.LittleEndian.AppendUint32(fields, uint32(len(data)))
+		fields = append(fields, 3)
+		fields = binary.LittleEndian.AppendUint32(fields, crc32.ChecksumIEEE(data))
+		fields = binary.LittleEndian.AppendUint32(fields, dosTime)
+		fields = append(fields, 20, 0x30)
+		fields = binary.LittleEndian.AppendUint16(fields, uint16(len(name)))
+		fields = binary.LittleEndian.AppendUint32(fields, 0100644)
+		fields = append(fields, name...)
+		buf.Write(rarHeader(0x74, flags, fields))
+		buf.Write(part)
+
+		var endFlags uint16
+		if i < len(volumes)-1 {
+			endFlags = 0x0001
+		}
+		buf.Write(rarHeader(0x7B, endFlags, nil))
+
+		if err := os.WriteFile(volume, buf.Bytes(), 0666); err != nil {
+			t.Fatalf("Could not write volume: %v", err)
+		}
+	}
+}
+
+func testData() []byte {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestFindSets(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"a.part01.rar", "a.part02.rar", "a.part10.rar",
+		"b.rar", "b.r00", "b.r01",
+		"c.r00", "c.r01",
+		"d.part02.rar",
+		"other.txt",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+	}
+
+	sets, err := FindRarSets(dir)
+	if err != nil {
+		t.Fatalf("Could not find sets: %v", err)
+	}
+	expected := []Set{
+		{Name: "a", Volumes: []string{
+			filepath.Join(dir, "a.part01.rar"), filepath.Join(dir, "a.part02.rar"), filepath.Join(dir, "a.part10.rar"),
+		}},
+		{Name: "b", Volumes: []string{
+			filepath.Join(dir, "b.rar"), filepath.Join(dir, "b.r00"), filepath.Join(dir, "b.r01"),
+		}},
+	}
+	if !reflect.DeepEqual(sets, expected) {
+		t.Errorf("Found sets %v, expected %v", sets, expected)
+	}
+}
+
+func TestExtractVolumes(t *testing.T) {
+	for _, volumes := range [][]string{
+		{"release.part1.rar", "release.part2.rar", "release.part3.rar"},
+		{"release.rar", "release.r00", "release.r01"},
+		{"release.rar"},
+	} {
+		dir := t.TempDir()
+		paths := make([]string, 0, len(volumes))
+		for _, v := range volumes {
+			paths = append(paths, filepath.Join(dir, v))
+		}
+		data := testData()
+		writeRar(t, paths, "sub\\movie.mkv", data, 0)
+
+		dest := filepath.Join(dir, "out")
+		extracted, err := ExtractAll(dir, dest, "")
+		if err != nil {
+			t.Fatalf("Could not extract %v: %v", volumes, err)
+		}
+		path := filepath.Join(dest, "sub", "movie.mkv")
+		if !reflect.DeepEqual(extracted, []string{path}) {
+			t.Errorf("Extracted %v, expected %v", extracted, []string{path})
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Could not read extracted file: %v", err)
+		}
+		if !bytes.Equal(content, data) {
+			t.Errorf("Content extracted from %v not equal to archived data", volumes)
+		}
+	}
+}
+
+func TestExtractReportsCRCFailure(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "release.part1.rar"), filepath.Join(dir, "release.part2.rar")}
+	writeRar(t, paths, "movie.mkv", testData(), 0)
+
+	content, err := os.ReadFile(paths[1])
+	if err != nil {
+		t.Fatalf("Could not read volume: %v", err)
+	}
+	content[len(content)-20] ^= 0xFF
+	if err := os.WriteFile(paths[1], content, 0666); err != nil {
+		t.Fatalf("Could not write volume: %v", err)
+	}
+
+	_, err = ExtractRar(Set{Name: "release", Volumes: paths}, filepath.Join(dir, "out"), "")
+	var crcErr *CRCError
+	if !errors.As(err, &crcErr) {
+		t.Fatalf("Expected a CRC error, got %v", err)
+	}
+	if crcErr.Set != "release" || crcErr.File != "movie.mkv" {
+		t.Errorf("CRC error names %s in %s, expected movie.mkv in release", crcErr.File, crcErr.Set)
+	}
+}
+
+func TestExtractEncryptedWithoutPassword(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "release.rar")
+	writeRar(t, []string{path}, "movie.mkv", testData(), fileEncrypted)
+
+	_, err := ExtractRar(Set{Name: "release", Volumes: []string{path}}, filepath.Join(dir, "out"), "")
+	if !errors.Is(err, ErrPassword) {
+		t.Errorf("Expected a password error, got %v", err)
+	}
+}
+
+func TestExtractSkipsEscapingPaths(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "release.rar")
+	writeRar(t, []string{path}, "../escaped.txt", testData(), 0)
+
+	dest := filepath.Join(dir, "out")
+	extracted, err := ExtractRar(Set{Name: "release", Volumes: []string{path}}, dest, "")
+	if err != nil {
+		t.Fatalf("Could not extract: %v", err)
+	}
+	if len(extracted) != 0 {
+		t.Errorf("Extracted %v, expected nothing", extracted)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); err == nil {
+		t.Errorf("File was written outside of the destination")
+	}
+}
+
+func writeTestFile(t *testing.T, path string, content []byte) {
+	if err := os.WriteFile(path, content, 0666); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) []byte {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	return content
+}
+
+// writeSplit writes data to dir as name.001, name.002... pieces of at most size bytes.
+func writeSplit(t *testing.T, dir string, name string, data []byte, size int) {
+	for i := 0; i*size < len(data); i++ {
+		piece := data[i*size : min((i+1)*size, len(data))]
+		writeTestFile(t, filepath.Join(dir, fmt.Sprintf("%s.%03d", name, i+1)), piece)
+	}
+}
+
+// par2FileDesc builds a PAR2 file description packet for a file of the given name and length.
+func par2FileDesc(name string, length uint64) []byte {
+	for len(name)%4 != 0 {
+		name += "\000"
+	}
+	body := make([]byte, 48)
+	body = binary.LittleEndian.AppendUint64(body, length)
+	body = append(body, name...)
+
+	packet := make([]byte, 64, 64+len(body))
+	copy(packet, "PAR2\000PKT")
+	binary.LittleEndian.PutUint64(packet[8:], uint64(64+len(body)))
+	copy(packet[48:], "PAR 2.0\000FileDesc")
+	packet = append(packet, body...)
+	hash := md5.Sum(packet[32:])
+	copy(packet[16:], hash[:])
+	return packet
+}
+
+func TestJoinSplits(t *testing.T) {
+	dir := t.TempDir()
+	data := testData()
+	writeSplit(t, dir, "movie.mkv", data, 4000)
+	writeTestFile(t, filepath.Join(dir, "archive.7z.001"), []byte("7z"))
+	writeTestFile(t, filepath.Join(dir, "incomplete.bin.001"), []byte("a"))
+	writeTestFile(t, filepath.Join(dir, "incomplete.bin.003"), []byte("c"))
+
+	joined, err := JoinSplits(dir)
+	if err != nil {
+		t.Fatalf("Could not join splits: %v", err)
+	}
+	expected := []string{filepath.Join(dir, "movie.mkv")}
+	if !reflect.DeepEqual(joined, expected) {
+		t.Errorf("Joined %v, expected %v", joined, expected)
+	}
+	if !bytes.Equal(readTestFile(t, expected[0]), data) {
+		t.Errorf("Joined file not equal to the original data")
+	}
+}
+
+func TestJoinSplitsChecksPar2Length(t *testing.T) {
+	dir := t.TempDir()
+	writeSplit(t, dir, "movie.mkv", testData(), 4000)
+	writeTestFile(t, filepath.Join(dir, "movie.par2"), par2FileDesc("movie.mkv", 12000))
+
+	joined, err := JoinSplits(dir)
+	if err == nil {
+		t.Fatalf("Expected joining a truncated file to fail")
+	}
+	if len(joined) != 0 || exists(filepath.Join(dir, "movie.mkv")) {
+		t.Errorf("Truncated file was joined")
+	}
+
+	writeTestFile(t, filepath.Join(dir, "movie.par2"), par2FileDesc("movie.mkv", 10000))
+	if _, err := JoinSplits(dir); err != nil {
+		t.Errorf("Could not join file matching the PAR2 length: %v", err)
+	}
+}
+
+func TestExtractZip(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range []string{"dir/", "dir/file.txt", "../escaped.txt"} {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatalf("Could not create zip entry: %v", err)
+		}
+		f.Write([]byte(name))
+	}
+	w.Close()
+	path := filepath.Join(dir, "release.zip")
+	writeTestFile(t, path, buf.Bytes())
+
+	dest := filepath.Join(dir, "out")
+	extracted, err := ExtractZip(path, dest)
+	if err != nil {
+		t.Fatalf("Could not extract zip: %v", err)
+	}
+	expected := []string{filepath.Join(dest, "dir", "file.txt")}
+	if !reflect.DeepEqual(extracted, expected) {
+		t.Errorf("Extracted %v, expected %v", extracted, expected)
+	}
+	if string(readTestFile(t, expected[0])) != "dir/file.txt" {
+		t.Errorf("Extracted file has the wrong content")
+	}
+	if exists(filepath.Join(dir, "escaped.txt")) {
+		t.Errorf("File was written outside of the destination")
+	}
+}
+
+func TestExtract7z(t *testing.T) {
+	for _, test := range []struct {
+		archive  string
+		password string
+		files    int
+	}{
+		{"plain.7z", "", 2},
+		{"encrypted.7z", "password", 2},
+		{"multi.7z.001", "", 10},
+	} {
+		dest := t.TempDir()
+		extracted, err := Extract7z(filepath.Join("testdata", test.archive), dest, test.password)
+		if err != nil {
+			t.Fatalf("Could not extract %s: %v", test.archive, err)
+		}
+		if len(extracted) != test.files {
+			t.Errorf("Extracted %d files from %s, expected %d", len(extracted), test.archive, test.files)
+		}
+	}
+}
+
+func TestExtract7zSkipsSymlinks(t *testing.T) {
+	// plain.7z holds the files "bar" and "foo" with an unencoded header, so foo can be made a
+	// symbolic link by changing its attributes, which are the last in the header.
+	archive := readTestFile(t, filepath.Join("testdata", "plain.7z"))
+	regular := []byte{0x20, 0x80, 0xa4, 0x81}
+	i := bytes.LastIndex(archive, regular)
+	if i < 0 {
+		t.Fatalf("Could not find the attributes of foo")
+	}
+	copy(archive[i:], []byte{0x20, 0x80, 0xff, 0xa1})
+	header := archive[32+binary.LittleEndian.Uint64(archive[12:]):]
+	binary.LittleEndian.PutUint32(archive[28:], crc32.ChecksumIEEE(header))
+	binary.LittleEndian.PutUint32(archive[8:], crc32.ChecksumIEEE(archive[12:32]))
+	dir := t.TempDir()
+	path := filepath.Join(dir, "link.7z")
+	writeTestFile(t, path, archive)
+
+	dest := filepath.Join(dir, "out")
+	extracted, err := Extract7z(path, dest, "")
+	if err != nil {
+		t.Fatalf("Could not extract: %v", err)
+	}
+	if expected := []string{filepath.Join(dest, "bar")}; !reflect.DeepEqual(extracted, expected) {
+		t.Errorf("Extracted %v, expected %v", extracted, expected)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "foo")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the symbolic link not to be extracted, got %v", err)
+	}
+}
+
+func TestExtract7zPassword(t *testing.T) {
+	for _, password := range []string{"", "wrong"} {
+		_, err := Extract7z(filepath.Join("testdata", "encrypted.7z"), t.TempDir(), password)
+		if !errors.Is(err, ErrPassword) {
+			t.Errorf("Expected a password error with password %q, got %v", password, err)
+		}
+	}
+}
+
+func TestExtractAll(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, _ := w.Create("zipped.txt")
+	f.Write([]byte("zipped"))
+	w.Close()
+	writeSplit(t, dir, "release.zip", buf.Bytes(), 100)
+	writeTestFile(t, filepath.Join(dir, "release.7z"), readTestFile(t, filepath.Join("testdata", "plain.7z")))
+	writeRar(t, []string{filepath.Join(dir, "release.part1.rar"), filepath.Join(dir, "release.part2.rar")},
+		"rarred.bin", testData(), 0)
+	if _, err := JoinSplits(dir); err != nil {
+		t.Fatalf("Could not join split files: %v", err)
+	}
+
+	dest := filepath.Join(dir, "out")
+	extracted, err := ExtractAll(dir, dest, "")
+	if err != nil {
+		t.Fatalf("Could not extract: %v", err)
+	}
+	sort.Strings(extracted)
+	expected := []string{
+		filepath.Join(dest, "bar"),
+		filepath.Join(dest, "foo"),
+		filepath.Join(dest, "rarred.bin"),
+		filepath.Join(dest, "zipped.txt"),
+	}
+	if !reflect.DeepEqual(extracted, expected) {
+		t.Errorf("Extracted %v, expected %v", extracted, expected)
+	}
+	if string(readTestFile(t, filepath.Join(dest, "foo"))) != "foo\n" {
+		t.Errorf("File extracted from 7z has the wrong content")
+	}
+}
+
+func TestIsArchive(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"release.part01.rar": true,
+		"release.rar":        true,
+		"release.r07":        true,
+		"release.7z":         true,
+		"release.7z.002":     true,
+		"release.zip":        true,
+		"movie.mkv.001":      true,
+		"movie.mkv":          false,
+		"release.par2":       false,
+		"release.nfo":        false,
+	} {
+		if IsArchive(name) != expected {
+			t.Errorf("IsArchive(%q) = %v, expected %v", name, !expected, expected)
+		}
+	}
+}
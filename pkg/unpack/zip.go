@@ -0,0 +1,51 @@
+package unpack
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// ExtractZip extracts the contents of the zip archive at path into dest, returning the paths of
+// the extracted files.
+//
+// Encrypted zip entries are not supported, and fail with ErrPassword. Entries that would be
+// written outside of dest, and links, are skipped.
+func ExtractZip(path string, dest string) ([]string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open %s: %w", path, err)
+	}
+	defer r.Close()
+
+	extracted := make([]string, 0)
+	for _, f := range r.File {
+		target, ok := localPath(dest, f.Name)
+		if !ok || f.Mode()&fs.ModeSymlink != 0 {
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return extracted, fmt.Errorf("Could not create directory %s: %w", target, err)
+			}
+			continue
+		}
+		// Bit 0 of the general purpose flags marks an encrypted entry.
+		if f.Flags&0x1 != 0 {
+			return extracted, fmt.Errorf("Could not extract %s from %s: %w", f.Name, path, ErrPassword)
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return extracted, fmt.Errorf("Could not extract %s from %s: %w", f.Name, path, err)
+		}
+		err = writeFile(target, rc, f.Modified)
+		rc.Close()
+		if err != nil {
+			return extracted, fmt.Errorf("Could not extract %s from %s: %w", f.Name, path, err)
+		}
+		extracted = append(extracted, target)
+	}
+	return extracted, nil
+}
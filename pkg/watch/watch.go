@@ -0,0 +1,199 @@
+// Package watch ingests NZB files dropped into a directory.
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/queue"
+)
+
+// DefaultInterval is how often the directory is scanned if no interval is configured.
+const DefaultInterval = 5 * time.Second
+
+// An Enqueuer accepts NZBs to download. It is implemented by *daemon.Daemon.
+type Enqueuer interface {
+	Add(n nzb.Nzb, name string, category string, priority queue.Priority) (queue.Job, error)
+}
+
+// Config configures a Watcher.
+type Config struct {
+	// Dir is the directory to watch. NZBs dropped into a subdirectory of Dir
+	// are given the subdirectory's name as their category.
+	Dir string
+	// ProcessedDir is where NZBs are moved once they have been queued.
+	// Defaults to the "processed" subdirectory of Dir.
+	ProcessedDir string
+	// FailedDir is where NZBs which could not be parsed are moved.
+	// Defaults to the "failed" subdirectory of Dir.
+	FailedDir string
+	// Interval is how often to scan Dir. Defaults to DefaultInterval.
+	Interval time.Duration
+	// OnError, if non-nil, is called with errors encountered while ingesting files.
+	OnError func(error)
+}
+
+// A Watcher polls a directory for new NZB files and adds them to a queue.
+type Watcher struct {
+	cfg   Config
+	queue Enqueuer
+	// seen records the size and modification time of each candidate file from
+	// the previous scan. Files are only ingested once they stop changing, so
+	// that partially written files are not picked up.
+	seen map[string]fileState
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// New creates a Watcher which adds NZBs found according to cfg to q.
+func New(cfg Config, q Enqueuer) *Watcher {
+	if cfg.ProcessedDir == "" {
+		cfg.ProcessedDir = filepath.Join(cfg.Dir, "processed")
+	}
+	if cfg.FailedDir == "" {
+		cfg.FailedDir = filepath.Join(cfg.Dir, "failed")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	cfg.Dir = filepath.Clean(cfg.Dir)
+	cfg.ProcessedDir = filepath.Clean(cfg.ProcessedDir)
+	cfg.FailedDir = filepath.Clean(cfg.FailedDir)
+	return &Watcher{
+		cfg:   cfg,
+		queue: q,
+		seen:  make(map[string]fileState),
+	}
+}
+
+// Run scans the directory every interval until ctx is done.
+func (w *Watcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := w.Scan(); err != nil {
+			w.reportError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan makes a single pass over the directory, queueing any NZB which has not
+// changed since the previous pass.
+func (w *Watcher) Scan() error {
+	current := make(map[string]fileState)
+	err := filepath.WalkDir(w.cfg.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path == w.cfg.ProcessedDir || path == w.cfg.FailedDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isNzb(path) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		state := fileState{size: info.Size(), modTime: info.ModTime()}
+		current[path] = state
+		if previous, ok := w.seen[path]; ok && previous == state {
+			w.ingest(path)
+			delete(current, path)
+		}
+		return nil
+	})
+	w.seen = current
+	if err != nil {
+		return fmt.Errorf("could not scan watch directory '%s': %w", w.cfg.Dir, err)
+	}
+	return nil
+}
+
+// ingest queues the NZB at path and moves it out of the watched directory.
+func (w *Watcher) ingest(path string) {
+	relative, err := filepath.Rel(w.cfg.Dir, path)
+	if err != nil {
+		w.reportError(err)
+		return
+	}
+	category := ""
+	if dir := filepath.Dir(relative); dir != "." {
+		category = strings.Split(filepath.ToSlash(dir), "/")[0]
+	}
+
+	n, err := nzb.FromFile(path)
+	if err != nil {
+		w.reportError(err)
+		w.move(path, w.cfg.FailedDir, relative)
+		return
+	}
+	if _, err = w.queue.Add(n, jobName(path), category, queue.Normal); err != nil {
+		// Leave the file where it is so that it is retried on a later scan.
+		w.reportError(fmt.Errorf("could not queue '%s': %w", path, err))
+		return
+	}
+	w.move(path, w.cfg.ProcessedDir, relative)
+}
+
+// move moves the file at path to the same relative location under dir, without overwriting any existing file.
+func (w *Watcher) move(path string, dir string, relative string) {
+	target := filepath.Join(dir, relative)
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		w.reportError(fmt.Errorf("could not move '%s': %w", path, err))
+		return
+	}
+	if _, err := os.Stat(target); err == nil {
+		ext := filepath.Ext(target)
+		target = fmt.Sprintf("%s.%d%s", strings.TrimSuffix(target, ext), time.Now().UnixNano(), ext)
+	}
+	if err := os.Rename(path, target); err != nil {
+		w.reportError(fmt.Errorf("could not move '%s': %w", path, err))
+	}
+}
+
+func (w *Watcher) reportError(err error) {
+	if w.cfg.OnError != nil {
+		w.cfg.OnError(err)
+	}
+}
+
+func isNzb(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasSuffix(lower, ".nzb") || strings.HasSuffix(lower, ".nzb.gz")
+}
+
+// jobName returns the name of the job for the NZB at path, which is its filename without extension.
+func jobName(path string) string {
+	name := filepath.Base(path)
+	lower := strings.ToLower(name)
+	if strings.HasSuffix(lower, ".gz") {
+		name = name[:len(name)-len(".gz")]
+		lower = lower[:len(lower)-len(".gz")]
+	}
+	if strings.HasSuffix(lower, ".nzb") {
+		name = name[:len(name)-len(".nzb")]
+	}
+	return name
+}
@@ -0,0 +1,167 @@
+package watch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/esteth/usenet/pkg/nzb"
+	"github.com/esteth/usenet/pkg/queue"
+)
+
+const testNzb = `<?xml version="1.0" encoding="utf-8"?>
+<nzb xmlns="http://www.newzbin.com/DTD/2003/nzb">
+<file subject="test"><segments><segment bytes="10" number="1">a@test</segment></segments></file>
+</nzb>`
+
+type added struct {
+	name     string
+	category string
+}
+
+type fakeQueue struct {
+	added []added
+	err   error
+}
+
+func (q *fakeQueue) Add(n nzb.Nzb, name string, category string, priority queue.Priority) (queue.Job, error) {
+	if q.err != nil {
+		return queue.Job{}, q.err
+	}
+	q.added = append(q.added, added{name, category})
+	return queue.Job{Name: name, Category: category}, nil
+}
+
+func writeFile(t *testing.T, path string, content []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	if err := os.WriteFile(path, content, 0666); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestIngestWithCategories(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "plain.nzb"), []byte(testNzb))
+	writeFile(t, filepath.Join(dir, "tv", "Show.S01E01.nzb"), []byte(testNzb))
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(testNzb))
+	gz.Close()
+	writeFile(t, filepath.Join(dir, "movies", "Movie.2020.nzb.gz"), compressed.Bytes())
+	writeFile(t, filepath.Join(dir, "tv", "notes.txt"), []byte("not an nzb"))
+
+	q := &fakeQueue{}
+	w := New(Config{Dir: dir}, q)
+	if err := w.Scan(); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(q.added) != 0 {
+		t.Fatalf("Files were ingested before they were seen to be stable: %v", q.added)
+	}
+	if err := w.Scan(); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	expected := map[added]bool{
+		{"plain", ""}:            true,
+		{"Show.S01E01", "tv"}:    true,
+		{"Movie.2020", "movies"}: true,
+	}
+	if len(q.added) != len(expected) {
+		t.Fatalf("Expected %d NZBs to be queued, got %v", len(expected), q.added)
+	}
+	for _, a := range q.added {
+		if !expected[a] {
+			t.Errorf("Unexpected NZB queued: %v", a)
+		}
+	}
+
+	for _, moved := range []string{"plain.nzb", "tv/Show.S01E01.nzb", "movies/Movie.2020.nzb.gz"} {
+		if exists(filepath.Join(dir, moved)) {
+			t.Errorf("%s was not moved out of the watch directory", moved)
+		}
+		if !exists(filepath.Join(dir, "processed", moved)) {
+			t.Errorf("%s was not moved into the processed directory", moved)
+		}
+	}
+	if !exists(filepath.Join(dir, "tv", "notes.txt")) {
+		t.Errorf("Non-NZB file was moved")
+	}
+
+	// Processed files must not be picked up again.
+	w.Scan()
+	w.Scan()
+	if len(q.added) != len(expected) {
+		t.Errorf("Processed NZBs were queued again: %v", q.added)
+	}
+}
+
+func TestInvalidNzbMovedToFailed(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "broken.nzb"), []byte("<nzb"))
+
+	var reported []error
+	q := &fakeQueue{}
+	w := New(Config{Dir: dir, OnError: func(err error) { reported = append(reported, err) }}, q)
+	w.Scan()
+	w.Scan()
+
+	if len(q.added) != 0 {
+		t.Errorf("Invalid NZB was queued")
+	}
+	if len(reported) != 1 {
+		t.Errorf("Expected one error to be reported, got %v", reported)
+	}
+	if !exists(filepath.Join(dir, "failed", "broken.nzb")) {
+		t.Errorf("Invalid NZB was not moved into the failed directory")
+	}
+}
+
+func TestQueueFailureRetries(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "retry.nzb"), []byte(testNzb))
+
+	q := &fakeQueue{err: errors.New("queue unavailable")}
+	w := New(Config{Dir: dir}, q)
+	w.Scan()
+	w.Scan()
+	if !exists(filepath.Join(dir, "retry.nzb")) {
+		t.Fatalf("NZB which could not be queued was moved")
+	}
+
+	q.err = nil
+	w.Scan()
+	w.Scan()
+	if len(q.added) != 1 || exists(filepath.Join(dir, "retry.nzb")) {
+		t.Errorf("NZB was not queued once the queue recovered: %v", q.added)
+	}
+}
+
+func TestChangingFileNotIngested(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "growing.nzb")
+	writeFile(t, path, []byte(testNzb[:20]))
+
+	q := &fakeQueue{}
+	w := New(Config{Dir: dir}, q)
+	w.Scan()
+	writeFile(t, path, []byte(testNzb))
+	w.Scan()
+	if len(q.added) != 0 {
+		t.Fatalf("File which was still being written was ingested")
+	}
+	w.Scan()
+	if len(q.added) != 1 {
+		t.Errorf("File was not ingested once it stopped changing")
+	}
+}
@@ -0,0 +1,51 @@
+package yenc
+
+import "hash/crc32"
+
+// CombineCRC returns the CRC32 checksum of two runs of data joined together, given the checksum
+// of each of them and the length of the second. It lets the checksum of a whole file be worked
+// out from those of its parts, without reading the file again.
+//
+// It works as zlib's crc32_combine does, multiplying crc1 by x^(8*len2) modulo the polynomial.
+func CombineCRC(crc1, crc2 uint32, len2 int64) uint32 {
+	return multModP(x2nModP(len2, 3), crc1) ^ crc2
+}
+
+// multModP returns a*b modulo the CRC32 polynomial. Polynomials are bit-reversed, as they are in
+// the checksum, so x^0 is the top bit.
+func multModP(a, b uint32) uint32 {
+	var p uint32
+	for m := uint32(1) << 31; m != 0; m >>= 1 {
+		if a&m != 0 {
+			p ^= b
+		}
+		if b&1 != 0 {
+			b = b>>1 ^ crc32.IEEE
+		} else {
+			b >>= 1
+		}
+	}
+	return p
+}
+
+// x2nTable holds x^(2^n) modulo the CRC32 polynomial, for each n below 32.
+var x2nTable = func() (table [32]uint32) {
+	p := uint32(1) << 30 // x^1
+	for n := range table {
+		table[n] = p
+		p = multModP(p, p)
+	}
+	return table
+}()
+
+// x2nModP returns x^(n*2^k) modulo the CRC32 polynomial.
+func x2nModP(n int64, k uint) uint32 {
+	p := uint32(1) << 31 // x^0
+	for ; n != 0; n >>= 1 {
+		if n&1 != 0 {
+			p = multModP(x2nTable[k&31], p)
+		}
+		k++
+	}
+	return p
+}
@@ -3,35 +3,51 @@ package yenc
 import (
 	"bufio"
 	"bytes"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash"
 	"hash/crc32"
 	"io"
-	"regexp"
 	"strconv"
 	"strings"
 )
 
+// ErrChecksum is returned when decoded data does not match the CRC32 checksum in its yend footer.
+var ErrChecksum = errors.New("yEnc CRC32 checksum mismatch")
+
+// ErrTruncated is returned when encoded data ends before its yend footer, such as when an article
+// was cut short.
+var ErrTruncated = errors.New("yEnc data ended before its yend footer")
+
 type header struct {
 	lineLength int
 	multipart  bool
 	name       string
 	offset     int64
 	size       int64
+	// fileSize is the size of the whole file, where size is only that of the part for multipart
+	// messages.
+	fileSize int64
 }
 
+// maxLineLength is the length of the longest line a Reader accepts.
+const maxLineLength = 64 * 1024
+
 // A Reader is an io.Reader that can be read to retrieve
 // yenc decoded data from a reader containing yenc encoded
 // data
 type Reader struct {
-	s              bufio.Scanner
+	r              *bufio.Reader
 	err            error
 	foundHeader    bool
 	header         header
 	overflowBuffer []byte
-	hash           hash.Hash
+	// long holds lines too long for r's buffer.
+	long []byte
+	// crc is the CRC32 of the data decoded from the current part so far.
+	crc uint32
+	// fileCRC is the CRC32 of the whole file, if hasFileCRC is set because a footer gave it.
+	fileCRC    uint32
+	hasFileCRC bool
 }
 
 // NewReader creates a new reader reading the given reader.
@@ -45,15 +61,45 @@ func NewReader(r io.Reader) (*Reader, error) {
 
 // Reset discards the Reader z's state and makes it equivalent to the
 // result of it's original state from NewReader, but reading from r instead.
-// This permits reusing a reader rather than allocating a new one.
+// This permits reusing a reader rather than allocating a new one, and its buffers
+// are kept so that decoding another article allocates almost nothing.
 func (z *Reader) Reset(r io.Reader) error {
-	*z = Reader{
-		s:    *bufio.NewScanner(r),
-		hash: crc32.New(crc32.MakeTable(crc32.IEEE)),
+	br, long := z.r, z.long
+	if br == nil {
+		br = bufio.NewReader(r)
+	} else {
+		br.Reset(r)
 	}
+	*z = Reader{r: br, long: long[:0]}
 	return nil
 }
 
+// nextLine returns the next line of input, without its line ending. The line is only valid
+// until nextLine is called again.
+func (z *Reader) nextLine() ([]byte, error) {
+	line, err := z.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		z.long = append(z.long[:0], line...)
+		for err == bufio.ErrBufferFull && len(z.long) <= maxLineLength {
+			line, err = z.r.ReadSlice('\n')
+			z.long = append(z.long, line...)
+		}
+		if err == bufio.ErrBufferFull {
+			return nil, bufio.ErrTooLong
+		}
+		line = z.long
+	}
+	if err == io.EOF && len(line) > 0 {
+		// The last line has no line ending.
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
 // Read implements io.Reader, reading encoded bytes from its underlying Reader.
 func (z *Reader) Read(buf []byte) (n int, err error) {
 	if z.err != nil {
@@ -68,47 +114,51 @@ func (z *Reader) Read(buf []byte) (n int, err error) {
 			return
 		}
 	}
+	var line []byte
 	for {
-		scanSucceeded := z.s.Scan()
-		if !scanSucceeded {
-			if z.s.Err() != nil {
-				return 0, z.s.Err()
+		line, err = z.nextLine()
+		if err != nil {
+			if err != io.EOF {
+				return 0, err
 			}
 			// We found the end of the file
 			z.err = io.EOF
+			if z.foundHeader {
+				z.err = ErrTruncated
+			}
 			if n > 0 {
 				// Most Reader clients expect 0, EOF, so save the EOF for the next Read call
 				return n, nil
 			}
-			return n, io.EOF
+			return n, z.err
 		}
 		if !z.foundHeader {
 			// Ignore all text until we find the yEnc begin header
-			if strings.HasPrefix(z.s.Text(), "=ybegin ") {
+			if bytes.HasPrefix(line, []byte("=ybegin ")) {
 				z.foundHeader = true
-				z.header, err = parseBegin(z.s.Text())
+				z.crc = 0
+				z.header, err = parseBegin(string(line))
 				if err != nil {
 					return n, fmt.Errorf("failed to parse ybegin header: %w", err)
 				}
 				if z.header.multipart {
-					scanSucceeded = z.s.Scan()
-					if !scanSucceeded {
-						if z.s.Err() != nil {
-							return n, z.s.Err()
-						} else {
-							return n, errors.New("found EOF while expecting ypart header")
+					line, err = z.nextLine()
+					if err != nil {
+						if err == io.EOF {
+							err = errors.New("found EOF while expecting ypart header")
 						}
+						return n, err
 					}
-					if !strings.HasPrefix(z.s.Text(), "=ypart ") {
+					if !bytes.HasPrefix(line, []byte("=ypart ")) {
 						return n, errors.New("did not find ypart header where expected")
 					}
-					z.header.offset, z.header.size, err = parsePart(z.s.Text())
+					z.header.offset, z.header.size, err = parsePart(string(line))
 				}
 			}
 		} else {
-			if strings.HasPrefix(z.s.Text(), "=yend") {
+			if bytes.HasPrefix(line, []byte("=yend")) {
 				z.foundHeader = false
-				err = z.validateEnd(z.s.Text())
+				err = z.validateEnd(string(line))
 				if err != nil {
 					return n, fmt.Errorf("Failed to validate footer: %w", err)
 				}
@@ -119,8 +169,8 @@ func (z *Reader) Read(buf []byte) (n int, err error) {
 		}
 	}
 
-	encodedLine := z.s.Bytes()
-	n, err = z.readLine(buf[n:], encodedLine)
+	lineBytes, err := z.readLine(buf[n:], line)
+	n += lineBytes
 	return
 }
 
@@ -129,7 +179,7 @@ func (z *Reader) Read(buf []byte) (n int, err error) {
 // If no header has been read, it reads to the header.
 func (z *Reader) Filename() (string, error) {
 	if z.header.name == "" {
-		z.Read(make([]byte, 0, 0))
+		z.Read(nil)
 		if z.header.name == "" {
 			return "", errors.New("Cannot find header in document, or header specifies empty filename")
 		}
@@ -142,7 +192,7 @@ func (z *Reader) Filename() (string, error) {
 // If no header has been read, it reads to the header.
 func (z *Reader) Multipart() (bool, error) {
 	if z.header.name == "" {
-		z.Read(make([]byte, 0, 0))
+		z.Read(nil)
 		if z.header.name == "" {
 			return false, errors.New("Cannot find header in document")
 		}
@@ -155,7 +205,7 @@ func (z *Reader) Multipart() (bool, error) {
 // If no header has been read, it reads to the header.
 func (z *Reader) Offset() (int64, error) {
 	if z.header.name == "" {
-		z.Read(make([]byte, 0, 0))
+		z.Read(nil)
 		if z.header.name == "" {
 			return 0, errors.New("Cannot find header in document")
 		}
@@ -163,16 +213,43 @@ func (z *Reader) Offset() (int64, error) {
 	return z.header.offset, nil
 }
 
+// Size returns the size of the whole file the stream is part of, from the ybegin header.
+//
+// If no header has been read, it reads to the header.
+func (z *Reader) Size() (int64, error) {
+	if z.header.name == "" {
+		z.Read(nil)
+		if z.header.name == "" {
+			return 0, errors.New("Cannot find header in document")
+		}
+	}
+	return z.header.fileSize, nil
+}
+
+// CRC returns the CRC32 checksum of the data decoded from the current part so far. Once the part
+// has been read to its end, it is the checksum of the whole part.
+func (z *Reader) CRC() uint32 {
+	return z.crc
+}
+
+// FileCRC returns the CRC32 checksum of the whole file the stream is part of, and whether it is
+// known. It is only known once a yend footer giving it has been read. Multipart posts usually
+// only give it in the footer of their last part, if at all.
+func (z *Reader) FileCRC() (uint32, bool) {
+	return z.fileCRC, z.hasFileCRC
+}
+
 // readLine reads a single line of input data from intput into output.
 // It returns the number of bytes written to output and and error.
 //
 // Note: readLine should only be called when the Reader is positioned between ybegin and yend.
 func (z *Reader) readLine(output []byte, input []byte) (n int, err error) {
 	// Before we return, add all the bytes we wrote to the ongoing CRC32
-	defer func() { z.hash.Write(output[:n]) }()
+	defer func() { z.crc = crc32.Update(z.crc, crc32.IEEETable, output[:n]) }()
 
 	escapeNext := false
 	for i, b := range input {
+		escaped := escapeNext
 		if b == '=' && !escapeNext {
 			// '=' is the escape character in yEnc. It shouldn't appear in the
 			// output, only modify the next character.
@@ -192,7 +269,11 @@ func (z *Reader) readLine(output []byte, input []byte) (n int, err error) {
 			output[n] = b
 			n++
 		} else {
-			// If we've run out of space in the output buffer, save the overflow in the Reader
+			// If we've run out of space in the output buffer, save the overflow in the Reader,
+			// along with the escape character before it.
+			if escaped {
+				i--
+			}
 			z.overflowBuffer = input[i:]
 			return
 		}
@@ -207,27 +288,30 @@ func parseBegin(beginLine string) (h header, err error) {
 		return header{}, fmt.Errorf("Failed to parse ybegin line '%v': %w", beginLine, err)
 	}
 
-	h.lineLength, err = strconv.Atoi(fields["line"])
+	line, _ := fields.get("line")
+	h.lineLength, err = strconv.Atoi(line)
 	if err != nil {
-		return header{}, fmt.Errorf("could not convert 'line' to int '%s': %w", fields["line"], err)
+		return header{}, fmt.Errorf("could not convert 'line' to int '%s': %w", line, err)
 	}
 
-	if size, ok := fields["size"]; ok {
+	if size, ok := fields.get("size"); ok {
 		h.size, err = strconv.ParseInt(size, 10, 0)
 		if err != nil {
-			return header{}, fmt.Errorf("could not convert 'size' to int '%s': %w", fields["size"], err)
+			return header{}, fmt.Errorf("could not convert 'size' to int '%s': %w", size, err)
 		}
 	} else {
 		return header{}, errors.New("ybegin header does not contain size field")
 	}
 
-	if name, ok := fields["name"]; ok {
+	h.fileSize = h.size
+
+	if name, ok := fields.get("name"); ok {
 		h.name = name
 	} else {
 		return header{}, errors.New("ybegin header does not contain name field")
 	}
 
-	if _, ok := fields["part"]; ok {
+	if _, ok := fields.get("part"); ok {
 		h.multipart = true
 	}
 
@@ -241,20 +325,20 @@ func parsePart(beginLine string) (offset int64, size int64, err error) {
 		return 0, 0, fmt.Errorf("Failed to parse ypart line '%v': %w", beginLine, err)
 	}
 
-	if offsetString, ok := fields["begin"]; ok {
+	if offsetString, ok := fields.get("begin"); ok {
 		offset, err = strconv.ParseInt(offsetString, 10, 0)
 		if err != nil {
-			return 0, 0, fmt.Errorf("could not convert 'begin' to int '%s': %w", fields["begin"], err)
+			return 0, 0, fmt.Errorf("could not convert 'begin' to int '%s': %w", offsetString, err)
 		}
 		offset-- // NZB files use 1-indexed numbers
 	} else {
 		return 0, 0, errors.New("ypart header does not contain start field")
 	}
 
-	if endString, ok := fields["end"]; ok {
+	if endString, ok := fields.get("end"); ok {
 		end, err := strconv.ParseInt(endString, 10, 0)
 		if err != nil {
-			return 0, 0, fmt.Errorf("could not convert 'end' to int '%s': %w", fields["end"], err)
+			return 0, 0, fmt.Errorf("could not convert 'end' to int '%s': %w", endString, err)
 		}
 		size = end - offset
 	} else {
@@ -271,20 +355,28 @@ func (z *Reader) validateEnd(endLine string) error {
 		return fmt.Errorf("Failed to parse yend line '%v': %w", endLine, err)
 	}
 
-	// Only conduct a CRC32 check if the checksum is present in the footer
-	if expectedString, ok := fields["crc32"]; ok {
-		expected, err := hex.DecodeString(expectedString)
+	// The crc32 field holds the checksum of the whole file, which is only that of the data read
+	// for single part messages. Parts of multipart messages have their own in pcrc32.
+	fileCRC, hasFileCRC, err := parseCRC(fields, "crc32")
+	if err != nil {
+		return err
+	}
+	partCRC, hasPartCRC := fileCRC, hasFileCRC && !z.header.multipart
+	if z.header.multipart {
+		partCRC, hasPartCRC, err = parseCRC(fields, "pcrc32")
 		if err != nil {
-			return fmt.Errorf("CRC32 Check Failure. Could not parse checksum '%s': %w", expectedString, err)
-		}
-		actual := z.hash.Sum(nil)
-
-		if !bytes.Equal(expected, actual) {
-			return fmt.Errorf("CRC32 Check failure. Expected %v, Actual %v", expected, actual)
+			return err
 		}
 	}
+	// Only conduct a CRC32 check if the checksum is present in the footer
+	if hasPartCRC && partCRC != z.crc {
+		return fmt.Errorf("CRC32 Check failure. Expected %08x, Actual %08x: %w", partCRC, z.crc, ErrChecksum)
+	}
+	if hasFileCRC {
+		z.fileCRC, z.hasFileCRC = fileCRC, true
+	}
 
-	if sizeString, ok := fields["size"]; ok {
+	if sizeString, ok := fields.get("size"); ok {
 		size, err := strconv.ParseInt(sizeString, 10, 0)
 		if err != nil {
 			return fmt.Errorf("size validation failure: Could not parse size in footer: %w", err)
@@ -301,19 +393,58 @@ func (z *Reader) validateEnd(endLine string) error {
 	return nil
 }
 
-// parseHeader parses a yenc header line, returning a map of the fields contained in it and an error.
-func parseHeader(line string) (m map[string]string, err error) {
-	fields := strings.Fields(line)[1:]
-	m = make(map[string]string, len(fields))
-	for _, field := range fields {
-		re := regexp.MustCompile(`(\w+)=([^\s]+)`)
-		result := re.FindSubmatch([]byte(field))
-		if result == nil || len(result) == 0 {
-			return nil, fmt.Errorf("Failed to parse header field \"%v\"", field)
+// parseCRC parses the checksum in the field with the given key, returning whether there is one.
+func parseCRC(fields headerFields, key string) (uint32, bool, error) {
+	s, ok := fields.get(key)
+	if !ok {
+		return 0, false, nil
+	}
+	crc, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, false, fmt.Errorf("CRC32 Check Failure. Could not parse checksum '%s': %w", s, err)
+	}
+	return uint32(crc), true, nil
+}
+
+// A field is a key=value pair from a yEnc header line.
+type field struct {
+	key, value string
+}
+
+// headerFields holds the fields of a yEnc header line. Header lines only have a few fields, so
+// they are searched rather than put in a map.
+type headerFields []field
+
+// get returns the value of the field with the given key, and whether there is one.
+func (f headerFields) get(key string) (string, bool) {
+	for _, field := range f {
+		if field.key == key {
+			return field.value, true
 		}
-		key := string(result[1])
-		val := string(result[2])
-		m[key] = val
 	}
-	return
+	return "", false
+}
+
+// parseHeader parses a yenc header line, returning the fields contained in it and an error.
+//
+// The name field runs to the end of the line, as names may contain spaces.
+func parseHeader(line string) (fields headerFields, err error) {
+	_, rest, _ := strings.Cut(line, " ")
+	fields = make(headerFields, 0, 8)
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			return fields, nil
+		}
+		text, next, _ := strings.Cut(rest, " ")
+		key, value, ok := strings.Cut(text, "=")
+		if ok && key == "name" {
+			value, next = strings.TrimRight(rest[len("name="):], " \t"), ""
+		}
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("Failed to parse header field \"%v\"", text)
+		}
+		fields = append(fields, field{key, value})
+		rest = next
+	}
 }
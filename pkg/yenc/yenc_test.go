@@ -2,10 +2,17 @@ package yenc
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
+
+	"github.com/esteth/usenet/pkg/nntp/nntptest"
 )
 
 func TestSinglePart(t *testing.T) {
@@ -161,4 +168,234 @@ func TestMultipart(t *testing.T) {
 	if offset != 11250 {
 		t.Errorf("Offset expected to be 11250, was %d", offset)
 	}
-}
\ No newline at end of file
+
+	expected, err := os.Stat("testdata/joystick.jpg")
+	if err != nil {
+		t.Fatalf("Could not stat expected data file: %v", err)
+	}
+	size, err := yencReader.Size()
+	if err != nil {
+		t.Fatalf("Failed to read size: %v", err)
+	}
+	if size != expected.Size() {
+		t.Errorf("Size expected to be %d, was %d", expected.Size(), size)
+	}
+}
+
+func TestMultipartContent(t *testing.T) {
+	expected, err := ioutil.ReadFile("testdata/joystick.jpg")
+	if err != nil {
+		t.Fatalf("Could not read expected data file: %v", err)
+	}
+
+	for _, part := range []string{"testdata/00000020.ntx", "testdata/00000021.ntx"} {
+		encodedFile, err := os.Open(part)
+		if err != nil {
+			t.Fatalf("Could not open encoded data file: %v", err)
+		}
+		defer encodedFile.Close()
+
+		yencReader, err := NewReader(encodedFile)
+		if err != nil {
+			t.Fatalf("Could not initialize yenc Reader: %v", err)
+		}
+		offset, err := yencReader.Offset()
+		if err != nil {
+			t.Fatalf("Failed to read offset: %v", err)
+		}
+		decoded, err := ioutil.ReadAll(yencReader)
+		if err != nil {
+			t.Fatalf("Failed to read encoded data file %s: %v", part, err)
+		}
+		if !bytes.Equal(decoded, expected[offset:offset+int64(len(decoded))]) {
+			t.Errorf("Data decoded from %s not equal to expected data", part)
+		}
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	encoded, err := os.ReadFile("testdata/encoded.txt")
+	if err != nil {
+		t.Fatalf("Could not read encoded data file: %v", err)
+	}
+	encoded = bytes.Replace(encoded, []byte("crc32=ded29f4f"), []byte("crc32=00000000"), 1)
+
+	yencReader, err := NewReader(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Could not initialize yenc Reader: %v", err)
+	}
+	if _, err = io.ReadAll(yencReader); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	encoded, err := os.ReadFile("testdata/encoded.txt")
+	if err != nil {
+		t.Fatalf("Could not read encoded data file: %v", err)
+	}
+	encoded = encoded[:bytes.Index(encoded, []byte("=yend"))]
+
+	yencReader, err := NewReader(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Could not initialize yenc Reader: %v", err)
+	}
+	if _, err = io.ReadAll(yencReader); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected a truncation error, got %v", err)
+	}
+}
+
+func TestOneByteReads(t *testing.T) {
+	encoded, err := os.ReadFile("testdata/encoded.txt")
+	if err != nil {
+		t.Fatalf("Could not read encoded data file: %v", err)
+	}
+	expected, err := os.ReadFile("testdata/expected.txt")
+	if err != nil {
+		t.Fatalf("Could not read expected data file: %v", err)
+	}
+
+	yencReader, err := NewReader(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Could not initialize yenc Reader: %v", err)
+	}
+	// Escaped characters are split from their escape character when the buffer fills between them.
+	decoded, err := io.ReadAll(iotest.OneByteReader(yencReader))
+	if err != nil {
+		t.Fatalf("Failed to read encoded data file: %v", err)
+	}
+	if !bytes.Equal(decoded, expected) {
+		t.Errorf("Data read a byte at a time not equal to expected data")
+	}
+}
+
+func TestNameWithSpaces(t *testing.T) {
+	encoded := "=ybegin line=128 size=3 name=my file.txt \r\n" + string([]byte{'a' + 42, 'b' + 42, 'c' + 42}) + "\r\n=yend size=3\r\n"
+	yencReader, err := NewReader(strings.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Could not initialize yenc Reader: %v", err)
+	}
+	filename, err := yencReader.Filename()
+	if err != nil || filename != "my file.txt" {
+		t.Errorf("Expected filename 'my file.txt', got '%s': %v", filename, err)
+	}
+	if decoded, err := io.ReadAll(yencReader); err != nil || string(decoded) != "abc" {
+		t.Errorf("Expected to decode 'abc', got '%s': %v", decoded, err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	encoded, err := os.ReadFile("testdata/encoded.txt")
+	if err != nil {
+		t.Fatalf("Could not read encoded data file: %v", err)
+	}
+	expected, err := os.ReadFile("testdata/expected.txt")
+	if err != nil {
+		t.Fatalf("Could not read expected data file: %v", err)
+	}
+
+	yencReader := new(Reader)
+	for i := 0; i < 2; i++ {
+		// The first article is cut short, to check nothing of it is left behind by Reset.
+		article := encoded
+		if i == 0 {
+			article = encoded[:len(encoded)/2]
+		}
+		if err := yencReader.Reset(bytes.NewReader(article)); err != nil {
+			t.Fatalf("Could not reset yenc Reader: %v", err)
+		}
+		decoded, err := io.ReadAll(yencReader)
+		if i == 0 {
+			if !errors.Is(err, ErrTruncated) {
+				t.Errorf("Expected a truncation error, got %v", err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(decoded, expected) {
+			t.Errorf("Data read after Reset not equal to expected data: %v", err)
+		}
+	}
+}
+
+func TestMultipartChecksums(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	parts := nntptest.Split("a.bin", data, 3000)
+
+	yencReader := new(Reader)
+	var crc uint32
+	for i, part := range parts {
+		if err := yencReader.Reset(bytes.NewReader(part)); err != nil {
+			t.Fatalf("Could not reset yenc Reader: %v", err)
+		}
+		decoded, err := io.ReadAll(yencReader)
+		if err != nil {
+			t.Fatalf("Failed to read part %d: %v", i+1, err)
+		}
+		crc = CombineCRC(crc, yencReader.CRC(), int64(len(decoded)))
+		fileCRC, ok := yencReader.FileCRC()
+		if ok != (i == len(parts)-1) {
+			t.Errorf("Unexpected whole-file checksum %08x in part %d", fileCRC, i+1)
+		}
+		if ok && fileCRC != crc32.ChecksumIEEE(data) {
+			t.Errorf("Whole-file checksum %08x does not match data", fileCRC)
+		}
+	}
+	if crc != crc32.ChecksumIEEE(data) {
+		t.Errorf("Combined checksum %08x does not match whole-file checksum %08x", crc, crc32.ChecksumIEEE(data))
+	}
+
+	// The whole-file checksum doesn't apply to the last part, so it must be checked against its own.
+	last := parts[len(parts)-1]
+	pcrc := fmt.Sprintf("pcrc32=%08x", crc32.ChecksumIEEE(data[9000:]))
+	broken := bytes.Replace(last, []byte(pcrc), []byte("pcrc32=00000000"), 1)
+	if err := yencReader.Reset(bytes.NewReader(broken)); err != nil {
+		t.Fatalf("Could not reset yenc Reader: %v", err)
+	}
+	if _, err := io.ReadAll(yencReader); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+}
+
+func TestCombineCRC(t *testing.T) {
+	data := make([]byte, 70000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, split := range []int{0, 1, 7, 40000, len(data) - 1, len(data)} {
+		crc := CombineCRC(crc32.ChecksumIEEE(data[:split]), crc32.ChecksumIEEE(data[split:]), int64(len(data)-split))
+		if crc != crc32.ChecksumIEEE(data) {
+			t.Errorf("Checksums combined at %d gave %08x, expected %08x", split, crc, crc32.ChecksumIEEE(data))
+		}
+	}
+}
+
+// BenchmarkDecode decodes a typical article with a reused Reader.
+func BenchmarkDecode(b *testing.B) {
+	data := make([]byte, 700<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	encoded := nntptest.EncodePart("a.bin", 1, 1, int64(len(data)), 0, data)
+	article := bytes.NewReader(encoded)
+	yencReader := new(Reader)
+	decoded := make([]byte, len(data))
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		article.Reset(encoded)
+		if err := yencReader.Reset(article); err != nil {
+			b.Fatalf("Could not reset yenc Reader: %v", err)
+		}
+		if _, err := io.ReadFull(yencReader, decoded); err != nil {
+			b.Fatalf("Could not decode article: %v", err)
+		}
+		if _, err := yencReader.Read(decoded); err != io.EOF {
+			b.Fatalf("Expected the end of the article, got %v", err)
+		}
+	}
+}